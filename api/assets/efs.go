@@ -0,0 +1,8 @@
+package assets
+
+import (
+	"embed"
+)
+
+//go:embed "forms" "prompts" "templates"
+var EmbeddedFiles embed.FS
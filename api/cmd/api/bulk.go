@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dev.danielrb/auto-imm/api/internal/database"
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/request"
+	"dev.danielrb/auto-imm/api/internal/response"
+
+	"github.com/gen2brain/go-fitz"
+)
+
+// Bulk OCR runs the same pipeline as /api/ocr over many documents, but sends
+// the LLM requests through the provider's batch API, at half the price and
+// without waiting on each one. A job takes up to two batches: one
+// classifying every page, unless the job was given the document type, and
+// one extracting every page with the prompt for its type. Each step is saved
+// as it completes, along with the batch being waited for, so that a job
+// interrupted by a restart carries on where it left off.
+
+var errBulkUnsupported = errors.New("bulk OCR needs the anthropic provider, without cassettes")
+
+// bulkPage is a page of a document in a bulk job.
+type bulkPage struct {
+	documentPage
+	num            int
+	metadata       pageMetadata
+	classification documentClassification
+}
+
+// bulkDocument is a document of a bulk job being processed.
+type bulkDocument struct {
+	*database.Document
+	data    []byte
+	pages   []bulkPage
+	ctx     context.Context
+	routing *modelRouting
+}
+
+// bulkProgress is what is kept of a document between the steps of a job.
+type bulkProgress struct {
+	Pages  []bulkPageClassification `json:"pages"`
+	Models map[string][]string      `json:"models,omitempty"`
+	Usage  llm.Usage                `json:"usage"`
+}
+
+type bulkPageClassification struct {
+	Type       string  `json:"type"`
+	Confidence float64 `json:"confidence"`
+	FirstPage  bool    `json:"firstPage"`
+}
+
+// batcher returns the provider's batch API, if it has one.
+func (app *application) batcher() (llm.Batcher, error) {
+	if app.llm == nil {
+		return nil, errLLMNotConfigured
+	}
+
+	batcher, ok := app.llm.(llm.Batcher)
+	if !ok {
+		return nil, errBulkUnsupported
+	}
+
+	return batcher, nil
+}
+
+// createBulkJob saves a job and its documents, ready to be run.
+func (app *application) createBulkJob(input *bulkJobInput) (*database.BulkJob, error) {
+	job := &database.BulkJob{
+		Status:       database.BulkJobClassifying,
+		DocumentType: input.DocumentType,
+		Model:        input.Model,
+	}
+	if job.DocumentType != "" {
+		job.Status = database.BulkJobExtracting
+	}
+
+	documents := make([]database.NewDocument, len(input.Files))
+	for i, file := range input.Files {
+		documents[i] = database.NewDocument{
+			Filename:  file.Filename,
+			MediaType: imaging.DetectMediaType(file.Data),
+			Data:      file.Data,
+		}
+	}
+
+	err := app.db.InsertBulkJob(job, documents)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.Info("bulk job created", "job", job.ID, "documents", job.Documents, "documentType", job.DocumentType)
+
+	return job, nil
+}
+
+// startBulkJob runs a job in the background until it ends or the server
+// shuts down.
+func (app *application) startBulkJob(job *database.BulkJob) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			pv := recover()
+			if pv != nil {
+				app.logger.Error(fmt.Sprintf("%v", pv), "job", job.ID)
+			}
+		}()
+
+		err := app.runBulkJob(app.shutdownCtx, job)
+		if err != nil {
+			app.logger.Error(err.Error(), "job", job.ID)
+		}
+	}()
+}
+
+// resumeBulkJobs starts the jobs that were interrupted by the last shutdown.
+func (app *application) resumeBulkJobs() error {
+	jobs, err := app.db.UnfinishedBulkJobs()
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		app.logger.Info("resuming bulk job", "job", jobs[i].ID, "status", jobs[i].Status)
+		app.startBulkJob(&jobs[i])
+	}
+
+	return nil
+}
+
+// runBulkJob processes a job from the step it got to until it ends. A job
+// that cannot be completed is marked as failed; an error is only returned if
+// its state cannot be saved. If ctx is cancelled, the job is left as it is,
+// to be resumed later.
+func (app *application) runBulkJob(ctx context.Context, job *database.BulkJob) error {
+	batcher, err := app.batcher()
+	if err != nil {
+		return app.failBulkJob(job, nil, err)
+	}
+
+	rows, err := app.db.BulkJobDocuments(job.ID)
+	if err != nil {
+		return err
+	}
+
+	var documents []*bulkDocument
+	for i := range rows {
+		if rows[i].Status != database.DocumentPending {
+			continue
+		}
+
+		document, err := app.loadBulkDocument(ctx, job, &rows[i])
+		if err != nil {
+			err = app.failDocument(&rows[i], err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		documents = append(documents, document)
+	}
+
+	if job.Status == database.BulkJobClassifying {
+		err = app.classifyBulkDocuments(ctx, batcher, job, documents)
+		if err != nil {
+			return app.failBulkJob(job, documents, err)
+		}
+	}
+
+	if job.Status == database.BulkJobExtracting {
+		err = app.extractBulkDocuments(ctx, batcher, job, documents)
+		if err != nil {
+			return app.failBulkJob(job, documents, err)
+		}
+	}
+
+	return nil
+}
+
+// loadBulkDocument reads the pages of a document, and the classifications
+// and usage saved by the steps the job has done so far.
+func (app *application) loadBulkDocument(ctx context.Context, job *database.BulkJob, row *database.Document) (*bulkDocument, error) {
+	data, err := app.db.DocumentData(row.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	document := &bulkDocument{Document: row, data: data}
+	document.ctx, document.routing = withModelRouting(ctx, job.Model)
+
+	if imaging.IsPaged(row.MediaType) {
+		doc, err := fitz.NewFromMemory(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open document: %w", err)
+		}
+		defer doc.Close()
+
+		if doc.NumPage() > maxPages {
+			return nil, fmt.Errorf("the document has more than %d pages", maxPages)
+		}
+
+		for pageNum := 0; pageNum < doc.NumPage(); pageNum++ {
+			page, err := app.loadPage(doc, pageNum, app.config.preprocess.anthropic)
+			if err != nil {
+				return nil, err
+			}
+			document.pages = append(document.pages, bulkPage{documentPage: page, num: pageNum, metadata: page.metadata(pageNum + 1)})
+		}
+	} else {
+		prepared, err := imaging.Preprocess(data, row.MediaType, app.config.preprocess.anthropic)
+		if err != nil {
+			return nil, err
+		}
+		document.pages = []bulkPage{{documentPage: documentPage{image: prepared}, metadata: newPageMetadata(1, prepared)}}
+	}
+
+	for i := range document.pages {
+		document.pages[i].classification = documentClassification{Type: job.DocumentType, Confidence: 1}
+	}
+
+	if row.Pages != "" {
+		var progress bulkProgress
+		err := json.Unmarshal([]byte(row.Pages), &progress)
+		if err != nil {
+			return nil, err
+		}
+		if len(progress.Pages) != len(document.pages) {
+			return nil, fmt.Errorf("the document has %d pages but %d were classified", len(document.pages), len(progress.Pages))
+		}
+
+		for i, c := range progress.Pages {
+			document.pages[i].classification = documentClassification{Type: c.Type, Confidence: c.Confidence, StartsDocument: c.FirstPage}
+		}
+		document.routing.used = progress.Models
+		document.routing.usage = progress.Usage
+	}
+
+	return document, nil
+}
+
+// classifyBulkDocuments classifies every page of the documents in one batch.
+func (app *application) classifyBulkDocuments(ctx context.Context, batcher llm.Batcher, job *database.BulkJob, documents []*bulkDocument) error {
+	var requests []llm.BatchRequest
+	for _, document := range documents {
+		for _, page := range document.pages {
+			req, err := app.classificationRequest(page.documentPage)
+			if err != nil {
+				return err
+			}
+			req.Model = app.modelFor(document.ctx, taskClassify)
+			requests = append(requests, llm.BatchRequest{ID: bulkRequestID(document, page), Request: req})
+		}
+	}
+
+	results, err := app.runBatch(ctx, batcher, job, requests)
+	if err != nil {
+		return err
+	}
+
+	for _, document := range documents {
+		progress := bulkProgress{Pages: make([]bulkPageClassification, len(document.pages))}
+
+		err := func() error {
+			for i := range document.pages {
+				page := &document.pages[i]
+
+				text, err := app.bulkResult(document, results, *page, taskClassify)
+				if err != nil {
+					return fmt.Errorf("failed to classify page %d: %w", page.num+1, err)
+				}
+
+				page.classification, err = app.parseClassification(document.ctx, text)
+				if err != nil {
+					return fmt.Errorf("failed to classify page %d: %w", page.num+1, err)
+				}
+
+				progress.Pages[i] = bulkPageClassification{
+					Type:       page.classification.Type,
+					Confidence: page.classification.Confidence,
+					FirstPage:  page.classification.StartsDocument,
+				}
+			}
+
+			return nil
+		}()
+		if err != nil {
+			err = app.failDocument(document.Document, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		progress.Models = document.routing.models()
+		if usage := document.routing.tokens(); usage != nil {
+			progress.Usage = *usage
+		}
+
+		pages, err := json.Marshal(progress)
+		if err != nil {
+			return err
+		}
+		document.Pages = string(pages)
+
+		err = app.db.UpdateDocument(document.Document)
+		if err != nil {
+			return err
+		}
+	}
+
+	job.Status = database.BulkJobExtracting
+	job.LLMBatchID = ""
+
+	return app.db.UpdateBulkJob(job)
+}
+
+// extractBulkDocuments extracts every page of the documents in one batch, and
+// saves the result of each document.
+func (app *application) extractBulkDocuments(ctx context.Context, batcher llm.Batcher, job *database.BulkJob, documents []*bulkDocument) error {
+	// Documents that failed to be classified are left out
+	documents = pendingDocuments(documents)
+
+	var requests []llm.BatchRequest
+	for _, document := range documents {
+		for _, page := range document.pages {
+			req, err := app.extractionRequest(lookupDocumentType(page.classification.Type), page.documentPage)
+			if err != nil {
+				return err
+			}
+			req.Model = app.modelFor(document.ctx, taskExtract)
+			requests = append(requests, llm.BatchRequest{ID: bulkRequestID(document, page), Request: req})
+		}
+	}
+
+	results, err := app.runBatch(ctx, batcher, job, requests)
+	if err != nil {
+		return err
+	}
+
+	for _, document := range documents {
+		result, err := app.assembleBulkResult(document, results)
+		if err != nil {
+			err = app.failDocument(document.Document, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+
+		document.Status = database.DocumentSuccess
+		document.Result = string(data)
+
+		err = app.db.UpdateDocument(document.Document)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	job.Status = database.BulkJobEnded
+	job.LLMBatchID = ""
+	job.EndedAt = &now
+
+	err = app.db.UpdateBulkJob(job)
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("bulk job ended", "job", job.ID)
+
+	return nil
+}
+
+// pendingDocuments returns the documents that have not failed.
+func pendingDocuments(documents []*bulkDocument) []*bulkDocument {
+	var pending []*bulkDocument
+
+	for _, document := range documents {
+		if document.Status == database.DocumentPending {
+			pending = append(pending, document)
+		}
+	}
+
+	return pending
+}
+
+// assembleBulkResult puts the extracted pages of a document together into
+// the same result that /api/ocr returns.
+func (app *application) assembleBulkResult(document *bulkDocument, results map[string]llm.BatchResult) (*ocrResult, error) {
+	var (
+		assembler = documentAssembler{fileData: document.data, numPages: len(document.pages)}
+		result    = &ocrResult{}
+	)
+
+	for _, page := range document.pages {
+		assembler.segment(page.num, page.classification)
+
+		text, err := app.bulkResult(document, results, page, taskExtract)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract text from page %d: %w", page.num+1, err)
+		}
+
+		assembler.addPage(page.num, app.parsePageExtraction(document.ctx, text, page.documentPage))
+		result.Metadata.Pages = append(result.Metadata.Pages, page.metadata)
+	}
+
+	result.Text, result.Documents = assembler.documents()
+	if len(result.Documents) > 0 {
+		result.Metadata.Document = &result.Documents[0].documentClassification
+	}
+	result.Metadata.Provider = ocrProviderAnthropic
+	result.Metadata.PromptVersion = app.prompts.Version()
+	result.Metadata.Models = document.routing.models()
+	result.Metadata.Usage = document.routing.tokens()
+	app.scanOCRResult(result)
+
+	return result, nil
+}
+
+// bulkResult returns the reply to the request for a page, and records the
+// model and tokens it used.
+func (app *application) bulkResult(document *bulkDocument, results map[string]llm.BatchResult, page bulkPage, task string) (string, error) {
+	result, ok := results[bulkRequestID(document, page)]
+	switch {
+	case !ok:
+		return "", errors.New("the batch has no result for the page")
+	case result.Err != nil:
+		return "", result.Err
+	}
+
+	document.routing.record(task, app.modelFor(document.ctx, task), result.Response.Usage)
+
+	return result.Response.Text, nil
+}
+
+// bulkRequestID identifies the request for a page in a batch.
+func bulkRequestID(document *bulkDocument, page bulkPage) string {
+	return fmt.Sprintf("doc%d-page%d", document.ID, page.num+1)
+}
+
+// runBatch submits requests as a batch, or picks up the batch that the job
+// already submitted, and waits for it to end. The results are returned by
+// request ID.
+func (app *application) runBatch(ctx context.Context, batcher llm.Batcher, job *database.BulkJob, requests []llm.BatchRequest) (map[string]llm.BatchResult, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	if job.LLMBatchID == "" {
+		batch, err := batcher.CreateBatch(ctx, requests)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create batch: %w", err)
+		}
+
+		job.LLMBatchID = batch.ID
+		err = app.db.UpdateBulkJob(job)
+		if err != nil {
+			return nil, err
+		}
+
+		app.logger.Info("batch created", "job", job.ID, "status", job.Status, "batch", batch.ID, "requests", len(requests))
+	}
+
+	for {
+		batch, err := batcher.GetBatch(ctx, job.LLMBatchID)
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err != nil && !llmUnavailable(err) && !llmQuotaExceeded(err):
+			return nil, fmt.Errorf("failed to get batch: %w", err)
+		case err != nil:
+			app.logger.Warn("failed to get batch, retrying", "job", job.ID, "batch", job.LLMBatchID, "error", err.Error())
+		case batch.Status == llm.BatchEnded:
+			app.logger.Info("batch ended", "job", job.ID, "batch", batch.ID, "succeeded", batch.Counts.Succeeded, "errored", batch.Counts.Errored, "expired", batch.Counts.Expired)
+
+			results, err := batcher.BatchResults(ctx, batch.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get batch results: %w", err)
+			}
+
+			byID := make(map[string]llm.BatchResult, len(results))
+			for _, result := range results {
+				byID[result.ID] = result
+			}
+			return byID, nil
+		default:
+			app.logger.Debug("batch in progress", "job", job.ID, "batch", batch.ID, "processing", batch.Counts.Processing)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(app.config.bulk.pollInterval):
+		}
+	}
+}
+
+// failDocument marks a document as failed.
+func (app *application) failDocument(document *database.Document, err error) error {
+	app.logger.Warn("bulk document failed", "job", document.BulkJobID, "document", document.ID, "filename", document.Filename, "error", err.Error())
+
+	document.Status = database.DocumentError
+	document.Error = err.Error()
+
+	return app.db.UpdateDocument(document)
+}
+
+// failBulkJob marks a job as failed, along with the documents it had not
+// finished, unless the error is that ctx was cancelled, in which case the job
+// is left to be resumed.
+func (app *application) failBulkJob(job *database.BulkJob, documents []*bulkDocument, err error) error {
+	if errors.Is(err, context.Canceled) {
+		app.logger.Info("bulk job interrupted", "job", job.ID, "status", job.Status, "batch", job.LLMBatchID)
+		return nil
+	}
+
+	app.logger.Error("bulk job failed", "job", job.ID, "status", job.Status, "error", err.Error())
+
+	for _, document := range documents {
+		if document.Status != database.DocumentPending {
+			continue
+		}
+
+		saveErr := app.failDocument(document.Document, err)
+		if saveErr != nil {
+			return saveErr
+		}
+	}
+
+	now := time.Now().UTC()
+	job.Status = database.BulkJobFailed
+	job.Error = err.Error()
+	job.EndedAt = &now
+
+	return app.db.UpdateBulkJob(job)
+}
+
+// bulkJobResponse is a job with its documents.
+type bulkJobResponse struct {
+	*database.BulkJob
+	DocumentList []database.Document `json:"documentList"`
+}
+
+// createBulkJobHandler handles an upload of many files, and starts a job
+// processing them in the background.
+func (app *application) createBulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := app.batcher()
+	if err != nil {
+		app.bulkUnsupported(w, r, err)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	err = rc.SetReadDeadline(time.Now().Add(batchTimeout))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	uploads, err := request.DecodeMultipartFiles(w, r, "file", maxFileSize, app.config.bulk.maxFiles)
+	if err != nil {
+		if errors.Is(err, request.ErrFileTooLarge) {
+			app.fileTooLarge(w, r, maxFileSize)
+			return
+		}
+		app.badRequest(w, r, err)
+		return
+	}
+	defer func() {
+		err := uploads.Close()
+		if err != nil {
+			app.logger.Warn("failed to remove uploaded files", "error", err.Error())
+		}
+	}()
+
+	input := app.newBulkJobInput()
+	input.DocumentType = uploads.Values.Get("documentType")
+	input.Model = uploads.Values.Get("model")
+
+	for _, upload := range uploads.Files {
+		file, err := upload.Load()
+		if err != nil {
+			if errors.Is(err, request.ErrFileTooLarge) {
+				app.fileTooLarge(w, r, maxFileSize)
+				return
+			}
+			app.serverError(w, r, err)
+			return
+		}
+		input.Files = append(input.Files, file)
+	}
+
+	input.validate()
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	job, err := app.createBulkJob(input)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.startBulkJob(job)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/admin/bulk-jobs/%d", job.ID))
+
+	err = response.JSONWithHeaders(w, http.StatusAccepted, job, headers)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listBulkJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := app.db.ListBulkJobs()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"jobs": jobs})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) showBulkJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	job, found, err := app.db.GetBulkJob(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	documents, err := app.db.BulkJobDocuments(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, bulkJobResponse{BulkJob: job, DocumentList: documents})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// showDocument returns a document of a bulk job with its OCR result.
+func (app *application) showDocument(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	document, found, err := app.db.GetDocument(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	data := struct {
+		*database.Document
+		Result json.RawMessage `json:"result,omitempty"`
+	}{Document: document}
+	if document.Result != "" {
+		data.Result = json.RawMessage(document.Result)
+	}
+
+	err = response.JSON(w, http.StatusOK, data)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
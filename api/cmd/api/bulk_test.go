@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dev.danielrb/auto-imm/api/internal/database"
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/llm/llmtest"
+	"dev.danielrb/auto-imm/api/internal/request"
+)
+
+// newBulkTestApplication returns a test application with an empty database,
+// that polls batches without waiting.
+func newBulkTestApplication(t *testing.T) (*application, *llmtest.Server) {
+	t.Helper()
+
+	app, srv := newTestApplication(t)
+	app.config.bulk.pollInterval = time.Millisecond
+
+	db, err := database.New(filepath.Join(t.TempDir(), "db.sqlite") + "?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	app.db = db
+
+	return app, srv
+}
+
+// newTestBulkJob creates a job for the given number of images.
+func newTestBulkJob(t *testing.T, app *application, files int, documentType string) *database.BulkJob {
+	t.Helper()
+
+	input := app.newBulkJobInput()
+	input.DocumentType = documentType
+	for i := range files {
+		input.Files = append(input.Files, &request.File{Filename: fmt.Sprintf("passport%d.png", i+1), Data: testImage(t)})
+	}
+
+	job, err := app.createBulkJob(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return job
+}
+
+// checkBulkJobEnded fails the test unless the job has ended with every
+// document extracted as testExtraction.
+func checkBulkJobEnded(t *testing.T, app *application, id int64, documents int) {
+	t.Helper()
+
+	job, found, err := app.db.GetBulkJob(id)
+	if err != nil || !found {
+		t.Fatalf("failed to get job: found %v, error %v", found, err)
+	}
+	if job.Status != database.BulkJobEnded || job.LLMBatchID != "" || job.EndedAt == nil {
+		t.Errorf("got job %+v, want it ended and not waiting for a batch", job)
+	}
+	if job.Documents != documents || job.Succeeded != documents || job.Failed != 0 {
+		t.Errorf("got %d documents, %d succeeded and %d failed, want all %d succeeded", job.Documents, job.Succeeded, job.Failed, documents)
+	}
+
+	rows, err := app.db.BulkJobDocuments(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		if row.Status != database.DocumentSuccess {
+			t.Errorf("document %s has status %q and error %q", row.Filename, row.Status, row.Error)
+			continue
+		}
+
+		var result ocrResult
+		err := json.Unmarshal([]byte(row.Result), &result)
+		if err != nil {
+			t.Fatalf("document %s has a result that is not JSON: %v", row.Filename, err)
+		}
+		if len(result.Documents) != 1 || result.Documents[0].Type != "passport" {
+			t.Fatalf("document %s has documents %+v, want one passport", row.Filename, result.Documents)
+		}
+
+		values := make(map[string]string)
+		for _, field := range result.Documents[0].Fields {
+			values[field.Name] = field.Value
+		}
+		if values["surname"] != "DOE" || values["givenNames"] != "JANE" {
+			t.Errorf("document %s has fields %v, want surname DOE and givenNames JANE", row.Filename, values)
+		}
+	}
+}
+
+func TestBulkJob(t *testing.T) {
+	app, srv := newBulkTestApplication(t)
+	srv.SetBatchPolls(2)
+	srv.Enqueue(llmtest.Reply(testClassification), llmtest.Reply(testClassification))
+	srv.Enqueue(llmtest.Reply(testExtraction), llmtest.Reply(testExtraction))
+
+	job := newTestBulkJob(t, app, 2, "")
+	if job.Status != database.BulkJobClassifying || job.Documents != 2 {
+		t.Fatalf("got job %+v, want 2 documents to classify", job)
+	}
+
+	err := app.runBulkJob(context.Background(), job)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkBulkJobEnded(t, app, job.ID, 2)
+
+	requests := srv.Requests()
+	if len(requests) != 4 {
+		t.Fatalf("got %d LLM requests, want 2 classifications and 2 extractions", len(requests))
+	}
+	for _, req := range requests {
+		if req.Images != 1 {
+			t.Errorf("got %d images in an LLM request, want 1", req.Images)
+		}
+	}
+}
+
+func TestBulkJobWithDocumentType(t *testing.T) {
+	app, srv := newBulkTestApplication(t)
+	srv.Enqueue(llmtest.Reply(testExtraction))
+
+	job := newTestBulkJob(t, app, 1, "passport")
+	if job.Status != database.BulkJobExtracting {
+		t.Fatalf("got status %q, want %q as classification is skipped", job.Status, database.BulkJobExtracting)
+	}
+
+	err := app.runBulkJob(context.Background(), job)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkBulkJobEnded(t, app, job.ID, 1)
+
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("got %d LLM requests, want 1", n)
+	}
+}
+
+func TestBulkJobDocumentError(t *testing.T) {
+	app, srv := newBulkTestApplication(t)
+	srv.Enqueue(llmtest.Reply(testExtraction), llmtest.Error(500, "api_error", "Internal server error"))
+
+	job := newTestBulkJob(t, app, 2, "passport")
+
+	err := app.runBulkJob(context.Background(), job)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	job, _, err = app.db.GetBulkJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.BulkJobEnded || job.Succeeded != 1 || job.Failed != 1 {
+		t.Errorf("got job %+v, want it ended with one document failed", job)
+	}
+}
+
+func TestBulkJobResume(t *testing.T) {
+	app, srv := newBulkTestApplication(t)
+	srv.SetBatchPolls(1)
+	srv.Enqueue(llmtest.Reply(testExtraction))
+
+	job := newTestBulkJob(t, app, 1, "passport")
+
+	rows, err := app.db.BulkJobDocuments(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The job was interrupted after submitting its batch
+	batcher, err := app.batcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := batcher.CreateBatch(context.Background(), []llm.BatchRequest{{
+		ID:      bulkRequestID(&bulkDocument{Document: &rows[0]}, bulkPage{num: 0}),
+		Request: llm.Request{MaxTokens: 1024, Parts: []llm.Part{llm.Text("Extract this passport.")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job.LLMBatchID = batch.ID
+	err = app.db.UpdateBulkJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := app.db.UnfinishedBulkJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].LLMBatchID != batch.ID {
+		t.Fatalf("got unfinished jobs %+v, want the job waiting for %s", jobs, batch.ID)
+	}
+
+	err = app.runBulkJob(context.Background(), &jobs[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkBulkJobEnded(t, app, job.ID, 1)
+
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("got %d LLM requests, want only the one in the existing batch", n)
+	}
+}
+
+func TestBulkJobInterrupted(t *testing.T) {
+	app, srv := newBulkTestApplication(t)
+	srv.SetBatchPolls(1000)
+	srv.Enqueue(llmtest.Reply(testExtraction))
+
+	job := newTestBulkJob(t, app, 1, "passport")
+
+	// The server shuts down while the batch is in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err := app.runBulkJob(ctx, job)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	job, _, err = app.db.GetBulkJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.BulkJobExtracting || job.LLMBatchID == "" {
+		t.Errorf("got job %+v, want it left waiting for its batch", job)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"dev.danielrb/auto-imm/api/internal/database"
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/request"
+	"dev.danielrb/auto-imm/api/internal/validator"
+)
+
+// bulkCommand runs a bulk OCR job from the command line, with the same
+// configuration as the server, and waits for it to end:
+//
+//	api [flags] bulk [-document-type=TYPE] [-model=MODEL] FILE|DIR...
+//	api [flags] bulk -resume=ID
+//
+// The results are saved to the database. If the command is interrupted, the
+// job is resumed with -resume, or by the server when it next starts.
+func (app *application) bulkCommand(args []string) error {
+	flags := flag.NewFlagSet("bulk", flag.ContinueOnError)
+	documentType := flags.String("document-type", "", "type of every document, which skips classification: "+strings.Join(documentTypeNames(), ", "))
+	model := flags.String("model", "", "LLM model to use instead of the configured ones, from -llm-allowed-models")
+	resume := flags.Int64("resume", 0, "resume the bulk job with this ID instead of starting a new one")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: api [flags] bulk [bulk flags] FILE|DIR...\n\nRuns OCR on the files, and the files in the directories, through the LLM provider's batch API, and saves the results to the database.\n\n")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.batcher()
+	if err != nil {
+		return err
+	}
+
+	var job *database.BulkJob
+
+	switch {
+	case *resume != 0:
+		var found bool
+		job, found, err = app.db.GetBulkJob(*resume)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("bulk job %d does not exist", *resume)
+		}
+	case flags.NArg() == 0:
+		flags.Usage()
+		return errors.New("no files given")
+	default:
+		input := app.newBulkJobInput()
+		input.DocumentType = *documentType
+		input.Model = *model
+
+		input.Files, err = readBulkFiles(flags.Args())
+		if err != nil {
+			return err
+		}
+
+		input.validate()
+		if input.Validator.HasErrors() {
+			return validationError(input.Validator)
+		}
+
+		job, err = app.createBulkJob(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(app.shutdownCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if job.Status == database.BulkJobClassifying || job.Status == database.BulkJobExtracting {
+		err = app.runBulkJob(ctx, job)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		fmt.Printf("Interrupted. Resume bulk job %d with -resume=%d, or start the server to resume it in the background.\n", job.ID, job.ID)
+		return nil
+	}
+
+	return app.printBulkJob(job.ID)
+}
+
+// readBulkFiles reads the files given on the command line. Directories are
+// read without descending into sub-directories, skipping hidden files and
+// files that are not supported documents.
+func readBulkFiles(paths []string) ([]*request.File, error) {
+	var files []*request.File
+
+	readFile := func(path string) (*request.File, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > maxFileSize {
+			return nil, fmt.Errorf("%s is larger than %d MB", path, maxFileSize>>20)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &request.File{Filename: filepath.Base(path), Size: info.Size(), Data: data}, nil
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			file, err := readFile(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			file, err := readFile(filepath.Join(path, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if !validator.In(imaging.DetectMediaType(file.Data), ocrMediaTypes...) {
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// validationError returns the errors of a validator as one error.
+func validationError(v validator.Validator) error {
+	messages := slices.Clone(v.Errors)
+	for _, key := range slices.Sorted(maps.Keys(v.FieldErrors)) {
+		messages = append(messages, key+": "+v.FieldErrors[key])
+	}
+
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// printBulkJob prints the status of a job and its documents.
+func (app *application) printBulkJob(id int64) error {
+	job, _, err := app.db.GetBulkJob(id)
+	if err != nil {
+		return err
+	}
+
+	documents, err := app.db.BulkJobDocuments(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Bulk job %d %s: %d documents, %d succeeded, %d failed\n", job.ID, job.Status, job.Documents, job.Succeeded, job.Failed)
+	if job.Error != "" {
+		fmt.Printf("Error: %s\n", job.Error)
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOCUMENT\tFILENAME\tSTATUS\tERROR")
+	for _, document := range documents {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", document.ID, document.Filename, document.Status, document.Error)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"dev.danielrb/auto-imm/api/internal/mrz"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ocrModeConsensus runs both OCR providers over an upload and reconciles
+// their results.
+const ocrModeConsensus = "consensus"
+
+// Statuses of a field in a consensus result.
+const (
+	consensusAgreed     = "agreed"
+	consensusDisagreed  = "disagreed"
+	consensusUnverified = "unverified"
+)
+
+// minConsensusValueRunes is the length below which a value is not looked for
+// in Tesseract's text, as a value such as "M" or "CAN" would be found in
+// almost any text by chance.
+const minConsensusValueRunes = 4
+
+// resolvedByMRZ marks fields whose value was taken from a machine readable
+// zone because its check digit confirmed it.
+const resolvedByMRZ = "mrz_check_digit"
+
+// consensusResult compares the fields Claude extracted with the text Tesseract
+// read from the same upload.
+type consensusResult struct {
+	Fields      []consensusField `json:"fields"`
+	Agreed      int              `json:"agreed"`
+	Disagreed   int              `json:"disagreed"`
+	Unverified  int              `json:"unverified"`
+	NeedsReview bool             `json:"needsReview"`
+	// MRZ is the machine readable zone Tesseract found, if any.
+	MRZ           *mrz.MRZ `json:"mrz,omitempty"`
+	TesseractText string   `json:"tesseractText"`
+}
+
+type consensusField struct {
+	DocumentID string `json:"documentId"`
+	Name       string `json:"name"`
+	// Value is the reconciled value, which is also written back to the
+	// field in the documents of the response.
+	Value          string `json:"value"`
+	ClaudeValue    string `json:"claudeValue"`
+	TesseractValue string `json:"tesseractValue,omitempty"`
+	Status         string `json:"status"`
+	ResolvedBy     string `json:"resolvedBy,omitempty"`
+	NeedsReview    bool   `json:"needsReview"`
+}
+
+// runConsensusOCR runs the anthropic and tesseract providers over the same
+// upload at the same time, and reconciles their results field by field.
+// Claude's result is returned, with any values corrected by a machine
+// readable zone, along with the reconciliation.
+func (app *application) runConsensusOCR(ctx context.Context, input *ocrInput, progress progressReporter) (*ocrResult, error) {
+	claudeInput := *input
+	claudeInput.Provider = ocrProviderAnthropic
+	claudeInput.Mode = ""
+
+	tesseractInput := *input
+	tesseractInput.Provider = ocrProviderTesseract
+	tesseractInput.Mode = ""
+	tesseractInput.Output = ocrOutputText
+
+	type tesseractOutcome struct {
+		result *ocrResult
+		err    error
+	}
+	tesseractDone := make(chan tesseractOutcome, 1)
+
+	go func() {
+		result, err := app.runProvider(ctx, &tesseractInput, nil)
+		tesseractDone <- tesseractOutcome{result, err}
+	}()
+
+	result, err := app.runProvider(ctx, &claudeInput, progress)
+	tesseract := <-tesseractDone
+	if err != nil {
+		return nil, err
+	}
+	if tesseract.err != nil {
+		return nil, tesseract.err
+	}
+
+	result.Consensus = reconcile(result.Documents, tesseract.result.Text)
+	return result, nil
+}
+
+// reconcile compares each field Claude extracted against the text Tesseract
+// read. Fields covered by a check digit in a machine readable zone are
+// compared with the decoded zone, and the zone wins when its check digit is
+// correct. Other fields are looked for in Tesseract's text. Every field that
+// the engines disagree on, or that Tesseract could not confirm, is flagged for
+// review.
+func reconcile(documents []documentSegment, tesseractText string) *consensusResult {
+	result := &consensusResult{
+		Fields:        []consensusField{},
+		TesseractText: tesseractText,
+	}
+
+	if zone, ok := mrz.Find(tesseractText); ok {
+		result.MRZ = zone
+	}
+
+	words := normalizeWords(tesseractText)
+
+	for i := range documents {
+		for j := range documents[i].Fields {
+			field := &documents[i].Fields[j]
+
+			cf := consensusField{
+				DocumentID:  field.DocumentID,
+				Name:        field.Name,
+				Value:       field.Value,
+				ClaudeValue: field.Value,
+			}
+
+			mrzValue, verified, inMRZ := mrzField(result.MRZ, field.Name)
+
+			// Claude may write a country name rather than its code, which
+			// cannot be compared with the zone without a lookup table
+			if (field.Name == "nationality" || field.Name == "issuingCountry") && len(normalizeValue(field.Value)) != 3 {
+				inMRZ = false
+			}
+
+			switch {
+			case inMRZ && valuesMatch(field.Name, field.Value, mrzValue):
+				cf.Status = consensusAgreed
+				cf.TesseractValue = mrzValue
+			case inMRZ:
+				cf.Status = consensusDisagreed
+				cf.TesseractValue = mrzValue
+				if verified {
+					cf.Value = mrzValue
+					cf.ResolvedBy = resolvedByMRZ
+					field.Value = mrzValue
+					field.Source = fieldSourceMRZ
+				}
+			case containsValue(words, field.Value):
+				cf.Status = consensusAgreed
+				cf.TesseractValue = field.Value
+			default:
+				cf.Status = consensusUnverified
+			}
+
+			cf.NeedsReview = cf.Status != consensusAgreed
+
+			switch cf.Status {
+			case consensusAgreed:
+				result.Agreed++
+			case consensusDisagreed:
+				result.Disagreed++
+			default:
+				result.Unverified++
+			}
+			result.NeedsReview = result.NeedsReview || cf.NeedsReview
+
+			result.Fields = append(result.Fields, cf)
+		}
+	}
+
+	return result
+}
+
+// mrzField returns the value of an extracted field as decoded from a machine
+// readable zone, and whether a correct check digit confirms it.
+func mrzField(zone *mrz.MRZ, name string) (value string, verified bool, ok bool) {
+	if zone == nil {
+		return "", false, false
+	}
+
+	switch name {
+	case "surname":
+		return zone.Surname, false, zone.Surname != ""
+	case "givenNames":
+		return zone.GivenNames, false, zone.GivenNames != ""
+	case "passportNumber", "documentNumber":
+		return zone.DocumentNumber, zone.Checks.DocumentNumber, zone.DocumentNumber != ""
+	case "nationality":
+		return zone.Nationality, false, zone.Nationality != ""
+	case "issuingCountry":
+		return zone.IssuingCountry, false, zone.IssuingCountry != ""
+	case "sex":
+		return zone.Sex, false, zone.Sex != ""
+	case "dateOfBirth":
+		return zone.DateOfBirth, zone.Checks.DateOfBirth, zone.DateOfBirth != ""
+	case "dateOfExpiry":
+		return zone.DateOfExpiry, zone.Checks.DateOfExpiry, zone.DateOfExpiry != ""
+	}
+
+	return "", false, false
+}
+
+// valuesMatch compares a value Claude extracted with the same value decoded
+// from a machine readable zone, allowing for the differences in how each
+// writes names, dates and codes.
+func valuesMatch(name, claudeValue, mrzValue string) bool {
+	switch name {
+	case "dateOfBirth", "dateOfExpiry":
+		for _, d := range parseDates(claudeValue) {
+			if d.Format("2006-01-02") == mrzValue {
+				return true
+			}
+		}
+		return false
+	case "sex":
+		v := normalizeValue(claudeValue)
+		return v != "" && v[:1] == mrzValue
+	}
+
+	// Names in the zone are truncated to fit, so a prefix match is enough.
+	v, m := normalizeValue(claudeValue), normalizeValue(mrzValue)
+	return v == m || (m != "" && strings.HasPrefix(v, m))
+}
+
+// containsValue reports whether a value appears as whole words in normalized
+// text, trying the common ways of writing it if it is a date. Values shorter
+// than minConsensusValueRunes are never found.
+func containsValue(words []string, value string) bool {
+	v := normalizeValue(value)
+	if utf8.RuneCountInString(v) < minConsensusValueRunes {
+		return false
+	}
+	if containsWords(words, v) {
+		return true
+	}
+
+	for _, d := range parseDates(value) {
+		for _, layout := range []string{"02Jan2006", "2Jan2006", "02012006", "20060102", "Jan022006", "02January2006"} {
+			if containsWords(words, strings.ToUpper(d.Format(layout))) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containsWords reports whether consecutive words, joined together, are equal
+// to a normalized value, so that "AB 123456" is found in "No. AB123456" and
+// the other way around, but not in "TAB1234567".
+func containsWords(words []string, v string) bool {
+	for i := range words {
+		joined := ""
+		for _, word := range words[i:] {
+			joined += word
+			if joined == v {
+				return true
+			}
+			if !strings.HasPrefix(v, joined) {
+				break
+			}
+		}
+	}
+
+	return false
+}
+
+// normalizeWords splits text into words of letters and digits, and
+// normalizes each of them.
+func normalizeWords(s string) []string {
+	var words []string
+
+	fields := strings.FieldsFunc(norm.NFD.String(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r)
+	})
+	for _, field := range fields {
+		if word := normalizeValue(field); word != "" {
+			words = append(words, word)
+		}
+	}
+
+	return words
+}
+
+// normalizeValue reduces text to upper case letters and digits, with accents
+// removed, so that values can be compared regardless of spacing, punctuation
+// and transliteration.
+func normalizeValue(s string) string {
+	var b strings.Builder
+
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+
+	return b.String()
+}
+
+// parseDates returns the dates a value could be. Dates written with numbers
+// only are ambiguous between day and month first, so both are returned.
+func parseDates(s string) []time.Time {
+	layouts := []string{
+		"2006-01-02", "2006/01/02", "02/01/2006", "01/02/2006", "02.01.2006", "02-01-2006",
+		"2 Jan 2006", "2 January 2006", "Jan 2, 2006", "January 2, 2006", "02 Jan 06", "2Jan2006",
+	}
+
+	s = strings.TrimSpace(s)
+
+	var dates []time.Time
+	for _, layout := range layouts {
+		d, err := time.Parse(layout, s)
+		if err == nil {
+			dates = append(dates, d)
+		}
+	}
+
+	return dates
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTesseractPassport is the text Tesseract reads from the ICAO Doc 9303
+// specimen passport.
+const testTesseractPassport = `UTOPIA PASSPORT
+Surname ERIKSSON
+Given names ANNA MARIA
+Place of birth ZENITH
+Authority PASSPORT OFFICE
+P<UTOERIKSSON<<ANNA<MARIA<<<<<<<<<<<<<<<<<<<
+L898902C36UTO7408122F1204159ZE184226B<<<<<10`
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		field      extractedField
+		wantStatus string
+		wantValue  string
+		wantSource string
+		wantMRZ    string
+		resolved   bool
+	}{
+		{
+			name:       "Agreed with the zone",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "surname", Value: "Eriksson", Source: fieldSourceVisualZone},
+			wantStatus: consensusAgreed,
+			wantValue:  "Eriksson",
+			wantSource: fieldSourceVisualZone,
+			wantMRZ:    "ERIKSSON",
+		},
+		{
+			name:       "Agreed date with the zone",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "dateOfBirth", Value: "12/08/1974", Source: fieldSourceVisualZone},
+			wantStatus: consensusAgreed,
+			wantValue:  "12/08/1974",
+			wantSource: fieldSourceVisualZone,
+			wantMRZ:    "1974-08-12",
+		},
+		{
+			name:       "Agreed with the text",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "issuingAuthority", Value: "Passport Office", Source: fieldSourceVisualZone},
+			wantStatus: consensusAgreed,
+			wantValue:  "Passport Office",
+			wantSource: fieldSourceVisualZone,
+			wantMRZ:    "Passport Office",
+		},
+		{
+			name:       "Disagreed and resolved by the check digit",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "passportNumber", Value: "L898902O3", Source: fieldSourceVisualZone},
+			wantStatus: consensusDisagreed,
+			wantValue:  "L898902C3",
+			wantSource: fieldSourceMRZ,
+			wantMRZ:    "L898902C3",
+			resolved:   true,
+		},
+		{
+			name:       "Disagreed with an invalid check digit",
+			text:       strings.Replace(testTesseractPassport, "L898902C36", "L898902C35", 1),
+			field:      extractedField{Name: "passportNumber", Value: "L898902O3", Source: fieldSourceVisualZone},
+			wantStatus: consensusDisagreed,
+			wantValue:  "L898902O3",
+			wantSource: fieldSourceVisualZone,
+			wantMRZ:    "L898902C3",
+		},
+		{
+			name:       "Disagreed with no check digit",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "givenNames", Value: "Annette", Source: fieldSourceVisualZone},
+			wantStatus: consensusDisagreed,
+			wantValue:  "Annette",
+			wantSource: fieldSourceVisualZone,
+			wantMRZ:    "ANNA MARIA",
+		},
+		{
+			name:       "Unverified",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "placeOfBirth", Value: "Utopia City", Source: fieldSourceVisualZone},
+			wantStatus: consensusUnverified,
+			wantValue:  "Utopia City",
+			wantSource: fieldSourceVisualZone,
+		},
+		{
+			name:       "Unverified short value",
+			text:       "SEX M",
+			field:      extractedField{Name: "sex", Value: "M", Source: fieldSourceVisualZone},
+			wantStatus: consensusUnverified,
+			wantValue:  "M",
+			wantSource: fieldSourceVisualZone,
+		},
+		{
+			name:       "Country name is not compared with the zone",
+			text:       testTesseractPassport,
+			field:      extractedField{Name: "nationality", Value: "Utopia", Source: fieldSourceVisualZone},
+			wantStatus: consensusAgreed,
+			wantValue:  "Utopia",
+			wantSource: fieldSourceVisualZone,
+			wantMRZ:    "Utopia",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			documents := []documentSegment{{ID: "doc-1", Fields: []extractedField{tt.field}}}
+
+			result := reconcile(documents, tt.text)
+
+			if len(result.Fields) != 1 {
+				t.Fatalf("got %d consensus fields, want 1", len(result.Fields))
+			}
+			cf := result.Fields[0]
+
+			if cf.Status != tt.wantStatus {
+				t.Errorf("got status %q, want %q", cf.Status, tt.wantStatus)
+			}
+			if cf.Value != tt.wantValue || documents[0].Fields[0].Value != tt.wantValue {
+				t.Errorf("got value %q and field value %q, want %q", cf.Value, documents[0].Fields[0].Value, tt.wantValue)
+			}
+			if cf.ClaudeValue != tt.field.Value {
+				t.Errorf("got Claude value %q, want %q", cf.ClaudeValue, tt.field.Value)
+			}
+			if cf.TesseractValue != tt.wantMRZ {
+				t.Errorf("got Tesseract value %q, want %q", cf.TesseractValue, tt.wantMRZ)
+			}
+			if got := documents[0].Fields[0].Source; got != tt.wantSource {
+				t.Errorf("got source %q, want %q", got, tt.wantSource)
+			}
+			if (cf.ResolvedBy == resolvedByMRZ) != tt.resolved {
+				t.Errorf("got resolved by %q, want resolved %t", cf.ResolvedBy, tt.resolved)
+			}
+			if cf.NeedsReview != (tt.wantStatus != consensusAgreed) || result.NeedsReview != cf.NeedsReview {
+				t.Errorf("got needs review %t for the field and %t for the result", cf.NeedsReview, result.NeedsReview)
+			}
+		})
+	}
+}
+
+func TestReconcileCounts(t *testing.T) {
+	documents := []documentSegment{
+		{ID: "doc-1", Fields: []extractedField{
+			{Name: "surname", Value: "ERIKSSON"},
+			{Name: "passportNumber", Value: "L898902O3"},
+			{Name: "placeOfBirth", Value: "Utopia City"},
+		}},
+		{ID: "doc-2", Fields: []extractedField{
+			{Name: "dateOfExpiry", Value: "15 Apr 2012"},
+		}},
+	}
+
+	result := reconcile(documents, testTesseractPassport)
+
+	if result.MRZ == nil || result.MRZ.DocumentNumber != "L898902C3" {
+		t.Fatalf("got zone %+v, want the specimen zone", result.MRZ)
+	}
+	if result.Agreed != 2 || result.Disagreed != 1 || result.Unverified != 1 {
+		t.Errorf("got %d agreed, %d disagreed and %d unverified, want 2, 1 and 1", result.Agreed, result.Disagreed, result.Unverified)
+	}
+	if !result.NeedsReview {
+		t.Error("got a result that does not need review")
+	}
+	if result.TesseractText != testTesseractPassport {
+		t.Error("the Tesseract text was not returned")
+	}
+}
+
+func TestValuesMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		field  string
+		claude string
+		mrz    string
+		want   bool
+	}{
+		{name: "Same name", field: "surname", claude: "ERIKSSON", mrz: "ERIKSSON", want: true},
+		{name: "Accented name", field: "surname", claude: "Eriksśon", mrz: "ERIKSSON", want: true},
+		{name: "Truncated name", field: "givenNames", claude: "Anna Maria Christina", mrz: "ANNA MARIA CHRIS", want: true},
+		{name: "Different name", field: "givenNames", claude: "Annette", mrz: "ANNA MARIA", want: false},
+		{name: "Document number", field: "passportNumber", claude: "L898 902C3", mrz: "L898902C3", want: true},
+		{name: "Misread document number", field: "passportNumber", claude: "L898902O3", mrz: "L898902C3", want: false},
+		{name: "ISO date", field: "dateOfBirth", claude: "1974-08-12", mrz: "1974-08-12", want: true},
+		{name: "Day first date", field: "dateOfBirth", claude: "12/08/1974", mrz: "1974-08-12", want: true},
+		{name: "Month first date", field: "dateOfBirth", claude: "08/12/1974", mrz: "1974-08-12", want: true},
+		{name: "Written date", field: "dateOfExpiry", claude: "15 April 2012", mrz: "2012-04-15", want: true},
+		{name: "Different date", field: "dateOfExpiry", claude: "15 April 2013", mrz: "2012-04-15", want: false},
+		{name: "Unparsable date", field: "dateOfExpiry", claude: "next April", mrz: "2012-04-15", want: false},
+		{name: "Sex word", field: "sex", claude: "Female", mrz: "F", want: true},
+		{name: "Different sex", field: "sex", claude: "M", mrz: "F", want: false},
+		{name: "Empty sex", field: "sex", claude: "", mrz: "F", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := valuesMatch(tt.field, tt.claude, tt.mrz); got != tt.want {
+				t.Errorf("valuesMatch(%q, %q, %q) = %t, want %t", tt.field, tt.claude, tt.mrz, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainsWords(t *testing.T) {
+	tests := []struct {
+		text  string
+		value string
+		want  bool
+	}{
+		{text: "Passport No. AB 123456", value: "AB123456", want: true},
+		{text: "Passport No. AB123456", value: "AB 123456", want: true},
+		{text: "Passport No. TAB1234567", value: "AB123456", want: false},
+		{text: "Passport No. AB 1234567", value: "AB123456", want: false},
+		{text: "Passport No. T AB 123456", value: "AB123456", want: true},
+		{text: "Name: José Müller", value: "JOSE MULLER", want: true},
+		{text: "", value: "AB123456", want: false},
+	}
+
+	for _, tt := range tests {
+		got := containsWords(normalizeWords(tt.text), normalizeValue(tt.value))
+		if got != tt.want {
+			t.Errorf("containsWords(%q, %q) = %t, want %t", tt.text, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestContainsValue(t *testing.T) {
+	tests := []struct {
+		text  string
+		value string
+		want  bool
+	}{
+		{text: "Date of birth 12 AUG 1974", value: "1974-08-12", want: true},
+		{text: "Date of birth 12.08.1974", value: "1974-08-12", want: true},
+		{text: "Date of birth 12 AUG 1975", value: "1974-08-12", want: false},
+		{text: "Sex M Nationality UTO", value: "UTO", want: false},
+	}
+
+	for _, tt := range tests {
+		got := containsValue(normalizeWords(tt.text), tt.value)
+		if got != tt.want {
+			t.Errorf("containsValue(%q, %q) = %t, want %t", tt.text, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseDates(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{s: "1974-08-12", want: []string{"1974-08-12"}},
+		{s: " 12 Aug 1974 ", want: []string{"1974-08-12"}},
+		{s: "August 12, 1974", want: []string{"1974-08-12"}},
+		{s: "12/08/1974", want: []string{"1974-08-12", "1974-12-08"}},
+		{s: "25/08/1974", want: []string{"1974-08-25"}},
+		{s: "12.08.1974", want: []string{"1974-08-12"}},
+		{s: "1974", want: nil},
+		{s: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, d := range parseDates(tt.s) {
+			got = append(got, d.Format(time.DateOnly))
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseDates(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
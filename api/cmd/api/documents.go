@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/pdf"
+	"dev.danielrb/auto-imm/api/internal/request"
+	"dev.danielrb/auto-imm/api/internal/response"
+	"dev.danielrb/auto-imm/api/internal/validator"
+
+	"github.com/gen2brain/go-fitz"
+)
+
+// Document types that uploads are classified as.
+const (
+	documentPassport            = "passport"
+	documentNationalID          = "national_id"
+	documentBirthCertificate    = "birth_certificate"
+	documentMarriageCertificate = "marriage_certificate"
+	documentBankStatement       = "bank_statement"
+	documentEmploymentLetter    = "employment_letter"
+	documentLanguageTestResult  = "language_test_result"
+	documentEducationCredential = "education_credential"
+	documentPhoto               = "photo"
+	documentOther               = "other"
+)
+
+// documentType describes a kind of document, how to recognise it and which
+// fields to extract from it.
+type documentType struct {
+	Name        string
+	Description string
+	// Fields are the keys of the JSON object returned for the document.
+	Fields []string
+	// Instructions are extra guidance for extracting this kind of document.
+	Instructions string
+}
+
+const mrzInstructions = "If you see a machine readable zone (MRZ), decode it to get the correct values and do not include the MRZ lines in the returned JSON."
+
+var documentTypes = []documentType{
+	{
+		Name:         documentPassport,
+		Description:  "a passport or travel document",
+		Fields:       []string{"surname", "givenNames", "passportNumber", "nationality", "sex", "dateOfBirth", "placeOfBirth", "dateOfIssue", "dateOfExpiry", "issuingCountry", "issuingAuthority"},
+		Instructions: mrzInstructions,
+	},
+	{
+		Name:         documentNationalID,
+		Description:  "a national identity card",
+		Fields:       []string{"surname", "givenNames", "documentNumber", "nationality", "sex", "dateOfBirth", "placeOfBirth", "address", "dateOfIssue", "dateOfExpiry", "issuingCountry"},
+		Instructions: mrzInstructions,
+	},
+	{
+		Name:        documentBirthCertificate,
+		Description: "a birth certificate",
+		Fields:      []string{"surname", "givenNames", "sex", "dateOfBirth", "placeOfBirth", "countryOfBirth", "fatherName", "motherName", "registrationNumber", "dateOfRegistration"},
+	},
+	{
+		Name:        documentMarriageCertificate,
+		Description: "a marriage certificate",
+		Fields:      []string{"spouse1Name", "spouse1DateOfBirth", "spouse2Name", "spouse2DateOfBirth", "dateOfMarriage", "placeOfMarriage", "countryOfMarriage", "registrationNumber"},
+	},
+	{
+		Name:         documentBankStatement,
+		Description:  "a bank statement",
+		Fields:       []string{"accountHolder", "address", "bankName", "accountNumber", "currency", "statementStartDate", "statementEndDate", "openingBalance", "closingBalance"},
+		Instructions: "Do not list individual transactions.",
+	},
+	{
+		Name:        documentEmploymentLetter,
+		Description: "an employment or reference letter from an employer",
+		Fields:      []string{"employeeName", "employerName", "employerAddress", "jobTitle", "startDate", "endDate", "hoursPerWeek", "salary", "duties", "signatoryName", "signatoryTitle", "dateOfLetter"},
+	},
+	{
+		Name:        documentLanguageTestResult,
+		Description: "a language test result such as IELTS, CELPIP, TEF or TCF",
+		Fields:      []string{"candidateName", "testName", "testVersion", "testDate", "registrationNumber", "listening", "reading", "writing", "speaking", "overall"},
+	},
+	{
+		Name:        documentEducationCredential,
+		Description: "a diploma, degree, transcript or educational credential assessment",
+		Fields:      []string{"studentName", "institution", "credential", "fieldOfStudy", "startDate", "dateCompleted", "country", "canadianEquivalency"},
+	},
+	{
+		Name:        documentPhoto,
+		Description: "a photograph of a person with no document text",
+		Fields:      []string{"description"},
+	},
+	{
+		Name:        documentOther,
+		Description: "any other personal document",
+	},
+}
+
+// lookupDocumentType returns the document type with the given name, falling
+// back to documentOther.
+func lookupDocumentType(name string) documentType {
+	for _, dt := range documentTypes {
+		if dt.Name == name {
+			return dt
+		}
+	}
+
+	return documentTypes[len(documentTypes)-1]
+}
+
+func documentTypeNames() []string {
+	names := make([]string, len(documentTypes))
+	for i, dt := range documentTypes {
+		names[i] = dt.Name
+	}
+	return names
+}
+
+// documentClassification is the type a document was classified as.
+type documentClassification struct {
+	Type       string  `json:"type"`
+	Confidence float64 `json:"confidence"`
+	// StartsDocument reports whether the classified page looks like the
+	// first page of a document, such as the photo page of a second passport,
+	// rather than a continuation of the page before it.
+	StartsDocument bool `json:"-"`
+}
+
+// documentSegment is a run of consecutive pages that make up one logical
+// document within an upload.
+type documentSegment struct {
+	ID string `json:"id"`
+	documentClassification
+	FirstPage int              `json:"firstPage"`
+	LastPage  int              `json:"lastPage"`
+	Text      string           `json:"text"`
+	Fields    []extractedField `json:"fields"`
+}
+
+// continuedBy reports whether a page with the given number and
+// classification belongs to the segment.
+func (s documentSegment) continuedBy(page int, classification documentClassification) bool {
+	return page == s.LastPage+1 &&
+		classification.Type == s.Type &&
+		!classification.StartsDocument
+}
+
+// documentAssembler puts the extracted pages of an upload together, in page
+// order, into its text and the logical documents that it holds.
+type documentAssembler struct {
+	fileData     []byte
+	numPages     int
+	text         strings.Builder
+	segments     []documentSegment
+	segmentTexts []*strings.Builder
+}
+
+// segment returns the segment that a classified page belongs to. A new one is
+// started when the page does not follow on from the last one, either because
+// pages in between were not selected or because it belongs to a different
+// document.
+func (a *documentAssembler) segment(pageNum int, classification documentClassification) *documentSegment {
+	if len(a.segments) == 0 || !a.segments[len(a.segments)-1].continuedBy(pageNum+1, classification) {
+		a.segments = append(a.segments, documentSegment{
+			ID:                     documentID(a.fileData, len(a.segments)),
+			documentClassification: classification,
+			FirstPage:              pageNum + 1,
+		})
+		a.segmentTexts = append(a.segmentTexts, &strings.Builder{})
+	}
+
+	return &a.segments[len(a.segments)-1]
+}
+
+// addPage adds the extraction of a page to the segment last returned by
+// segment.
+func (a *documentAssembler) addPage(pageNum int, extraction pageExtraction) {
+	segment := &a.segments[len(a.segments)-1]
+
+	for _, field := range extraction.Fields {
+		field.DocumentID = segment.ID
+		field.Page = pageNum + 1
+		segment.Fields = append(segment.Fields, field)
+	}
+
+	segment.LastPage = pageNum + 1
+	writePageText(&a.text, a.numPages, pageNum, extraction.Text)
+	writePageText(a.segmentTexts[len(a.segmentTexts)-1], a.numPages, pageNum, extraction.Text)
+}
+
+// documents returns the text of the upload and its segments.
+func (a *documentAssembler) documents() (string, []documentSegment) {
+	for i := range a.segments {
+		a.segments[i].Text = a.segmentTexts[i].String()
+	}
+
+	return a.text.String(), a.segments
+}
+
+// classificationPrompt returns the prompt used to classify a page.
+func (app *application) classificationPrompt() (string, error) {
+	return app.prompts.Execute("classify.tmpl", struct {
+		DocumentTypes []documentType
+	}{documentTypes})
+}
+
+// extractionPrompt returns the prompt used to extract the text of a document
+// of the given type. The source describes what Claude is given, such as
+// "this image".
+func (app *application) extractionPrompt(dt documentType, source string) (string, error) {
+	return app.prompts.Execute("extract.tmpl", struct {
+		DocumentType documentType
+		Source       string
+	}{dt, source})
+}
+
+// classifyDocument asks Claude what kind of document a page comes from.
+func (app *application) classifyDocument(ctx context.Context, page documentPage) (documentClassification, error) {
+	req, err := app.classificationRequest(page)
+	if err != nil {
+		return documentClassification{}, err
+	}
+
+	responseText, err := app.complete(ctx, taskClassify, req)
+	if err != nil {
+		return documentClassification{}, err
+	}
+
+	return app.parseClassification(ctx, responseText)
+}
+
+// classificationRequest returns the request that classifies a page.
+func (app *application) classificationRequest(page documentPage) (llm.Request, error) {
+	prompt, err := app.classificationPrompt()
+	if err != nil {
+		return llm.Request{}, err
+	}
+
+	return llm.Request{
+		MaxTokens: 256,
+		Parts:     []llm.Part{llm.Text(prompt), page.part()},
+	}, nil
+}
+
+// parseClassification parses Claude's response to a classification request.
+func (app *application) parseClassification(ctx context.Context, responseText string) (documentClassification, error) {
+	var classifyResponse struct {
+		Type       string  `json:"type"`
+		Confidence float64 `json:"confidence"`
+		FirstPage  bool    `json:"firstPage"`
+	}
+
+	err := app.parseWithRepair(ctx, responseText, func(text string) error {
+		err := json.Unmarshal([]byte(trimCodeFence(text)), &classifyResponse)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAIResponseInvalid, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return documentClassification{}, err
+	}
+
+	classification := documentClassification{
+		Type:           lookupDocumentType(classifyResponse.Type).Name,
+		Confidence:     min(max(classifyResponse.Confidence, 0), 1),
+		StartsDocument: classifyResponse.FirstPage,
+	}
+
+	app.logger.Debug("document classified", "type", classification.Type, "confidence", classification.Confidence)
+
+	return classification, nil
+}
+
+// classifyUpload handles a single file upload and reports what kind of
+// document it is, without extracting its text. Paged documents are
+// classified from their first selected page.
+func (app *application) classifyUpload(w http.ResponseWriter, r *http.Request) {
+	file, err := request.DecodeMultipartFile(w, r, "file", maxFileSize)
+	if err != nil {
+		if errors.Is(err, request.ErrFileTooLarge) {
+			app.fileTooLarge(w, r, maxFileSize)
+			return
+		}
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input := app.newOCRInput(r, file, ocrProviderAnthropic, r.FormValue("pages"))
+	input.Model = r.FormValue("model")
+
+	if !validator.In(input.MediaType, ocrMediaTypes...) {
+		app.unsupportedMediaType(w, r, input.MediaType)
+		return
+	}
+
+	input.validate()
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	ctx, _ := withModelRouting(r.Context(), input.Model)
+
+	classification, err := app.runClassification(ctx, input)
+	if err != nil {
+		problem, headers := app.ocrProblem(r, input, err)
+		app.writeProblem(w, r, problem, headers)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, classification)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) runClassification(ctx context.Context, input *ocrInput) (documentClassification, error) {
+	if app.llm == nil {
+		return documentClassification{}, errLLMNotConfigured
+	}
+
+	if !imaging.IsPaged(input.MediaType) {
+		prepared, err := imaging.Preprocess(input.File.Data, input.MediaType, app.config.preprocess.anthropic)
+		if err != nil {
+			return documentClassification{}, err
+		}
+
+		return app.classifyDocument(ctx, documentPage{image: prepared})
+	}
+
+	doc, err := fitz.NewFromMemory(input.File.Data)
+	if err != nil {
+		return documentClassification{}, fmt.Errorf("failed to open document: %w", err)
+	}
+	defer doc.Close()
+
+	numPages := doc.NumPage()
+	if input.pageRanges.last() > numPages {
+		return documentClassification{}, fmt.Errorf("%w: the document has %d pages", errPagesOutOfRange, numPages)
+	}
+
+	for pageNum := 0; pageNum < numPages; pageNum++ {
+		if !input.pageRanges.contains(pageNum + 1) {
+			continue
+		}
+
+		page, err := app.loadPage(doc, pageNum, app.config.preprocess.anthropic)
+		if err != nil {
+			return documentClassification{}, err
+		}
+
+		return app.classifyDocument(ctx, page)
+	}
+
+	return documentClassification{}, errors.New("the document has no pages")
+}
+
+// splitDocumentResponse holds each requested segment of a PDF as a PDF of its
+// own. The data is base64 encoded in the JSON response.
+type splitDocumentResponse struct {
+	Documents []splitDocument `json:"documents"`
+}
+
+type splitDocument struct {
+	FirstPage int    `json:"firstPage"`
+	LastPage  int    `json:"lastPage"`
+	Filename  string `json:"filename"`
+	Data      []byte `json:"data"`
+}
+
+// splitDocument handles a PDF upload along with a list of page ranges, such as
+// the firstPage and lastPage of each of the documents returned by /api/ocr,
+// and returns each range as a separate PDF.
+func (app *application) splitDocument(w http.ResponseWriter, r *http.Request) {
+	file, err := request.DecodeMultipartFile(w, r, "file", maxFileSize)
+	if err != nil {
+		if errors.Is(err, request.ErrFileTooLarge) {
+			app.fileTooLarge(w, r, maxFileSize)
+			return
+		}
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input := splitInput{
+		File:      file,
+		MediaType: imaging.DetectMediaType(file.Data),
+		Segments:  r.FormValue("segments"),
+	}
+
+	if input.MediaType != imaging.MediaTypePDF {
+		app.unsupportedMediaType(w, r, input.MediaType)
+		return
+	}
+
+	input.validate()
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	doc, err := fitz.NewFromMemory(file.Data)
+	if err != nil {
+		app.badRequest(w, r, fmt.Errorf("failed to open document: %w", err))
+		return
+	}
+	numPages := doc.NumPage()
+	doc.Close()
+
+	if input.segments.last() > numPages {
+		input.Validator.AddFieldError("segments", fmt.Sprintf("Segments must not exceed the number of pages in the document (%d)", numPages))
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	base := strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))
+	if base == "" {
+		base = "document"
+	}
+
+	var resp splitDocumentResponse
+
+	for _, segment := range input.segments {
+		data, err := pdf.ExtractPages(file.Data, segment.first, segment.last)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		resp.Documents = append(resp.Documents, splitDocument{
+			FirstPage: segment.first,
+			LastPage:  segment.last,
+			Filename:  fmt.Sprintf("%s-pages-%d-%d.pdf", base, segment.first, segment.last),
+			Data:      data,
+		})
+	}
+
+	err = response.JSON(w, http.StatusOK, resp)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
@@ -1,16 +1,39 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strings"
 
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/llm"
 	"dev.danielrb/auto-imm/api/internal/response"
 	"dev.danielrb/auto-imm/api/internal/validator"
 )
 
+// Stable error codes returned in the "code" member of every problem response.
+// Clients should branch on these rather than on the detail message.
+const (
+	errCodeServerError            = "server_error"
+	errCodeNotFound               = "not_found"
+	errCodeMethodNotAllowed       = "method_not_allowed"
+	errCodeBadRequest             = "bad_request"
+	errCodeValidationFailed       = "validation_failed"
+	errCodeAuthenticationRequired = "authentication_required"
+	errCodeFileTooLarge           = "file_too_large"
+	errCodeUnsupportedMediaType   = "unsupported_media_type"
+	errCodeLLMUnavailable         = "llm_unavailable"
+	errCodeAIResponseInvalid      = "ai_response_invalid"
+	errCodeQuotaExceeded          = "quota_exceeded"
+	errCodeBulkUnsupported        = "bulk_unsupported"
+	errCodeFormTemplatesReadOnly  = "form_templates_read_only"
+)
+
 func (app *application) reportServerError(r *http.Request, err error) {
 	var (
 		message = err.Error()
@@ -23,10 +46,32 @@ func (app *application) reportServerError(r *http.Request, err error) {
 	app.logger.Error(message, requestAttrs, "trace", trace)
 }
 
-func (app *application) errorMessage(w http.ResponseWriter, r *http.Request, status int, message string, headers http.Header) {
+const (
+	serverErrorMessage    = "The server encountered a problem and could not process your request"
+	llmUnavailableMessage = "The AI service is currently unavailable, please try again later"
+	quotaExceededMessage  = "The AI service quota has been exceeded, please try again later"
+)
+
+var (
+	errLLMNotConfigured  = errors.New("LLM provider not configured")
+	errAIResponseInvalid = errors.New("failed to parse AI response")
+)
+
+func (app *application) problem(r *http.Request, status int, code, message string) response.Problem {
 	message = strings.ToUpper(message[:1]) + message[1:]
 
-	err := response.JSONWithHeaders(w, status, map[string]string{"Error": message}, headers)
+	problem := response.NewProblem(status, code, message)
+	problem.Instance = r.URL.Path
+
+	return problem
+}
+
+func (app *application) errorMessage(w http.ResponseWriter, r *http.Request, status int, code, message string, headers http.Header) {
+	app.writeProblem(w, r, app.problem(r, status, code, message), headers)
+}
+
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, problem response.Problem, headers http.Header) {
+	err := response.ProblemJSON(w, problem, headers)
 	if err != nil {
 		app.reportServerError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -36,29 +81,33 @@ func (app *application) errorMessage(w http.ResponseWriter, r *http.Request, sta
 func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
 	app.reportServerError(r, err)
 
-	message := "The server encountered a problem and could not process your request"
-	app.errorMessage(w, r, http.StatusInternalServerError, message, nil)
+	app.errorMessage(w, r, http.StatusInternalServerError, errCodeServerError, serverErrorMessage, nil)
 }
 
 func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
 	message := "The requested resource could not be found"
-	app.errorMessage(w, r, http.StatusNotFound, message, nil)
+	app.errorMessage(w, r, http.StatusNotFound, errCodeNotFound, message, nil)
 }
 
 func (app *application) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("The %s method is not supported for this resource", r.Method)
-	app.errorMessage(w, r, http.StatusMethodNotAllowed, message, nil)
+	app.errorMessage(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message, nil)
 }
 
 func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorMessage(w, r, http.StatusBadRequest, err.Error(), nil)
+	app.errorMessage(w, r, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+}
+
+func (app *application) validationProblem(r *http.Request, v validator.Validator) response.Problem {
+	problem := app.problem(r, http.StatusUnprocessableEntity, errCodeValidationFailed, "The request contains invalid data")
+	problem.Errors = v.Errors
+	problem.FieldErrors = v.FieldErrors
+
+	return problem
 }
 
 func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, v validator.Validator) {
-	err := response.JSON(w, http.StatusUnprocessableEntity, v)
-	if err != nil {
-		app.serverError(w, r, err)
-	}
+	app.writeProblem(w, r, app.validationProblem(r, v), nil)
 }
 
 func (app *application) basicAuthenticationRequired(w http.ResponseWriter, r *http.Request) {
@@ -66,5 +115,150 @@ func (app *application) basicAuthenticationRequired(w http.ResponseWriter, r *ht
 	headers.Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 
 	message := "You must be authenticated to access this resource"
-	app.errorMessage(w, r, http.StatusUnauthorized, message, headers)
+	app.errorMessage(w, r, http.StatusUnauthorized, errCodeAuthenticationRequired, message, headers)
+}
+
+func (app *application) fileTooLargeProblem(r *http.Request, limit int64) response.Problem {
+	message := fmt.Sprintf("The uploaded file must not be larger than %d MB", limit>>20)
+	return app.problem(r, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, message)
+}
+
+func (app *application) fileTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	app.writeProblem(w, r, app.fileTooLargeProblem(r, limit), nil)
+}
+
+func (app *application) tooManyPixelsProblem(r *http.Request) response.Problem {
+	message := fmt.Sprintf("The uploaded image must not be larger than %d megapixels", imaging.MaxDecodePixels/1_000_000)
+	return app.problem(r, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, message)
+}
+
+func (app *application) unsupportedMediaTypeProblem(r *http.Request, mediaType string) response.Problem {
+	message := fmt.Sprintf("Files of type %q are not supported", mediaType)
+	return app.problem(r, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, message)
+}
+
+func (app *application) unsupportedMediaType(w http.ResponseWriter, r *http.Request, mediaType string) {
+	app.writeProblem(w, r, app.unsupportedMediaTypeProblem(r, mediaType), nil)
+}
+
+func (app *application) llmUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Warn("llm unavailable", "error", err.Error())
+
+	app.errorMessage(w, r, http.StatusServiceUnavailable, errCodeLLMUnavailable, llmUnavailableMessage, nil)
+}
+
+// bulkUnsupported responds to a bulk OCR request when the LLM provider has no
+// batch API.
+func (app *application) bulkUnsupported(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errLLMNotConfigured) {
+		app.llmUnavailable(w, r, err)
+		return
+	}
+
+	message := "Bulk OCR needs the anthropic provider, without LLM cassettes"
+	app.errorMessage(w, r, http.StatusNotImplemented, errCodeBulkUnsupported, message, nil)
+}
+
+// formTemplatesReadOnly responds to a change to the form templates when they
+// are the embedded ones.
+func (app *application) formTemplatesReadOnly(w http.ResponseWriter, r *http.Request) {
+	message := "The form templates are read-only; set --form-template-dir to change them"
+	app.errorMessage(w, r, http.StatusConflict, errCodeFormTemplatesReadOnly, message, nil)
+}
+
+func (app *application) aiResponseInvalidProblem(r *http.Request, err error) response.Problem {
+	app.logger.Warn("invalid ai response", "error", err.Error())
+
+	message := "The AI service returned a response that could not be understood"
+	return app.problem(r, http.StatusBadGateway, errCodeAIResponseInvalid, message)
+}
+
+func (app *application) aiResponseInvalid(w http.ResponseWriter, r *http.Request, err error) {
+	app.writeProblem(w, r, app.aiResponseInvalidProblem(r, err), nil)
+}
+
+func (app *application) quotaExceeded(w http.ResponseWriter, r *http.Request, headers http.Header) {
+	app.errorMessage(w, r, http.StatusTooManyRequests, errCodeQuotaExceeded, quotaExceededMessage, headers)
+}
+
+// llmProblem maps an error returned while calling the LLM provider onto the
+// matching problem, along with any headers that should accompany it.
+func (app *application) llmProblem(r *http.Request, err error) (response.Problem, http.Header) {
+	var apiErr *llm.APIError
+
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests:
+		headers := make(http.Header)
+		if apiErr.RetryAfter != "" {
+			headers.Set("Retry-After", apiErr.RetryAfter)
+		}
+		return app.problem(r, http.StatusTooManyRequests, errCodeQuotaExceeded, quotaExceededMessage), headers
+	case llmUnavailable(err):
+		app.logger.Warn("llm unavailable", "error", err.Error())
+		return app.problem(r, http.StatusServiceUnavailable, errCodeLLMUnavailable, llmUnavailableMessage), nil
+	default:
+		app.reportServerError(r, err)
+		return app.problem(r, http.StatusInternalServerError, errCodeServerError, serverErrorMessage), nil
+	}
+}
+
+// llmUnavailable reports whether an error means that the LLM provider cannot
+// be used at the moment, as opposed to a problem with the request.
+func llmUnavailable(err error) bool {
+	var (
+		apiErr *llm.APIError
+		netErr net.Error
+	)
+
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+	case errors.Is(err, errLLMNotConfigured), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return true
+	}
+
+	return false
+}
+
+// llmQuotaExceeded reports whether an error means that the LLM provider's rate
+// limits or quota have been reached.
+func llmQuotaExceeded(err error) bool {
+	var apiErr *llm.APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests
+}
+
+// llmError responds to an error returned while calling the LLM provider.
+func (app *application) llmError(w http.ResponseWriter, r *http.Request, err error) {
+	problem, headers := app.llmProblem(r, err)
+	app.writeProblem(w, r, problem, headers)
+}
+
+// ocrProblem maps an error from the OCR pipeline onto the matching problem.
+func (app *application) ocrProblem(r *http.Request, input *ocrInput, err error) (response.Problem, http.Header) {
+	switch {
+	case errors.Is(err, errPagesOutOfRange):
+		input.Validator.AddFieldError("pages", "Pages must not exceed the number of pages in the document")
+		return app.validationProblem(r, input.Validator), nil
+	case errors.Is(err, errLanguageNotFound):
+		input.Validator.AddFieldError("language", "Language must be installed on the server: "+strings.TrimPrefix(err.Error(), errLanguageNotFound.Error()+": "))
+		return app.validationProblem(r, input.Validator), nil
+	case errors.Is(err, imaging.ErrTooManyPixels):
+		return app.tooManyPixelsProblem(r), nil
+	case errors.Is(err, imaging.ErrDecode):
+		return app.problem(r, http.StatusBadRequest, errCodeBadRequest, err.Error()), nil
+	case errors.Is(err, errAIResponseInvalid):
+		return app.aiResponseInvalidProblem(r, err), nil
+	default:
+		return app.llmProblem(r, err)
+	}
+}
+
+// fillFormProblem maps an error from matching form fields onto the matching
+// problem.
+func (app *application) fillFormProblem(r *http.Request, err error) (response.Problem, http.Header) {
+	if errors.Is(err, errAIResponseInvalid) {
+		return app.aiResponseInvalidProblem(r, err), nil
+	}
+
+	return app.llmProblem(r, err)
 }
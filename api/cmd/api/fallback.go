@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"dev.danielrb/auto-imm/api/internal/mrz"
+)
+
+// Confidence given to values decoded from a machine readable zone when
+// falling back to tesseract. Values with a correct check digit are as good as
+// certain, while the names and codes have no check digit of their own.
+const (
+	mrzCheckedConfidence   = 0.99
+	mrzUncheckedConfidence = 0.7
+)
+
+// parseFallbackChain parses a comma-separated list of OCR providers, in the
+// order they are tried.
+func parseFallbackChain(value string) ([]string, error) {
+	var chain []string
+
+	for _, provider := range strings.Split(value, ",") {
+		provider = strings.TrimSpace(provider)
+		switch {
+		case provider == "":
+			continue
+		case provider != ocrProviderAnthropic && provider != ocrProviderTesseract:
+			return nil, fmt.Errorf("unknown OCR provider %q in fallback chain", provider)
+		case slices.Contains(chain, provider):
+			return nil, fmt.Errorf("OCR provider %q is listed more than once in fallback chain", provider)
+		}
+		chain = append(chain, provider)
+	}
+
+	return chain, nil
+}
+
+// runOCR extracts the text from a validated upload using the requested
+// provider. If the provider is unavailable, the providers after it in the
+// fallback chain are tried in turn, and the result says that it was produced
+// by a degraded engine.
+func (app *application) runOCR(ctx context.Context, input *ocrInput, progress progressReporter) (*ocrResult, error) {
+	ctx, routing := withModelRouting(ctx, input.Model)
+
+	result, err := app.runProvider(ctx, input, progress)
+	if err == nil {
+		result.Metadata.Provider = input.Provider
+		if input.Provider == ocrProviderAnthropic {
+			result.Metadata.PromptVersion = app.prompts.Version()
+			result.Metadata.Models = routing.models()
+			result.Metadata.Usage = routing.tokens()
+		}
+		app.scanOCRResult(result)
+		return result, nil
+	}
+
+	if !llmUnavailable(err) && !llmQuotaExceeded(err) || ctx.Err() != nil {
+		return nil, err
+	}
+
+	for _, provider := range app.fallbackProviders(input.Provider) {
+		app.logger.Warn("ocr provider unavailable, falling back", "provider", input.Provider, "fallback", provider, "error", err.Error())
+		progress.stage(stageFallback, 0, 0)
+
+		fallbackInput := *input
+		fallbackInput.Provider = provider
+		fallbackInput.Mode = ""
+		fallbackInput.Output = ""
+
+		result, fallbackErr := app.runProvider(ctx, &fallbackInput, progress)
+		if fallbackErr != nil {
+			app.logger.Warn("ocr fallback failed", "fallback", provider, "error", fallbackErr.Error())
+			continue
+		}
+
+		if provider == ocrProviderTesseract {
+			result.Documents = mrzDocuments(input.File.Data, result.Text)
+			if len(result.Documents) > 0 {
+				result.Metadata.Document = &result.Documents[0].documentClassification
+			}
+		}
+
+		result.Metadata.Provider = provider
+		if provider == ocrProviderAnthropic {
+			result.Metadata.PromptVersion = app.prompts.Version()
+			result.Metadata.Models = routing.models()
+			result.Metadata.Usage = routing.tokens()
+		}
+		result.Metadata.Degraded = true
+		result.Metadata.DegradedReason = errCodeLLMUnavailable
+		if llmQuotaExceeded(err) {
+			result.Metadata.DegradedReason = errCodeQuotaExceeded
+		}
+		app.scanOCRResult(result)
+
+		return result, nil
+	}
+
+	// Report why the requested provider failed rather than why the last
+	// fallback did
+	return nil, err
+}
+
+// fallbackProviders returns the providers to try, in order, when the given
+// provider is unavailable. Providers that are not enabled are skipped.
+func (app *application) fallbackProviders(provider string) []string {
+	i := slices.Index(app.config.ocr.fallback, provider)
+	if i < 0 {
+		return nil
+	}
+
+	var providers []string
+	for _, fallback := range app.config.ocr.fallback[i+1:] {
+		if slices.Contains(app.ocrProviders(), fallback) {
+			providers = append(providers, fallback)
+		}
+	}
+
+	return providers
+}
+
+// pageMarkerRX matches the line that writePageText puts before each page of a
+// multi-page document.
+var pageMarkerRX = regexp.MustCompile(`(?m)^=== Page (\d+) ===$`)
+
+// mrzDocuments decodes the machine readable zones in text read by tesseract,
+// and returns a document for each page that has one. This is the only
+// structured data available when Claude cannot be used.
+func mrzDocuments(fileData []byte, text string) []documentSegment {
+	type pageText struct {
+		page int
+		text string
+	}
+
+	pages := []pageText{{page: 1, text: text}}
+	if markers := pageMarkerRX.FindAllStringSubmatchIndex(text, -1); len(markers) > 0 {
+		pages = pages[:0]
+		for i, m := range markers {
+			end := len(text)
+			if i+1 < len(markers) {
+				end = markers[i+1][0]
+			}
+			page, _ := strconv.Atoi(text[m[2]:m[3]])
+			pages = append(pages, pageText{page: page, text: text[m[1]:end]})
+		}
+	}
+
+	documents := []documentSegment{}
+	for _, p := range pages {
+		zone, ok := mrz.Find(p.text)
+		if !ok {
+			continue
+		}
+
+		segment := documentSegment{
+			ID:        documentID(fileData, len(documents)),
+			FirstPage: p.page,
+			LastPage:  p.page,
+			Text:      strings.TrimSpace(p.text),
+		}
+
+		numberField := "documentNumber"
+		segment.Type = documentNationalID
+		if zone.Format == mrz.FormatTD3 || strings.HasPrefix(zone.DocumentCode, "P") {
+			numberField = "passportNumber"
+			segment.Type = documentPassport
+		}
+		segment.Confidence = mrzUncheckedConfidence
+		if zone.Checks.Valid() {
+			segment.Confidence = mrzCheckedConfidence
+		}
+
+		values := []struct {
+			name    string
+			value   string
+			checked bool
+		}{
+			{"surname", zone.Surname, false},
+			{"givenNames", zone.GivenNames, false},
+			{numberField, zone.DocumentNumber, zone.Checks.DocumentNumber},
+			{"nationality", zone.Nationality, false},
+			{"sex", zone.Sex, false},
+			{"dateOfBirth", zone.DateOfBirth, zone.Checks.DateOfBirth},
+			{"dateOfExpiry", zone.DateOfExpiry, zone.Checks.DateOfExpiry},
+			{"issuingCountry", zone.IssuingCountry, false},
+		}
+
+		for _, v := range values {
+			if v.value == "" {
+				continue
+			}
+
+			field := extractedField{
+				Name:       v.name,
+				Value:      v.value,
+				Confidence: mrzUncheckedConfidence,
+				Source:     fieldSourceMRZ,
+				DocumentID: segment.ID,
+				Page:       p.page,
+			}
+			if v.checked {
+				field.Confidence = mrzCheckedConfidence
+			}
+			segment.Fields = append(segment.Fields, field)
+		}
+
+		documents = append(documents, segment)
+	}
+
+	return documents
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"dev.danielrb/auto-imm/api/internal/llm/llmtest"
+)
+
+// testTesseractTD1 is the text Tesseract reads from the ICAO Doc 9303
+// specimen identity card.
+const testTesseractTD1 = `UTOPIA IDENTITY CARD
+I<UTOD231458907<<<<<<<<<<<<<<<
+7408122F1204159UTO<<<<<<<<<<<6
+ERIKSSON<<ANNA<MARIA<<<<<<<<<<`
+
+func TestOCRFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		llm        []llmtest.Response
+		noLLM      bool
+		wantReason string
+	}{
+		{name: "LLM unavailable", llm: []llmtest.Response{llmtest.Error(http.StatusServiceUnavailable, "overloaded_error", "Overloaded")}, wantReason: errCodeLLMUnavailable},
+		{name: "LLM server error", llm: []llmtest.Response{llmtest.Error(http.StatusInternalServerError, "api_error", "Internal server error")}, wantReason: errCodeLLMUnavailable},
+		{name: "LLM quota exceeded", llm: []llmtest.Response{llmtest.Error(http.StatusTooManyRequests, "rate_limit_error", "Rate limited")}, wantReason: errCodeQuotaExceeded},
+		{name: "LLM not configured", noLLM: true, wantReason: errCodeLLMUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, srv := newTestApplication(t)
+			app.config.tesseract.enabled = true
+			app.config.tesseract.language = "eng"
+			app.config.ocr.fallback = []string{ocrProviderAnthropic, ocrProviderTesseract}
+			app.tesseract = &fakeTesseract{text: testTesseractPassport}
+			if tt.noLLM {
+				app.llm = nil
+			}
+			srv.Enqueue(tt.llm...)
+
+			res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), testUsername, testPassword)
+			if res.status != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+			}
+
+			metadata := res.body["metadata"].(map[string]any)
+			if metadata["degraded"] != true || metadata["degradedReason"] != tt.wantReason || metadata["provider"] != ocrProviderTesseract {
+				t.Errorf("got degraded %v for %v by %v, want true for %s by tesseract", metadata["degraded"], metadata["degradedReason"], metadata["provider"], tt.wantReason)
+			}
+			if document, _ := metadata["document"].(map[string]any); document["type"] != documentPassport {
+				t.Errorf("got document %v, want a passport", metadata["document"])
+			}
+			if res.body["text"] != testTesseractPassport {
+				t.Errorf("got text %q, want Tesseract's", res.body["text"])
+			}
+
+			documents, _ := res.body["documents"].([]any)
+			if len(documents) != 1 {
+				t.Fatalf("got %d documents, want 1: %v", len(documents), res.body)
+			}
+
+			fields := make(map[string]map[string]any)
+			for _, field := range documents[0].(map[string]any)["fields"].([]any) {
+				field := field.(map[string]any)
+				fields[field["name"].(string)] = field
+			}
+			if fields["passportNumber"]["value"] != "L898902C3" || fields["passportNumber"]["confidence"] != mrzCheckedConfidence || fields["passportNumber"]["source"] != fieldSourceMRZ {
+				t.Errorf("got passport number %v, want L898902C3 checked in the MRZ", fields["passportNumber"])
+			}
+			if fields["surname"]["value"] != "ERIKSSON" || fields["surname"]["confidence"] != mrzUncheckedConfidence {
+				t.Errorf("got surname %v, want ERIKSSON unchecked", fields["surname"])
+			}
+
+			if n := len(srv.Requests()); n != len(tt.llm) {
+				t.Errorf("got %d LLM requests, want %d", n, len(tt.llm))
+			}
+		})
+	}
+}
+
+func TestOCRNoFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		llm        llmtest.Response
+		fallback   []string
+		tesseract  *fakeTesseract
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "Fallback disabled",
+			llm:        llmtest.Error(http.StatusServiceUnavailable, "overloaded_error", "Overloaded"),
+			fallback:   []string{ocrProviderAnthropic},
+			tesseract:  &fakeTesseract{text: testTesseractPassport},
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   errCodeLLMUnavailable,
+		},
+		{
+			// The error of the requested provider is reported, not that of
+			// the fallback
+			name:       "Fallback failed",
+			llm:        llmtest.Error(http.StatusTooManyRequests, "rate_limit_error", "Rate limited"),
+			fallback:   []string{ocrProviderAnthropic, ocrProviderTesseract},
+			tesseract:  &fakeTesseract{err: errors.New("tesseract crashed")},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   errCodeQuotaExceeded,
+		},
+		{
+			name:       "Invalid response",
+			llm:        llmtest.Reply("not JSON"),
+			fallback:   []string{ocrProviderAnthropic, ocrProviderTesseract},
+			tesseract:  &fakeTesseract{text: testTesseractPassport},
+			wantStatus: http.StatusBadGateway,
+			wantCode:   errCodeAIResponseInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, srv := newTestApplication(t)
+			app.config.tesseract.enabled = true
+			app.config.tesseract.language = "eng"
+			app.config.ocr.fallback = tt.fallback
+			app.tesseract = tt.tesseract
+			srv.Enqueue(tt.llm, tt.llm)
+
+			res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), testUsername, testPassword)
+			checkProblem(t, res, tt.wantStatus, tt.wantCode)
+		})
+	}
+}
+
+func TestMRZDocuments(t *testing.T) {
+	t.Run("One page", func(t *testing.T) {
+		documents := mrzDocuments([]byte("file"), testTesseractPassport)
+		if len(documents) != 1 {
+			t.Fatalf("got %d documents, want 1", len(documents))
+		}
+
+		d := documents[0]
+		if d.ID != documentID([]byte("file"), 0) || d.Type != documentPassport || d.FirstPage != 1 || d.LastPage != 1 || d.Confidence != mrzCheckedConfidence {
+			t.Errorf("got document %+v, want a passport on page 1", d)
+		}
+		if d.Text != testTesseractPassport {
+			t.Errorf("got text %q, want the page's", d.Text)
+		}
+		if len(d.Fields) != 8 {
+			t.Errorf("got %d fields, want 8", len(d.Fields))
+		}
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		var b strings.Builder
+		for i, text := range []string{"Cover page, no zone here", testTesseractTD1, "Visa page", testTesseractPassport} {
+			writePageText(&b, 4, i, text)
+		}
+
+		documents := mrzDocuments([]byte("file"), b.String())
+		if len(documents) != 2 {
+			t.Fatalf("got %d documents, want 2", len(documents))
+		}
+
+		card, passport := documents[0], documents[1]
+		if card.Type != documentNationalID || card.FirstPage != 2 || card.LastPage != 2 || card.Text != testTesseractTD1 {
+			t.Errorf("got document %+v, want an identity card on page 2", card)
+		}
+		if passport.Type != documentPassport || passport.FirstPage != 4 || passport.ID != documentID([]byte("file"), 1) {
+			t.Errorf("got document %+v, want the second document, a passport on page 4", passport)
+		}
+
+		var names []string
+		for _, field := range card.Fields {
+			names = append(names, field.Name)
+			if field.Page != 2 || field.DocumentID != card.ID {
+				t.Errorf("got field %+v, want it on page 2 of %s", field, card.ID)
+			}
+		}
+		if !slices.Contains(names, "documentNumber") || slices.Contains(names, "passportNumber") {
+			t.Errorf("got fields %v, want a documentNumber for an identity card", names)
+		}
+	})
+
+	t.Run("Failed check digits", func(t *testing.T) {
+		text := strings.Replace(testTesseractPassport, "L898902C36", "L898902C35", 1)
+
+		documents := mrzDocuments([]byte("file"), text)
+		if len(documents) != 1 {
+			t.Fatalf("got %d documents, want 1", len(documents))
+		}
+		if documents[0].Confidence != mrzUncheckedConfidence {
+			t.Errorf("got confidence %v, want %v", documents[0].Confidence, mrzUncheckedConfidence)
+		}
+		for _, field := range documents[0].Fields {
+			if field.Name == "passportNumber" && field.Confidence != mrzUncheckedConfidence {
+				t.Errorf("got confidence %v for the passport number, want %v", field.Confidence, mrzUncheckedConfidence)
+			}
+			if field.Name == "dateOfBirth" && field.Confidence != mrzCheckedConfidence {
+				t.Errorf("got confidence %v for the date of birth, want %v", field.Confidence, mrzCheckedConfidence)
+			}
+		}
+	})
+
+	t.Run("No zone", func(t *testing.T) {
+		documents := mrzDocuments([]byte("file"), "=== Page 1 ===\nA letter\n\n=== Page 2 ===\nSigned")
+		if documents == nil || len(documents) != 0 {
+			t.Errorf("got %v, want no documents", documents)
+		}
+	})
+}
+
+func TestParseFallbackChain(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "anthropic,tesseract", want: []string{ocrProviderAnthropic, ocrProviderTesseract}},
+		{value: " tesseract , ,anthropic ", want: []string{ocrProviderTesseract, ocrProviderAnthropic}},
+		{value: "", want: nil},
+		{value: "anthropic,openai", wantErr: true},
+		{value: "anthropic,anthropic", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFallbackChain(tt.value)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseFallbackChain(%q) = %v, %v, want %v and error %t", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
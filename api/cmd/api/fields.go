@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+)
+
+// Sources that an extracted value can come from.
+const (
+	fieldSourceMRZ        = "mrz"
+	fieldSourceVisualZone = "visual_zone"
+	fieldSourceTextLayer  = "text_layer"
+	fieldSourceInference  = "llm_inference"
+)
+
+// extractedField is a value extracted from a document, along with how sure we
+// are of it and where in the upload it came from.
+type extractedField struct {
+	Name        string       `json:"name"`
+	Value       string       `json:"value"`
+	Confidence  float64      `json:"confidence"`
+	Source      string       `json:"source"`
+	DocumentID  string       `json:"documentId"`
+	Page        int          `json:"page"`
+	BoundingBox *boundingBox `json:"boundingBox,omitempty"`
+}
+
+// boundingBox is the area of a page that a value was read from, given as
+// fractions of the page's width and height from its top left corner.
+type boundingBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+func (b *boundingBox) valid() bool {
+	return b.X >= 0 && b.Y >= 0 && b.Width > 0 && b.Height > 0 &&
+		b.X+b.Width <= 1.001 && b.Y+b.Height <= 1.001
+}
+
+// pageExtraction is the text and fields Claude extracted from one page.
+type pageExtraction struct {
+	// Text is a JSON object of the field values and any other text on the
+	// page, which is what is returned as the text of the page.
+	Text   string
+	Fields []extractedField
+}
+
+// parseExtraction parses Claude's response to an extraction prompt. Pages
+// taken from a text layer have no image, so their values are attributed to
+// the text layer and any bounding boxes are dropped.
+func parseExtraction(responseText string, textLayer bool) (pageExtraction, error) {
+	var extractResponse struct {
+		Fields []struct {
+			Name        string          `json:"name"`
+			Value       json.RawMessage `json:"value"`
+			Confidence  float64         `json:"confidence"`
+			Source      string          `json:"source"`
+			BoundingBox *boundingBox    `json:"boundingBox"`
+		} `json:"fields"`
+		OtherText string `json:"otherText"`
+	}
+
+	err := json.Unmarshal([]byte(trimCodeFence(responseText)), &extractResponse)
+	if err != nil {
+		return pageExtraction{}, fmt.Errorf("%w: %w", errAIResponseInvalid, err)
+	}
+
+	var (
+		extraction pageExtraction
+		values     = make(map[string]string)
+	)
+
+	for _, f := range extractResponse.Fields {
+		name := strings.TrimSpace(f.Name)
+		if name == "" {
+			continue
+		}
+
+		field := extractedField{
+			Name:        name,
+			Value:       rawValueString(f.Value),
+			Confidence:  min(max(f.Confidence, 0), 1),
+			Source:      f.Source,
+			BoundingBox: f.BoundingBox,
+		}
+
+		switch {
+		case field.Source == fieldSourceInference:
+		case textLayer:
+			field.Source = fieldSourceTextLayer
+		case field.Source != fieldSourceMRZ:
+			field.Source = fieldSourceVisualZone
+		}
+
+		if textLayer || (field.BoundingBox != nil && !field.BoundingBox.valid()) {
+			field.BoundingBox = nil
+		}
+
+		extraction.Fields = append(extraction.Fields, field)
+		values[name] = field.Value
+	}
+
+	if extractResponse.OtherText != "" {
+		values["otherText"] = extractResponse.OtherText
+	}
+
+	text, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return pageExtraction{}, err
+	}
+	extraction.Text = string(text)
+
+	return extraction, nil
+}
+
+// rawValueString returns a JSON value as a string, unquoting strings and
+// leaving numbers and other values as they were written.
+func rawValueString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+
+	if string(raw) == "null" {
+		return ""
+	}
+
+	return string(raw)
+}
+
+// documentID returns an identifier for a document within an upload. It is
+// derived from the file's contents so that it stays the same if the file is
+// processed again, and differs between files that are uploaded separately.
+func documentID(fileData []byte, index int) string {
+	sum := sha256.Sum256(fileData)
+	return fmt.Sprintf("%x-%d", sum[:4], index+1)
+}
+
+// Ways that a form value was matched to its field.
+const (
+	matchedByTemplate = "template"
+	matchedByRules    = "rules"
+	matchedByLLM      = "llm"
+)
+
+// profileDocumentTypes are the types of document that the applicant's
+// details are taken from for filling forms with templates and rules, most
+// reliable first.
+var profileDocumentTypes = []string{documentPassport, documentNationalID, documentBirthCertificate}
+
+// profileFields lists the fields of the applicant's profile: those extracted
+// from the profile document types.
+func profileFields() []string {
+	var names []string
+	for _, name := range profileDocumentTypes {
+		for _, field := range lookupDocumentType(name).Fields {
+			if !slices.Contains(names, field) {
+				names = append(names, field)
+			}
+		}
+	}
+
+	return names
+}
+
+// applicantProfile collects the applicant's details from the fields
+// extracted from their identity documents. It also returns the ID of the
+// document that each profile field was taken from.
+func applicantProfile(documents []documentSegment) (form.Profile, map[string]string) {
+	var (
+		profile = make(form.Profile)
+		sources = make(map[string]string)
+	)
+
+	for _, documentType := range profileDocumentTypes {
+		for _, document := range documents {
+			if document.Type != documentType {
+				continue
+			}
+
+			for _, f := range document.Fields {
+				if _, ok := profile[f.Name]; ok || strings.TrimSpace(f.Value) == "" {
+					continue
+				}
+				profile[f.Name] = f.Value
+				sources[f.Name] = document.ID
+			}
+		}
+	}
+
+	return profile, sources
+}
+
+// profileFilledFields turns the values filled from the applicant's profile
+// into field mappings, with the provenance of the extracted fields they were
+// taken from.
+func profileFilledFields(filled []form.Filled, documents []documentSegment, sources map[string]string, matchedBy string) []filledField {
+	fields := make([]filledField, len(filled))
+	for i, f := range filled {
+		fields[i] = filledField{
+			FieldID:    f.FieldID,
+			Value:      f.Value,
+			Provenance: lookupProvenance(documents, sources[f.Profile], f.Profile, 0),
+			MatchedBy:  matchedBy,
+		}
+	}
+
+	return fields
+}
+
+// fieldProvenance describes where a filled form value came from.
+type fieldProvenance struct {
+	DocumentID  string       `json:"documentId,omitempty"`
+	Field       string       `json:"field,omitempty"`
+	Page        int          `json:"page,omitempty"`
+	Source      string       `json:"source"`
+	Confidence  float64      `json:"confidence"`
+	BoundingBox *boundingBox `json:"boundingBox,omitempty"`
+}
+
+// lookupProvenance finds the extracted field a form value was matched from.
+// Values that Claude did not attribute to an extracted field are reported as
+// inferred, with Claude's own confidence.
+func lookupProvenance(documents []documentSegment, documentID, field string, confidence float64) *fieldProvenance {
+	for _, document := range documents {
+		if document.ID != documentID {
+			continue
+		}
+
+		for _, f := range document.Fields {
+			if f.Name != field {
+				continue
+			}
+
+			// The value is only as reliable as both the extraction and the
+			// match
+			if confidence > 0 {
+				confidence = min(f.Confidence, confidence)
+			} else {
+				confidence = f.Confidence
+			}
+
+			return &fieldProvenance{
+				DocumentID:  f.DocumentID,
+				Field:       f.Name,
+				Page:        f.Page,
+				Source:      f.Source,
+				Confidence:  confidence,
+				BoundingBox: f.BoundingBox,
+			}
+		}
+	}
+
+	return &fieldProvenance{
+		Source:     fieldSourceInference,
+		Confidence: confidence,
+	}
+}
+
+// extractedFieldsJSON lists the fields extracted from the documents for the
+// form filling prompt, leaving out the provenance that Claude does not need.
+func extractedFieldsJSON(documents []documentSegment) string {
+	type promptField struct {
+		DocumentID string `json:"documentId"`
+		Field      string `json:"field"`
+		Value      string `json:"value"`
+	}
+
+	fields := []promptField{}
+	for _, document := range documents {
+		for _, f := range document.Fields {
+			fields = append(fields, promptField{DocumentID: document.ID, Field: f.Name, Value: f.Value})
+		}
+	}
+
+	js, err := json.Marshal(fields)
+	if err != nil {
+		return "[]"
+	}
+
+	return string(js)
+}
+
+// formSchemaJSON lists the fields of a form for the form filling prompt. The
+// list is the same every time a form page is sent, whatever values or tokens
+// the page holds, so it can be cached. If no fields could be read from the
+// HTML, an empty string is returned and the HTML is sent as it is.
+func formSchemaJSON(fields []form.Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err := enc.Encode(fields)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+	"dev.danielrb/auto-imm/api/internal/formtemplates"
+	"dev.danielrb/auto-imm/api/internal/request"
+	"dev.danielrb/auto-imm/api/internal/response"
+	"dev.danielrb/auto-imm/api/internal/validator"
+)
+
+func (app *application) listFormTemplates(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"templates": app.formTemplates.List(),
+		"readOnly":  app.formTemplates.ReadOnly(),
+	}
+
+	err := response.JSON(w, http.StatusOK, data)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) showFormTemplate(w http.ResponseWriter, r *http.Request) {
+	template, found := app.formTemplates.Get(r.PathValue("id"))
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	err := response.JSON(w, http.StatusOK, template)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// saveFormTemplate creates the template with the ID in the path, or replaces
+// it.
+func (app *application) saveFormTemplate(w http.ResponseWriter, r *http.Request) {
+	if app.formTemplates.ReadOnly() {
+		app.formTemplatesReadOnly(w, r)
+		return
+	}
+
+	var input formTemplateInput
+
+	err := request.DecodeJSONLimit(w, r, &input, maxFormJSONBytes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.ID = r.PathValue("id")
+	input.validate()
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	template, created, err := app.formTemplates.Save(form.Template{
+		ID:          input.ID,
+		Name:        input.Name,
+		Fingerprint: input.Fingerprint,
+		Fields:      input.Fields,
+	})
+	if errors.Is(err, formtemplates.ErrDuplicateFingerprint) {
+		input.Validator.AddFieldError("fingerprint", "Another template has the same fingerprint")
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("form template saved", "template", template.ID, "version", template.Version)
+
+	status, headers := http.StatusOK, make(http.Header)
+	if created {
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("/admin/form-templates/%s", template.ID))
+	}
+
+	err = response.JSONWithHeaders(w, status, template, headers)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) deleteFormTemplate(w http.ResponseWriter, r *http.Request) {
+	if app.formTemplates.ReadOnly() {
+		app.formTemplatesReadOnly(w, r)
+		return
+	}
+
+	found, err := app.formTemplates.Delete(r.PathValue("id"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	app.logger.Info("form template deleted", "template", r.PathValue("id"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fingerprintForm returns the fingerprint and fields of a form page, and the
+// template that matches it if there is one, to help write templates.
+func (app *application) fingerprintForm(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FormHTML  string              `json:"formHTML"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSONLimit(w, r, &input, maxFormJSONBytes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(validator.NotBlank(input.FormHTML), "formHTML", "FormHTML is required")
+	input.Validator.CheckField(validator.MaxRunes(input.FormHTML, maxFormHTMLRunes), "formHTML", fmt.Sprintf("FormHTML must not be more than %d characters", maxFormHTMLRunes))
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	fields := form.Parse(input.FormHTML)
+	if fields == nil {
+		fields = []form.Field{}
+	}
+
+	data := map[string]any{
+		"fingerprint": form.Fingerprint(fields),
+		"fields":      fields,
+	}
+	if template, ok := app.formTemplates.Match(fields); ok {
+		data["template"] = template.ID
+	}
+
+	err = response.JSON(w, http.StatusOK, data)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dev.danielrb/auto-imm/api/assets"
+	"dev.danielrb/auto-imm/api/internal/form"
+	"dev.danielrb/auto-imm/api/internal/formtemplates"
+)
+
+// evalFormHTML returns the IRCC form page that the embedded template is for.
+func evalFormHTML(t *testing.T) string {
+	t.Helper()
+
+	data, err := os.ReadFile("../../testdata/eval/form.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// withTemplateDir gives the application a registry of form templates that
+// can be changed, seeded with the embedded ones, and returns its directory.
+func withTemplateDir(t *testing.T, app *application) string {
+	t.Helper()
+
+	formFiles, err := fs.Sub(assets.EmbeddedFiles, "forms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	app.formTemplates, err = formtemplates.New(formFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestFormTemplatesReadOnly(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	res := serve(t, app, httptest.NewRequest(http.MethodGet, "/admin/form-templates", nil), testAdminUsername, testAdminPassword)
+	if res.status != http.StatusOK || res.body["readOnly"] != true {
+		t.Errorf("got status %d and read-only %v, want 200 and true", res.status, res.body["readOnly"])
+	}
+	if templates, _ := res.body["templates"].([]any); len(templates) != 1 {
+		t.Errorf("got templates %v, want the embedded one", res.body["templates"])
+	}
+
+	res = serve(t, app, newJSONRequest(t, http.MethodPut, "/admin/form-templates/passport", map[string]any{
+		"name":        "Passport",
+		"fingerprint": strings.Repeat("a", 64),
+		"fields":      []map[string]any{{"fieldId": "number", "profile": "passportNumber"}},
+	}), testAdminUsername, testAdminPassword)
+	checkProblem(t, res, http.StatusConflict, errCodeFormTemplatesReadOnly)
+
+	res = serve(t, app, httptest.NewRequest(http.MethodDelete, "/admin/form-templates/ircc-personal-details", nil), testAdminUsername, testAdminPassword)
+	checkProblem(t, res, http.StatusConflict, errCodeFormTemplatesReadOnly)
+
+	res = serve(t, app, httptest.NewRequest(http.MethodGet, "/admin/form-templates/ircc-personal-details", nil), testAdminUsername, testAdminPassword)
+	if res.status != http.StatusOK || res.body["version"] != float64(1) {
+		t.Errorf("got status %d and version %v, want the template unchanged", res.status, res.body["version"])
+	}
+}
+
+func TestFormTemplates(t *testing.T) {
+	app, _ := newTestApplication(t)
+	dir := withTemplateDir(t, app)
+
+	template := map[string]any{
+		"name":     "IRCC portal: names",
+		"formHTML": evalFormHTML(t),
+		"fields": []map[string]any{
+			{"fieldId": "lastName_input", "profile": "surname", "transform": "upper"},
+			{"fieldId": "firstName_input", "profile": "givenNames", "transform": "upper"},
+		},
+	}
+
+	t.Run("Duplicate fingerprint", func(t *testing.T) {
+		// The embedded template is for the same form
+		res := serve(t, app, newJSONRequest(t, http.MethodPut, "/admin/form-templates/ircc-names", template), testAdminUsername, testAdminPassword)
+		checkProblem(t, res, http.StatusUnprocessableEntity, errCodeValidationFailed)
+
+		fieldErrors, _ := res.body["fieldErrors"].(map[string]any)
+		if fieldErrors["fingerprint"] == nil {
+			t.Errorf("got field errors %v, want one for the fingerprint", fieldErrors)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		res := serve(t, app, httptest.NewRequest(http.MethodDelete, "/admin/form-templates/ircc-personal-details", nil), testAdminUsername, testAdminPassword)
+		if res.status != http.StatusNoContent {
+			t.Fatalf("got status %d, want 204: %v", res.status, res.body)
+		}
+
+		res = serve(t, app, httptest.NewRequest(http.MethodDelete, "/admin/form-templates/ircc-personal-details", nil), testAdminUsername, testAdminPassword)
+		checkProblem(t, res, http.StatusNotFound, errCodeNotFound)
+
+		res = serve(t, app, httptest.NewRequest(http.MethodGet, "/admin/form-templates/ircc-personal-details", nil), testAdminUsername, testAdminPassword)
+		checkProblem(t, res, http.StatusNotFound, errCodeNotFound)
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		res := serve(t, app, newJSONRequest(t, http.MethodPut, "/admin/form-templates/ircc-names", template), testAdminUsername, testAdminPassword)
+		if res.status != http.StatusCreated {
+			t.Fatalf("got status %d, want 201: %v", res.status, res.body)
+		}
+		if got := res.header.Get("Location"); got != "/admin/form-templates/ircc-names" {
+			t.Errorf("got Location %q", got)
+		}
+		if res.body["version"] != float64(1) || res.body["fingerprint"] != form.Fingerprint(form.Parse(evalFormHTML(t))) {
+			t.Errorf("got version %v and fingerprint %v, want version 1 and the fingerprint of the form", res.body["version"], res.body["fingerprint"])
+		}
+		if _, ok := res.body["formHTML"]; ok {
+			t.Error("the form's HTML was saved with the template")
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "ircc-names.json")); err != nil {
+			t.Errorf("the template was not written: %v", err)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		template["name"] = "IRCC portal: surname and given names"
+
+		res := serve(t, app, newJSONRequest(t, http.MethodPut, "/admin/form-templates/ircc-names", template), testAdminUsername, testAdminPassword)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want 200: %v", res.status, res.body)
+		}
+		if res.body["version"] != float64(2) || res.body["name"] != template["name"] {
+			t.Errorf("got version %v and name %v, want the second version", res.body["version"], res.body["name"])
+		}
+	})
+
+	t.Run("Fingerprint", func(t *testing.T) {
+		res := serve(t, app, newJSONRequest(t, http.MethodPost, "/admin/form-templates/fingerprint", map[string]any{
+			"formHTML": evalFormHTML(t),
+		}), testAdminUsername, testAdminPassword)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want 200: %v", res.status, res.body)
+		}
+		if res.body["template"] != "ircc-names" {
+			t.Errorf("got template %v, want ircc-names", res.body["template"])
+		}
+		if fields, _ := res.body["fields"].([]any); len(fields) != 9 {
+			t.Errorf("got %d fields, want 9", len(fields))
+		}
+
+		res = serve(t, app, newJSONRequest(t, http.MethodPost, "/admin/form-templates/fingerprint", map[string]any{
+			"formHTML": testFormHTML,
+		}), testAdminUsername, testAdminPassword)
+		if _, ok := res.body["template"]; ok || res.body["fingerprint"] == "" {
+			t.Errorf("got template %v and fingerprint %v, want no template", res.body["template"], res.body["fingerprint"])
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		res := serve(t, app, httptest.NewRequest(http.MethodGet, "/admin/form-templates", nil), testAdminUsername, testAdminPassword)
+		templates, _ := res.body["templates"].([]any)
+		if res.body["readOnly"] != false || len(templates) != 1 {
+			t.Fatalf("got read-only %v and templates %v, want ircc-names only", res.body["readOnly"], templates)
+		}
+		if got := templates[0].(map[string]any)["id"]; got != "ircc-names" {
+			t.Errorf("got template %v, want ircc-names", got)
+		}
+	})
+}
+
+func TestSaveFormTemplateValidation(t *testing.T) {
+	app, _ := newTestApplication(t)
+	withTemplateDir(t, app)
+
+	fields := []map[string]any{{"fieldId": "lastName_input", "profile": "surname"}}
+
+	tests := []struct {
+		name      string
+		id        string
+		input     map[string]any
+		wantField string
+	}{
+		{name: "Invalid ID", id: "IRCC_names", input: map[string]any{"name": "Names", "fingerprint": strings.Repeat("a", 64), "fields": fields}, wantField: "id"},
+		{name: "No name", id: "names", input: map[string]any{"fingerprint": strings.Repeat("a", 64), "fields": fields}, wantField: "name"},
+		{name: "No fingerprint", id: "names", input: map[string]any{"name": "Names", "fields": fields}, wantField: "fingerprint"},
+		{name: "Invalid fingerprint", id: "names", input: map[string]any{"name": "Names", "fingerprint": "abc", "fields": fields}, wantField: "fingerprint"},
+		{name: "Fingerprint of another form", id: "names", input: map[string]any{"name": "Names", "fingerprint": strings.Repeat("a", 64), "formHTML": evalFormHTML(t), "fields": fields}, wantField: "fingerprint"},
+		{name: "Form without fields", id: "names", input: map[string]any{"name": "Names", "formHTML": "<p>No form</p>", "fields": fields}, wantField: "formHTML"},
+		{name: "No fields", id: "names", input: map[string]any{"name": "Names", "fingerprint": strings.Repeat("a", 64)}, wantField: "fields"},
+		{name: "Field not in the form", id: "names", input: map[string]any{"name": "Names", "formHTML": evalFormHTML(t), "fields": []map[string]any{{"fieldId": "email", "profile": "surname"}}}, wantField: "fields"},
+		{name: "Field mapped twice", id: "names", input: map[string]any{"name": "Names", "fingerprint": strings.Repeat("a", 64), "fields": append(fields, fields[0])}, wantField: "fields"},
+		{name: "Unknown profile", id: "names", input: map[string]any{"name": "Names", "fingerprint": strings.Repeat("a", 64), "fields": []map[string]any{{"fieldId": "email", "profile": "email"}}}, wantField: "fields"},
+		{name: "Unknown transform", id: "names", input: map[string]any{"name": "Names", "fingerprint": strings.Repeat("a", 64), "fields": []map[string]any{{"fieldId": "email", "profile": "surname", "transform": "title"}}}, wantField: "fields"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serve(t, app, newJSONRequest(t, http.MethodPut, "/admin/form-templates/"+tt.id, tt.input), testAdminUsername, testAdminPassword)
+			checkProblem(t, res, http.StatusUnprocessableEntity, errCodeValidationFailed)
+
+			fieldErrors, _ := res.body["fieldErrors"].(map[string]any)
+			if fieldErrors[tt.wantField] == nil {
+				t.Errorf("got field errors %v, want one for %s", fieldErrors, tt.wantField)
+			}
+		})
+	}
+
+	if templates := app.formTemplates.List(); len(templates) != 1 {
+		t.Errorf("got %d templates, want only the embedded one", len(templates))
+	}
+}
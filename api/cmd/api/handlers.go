@@ -1,27 +1,116 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image/jpeg"
-	"image/png"
-	"io"
+	"image"
 	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
-
+	"sync"
+	"time"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/injection"
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/prompts"
 	"dev.danielrb/auto-imm/api/internal/request"
 	"dev.danielrb/auto-imm/api/internal/response"
-	"github.com/anthropics/anthropic-sdk-go"
-	"github.com/anthropics/anthropic-sdk-go/option"
+	"dev.danielrb/auto-imm/api/internal/validator"
+
 	"github.com/gen2brain/go-fitz"
-	"github.com/otiai10/gosseract/v2"
 )
 
+const maxFileSize = 20 << 20 // 20MB
+
+// Methods used to get the text of a page.
+const (
+	pageMethodOCR       = "ocr"
+	pageMethodTextLayer = "text_layer"
+)
+
+// ocrResult is the response to an OCR request.
+type ocrResult struct {
+	Text string `json:"text"`
+	// Documents are the logical documents found in the upload, such as a
+	// passport and a birth certificate scanned into one PDF. They are set
+	// for the anthropic provider, and for passports and identity cards when
+	// falling back to tesseract.
+	Documents []documentSegment `json:"documents,omitempty"`
+	// Layout holds the position of the text on each page. It is only set
+	// for the tesseract provider with the layout or hocr output.
+	Layout []pageLayout `json:"layout,omitempty"`
+	// Consensus compares the results of both providers. It is only set in
+	// consensus mode.
+	Consensus *consensusResult `json:"consensus,omitempty"`
+	Metadata  ocrMetadata      `json:"metadata"`
+}
+
+type ocrMetadata struct {
+	// Document is the type the first document in the upload was classified
+	// as. It is only set for the anthropic provider.
+	Document *documentClassification `json:"document,omitempty"`
+	Pages    []pageMetadata          `json:"pages"`
+	// Provider is the OCR provider that produced the result.
+	Provider string `json:"provider"`
+	// PromptVersion is the version of the prompts used, if the provider
+	// uses an LLM.
+	PromptVersion string `json:"promptVersion,omitempty"`
+	// Models are the LLM models that served each task, such as "extract",
+	// if the LLM was used.
+	Models map[string][]string `json:"models,omitempty"`
+	// Usage counts the LLM tokens used, including those read from and
+	// written to the prompt cache.
+	Usage *llm.Usage `json:"usage,omitempty"`
+	// InjectionWarnings are passages of the document that look like prompt
+	// injection, such as text telling the model to ignore its instructions.
+	InjectionWarnings []injection.Finding `json:"injectionWarnings,omitempty"`
+	// Degraded is set when the requested provider was unavailable and the
+	// result was produced by a fallback provider instead, with
+	// DegradedReason saying why.
+	Degraded       bool   `json:"degraded"`
+	DegradedReason string `json:"degradedReason,omitempty"`
+}
+
+// pageMetadata describes how the text of a page or image was obtained.
+type pageMetadata struct {
+	Page      int    `json:"page"`
+	Method    string `json:"method"`
+	DPI       int    `json:"dpi,omitempty"`
+	MediaType string `json:"mediaType"`
+	Quality   int    `json:"quality,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Bytes     int    `json:"bytes"`
+	Attempts  int    `json:"attempts,omitempty"`
+}
+
+func newTextLayerPageMetadata(page int, layerText string) pageMetadata {
+	return pageMetadata{
+		Page:      page,
+		Method:    pageMethodTextLayer,
+		MediaType: "text/plain",
+		Bytes:     len(layerText),
+	}
+}
+
+func newPageMetadata(page int, encoded imaging.Encoded) pageMetadata {
+	return pageMetadata{
+		Page:      page,
+		Method:    pageMethodOCR,
+		DPI:       encoded.DPI,
+		MediaType: encoded.MediaType,
+		Quality:   encoded.Quality,
+		Width:     encoded.Width,
+		Height:    encoded.Height,
+		Bytes:     len(encoded.Data),
+		Attempts:  encoded.Attempts,
+	}
+}
+
 func (app *application) status(w http.ResponseWriter, r *http.Request) {
 	data := map[string]string{
 		"Status": "OK",
@@ -44,451 +133,924 @@ func (app *application) restricted(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Helper function to extract text from a single image using Claude
-func (app *application) extractTextFromImageData(ctx context.Context, client anthropic.Client, base64Image string, mediaType string) (string, error) {
-	prompt := "Extract all text from this image. Translate to English and format the text into json. Assume the image is a personal document like a passport. Return only the json. If you see the passport MRZ string then use that and decode it to get the correct values and remove the MRZ strings from the returned JSON."
-	message, err := client.Messages.New(ctx, anthropic.MessageNewParams{
-		Model:     "claude-sonnet-4-5",
-		MaxTokens: int64(app.config.anthropic.maxTokens),
-		Messages: []anthropic.MessageParam{
-			anthropic.NewUserMessage(
-				anthropic.NewTextBlock(prompt),
-				anthropic.NewImageBlockBase64(mediaType, base64Image),
-			),
-		},
-	})
+// documentPage is an image or document page ready to be sent to Claude,
+// either as the text of its PDF text layer or as an encoded image.
+type documentPage struct {
+	layerText string
+	image     imaging.Encoded
+}
+
+// part returns the page as part of a message. A text layer comes from the
+// uploaded file, so it is fenced off as untrusted.
+func (p documentPage) part() llm.Part {
+	if p.layerText != "" {
+		return llm.Text(prompts.Fence("page_text", p.layerText))
+	}
+
+	return llm.Image(p.image.MediaType, p.image.Data)
+}
+
+func (p documentPage) metadata(page int) pageMetadata {
+	if p.layerText != "" {
+		return newTextLayerPageMetadata(page, p.layerText)
+	}
+
+	return newPageMetadata(page, p.image)
+}
 
+// Helper function to extract text from an image or page using Claude, with a
+// prompt and field names suited to the type of document. Pages with a text
+// layer are sent as text, which avoids the cost of sending them as images.
+func (app *application) extractTextFromPage(ctx context.Context, dt documentType, page documentPage) (pageExtraction, error) {
+	req, err := app.extractionRequest(dt, page)
 	if err != nil {
-		return "", err
+		return pageExtraction{}, err
 	}
 
-	// Extract text from response
-	var extractedText string
-	for _, block := range message.Content {
-		if block.Type == "text" {
-			extractedText += block.Text
-		}
+	extractedText, err := app.complete(ctx, taskExtract, req)
+	if err != nil {
+		return pageExtraction{}, err
+	}
+
+	return app.parsePageExtraction(ctx, extractedText, page), nil
+}
+
+// extractionRequest returns the request that extracts the text of a page of
+// the given type of document.
+func (app *application) extractionRequest(dt documentType, page documentPage) (llm.Request, error) {
+	source := "this image"
+	if page.layerText != "" {
+		source = "the text inside the <page_text> tags below, taken from the text layer of a page in a PDF"
+	}
+
+	prompt, err := app.extractionPrompt(dt, source)
+	if err != nil {
+		return llm.Request{}, err
+	}
+
+	return llm.Request{
+		MaxTokens: app.config.llm.maxTokens,
+		Parts:     []llm.Part{llm.Text(prompt), page.part()},
+	}, nil
+}
+
+// parsePageExtraction parses Claude's response to an extraction request.
+// The text of pages whose fields could not be parsed is kept, rather than
+// failing the whole document.
+func (app *application) parsePageExtraction(ctx context.Context, extractedText string, page documentPage) pageExtraction {
+	var extraction pageExtraction
+	err := app.parseWithRepair(ctx, extractedText, func(text string) error {
+		var err error
+		extraction, err = parseExtraction(text, page.layerText != "")
+		return err
+	})
+	if err != nil {
+		app.logger.Warn("failed to parse extracted fields", "error", err.Error())
+		return pageExtraction{Text: extractedText}
+	}
+
+	return extraction
+}
+
+// loadPage returns the text layer of a document page if it has a usable one,
+// and otherwise renders the page at the highest resolution that fits the
+// pixel and byte limits, dropping the resolution if the encoded page is too
+// large.
+func (app *application) loadPage(doc *fitz.Document, pageNum int, opts imaging.Options) (documentPage, error) {
+	if layerText, ok := app.pageTextLayer(doc, pageNum); ok {
+		return documentPage{layerText: layerText}, nil
+	}
+
+	page, err := imaging.RenderPage(doc, pageNum, opts)
+	if err != nil {
+		return documentPage{}, fmt.Errorf("failed to render page %d: %w", pageNum+1, err)
 	}
+	app.logger.Debug("rendered page", "page", pageNum+1, "dpi", page.DPI, "quality", page.Quality, "bytes", len(page.Data), "attempts", page.Attempts)
 
-	return extractedText, nil
+	return documentPage{image: page}, nil
 }
 
-// Helper function to process PDF by converting pages to images
-func (app *application) processPDF(ctx context.Context, client anthropic.Client, pdfData []byte) (string, error) {
+// Helper function to process a PDF, or any other paged document such as a
+// multi-page TIFF, by converting pages to images. Each page is classified, and
+// runs of consecutive pages of the same type are split into segments, each
+// extracted with a prompt suited to its type. If documentType is set, the
+// pages are not classified and are all given that type.
+func (app *application) processPDF(ctx context.Context, pdfData []byte, pages pageRanges, documentType string, progress progressReporter) (string, []pageMetadata, []documentSegment, error) {
 	// Open PDF document
 	doc, err := fitz.NewFromMemory(pdfData)
 	if err != nil {
-		return "", fmt.Errorf("failed to open PDF: %w", err)
+		return "", nil, nil, fmt.Errorf("failed to open document: %w", err)
 	}
 	defer doc.Close()
 
 	numPages := doc.NumPage()
-	var allText strings.Builder
+	if pages.last() > numPages {
+		return "", nil, nil, fmt.Errorf("%w: the document has %d pages", errPagesOutOfRange, numPages)
+	}
+
+	var (
+		assembler = documentAssembler{fileData: pdfData, numPages: numPages}
+		metadata  []pageMetadata
+	)
 
-	// Process each page
+	// Process each selected page
 	for pageNum := 0; pageNum < numPages; pageNum++ {
-		app.logger.Info("Parsing page num")
-		app.logger.Info(strconv.Itoa(pageNum))
-		// Render page to image at 150 DPI (sufficient for OCR, keeps file size under 5MB limit)
-		img, err := doc.ImageDPI(pageNum, 150.0)
-		if err != nil {
-			return "", fmt.Errorf("failed to render page %d: %w", pageNum+1, err)
+		if !pages.contains(pageNum + 1) {
+			continue
 		}
 
-		// Convert image to JPEG bytes with 85% quality (good balance of quality and size)
-		var buf bytes.Buffer
-		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		// Digital PDFs carry a text layer, which is more accurate than OCR
+		// and avoids sending the page as an image
+		page, err := app.loadPage(doc, pageNum, app.config.preprocess.anthropic)
 		if err != nil {
-			return "", fmt.Errorf("failed to encode page %d as JPEG: %w", pageNum+1, err)
+			return "", nil, nil, err
+		}
+		if page.layerText == "" {
+			progress.stage(stagePageRendered, pageNum+1, numPages)
 		}
 
-		// Base64 encode the JPEG
-		base64Image := base64.StdEncoding.EncodeToString(buf.Bytes())
+		classification := documentClassification{Type: documentType, Confidence: 1}
+		if documentType == "" {
+			classification, err = app.classifyDocument(ctx, page)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("failed to classify page %d: %w", pageNum+1, err)
+			}
+			progress.stage(stageClassified, pageNum+1, numPages)
+		}
+
+		segment := assembler.segment(pageNum, classification)
 
 		// Extract text from this page
-		pageText, err := app.extractTextFromImageData(ctx, client, base64Image, "image/jpeg")
+		extraction, err := app.extractTextFromPage(ctx, lookupDocumentType(segment.Type), page)
 		if err != nil {
-			return "", fmt.Errorf("failed to extract text from page %d: %w", pageNum+1, err)
+			return "", nil, nil, fmt.Errorf("failed to extract text from page %d: %w", pageNum+1, err)
 		}
 
-		// Add page separator and text
-		if numPages > 1 {
-			allText.WriteString(fmt.Sprintf("=== Page %d ===\n", pageNum+1))
-		}
-		allText.WriteString(pageText)
-		if pageNum < numPages-1 {
-			allText.WriteString("\n\n")
-		}
+		metadata = append(metadata, page.metadata(pageNum+1))
+		assembler.addPage(pageNum, extraction)
+		progress.stage(stagePageExtracted, pageNum+1, numPages)
+		progress.pageText(pageNum+1, extraction.Text)
 	}
 
-	return allText.String(), nil
+	text, segments := assembler.documents()
+
+	return text, metadata, segments, nil
 }
 
 func (app *application) extractTextFromImage(w http.ResponseWriter, r *http.Request) {
-	// Check if Anthropic API key is configured
-	if app.config.anthropic.apiKey == "" {
-		app.serverError(w, r, errors.New("Anthropic API key not configured"))
-		return
-	}
+	app.respondWithOCR(w, r, "")
+}
 
-	// Parse multipart form (32MB limit)
-	err := r.ParseMultipartForm(32 << 20)
+// respondWithOCR handles a single file upload. The provider is taken from the
+// "provider" form value unless one is given.
+func (app *application) respondWithOCR(w http.ResponseWriter, r *http.Request, provider string) {
+	file, err := request.DecodeMultipartFile(w, r, "file", maxFileSize)
 	if err != nil {
+		if errors.Is(err, request.ErrFileTooLarge) {
+			app.fileTooLarge(w, r, maxFileSize)
+			return
+		}
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// Get uploaded file
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		app.badRequest(w, r, errors.New("file is required"))
+	if provider == "" {
+		provider = r.FormValue("provider")
+	}
+
+	input := app.newOCRInput(r, file, provider, r.FormValue("pages"))
+	input.DocumentType = r.FormValue("documentType")
+	input.Mode = r.FormValue("mode")
+	input.Language = r.FormValue("language")
+	input.Output = r.FormValue("output")
+	input.Model = r.FormValue("model")
+
+	if !validator.In(input.MediaType, ocrMediaTypes...) {
+		app.unsupportedMediaType(w, r, input.MediaType)
+		return
+	}
+
+	input.validate()
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
-	defer file.Close()
 
-	// Validate file size (20MB limit)
-	const maxFileSize = 20 * 1024 * 1024 // 20MB
-	if header.Size > maxFileSize {
-		app.badRequest(w, r, errors.New("file must be less than 20MB"))
+	if wantsEventStream(r) {
+		app.streamEvents(w, r, func(progress progressReporter) (any, error) {
+			progress.stage(stageUploaded, 0, 0)
+			return app.runOCR(r.Context(), input, progress)
+		}, func(err error) response.Problem {
+			problem, _ := app.ocrProblem(r, input, err)
+			return problem
+		})
 		return
 	}
 
-	// Read file content
-	fileData, err := io.ReadAll(file)
+	result, err := app.runOCR(r.Context(), input, nil)
 	if err != nil {
-		app.serverError(w, r, err)
+		problem, headers := app.ocrProblem(r, input, err)
+		app.writeProblem(w, r, problem, headers)
 		return
 	}
 
-	// Create Anthropic client
-	client := anthropic.NewClient(
-		option.WithAPIKey(app.config.anthropic.apiKey),
-	)
-	ctx := context.Background()
+	app.logger.Debug("text extracted", "length", len(result.Text))
+	err = response.JSON(w, http.StatusOK, result)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// runProvider extracts the text from a validated upload using the requested
+// provider.
+func (app *application) runProvider(ctx context.Context, input *ocrInput, progress progressReporter) (*ocrResult, error) {
+	if input.Mode == ocrModeConsensus {
+		return app.runConsensusOCR(ctx, input, progress)
+	}
+
+	result := &ocrResult{}
 
-	var extractedText string
+	var err error
 
-	// Check if file is a PDF
-	isPDF := strings.HasSuffix(strings.ToLower(header.Filename), ".pdf")
+	if input.Provider == ocrProviderTesseract {
+		opts := tesseractOptions{Language: input.Language, Output: input.Output}
+		if opts.Language == "" {
+			opts.Language = app.config.tesseract.language
+		}
 
-	if isPDF {
-		app.logger.Info("Process PDF by converting pages to images")
-		extractedText, err = app.processPDF(ctx, client, fileData)
+		err := app.checkTesseractLanguage(opts.Language)
 		if err != nil {
-			app.serverError(w, r, err)
-			return
+			return nil, err
 		}
-	} else {
-		// Process as image
-		// Base64 encode the image
-		base64Image := base64.StdEncoding.EncodeToString(fileData)
-
-		// Determine media type from file extension
-		mediaType := "image/jpeg"
-		if len(header.Filename) > 4 {
-			ext := strings.ToLower(header.Filename[len(header.Filename)-4:])
-			switch ext {
-			case ".png":
-				mediaType = "image/png"
-			case ".jpg", "jpeg":
-				mediaType = "image/jpeg"
+
+		if imaging.IsPaged(input.MediaType) {
+			// Process PDF or TIFF with Tesseract
+			result.Text, result.Metadata.Pages, result.Layout, err = app.processPDFWithTesseract(input.File.Data, input.pageRanges, opts, progress)
+			if err != nil {
+				return nil, err
 			}
+			return result, nil
 		}
 
-		extractedText, err = app.extractTextFromImageData(ctx, client, base64Image, mediaType)
+		// Process image with Tesseract, transcoding formats that Leptonica
+		// cannot read
+		prepared, err := imaging.Preprocess(input.File.Data, input.MediaType, app.config.preprocess.tesseract)
 		if err != nil {
-			app.serverError(w, r, err)
-			return
+			return nil, err
+		}
+
+		ocrPage, err := app.tesseract.Recognize(prepared.Data, prepared.Width, prepared.Height, opts)
+		if err != nil {
+			return nil, err
 		}
+
+		result.Text = ocrPage.Text
+		if ocrPage.Layout != nil {
+			ocrPage.Layout.Page = 1
+			result.Layout = append(result.Layout, *ocrPage.Layout)
+		}
+
+		result.Metadata.Pages = append(result.Metadata.Pages, newPageMetadata(1, prepared))
+		progress.stage(stagePageExtracted, 1, 1)
+		progress.pageText(1, result.Text)
+		return result, nil
 	}
 
-	// Return extracted text as plain text
-	// w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	// w.WriteHeader(http.StatusOK)
-	// _, err = w.Write([]byte(extractedText))
-	app.logger.Info("bob")
-	app.logger.Info(extractedText)
-	data := map[string]string{
-		"text": extractedText,
+	if app.llm == nil {
+		return nil, errLLMNotConfigured
 	}
-	err = response.JSON(w, http.StatusOK, data)
-	if err != nil {
-		app.logger.Error(err.Error())
+
+	if imaging.IsPaged(input.MediaType) {
+		app.logger.Info("Process document by converting pages to images", "mediaType", input.MediaType)
+		result.Text, result.Metadata.Pages, result.Documents, err = app.processPDF(ctx, input.File.Data, input.pageRanges, input.DocumentType, progress)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Documents) > 0 {
+			result.Metadata.Document = &result.Documents[0].documentClassification
+		}
+		return result, nil
 	}
-}
 
-// Helper function to extract text from image using Tesseract OCR
-func (app *application) processImageWithTesseract(imageData []byte) (string, error) {
-	client := gosseract.NewClient()
-	defer client.Close()
+	// Process as image, correcting its orientation, fitting it within
+	// Claude's limits and transcoding formats that Claude does not accept
+	prepared, err := imaging.Preprocess(input.File.Data, input.MediaType, app.config.preprocess.anthropic)
+	if err != nil {
+		return nil, err
+	}
 
-	// Set language to English
-	client.SetLanguage("eng")
+	page := documentPage{image: prepared}
 
-	// Set image from bytes
-	if err := client.SetImageFromBytes(imageData); err != nil {
-		return "", fmt.Errorf("invalid image format: %w", err)
+	document := documentClassification{Type: input.DocumentType, Confidence: 1}
+	if input.DocumentType == "" {
+		document, err = app.classifyDocument(ctx, page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to classify document: %w", err)
+		}
+		progress.stage(stageClassified, 1, 1)
 	}
 
-	// Extract textDashboard
-	text, err := client.Text()
+	extraction, err := app.extractTextFromPage(ctx, lookupDocumentType(document.Type), page)
 	if err != nil {
-		return "", fmt.Errorf("OCR processing failed: %w", err)
+		return nil, err
+	}
+	result.Text = extraction.Text
+
+	segment := documentSegment{
+		ID:                     documentID(input.File.Data, 0),
+		documentClassification: document,
+		FirstPage:              1,
+		LastPage:               1,
+		Text:                   result.Text,
+	}
+	for _, field := range extraction.Fields {
+		field.DocumentID = segment.ID
+		field.Page = 1
+		segment.Fields = append(segment.Fields, field)
 	}
 
-	return text, nil
+	result.Documents = []documentSegment{segment}
+	result.Metadata.Document = &document
+	result.Metadata.Pages = append(result.Metadata.Pages, newPageMetadata(1, prepared))
+	progress.stage(stagePageExtracted, 1, 1)
+	progress.pageText(1, result.Text)
+	return result, nil
 }
 
-// Helper function to process PDF using Tesseract OCR
-func (app *application) processPDFWithTesseract(pdfData []byte) (string, error) {
-	// Open PDF document
-	doc, err := fitz.NewFromMemory(pdfData)
+// Statuses of the files in a batch OCR response.
+const (
+	batchStatusSuccess = "success"
+	batchStatusError   = "error"
+)
+
+// batchTimeout is how long a batch OCR request may take to upload and
+// process. It replaces the server-wide read and write timeouts, which are
+// sized for a single file.
+const batchTimeout = 10 * time.Minute
+
+type batchResult struct {
+	Files []batchFileResult `json:"files"`
+	Stats batchStats        `json:"stats"`
+}
+
+type batchFileResult struct {
+	Index    int               `json:"index"`
+	Filename string            `json:"filename"`
+	Status   string            `json:"status"`
+	Text     string            `json:"text,omitempty"`
+	Metadata *ocrMetadata      `json:"metadata,omitempty"`
+	Error    *response.Problem `json:"error,omitempty"`
+}
+
+type batchStats struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// extractTextFromImages handles several file uploads in one request. The
+// files are streamed to disk and processed concurrently, and each one gets
+// its own result so that a single bad file does not fail the whole batch.
+func (app *application) extractTextFromImages(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	err := rc.SetReadDeadline(time.Now().Add(batchTimeout))
 	if err != nil {
-		return "", fmt.Errorf("failed to open PDF: %w", err)
+		app.serverError(w, r, err)
+		return
 	}
-	defer doc.Close()
 
-	numPages := doc.NumPage()
-	var allText strings.Builder
+	err = rc.SetWriteDeadline(time.Now().Add(batchTimeout))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
-	// Process each page
-	for pageNum := 0; pageNum < numPages; pageNum++ {
-		// Render page to image at 300 DPI (higher DPI for better OCR accuracy with Tesseract)
-		img, err := doc.ImageDPI(pageNum, 300.0)
-		if err != nil {
-			return "", fmt.Errorf("failed to render page %d: %w", pageNum+1, err)
+	uploads, err := request.DecodeMultipartFiles(w, r, "file", maxFileSize, app.config.ocr.batchMaxFiles)
+	if err != nil {
+		if errors.Is(err, request.ErrFileTooLarge) {
+			app.fileTooLarge(w, r, maxFileSize)
+			return
 		}
-
-		// Convert image to PNG bytes (Tesseract works well with PNG)
-		var buf bytes.Buffer
-		err = png.Encode(&buf, img)
+		app.badRequest(w, r, err)
+		return
+	}
+	defer func() {
+		err := uploads.Close()
 		if err != nil {
-			return "", fmt.Errorf("failed to encode page %d as PNG: %w", pageNum+1, err)
+			app.logger.Warn("failed to remove uploaded files", "error", err.Error())
 		}
+	}()
 
-		// Extract text from this page using Tesseract
-		pageText, err := app.processImageWithTesseract(buf.Bytes())
-		if err != nil {
-			return "", fmt.Errorf("failed to OCR page %d: %w", pageNum+1, err)
-		}
+	result := batchResult{
+		Files: make([]batchFileResult, len(uploads.Files)),
+	}
 
-		// Add page separator and text
-		if numPages > 1 {
-			allText.WriteString(fmt.Sprintf("=== Page %d ===\n", pageNum+1))
-		}
-		allText.WriteString(pageText)
-		if pageNum < numPages-1 {
-			allText.WriteString("\n\n")
+	sem := make(chan struct{}, max(app.config.ocr.batchConcurrency, 1))
+	budget := newMemoryBudget(app.config.ocr.batchMaxMemory << 20)
+	var wg sync.WaitGroup
+
+	for i, upload := range uploads.Files {
+		result.Files[i] = batchFileResult{Index: i, Filename: upload.Filename}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer app.recoverBatchFile(r, &result.Files[i])
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			weight := budget.acquire(batchFileMemory(upload))
+			defer budget.release(weight)
+
+			result.Files[i] = app.processBatchFile(r, i, upload, uploads.Values)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, file := range result.Files {
+		switch file.Status {
+		case batchStatusSuccess:
+			result.Stats.Succeeded++
+		default:
+			result.Stats.Failed++
 		}
 	}
+	result.Stats.Total = len(result.Files)
 
-	return allText.String(), nil
+	app.logger.Debug("batch processed", "total", result.Stats.Total, "failed", result.Stats.Failed)
+	err = response.JSON(w, http.StatusOK, result)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
 }
 
-// HTTP handler for Tesseract OCR endpoint
-func (app *application) extractTextFromImageTesseract(w http.ResponseWriter, r *http.Request) {
-	// Parse multipart form (32MB limit)
-	err := r.ParseMultipartForm(32 << 20)
-	if err != nil {
-		app.badRequest(w, r, err)
-		return
+// memoryBudget bounds the memory used by the files of a batch that are being
+// processed at once. Files wait on disk until their share of the budget is
+// free; a file larger than the whole budget waits until nothing else is
+// loaded.
+type memoryBudget struct {
+	mu    sync.Mutex
+	freed *sync.Cond
+	total int64
+	used  int64
+}
+
+func newMemoryBudget(total int64) *memoryBudget {
+	b := &memoryBudget{total: total}
+	b.freed = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes of the budget are free and takes them. It
+// returns the number of bytes taken, to be given back with release.
+func (b *memoryBudget) acquire(n int64) int64 {
+	n = min(n, b.total)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used+n > b.total {
+		b.freed.Wait()
 	}
+	b.used += n
+
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	b.freed.Broadcast()
+}
+
+// batchFileMemory estimates the memory needed to process a file of a batch:
+// the file itself and, for a single image, its decoded pixels at four bytes
+// each. Document pages are rendered one at a time within the provider's
+// pixel limits, so they are not counted.
+func batchFileMemory(upload *request.UploadedFile) int64 {
+	size := upload.Size
 
-	// Get uploaded file
-	file, header, err := r.FormFile("file")
+	file, err := upload.Open()
 	if err != nil {
-		app.badRequest(w, r, errors.New("file is required"))
-		return
+		return size
 	}
 	defer file.Close()
 
-	// Validate file size (20MB limit)
-	const maxFileSize = 20 * 1024 * 1024 // 20MB
-	if header.Size > maxFileSize {
-		app.badRequest(w, r, errors.New("file must be less than 20MB"))
-		return
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return size
+	}
+
+	return size + min(int64(config.Width)*int64(config.Height), imaging.MaxDecodePixels)*4
+}
+
+// processBatchFile runs OCR on one file of a batch, reporting any failure as
+// a problem in the file's result. The form values sent with the batch apply
+// to every file.
+func (app *application) processBatchFile(r *http.Request, index int, upload *request.UploadedFile, values url.Values) batchFileResult {
+	fileResult := batchFileResult{
+		Index:    index,
+		Filename: upload.Filename,
+		Status:   batchStatusError,
+	}
+
+	fail := func(problem response.Problem) batchFileResult {
+		fileResult.Error = &problem
+		return fileResult
 	}
 
-	// Read file content
-	fileData, err := io.ReadAll(file)
+	file, err := upload.Load()
 	if err != nil {
-		app.serverError(w, r, err)
+		if errors.Is(err, request.ErrFileTooLarge) {
+			return fail(app.fileTooLargeProblem(r, maxFileSize))
+		}
+		app.reportServerError(r, err)
+		return fail(app.problem(r, http.StatusInternalServerError, errCodeServerError, serverErrorMessage))
+	}
+
+	input := app.newOCRInput(r, file, values.Get("provider"), values.Get("pages"))
+	input.DocumentType = values.Get("documentType")
+	input.Mode = values.Get("mode")
+	input.Language = values.Get("language")
+	input.Output = values.Get("output")
+	input.Model = values.Get("model")
+
+	if !validator.In(input.MediaType, ocrMediaTypes...) {
+		return fail(app.unsupportedMediaTypeProblem(r, input.MediaType))
+	}
+
+	input.validate()
+	if input.Validator.HasErrors() {
+		return fail(app.validationProblem(r, input.Validator))
+	}
+
+	ocr, err := app.runOCR(r.Context(), input, nil)
+	if err != nil {
+		problem, _ := app.ocrProblem(r, input, err)
+		return fail(problem)
+	}
+
+	fileResult.Status = batchStatusSuccess
+	fileResult.Text = ocr.Text
+	fileResult.Metadata = &ocr.Metadata
+	return fileResult
+}
+
+// recoverBatchFile turns a panic while processing one file of a batch into a
+// failed result for that file instead of taking down the whole request.
+func (app *application) recoverBatchFile(r *http.Request, fileResult *batchFileResult) {
+	pv := recover()
+	if pv == nil {
 		return
 	}
 
-	var extractedText string
+	app.reportServerError(r, fmt.Errorf("%s", pv))
+
+	problem := app.problem(r, http.StatusInternalServerError, errCodeServerError, serverErrorMessage)
+	fileResult.Status = batchStatusError
+	fileResult.Text = ""
+	fileResult.Metadata = nil
+	fileResult.Error = &problem
+}
+
+// Helper function to process a PDF or multi-page TIFF using Tesseract OCR
+func (app *application) processPDFWithTesseract(pdfData []byte, pages pageRanges, opts tesseractOptions, progress progressReporter) (string, []pageMetadata, []pageLayout, error) {
+	// Open PDF document
+	doc, err := fitz.NewFromMemory(pdfData)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to open document: %w", err)
+	}
+	defer doc.Close()
+
+	numPages := doc.NumPage()
+	if pages.last() > numPages {
+		return "", nil, nil, fmt.Errorf("%w: the document has %d pages", errPagesOutOfRange, numPages)
+	}
+
+	var (
+		allText  strings.Builder
+		metadata []pageMetadata
+		layouts  []pageLayout
+	)
 
-	// Check if file is a PDF
-	isPDF := strings.HasSuffix(strings.ToLower(header.Filename), ".pdf")
+	// Process each selected page
+	for pageNum := 0; pageNum < numPages; pageNum++ {
+		if !pages.contains(pageNum + 1) {
+			continue
+		}
+
+		// Use the text layer of digital PDFs as-is. It carries no layout.
+		if layerText, ok := app.pageTextLayer(doc, pageNum); ok {
+			metadata = append(metadata, newTextLayerPageMetadata(pageNum+1, layerText))
+			writePageText(&allText, numPages, pageNum, layerText)
+			progress.stage(stagePageExtracted, pageNum+1, numPages)
+			progress.pageText(pageNum+1, layerText)
+			continue
+		}
 
-	if isPDF {
-		// Process PDF with Tesseract
-		extractedText, err = app.processPDFWithTesseract(fileData)
+		// Render page to image at up to 300 DPI (higher DPI for better OCR
+		// accuracy with Tesseract) and encode it as PNG
+		page, err := imaging.RenderPage(doc, pageNum, app.config.preprocess.tesseract)
 		if err != nil {
-			app.serverError(w, r, err)
-			return
+			return "", nil, nil, fmt.Errorf("failed to render page %d: %w", pageNum+1, err)
 		}
-	} else {
-		// Process image with Tesseract
-		extractedText, err = app.processImageWithTesseract(fileData)
+		progress.stage(stagePageRendered, pageNum+1, numPages)
+
+		// Extract text from this page using Tesseract
+		ocrPage, err := app.tesseract.Recognize(page.Data, page.Width, page.Height, opts)
 		if err != nil {
-			app.serverError(w, r, err)
-			return
+			return "", nil, nil, fmt.Errorf("failed to OCR page %d: %w", pageNum+1, err)
 		}
-	}
 
-	// Return extracted text as plain text
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(extractedText))
-	if err != nil {
-		app.logger.Error(err.Error())
+		metadata = append(metadata, newPageMetadata(pageNum+1, page))
+		if ocrPage.Layout != nil {
+			ocrPage.Layout.Page = pageNum + 1
+			layouts = append(layouts, *ocrPage.Layout)
+		}
+
+		writePageText(&allText, numPages, pageNum, ocrPage.Text)
+		progress.stage(stagePageExtracted, pageNum+1, numPages)
+		progress.pageText(pageNum+1, ocrPage.Text)
 	}
+
+	return allText.String(), metadata, layouts, nil
+}
+
+// HTTP handler for Tesseract OCR endpoint
+func (app *application) extractTextFromImageTesseract(w http.ResponseWriter, r *http.Request) {
+	app.respondWithOCR(w, r, ocrProviderTesseract)
+}
+
+// filledField is a form field and the value it should be filled with.
+type filledField struct {
+	FieldID    string           `json:"fieldId"`
+	Value      string           `json:"value"`
+	Provenance *fieldProvenance `json:"provenance,omitempty"`
+	// MatchedBy is matchedByRules or matchedByLLM.
+	MatchedBy string `json:"matchedBy"`
+}
+
+// formFill is the result of filling a form.
+type formFill struct {
+	Fields []filledField
+	// Rejected are the values that the model returned but the form cannot
+	// take.
+	Rejected []rejectedField
+	// InjectionWarnings are passages of the form or documents that look like
+	// prompt injection.
+	InjectionWarnings []injection.Finding
+	// Template is the template of the form, if it is a known form.
+	Template *form.Template
 }
 
 func (app *application) fillForm(w http.ResponseWriter, r *http.Request) {
-	if app.config.anthropic.apiKey == "" {
-		app.serverError(w, r, errors.New("Anthropic API key not configured"))
+	if app.llm == nil {
+		app.llmUnavailable(w, r, errLLMNotConfigured)
 		return
 	}
 
-	// Parse request body
-	var input struct {
-		FormHTML               string `json:"formHTML"`
-		DocumentsExtractedText string `json:"documentsExtractedText"`
-	}
+	var input fillFormInput
 
-	err := request.DecodeJSON(w, r, &input)
+	err := request.DecodeJSONLimit(w, r, &input, maxFormJSONBytes)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// Validate inputs
-	if input.FormHTML == "" {
-		app.badRequest(w, r, errors.New("formHTML is required"))
+	input.models = app.allowedModels(r)
+	input.validate()
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
-	if input.DocumentsExtractedText == "" {
-		app.badRequest(w, r, errors.New("documentsExtractedText is required"))
-		return
-	}
+	ctx, routing := withModelRouting(r.Context(), input.Model)
 
 	// Log both parameters
 	app.logger.Info("fillForm request received")
 	app.logger.Info("formHTML length", "bytes", len(input.FormHTML))
 	app.logger.Info("documentsExtractedText length", "bytes", len(input.DocumentsExtractedText))
 
-	// Create Claude prompt for form filling
-	prompt := fmt.Sprintf(`You are a form-filling assistant. Analyze this HTML form and extracted document text, then return a JSON mapping of form fields to values.
-		Use only English and French letters Example: Aa, Bb, Cc and French accents such as é, è, ê, ë, û and special characters: hyphens, apostrophes, and spaces; cannot begin or end with a hyphen, apostrophe, or space. If your name has special letters or characters, use the letter without the accent.
-
-FORM HTML:
-%s
-
-DOCUMENT TEXT JSON:
-%s
-
-Your task:
-1. Identify all fillable form fields (inputs, selects, radio buttons) by their ID attribute
-2. Match document data to appropriate fields
-3. Return ONLY valid JSON in this exact format (no markdown, no code blocks):
-
-{
-  "fields": [
-    {
-      "fieldId": "lastName_input",
-      "fieldType": "input",
-      "value": "Smith"
-    },
-    {
-      "fieldId": "year_sltDateYear",
-      "fieldType": "select",
-      "value": "1990"
-    },
-		{
-      "fieldId": "codePassport_select",
-      "fieldType": "select",
-      "value": "131"
-		}
-  ]
+	if wantsEventStream(r) {
+		app.streamEvents(w, r, func(progress progressReporter) (any, error) {
+			progress.stage(stageUploaded, 0, 0)
+			progress.stage(stageMatching, 0, 0)
+
+			fill, err := app.matchFields(ctx, &input)
+			if err != nil {
+				return nil, err
+			}
+			return app.newFillFormResponse(fill, routing), nil
+		}, func(err error) response.Problem {
+			problem, _ := app.fillFormProblem(r, err)
+			return problem
+		})
+		return
+	}
+
+	fill, err := app.matchFields(ctx, &input)
+	if err != nil {
+		problem, headers := app.fillFormProblem(r, err)
+		app.writeProblem(w, r, problem, headers)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, app.newFillFormResponse(fill, routing))
+	if err != nil {
+		app.serverError(w, r, err)
+	}
 }
 
-Rules:
-- Use exact field IDs from the HTML id attributes
-- For dates, parse and split into separate year/month/day fields
-- For radio buttons, use the exact value attribute (01=Female, 02=Male, 03=Unknown, 04=Another)
-- Only include fields where you found matching data
-- Return ONLY valid JSON, no additional text or formatting`, input.FormHTML, input.DocumentsExtractedText)
+// matchFields fills the fields of the form from its template, if it is a
+// known form, and those that map directly to extracted document fields with
+// rules, and asks Claude to match the extracted document text against the
+// rest. The form and documents are untrusted, so they are
+// scanned for prompt injection, and the values returned are checked against
+// the fields of the form.
+func (app *application) matchFields(ctx context.Context, input *fillFormInput) (*formFill, error) {
+	formFields := form.Parse(input.FormHTML)
+
+	fill := &formFill{InjectionWarnings: scanFillFormInput(input, formSchemaJSON(formFields))}
+	for _, finding := range fill.InjectionWarnings {
+		app.logger.Warn("possible prompt injection in form filling request", "rule", finding.Rule, "source", finding.Source, "excerpt", finding.Excerpt)
+	}
 
-	// Create Anthropic client
-	client := anthropic.NewClient(
-		option.WithAPIKey(app.config.anthropic.apiKey),
+	// Known form pages are filled from their template, and the fields that
+	// map directly to extracted document fields with rules
+	var (
+		profile, sources = applicantProfile(input.Documents)
+		ruleFields       []filledField
+		llmFields        = formFields
 	)
-	ctx := context.Background()
-
-	// Call Claude API
-	message, err := client.Messages.New(ctx, anthropic.MessageNewParams{
-		Model:     "claude-sonnet-4-5",
-		MaxTokens: int64(app.config.anthropic.maxTokens),
-		Messages: []anthropic.MessageParam{
-			anthropic.NewUserMessage(
-				anthropic.NewTextBlock(prompt),
-			),
-		},
-	})
 
+	if template, ok := app.formTemplates.Match(formFields); ok {
+		var filled []form.Filled
+		filled, llmFields = template.Fill(llmFields, profile)
+		ruleFields = profileFilledFields(filled, input.Documents, sources, matchedByTemplate)
+		fill.Template = &template
+		app.logger.Info("filled form fields from template", "template", template.ID, "version", template.Version, "fields", len(filled), "remaining", len(llmFields))
+	}
+
+	if app.config.fillForm.rules && len(llmFields) > 0 {
+		var filled []form.Filled
+		filled, llmFields = form.Fill(llmFields, profile)
+		ruleFields = append(ruleFields, profileFilledFields(filled, input.Documents, sources, matchedByRules)...)
+		app.logger.Info("filled form fields with rules", "fields", len(filled), "remaining", len(llmFields))
+	}
+
+	// Every field was filled, so there is nothing to ask Claude
+	if len(formFields) > 0 && len(llmFields) == 0 {
+		fill.Fields, fill.Rejected = allowListFields(formFields, ruleFields)
+		return fill, nil
+	}
+	schemaJSON := formSchemaJSON(llmFields)
+
+	instructions, err := app.prompts.Execute("fill-form.tmpl", nil)
 	if err != nil {
-		app.serverError(w, r, err)
-		return
+		return nil, err
 	}
 
-	// Extract text from response
-	var responseText string
-	for _, block := range message.Content {
-		if block.Type == "text" {
-			responseText += block.Text
-		}
+	schema, err := app.prompts.Execute("fill-form-schema.tmpl", struct {
+		Fields   string
+		FormHTML string
+	}{schemaJSON, input.FormHTML})
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := app.prompts.Execute("fill-form-documents.tmpl", struct {
+		DocumentsText   string
+		ExtractedFields string
+	}{input.DocumentsExtractedText, extractedFieldsJSON(input.Documents)})
+	if err != nil {
+		return nil, err
+	}
+
+	// The instructions and the form are the same every time a form page is
+	// filled, so they go first and are marked as cacheable prefixes
+	cache := app.config.llm.promptCaching
+	responseText, err := app.complete(ctx, taskMatch, llm.Request{
+		MaxTokens: app.config.llm.maxTokens,
+		Parts: []llm.Part{
+			{Text: instructions, Cache: cache},
+			{Text: schema, Cache: cache},
+			llm.Text(documents),
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	app.logger.Info("Claude response received", "length", len(responseText))
 	app.logger.Debug("Claude response", "text", responseText)
 
-	// Clean up response (remove markdown code blocks if present)
-	responseText = strings.TrimSpace(responseText)
-	responseText = strings.TrimPrefix(responseText, "```json")
-	responseText = strings.TrimPrefix(responseText, "```")
-	responseText = strings.TrimSuffix(responseText, "```")
-	responseText = strings.TrimSpace(responseText)
-
 	// Parse JSON response
 	var fillResponse struct {
 		Fields []struct {
 			FieldID string `json:"fieldId"`
 			Value   string `json:"value"`
+			Source  *struct {
+				DocumentID string `json:"documentId"`
+				Field      string `json:"field"`
+			} `json:"source"`
+			Confidence float64 `json:"confidence"`
 		} `json:"fields"`
 	}
 
-	err = json.Unmarshal([]byte(responseText), &fillResponse)
+	err = app.parseWithRepair(ctx, responseText, func(text string) error {
+		// Clean up response (remove markdown code blocks if present)
+		err := json.Unmarshal([]byte(trimCodeFence(text)), &fillResponse)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAIResponseInvalid, err)
+		}
+		return nil
+	})
 	if err != nil {
 		app.logger.Error("Failed to parse Claude response as JSON", "error", err.Error(), "response", responseText)
-		app.serverError(w, r, fmt.Errorf("failed to parse AI response: %w", err))
-		return
+		return nil, err
+	}
+
+	ruleFilled := make(map[string]bool, len(ruleFields))
+	for _, f := range ruleFields {
+		ruleFilled[f.FieldID] = true
+	}
+
+	// Attach where each value came from, using the provenance of the
+	// extracted field it was matched from. Values for fields that were
+	// filled from the template or with rules are dropped, as those took them
+	// straight from the documents.
+	fields := ruleFields
+	for _, f := range fillResponse.Fields {
+		if ruleFilled[f.FieldID] {
+			continue
+		}
+
+		var documentID, field string
+		if f.Source != nil {
+			documentID, field = f.Source.DocumentID, f.Source.Field
+		}
+
+		fields = append(fields, filledField{
+			FieldID:    f.FieldID,
+			Value:      f.Value,
+			Provenance: lookupProvenance(input.Documents, documentID, field, min(max(f.Confidence, 0), 1)),
+			MatchedBy:  matchedByLLM,
+		})
+	}
+
+	// Without a schema there is nothing to check the values against
+	fill.Fields = fields
+	if len(formFields) > 0 {
+		fill.Fields, fill.Rejected = allowListFields(formFields, fields)
+		for _, f := range fill.Rejected {
+			app.logger.Warn("rejected filled value", "fieldId", f.FieldID, "reason", f.Reason)
+		}
+	}
+
+	return fill, nil
+}
+
+func (app *application) newFillFormResponse(fill *formFill, routing *modelRouting) map[string]any {
+	var templateFields, ruleFields int
+	for _, f := range fill.Fields {
+		switch f.MatchedBy {
+		case matchedByTemplate:
+			templateFields++
+		case matchedByRules:
+			ruleFields++
+		}
 	}
 
-	// Return field mappings
-	data := map[string]interface{}{
-		"status":  "success",
-		"message": "Form filled successfully",
-		"fields":  fillResponse.Fields,
+	data := map[string]any{
+		"status":        "success",
+		"message":       "Form filled successfully",
+		"fields":        fill.Fields,
+		"promptVersion": app.prompts.Version(),
+		"models":        routing.models(),
+		"usage":         routing.tokens(),
 		"stats": map[string]int{
-			"totalFields": len(fillResponse.Fields),
+			"totalFields":    len(fill.Fields),
+			"templateFields": templateFields,
+			"ruleFields":     ruleFields,
+			"rejectedFields": len(fill.Rejected),
 		},
 	}
 
-	err = response.JSON(w, http.StatusOK, data)
-	if err != nil {
-		app.serverError(w, r, err)
+	if fill.Template != nil {
+		data["template"] = map[string]any{"id": fill.Template.ID, "version": fill.Template.Version}
 	}
+
+	if len(fill.Rejected) > 0 {
+		data["rejectedFields"] = fill.Rejected
+	}
+	if len(fill.InjectionWarnings) > 0 {
+		data["injectionWarnings"] = fill.InjectionWarnings
+	}
+
+	return data
 }
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/llm/llmtest"
+)
+
+const (
+	testClassification = `{"type": "passport", "confidence": 0.95, "firstPage": true}`
+	testExtraction     = `{"fields": [{"name": "surname", "value": "DOE", "confidence": 0.9, "source": "mrz"}, {"name": "givenNames", "value": "JANE", "confidence": 0.9, "source": "visual"}], "otherText": ""}`
+	testFormHTML       = `<form><label for="city">City of residence</label><input id="city" name="city"></form>`
+)
+
+// checkProblem fails the test unless the response is a problem with the
+// given status and code.
+func checkProblem(t *testing.T, res testResponse, status int, code string) {
+	t.Helper()
+
+	if res.status != status {
+		t.Errorf("got status %d, want %d: %v", res.status, status, res.body)
+	}
+	if res.body["code"] != code {
+		t.Errorf("got code %v, want %q", res.body["code"], code)
+	}
+}
+
+func TestOCR(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Reply(testClassification), llmtest.Reply(testExtraction))
+
+	res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), testUsername, testPassword)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+	}
+
+	documents, _ := res.body["documents"].([]any)
+	if len(documents) != 1 {
+		t.Fatalf("got %d documents, want 1: %v", len(documents), res.body)
+	}
+	document := documents[0].(map[string]any)
+	if document["type"] != "passport" {
+		t.Errorf("got document type %v, want passport", document["type"])
+	}
+
+	values := make(map[string]any)
+	for _, field := range document["fields"].([]any) {
+		field := field.(map[string]any)
+		values[field["name"].(string)] = field["value"]
+	}
+	if values["surname"] != "DOE" || values["givenNames"] != "JANE" {
+		t.Errorf("got fields %v, want surname DOE and givenNames JANE", values)
+	}
+
+	requests := srv.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d LLM requests, want 2", len(requests))
+	}
+	for _, req := range requests {
+		if req.Images != 1 {
+			t.Errorf("got %d images in an LLM request, want 1", req.Images)
+		}
+	}
+}
+
+func TestOCRWithDocumentType(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Reply(testExtraction))
+
+	res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), map[string]string{"documentType": "passport"}), testUsername, testPassword)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+	}
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("got %d LLM requests, want 1 as classification is skipped", n)
+	}
+}
+
+func TestOCRMalformedClassification(t *testing.T) {
+	t.Run("Repaired", func(t *testing.T) {
+		app, srv := newTestApplication(t)
+		srv.Enqueue(llmtest.Reply("It looks like a passport."), llmtest.Reply(testClassification), llmtest.Reply(testExtraction))
+
+		res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), testUsername, testPassword)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+		}
+		if n := len(srv.Requests()); n != 3 {
+			t.Errorf("got %d LLM requests, want 3", n)
+		}
+	})
+
+	t.Run("Still invalid", func(t *testing.T) {
+		app, srv := newTestApplication(t)
+		srv.Enqueue(llmtest.Reply("It looks like a passport."), llmtest.Reply(`{"type": "passport"`))
+
+		res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), testUsername, testPassword)
+		checkProblem(t, res, http.StatusBadGateway, errCodeAIResponseInvalid)
+	})
+
+	t.Run("Repair disabled", func(t *testing.T) {
+		app, srv := newTestApplication(t)
+		app.config.llm.repair = false
+		srv.Enqueue(llmtest.Reply("It looks like a passport."))
+
+		res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), testUsername, testPassword)
+		checkProblem(t, res, http.StatusBadGateway, errCodeAIResponseInvalid)
+		if n := len(srv.Requests()); n != 1 {
+			t.Errorf("got %d LLM requests, want 1", n)
+		}
+	})
+}
+
+func TestOCRValidation(t *testing.T) {
+	app, srv := newTestApplication(t)
+
+	tests := []struct {
+		name       string
+		file       []byte
+		values     map[string]string
+		wantStatus int
+		wantCode   string
+		wantField  string
+	}{
+		{name: "Unknown provider", file: testImage(t), values: map[string]string{"provider": "textract"}, wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeValidationFailed, wantField: "provider"},
+		{name: "Pages of an image", file: testImage(t), values: map[string]string{"pages": "1-2"}, wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeValidationFailed, wantField: "pages"},
+		{name: "Unknown document type", file: testImage(t), values: map[string]string{"documentType": "visa"}, wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeValidationFailed, wantField: "documentType"},
+		{name: "Model not allowed", file: testImage(t), values: map[string]string{"model": "claude-other"}, wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeValidationFailed, wantField: "model"},
+		{name: "Unsupported file", file: []byte("plain text"), wantStatus: http.StatusUnsupportedMediaType, wantCode: errCodeUnsupportedMediaType},
+		{name: "Corrupt image", file: testImage(t)[:60], wantStatus: http.StatusBadRequest, wantCode: errCodeBadRequest},
+		{name: "Too many pixels", file: testImageDeclaring(t, 12_000, 12_000), wantStatus: http.StatusRequestEntityTooLarge, wantCode: errCodeFileTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serve(t, app, newUploadRequest(t, "/api/ocr", tt.file, tt.values), testUsername, testPassword)
+			checkProblem(t, res, tt.wantStatus, tt.wantCode)
+
+			if tt.wantField != "" {
+				fieldErrors, _ := res.body["fieldErrors"].(map[string]any)
+				if _, ok := fieldErrors[tt.wantField]; !ok {
+					t.Errorf("got field errors %v, want one for %q", fieldErrors, tt.wantField)
+				}
+			}
+		})
+	}
+
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("got %d LLM requests for invalid uploads, want 0", n)
+	}
+}
+
+// TestOCRUploadNames checks that uploads are recognized by their content,
+// whatever they are named or declared as.
+func TestOCRUploadNames(t *testing.T) {
+	var jpegData bytes.Buffer
+	err := jpeg.Encode(&jpegData, image.NewGray(image.Rect(0, 0, 64, 40)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		file        []byte
+		wantStatus  int
+	}{
+		{name: "Uppercase extension", filename: "SCAN.PNG", contentType: "image/png", file: testImage(t), wantStatus: http.StatusOK},
+		{name: "Uppercase JPEG extension", filename: "Passport.JPEG", contentType: "image/jpeg", file: jpegData.Bytes(), wantStatus: http.StatusOK},
+		{name: "PNG renamed to JPEG", filename: "passport.jpg", contentType: "image/jpeg", file: testImage(t), wantStatus: http.StatusOK},
+		{name: "JPEG renamed to PDF", filename: "passport.pdf", contentType: "application/pdf", file: jpegData.Bytes(), wantStatus: http.StatusOK},
+		{name: "No extension", filename: "passport", contentType: "application/octet-stream", file: jpegData.Bytes(), wantStatus: http.StatusOK},
+		{name: "Text renamed to PNG", filename: "passport.PNG", contentType: "image/png", file: []byte("Surname: DOE"), wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, srv := newTestApplication(t)
+			srv.Enqueue(llmtest.Reply(testClassification), llmtest.Reply(testExtraction))
+
+			res := serve(t, app, newNamedUploadRequest(t, "/api/ocr", tt.filename, tt.contentType, tt.file, nil), testUsername, testPassword)
+			if tt.wantStatus != http.StatusOK {
+				checkProblem(t, res, tt.wantStatus, errCodeUnsupportedMediaType)
+				return
+			}
+			if res.status != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+			}
+
+			requests := srv.Requests()
+			if len(requests) != 2 || requests[0].Images != 1 {
+				t.Errorf("got %d LLM requests, want 2 with the image", len(requests))
+			}
+		})
+	}
+}
+
+func TestFillForm(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Reply(`{"fields": [{"fieldId": "city", "value": "Toronto", "confidence": 0.9}]}`))
+
+	res := serve(t, app, newJSONRequest(t, http.MethodPost, "/api/fill-form", map[string]any{
+		"formHTML":               testFormHTML,
+		"documentsExtractedText": "Jane Doe lives in Toronto.",
+	}), testUsername, testPassword)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+	}
+
+	fields, _ := res.body["fields"].([]any)
+	if len(fields) != 1 {
+		t.Fatalf("got %d fields, want 1: %v", len(fields), res.body)
+	}
+	field := fields[0].(map[string]any)
+	if field["fieldId"] != "city" || field["value"] != "Toronto" || field["matchedBy"] != matchedByLLM {
+		t.Errorf("got field %v, want city filled with Toronto by the LLM", field)
+	}
+}
+
+func TestFillFormMalformedReply(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Reply("Here are the fields: city is Toronto."), llmtest.Reply("city: Toronto"))
+
+	res := serve(t, app, newJSONRequest(t, http.MethodPost, "/api/fill-form", map[string]any{
+		"formHTML":               testFormHTML,
+		"documentsExtractedText": "Jane Doe lives in Toronto.",
+	}), testUsername, testPassword)
+	checkProblem(t, res, http.StatusBadGateway, errCodeAIResponseInvalid)
+}
+
+func TestFillFormValidation(t *testing.T) {
+	app, srv := newTestApplication(t)
+
+	res := serve(t, app, newJSONRequest(t, http.MethodPost, "/api/fill-form", map[string]any{"formHTML": " "}), testUsername, testPassword)
+	checkProblem(t, res, http.StatusUnprocessableEntity, errCodeValidationFailed)
+
+	fieldErrors, _ := res.body["fieldErrors"].(map[string]any)
+	for _, field := range []string{"formHTML", "documentsExtractedText"} {
+		if _, ok := fieldErrors[field]; !ok {
+			t.Errorf("got field errors %v, want one for %q", fieldErrors, field)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/fill-form", nil)
+	res = serve(t, app, r, testUsername, testPassword)
+	checkProblem(t, res, http.StatusBadRequest, errCodeBadRequest)
+
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("got %d LLM requests for invalid requests, want 0", n)
+	}
+}
+
+func TestFillFormLLMUnavailable(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Error(http.StatusServiceUnavailable, "overloaded_error", "Overloaded"))
+
+	res := serve(t, app, newJSONRequest(t, http.MethodPost, "/api/fill-form", map[string]any{
+		"formHTML":               testFormHTML,
+		"documentsExtractedText": "Jane Doe lives in Toronto.",
+	}), testUsername, testPassword)
+	checkProblem(t, res, http.StatusServiceUnavailable, errCodeLLMUnavailable)
+}
+
+func TestAuthentication(t *testing.T) {
+	app, srv := newTestApplication(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{name: "OCR without credentials", method: http.MethodPost, target: "/api/ocr", wantStatus: http.StatusUnauthorized},
+		{name: "OCR with wrong password", method: http.MethodPost, target: "/api/ocr", username: testUsername, password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "OCR with wrong user name", method: http.MethodPost, target: "/api/ocr", username: "alice", password: testPassword, wantStatus: http.StatusUnauthorized},
+		{name: "Fill form without credentials", method: http.MethodPost, target: "/api/fill-form", wantStatus: http.StatusUnauthorized},
+		{name: "Fill form with wrong password", method: http.MethodPost, target: "/api/fill-form", username: testUsername, password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "Admin with extension credential", method: http.MethodGet, target: "/admin/form-templates", username: testUsername, password: testPassword, wantStatus: http.StatusUnauthorized},
+		{name: "Admin with admin credential", method: http.MethodGet, target: "/admin/form-templates", username: testAdminUsername, password: testAdminPassword, wantStatus: http.StatusOK},
+		{name: "Status", method: http.MethodGet, target: "/status", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serve(t, app, httptest.NewRequest(tt.method, tt.target, nil), tt.username, tt.password)
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %v", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus == http.StatusUnauthorized {
+				checkProblem(t, res, http.StatusUnauthorized, errCodeAuthenticationRequired)
+				if res.header.Get("WWW-Authenticate") == "" {
+					t.Error("missing WWW-Authenticate header")
+				}
+			}
+		})
+	}
+
+	t.Run("Admin disabled", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		app.config.adminAuth.hashedPassword = ""
+
+		res := serve(t, app, httptest.NewRequest(http.MethodGet, "/admin/form-templates", nil), testAdminUsername, testAdminPassword)
+		checkProblem(t, res, http.StatusNotFound, errCodeNotFound)
+	})
+
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("got %d LLM requests for unauthenticated requests, want 0", n)
+	}
+}
+
+func TestModelScope(t *testing.T) {
+	const model = "claude-haiku-4-5"
+
+	tests := []struct {
+		name          string
+		adminUsername string
+		username      string
+		password      string
+		wantModel     bool
+	}{
+		{name: "Extension credential", username: testUsername, password: testPassword},
+		{name: "Admin credential", username: testAdminUsername, password: testAdminPassword, wantModel: true},
+		{name: "Extension credential sharing the user name", adminUsername: testUsername, username: testUsername, password: testPassword},
+		{name: "Admin credential sharing the user name", adminUsername: testUsername, username: testUsername, password: testAdminPassword, wantModel: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, srv := newTestApplication(t)
+			app.config.llm.allowedModels = []string{model}
+			if tt.adminUsername != "" {
+				app.config.adminAuth.username = tt.adminUsername
+			}
+			srv.Enqueue(llmtest.Reply(testClassification), llmtest.Reply(testExtraction))
+
+			res := serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), map[string]string{"model": model}), tt.username, tt.password)
+			if !tt.wantModel {
+				checkProblem(t, res, http.StatusUnprocessableEntity, errCodeValidationFailed)
+				if fieldErrors, _ := res.body["fieldErrors"].(map[string]any); fieldErrors["model"] == nil {
+					t.Errorf("got field errors %v, want one for the model", fieldErrors)
+				}
+
+				res = serve(t, app, newJSONRequest(t, http.MethodPost, "/api/fill-form", map[string]any{
+					"formHTML":               testFormHTML,
+					"documentsExtractedText": "Jane Doe lives in Toronto.",
+					"model":                  model,
+				}), tt.username, tt.password)
+				checkProblem(t, res, http.StatusUnprocessableEntity, errCodeValidationFailed)
+
+				// The credential works without a model
+				res = serve(t, app, newUploadRequest(t, "/api/ocr", testImage(t), nil), tt.username, tt.password)
+				if res.status != http.StatusOK {
+					t.Errorf("got status %d without a model, want %d: %v", res.status, http.StatusOK, res.body)
+				}
+				return
+			}
+
+			if res.status != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+			}
+			for _, req := range srv.Requests() {
+				if req.Model != model {
+					t.Errorf("got an LLM request for %q, want %q", req.Model, model)
+				}
+			}
+		})
+	}
+}
+
+func TestFillFormOpenAIErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter string
+	}{
+		{name: "Rate limited", status: http.StatusTooManyRequests, retryAfter: "30", wantStatus: http.StatusTooManyRequests, wantCode: errCodeQuotaExceeded, wantRetryAfter: "30"},
+		{name: "Unavailable", status: http.StatusServiceUnavailable, retryAfter: "5", wantStatus: http.StatusServiceUnavailable, wantCode: errCodeLLMUnavailable},
+		{name: "Bad gateway", status: http.StatusBadGateway, wantStatus: http.StatusServiceUnavailable, wantCode: errCodeLLMUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				http.Error(w, `{"error": {"message": "try again later"}}`, tt.status)
+			}))
+			defer srv.Close()
+
+			app, _ := newTestApplication(t)
+			app.llm = llm.NewOpenAI(llm.ProviderOllama, srv.URL, "", "llava", time.Minute)
+
+			res := serve(t, app, newJSONRequest(t, http.MethodPost, "/api/fill-form", map[string]any{
+				"formHTML":               testFormHTML,
+				"documentsExtractedText": "Jane Doe lives in Toronto.",
+			}), testUsername, testPassword)
+			checkProblem(t, res, tt.wantStatus, tt.wantCode)
+
+			if got := res.header.Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(100)
+
+	if n := budget.acquire(60); n != 60 {
+		t.Fatalf("took %d bytes, want 60", n)
+	}
+
+	acquired := make(chan int64)
+	go func() {
+		acquired <- budget.acquire(500)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("a file larger than the free budget was let through")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	budget.release(60)
+
+	select {
+	case n := <-acquired:
+		if n != 100 {
+			t.Errorf("took %d bytes for a file larger than the budget, want the whole budget of 100", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a file was still waiting after the budget was freed")
+	}
+}
+
+func TestOCRBatch(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Reply(testExtraction), llmtest.Reply(testExtraction))
+
+	files := [][]byte{testImage(t), []byte("plain text"), testImage(t)}
+	res := serve(t, app, newBatchRequest(t, files, map[string]string{"documentType": "passport"}), testUsername, testPassword)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %v", res.status, http.StatusOK, res.body)
+	}
+
+	results, _ := res.body["files"].([]any)
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3: %v", len(results), res.body)
+	}
+
+	wantStatuses := []string{batchStatusSuccess, batchStatusError, batchStatusSuccess}
+	for i, want := range wantStatuses {
+		result := results[i].(map[string]any)
+		if result["index"] != float64(i) || result["status"] != want {
+			t.Errorf("got result %v for file %d, want status %s", result, i, want)
+		}
+	}
+
+	problem, _ := results[1].(map[string]any)["error"].(map[string]any)
+	if problem["code"] != errCodeUnsupportedMediaType {
+		t.Errorf("got problem %v for the text file, want %s", problem, errCodeUnsupportedMediaType)
+	}
+
+	stats, _ := res.body["stats"].(map[string]any)
+	if stats["total"] != float64(3) || stats["succeeded"] != float64(2) || stats["failed"] != float64(1) {
+		t.Errorf("got stats %v, want 3 files with 2 succeeded", stats)
+	}
+
+	if n := len(srv.Requests()); n != 2 {
+		t.Errorf("got %d LLM requests, want 2 as the document type skips classification", n)
+	}
+
+	t.Run("Pages", func(t *testing.T) {
+		res := serve(t, app, newBatchRequest(t, [][]byte{testImage(t)}, map[string]string{"pages": "1"}), testUsername, testPassword)
+
+		results, _ := res.body["files"].([]any)
+		if len(results) != 1 {
+			t.Fatalf("got %d results, want 1: %v", len(results), res.body)
+		}
+
+		problem, _ := results[0].(map[string]any)["error"].(map[string]any)
+		fieldErrors, _ := problem["fieldErrors"].(map[string]any)
+		if _, ok := fieldErrors["pages"]; !ok {
+			t.Errorf("got problem %v, want a field error for pages of an image", problem)
+		}
+	})
+}
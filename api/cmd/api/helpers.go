@@ -3,6 +3,11 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gen2brain/go-fitz"
 )
 
 func (app *application) backgroundTask(r *http.Request, fn func() error) {
@@ -24,3 +29,82 @@ func (app *application) backgroundTask(r *http.Request, fn func() error) {
 		}
 	}()
 }
+
+// writePageText appends the text of one page to the text of a document,
+// separating and labelling pages when the document has more than one.
+func writePageText(b *strings.Builder, numPages, pageNum int, pageText string) {
+	if b.Len() > 0 {
+		b.WriteString("\n\n")
+	}
+	if numPages > 1 {
+		fmt.Fprintf(b, "=== Page %d ===\n", pageNum+1)
+	}
+	b.WriteString(pageText)
+}
+
+const (
+	minTextLayerRunes       = 50
+	minTextLayerWordRatio   = 0.6
+	maxTextLayerGarbleRatio = 0.02
+)
+
+// pageTextLayer returns the text embedded in a document page, if the page has
+// a text layer worth using. Scanned pages have no text layer, or one produced
+// by a poor OCR pass or a font without a Unicode mapping, and are left to be
+// rendered and OCRed instead.
+func (app *application) pageTextLayer(doc *fitz.Document, pageNum int) (string, bool) {
+	if !app.config.ocr.useTextLayer {
+		return "", false
+	}
+
+	text, err := doc.Text(pageNum)
+	if err != nil {
+		app.logger.Debug("failed to read text layer", "page", pageNum+1, "error", err.Error())
+		return "", false
+	}
+
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) < minTextLayerRunes {
+		return "", false
+	}
+
+	var visible, wordRunes, garbled int
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			continue
+		case r == utf8.RuneError || unicode.Is(unicode.Co, r) || unicode.IsControl(r):
+			garbled++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			wordRunes++
+		}
+		visible++
+	}
+
+	if visible == 0 ||
+		float64(wordRunes)/float64(visible) < minTextLayerWordRatio ||
+		float64(garbled)/float64(visible) > maxTextLayerGarbleRatio {
+		return "", false
+	}
+
+	return text, true
+}
+
+// trimCodeFence removes the markdown code block that Claude sometimes wraps
+// JSON responses in.
+func trimCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "```json")
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimSuffix(s, "```")
+	return strings.TrimSpace(s)
+}
+
+// ocrProviders returns the OCR providers that requests may select.
+func (app *application) ocrProviders() []string {
+	if app.config.tesseract.enabled {
+		return []string{ocrProviderAnthropic, ocrProviderTesseract}
+	}
+
+	return []string{ocrProviderAnthropic}
+}
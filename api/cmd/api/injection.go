@@ -0,0 +1,149 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+	"dev.danielrb/auto-imm/api/internal/injection"
+)
+
+// Reasons that a filled value can be rejected for.
+const (
+	rejectUnknownField  = "unknown_field"
+	rejectUnknownOption = "unknown_option"
+	rejectTooLong       = "too_long"
+	rejectDuplicate     = "duplicate"
+)
+
+// rejectedField is a value returned by the model that was left out of the
+// filled form, because the form could not take it.
+type rejectedField struct {
+	FieldID string `json:"fieldId"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason"`
+}
+
+// allowListFields checks the values returned by the model against the fields
+// of the form. A prompt injection in a document could get the model to make
+// up fields or values, so a value is only kept if it is for a field of the
+// form, is one of the field's options if it has any, and fits in the field.
+// Select values given as the label of an option are replaced with the
+// option's value.
+func allowListFields(schema []form.Field, fields []filledField) ([]filledField, []rejectedField) {
+	byID := make(map[string]form.Field, len(schema))
+	for _, field := range schema {
+		if _, ok := byID[field.ID]; !ok {
+			byID[field.ID] = field
+		}
+	}
+
+	var (
+		kept     = []filledField{}
+		rejected []rejectedField
+		seen     = make(map[string]bool)
+	)
+
+	for _, f := range fields {
+		field, ok := byID[f.FieldID]
+
+		var reason string
+		switch {
+		case !ok:
+			reason = rejectUnknownField
+		case seen[f.FieldID]:
+			reason = rejectDuplicate
+		case field.MaxLength > 0 && utf8.RuneCountInString(f.Value) > field.MaxLength:
+			reason = rejectTooLong
+		case field.Tag == "select" && len(field.Options) > 0:
+			value, ok := matchOption(field.Options, f.Value)
+			if !ok {
+				reason = rejectUnknownOption
+			}
+			f.Value = value
+		case (field.Type == "radio" || field.Type == "checkbox") && field.Value != "":
+			if f.Value != field.Value {
+				reason = rejectUnknownOption
+			}
+		}
+
+		if reason != "" {
+			rejected = append(rejected, rejectedField{FieldID: f.FieldID, Value: f.Value, Reason: reason})
+			continue
+		}
+
+		seen[f.FieldID] = true
+		kept = append(kept, f)
+	}
+
+	return kept, rejected
+}
+
+// matchOption returns the value of the option with the given value or, failing
+// that, label.
+func matchOption(options []form.Option, value string) (string, bool) {
+	for _, option := range options {
+		if option.Value == value {
+			return option.Value, true
+		}
+	}
+
+	for _, option := range options {
+		if option.Label != "" && strings.EqualFold(option.Label, strings.TrimSpace(value)) {
+			return option.Value, true
+		}
+	}
+
+	return value, false
+}
+
+// scanFillFormInput looks for prompt injection in the form and documents
+// sent to be filled. The form is scanned as it is sent to the model: as its
+// schema if it has one, and otherwise as HTML.
+func scanFillFormInput(input *fillFormInput, schemaJSON string) []injection.Finding {
+	formText := schemaJSON
+	if formText == "" {
+		formText = input.FormHTML
+	}
+
+	var values []string
+	for _, document := range input.Documents {
+		for _, f := range document.Fields {
+			values = append(values, f.Value)
+		}
+	}
+
+	return scanUntrusted(map[string]string{
+		"formHTML":               formText,
+		"documentsExtractedText": input.DocumentsExtractedText,
+		"documents":              strings.Join(values, "\n"),
+	})
+}
+
+// scanUntrusted looks for prompt injection in each named input, and returns
+// the findings in order of input name.
+func scanUntrusted(inputs map[string]string) []injection.Finding {
+	var findings []injection.Finding
+
+	for _, source := range slices.Sorted(maps.Keys(inputs)) {
+		for _, finding := range injection.Scan(inputs[source]) {
+			finding.Source = source
+			findings = append(findings, finding)
+		}
+	}
+
+	return findings
+}
+
+// scanOCRResult looks for prompt injection in the text read from a document,
+// so that documents trying to manipulate the form filling that follows are
+// flagged before they get there.
+func (app *application) scanOCRResult(result *ocrResult) {
+	result.Metadata.InjectionWarnings = scanUntrusted(map[string]string{"text": result.Text})
+
+	for _, finding := range result.Metadata.InjectionWarnings {
+		app.logger.Warn("possible prompt injection in document", "rule", finding.Rule, "excerpt", finding.Excerpt)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+	"dev.danielrb/auto-imm/api/internal/injection"
+
+	"github.com/gen2brain/go-fitz"
+)
+
+// adversarialDir holds the adversarial samples used by cmd/eval.
+const adversarialDir = "../../testdata/adversarial"
+
+func TestScanAdversarialCorpus(t *testing.T) {
+	tests := []struct {
+		sample        string
+		wantDocument  []string
+		wantFormRules []string
+	}{
+		{sample: "clean-passport"},
+		{sample: "passport-ignore-above", wantDocument: []string{injection.RuleIgnoreInstructions}},
+		{sample: "passport-fake-system-prompt", wantDocument: []string{injection.RuleNewInstructions}},
+		{sample: "passport-chat-markup", wantDocument: []string{injection.RuleChatMarkup}},
+		{sample: "passport-invisible-text", wantDocument: []string{injection.RuleRoleChange}},
+		{sample: "passport-fence-escape", wantDocument: []string{injection.RuleNewInstructions}},
+		{sample: "passport-invalid-option", wantDocument: []string{injection.RuleNewInstructions}},
+		{sample: "form-label-injection", wantFormRules: []string{injection.RuleIgnoreInstructions, injection.RuleFieldOverride}},
+	}
+
+	app, _ := newTestApplication(t)
+	app.config.ocr.useTextLayer = true
+
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			dir := filepath.Join(adversarialDir, tt.sample)
+
+			data, err := os.ReadFile(filepath.Join(dir, "passport.pdf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc, err := fitz.NewFromMemory(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer doc.Close()
+
+			text, ok := app.pageTextLayer(doc, 0)
+			if !ok {
+				t.Fatal("the passport has no usable text layer")
+			}
+
+			result := &ocrResult{Text: text}
+			app.scanOCRResult(result)
+			checkRules(t, "document", result.Metadata.InjectionWarnings, tt.wantDocument)
+
+			formPath := filepath.Join(adversarialDir, "form.html")
+			if _, err := os.Stat(filepath.Join(dir, "form.html")); err == nil {
+				formPath = filepath.Join(dir, "form.html")
+			}
+
+			formHTML, err := os.ReadFile(formPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			findings := scanFillFormInput(&fillFormInput{FormHTML: string(formHTML)}, "")
+			checkRules(t, "form", findings, tt.wantFormRules)
+		})
+	}
+}
+
+// checkRules checks that findings match exactly the given rules, in order.
+func checkRules(t *testing.T, source string, findings []injection.Finding, want []string) {
+	t.Helper()
+
+	var rules []string
+	for _, finding := range findings {
+		rules = append(rules, finding.Rule)
+	}
+
+	if !slices.Equal(rules, want) {
+		t.Errorf("got %s rules %q, want %q", source, rules, want)
+	}
+}
+
+func TestAllowListFields(t *testing.T) {
+	schema := []form.Field{
+		{ID: "lastName_input", Tag: "input", Type: "text", MaxLength: 10},
+		{ID: "year_sltDateYear", Tag: "select", Options: []form.Option{{Value: ""}, {Value: "1986", Label: "1986"}, {Value: "1987", Label: "1987"}}},
+		{ID: "month_sltDateMonth", Tag: "select", Options: []form.Option{{Value: "03", Label: "March"}}},
+		{ID: "gender_radio-button-01-input", Tag: "input", Type: "radio", Value: "01"},
+	}
+
+	tests := []struct {
+		name       string
+		field      filledField
+		wantValue  string
+		wantReason string
+	}{
+		{name: "Text", field: filledField{FieldID: "lastName_input", Value: "MARTIN"}, wantValue: "MARTIN"},
+		{name: "Text at max length", field: filledField{FieldID: "lastName_input", Value: "ÉÉÉÉÉÉÉÉÉÉ"}, wantValue: "ÉÉÉÉÉÉÉÉÉÉ"},
+		{name: "Text too long", field: filledField{FieldID: "lastName_input", Value: "MARTIN-DUBOIS"}, wantValue: "MARTIN-DUBOIS", wantReason: rejectTooLong},
+		{name: "Option value", field: filledField{FieldID: "year_sltDateYear", Value: "1986"}, wantValue: "1986"},
+		{name: "Option label", field: filledField{FieldID: "month_sltDateMonth", Value: " march "}, wantValue: "03"},
+		{name: "Not an option", field: filledField{FieldID: "year_sltDateYear", Value: "1850"}, wantValue: "1850", wantReason: rejectUnknownOption},
+		{name: "Radio value", field: filledField{FieldID: "gender_radio-button-01-input", Value: "01"}, wantValue: "01"},
+		{name: "Not the radio value", field: filledField{FieldID: "gender_radio-button-01-input", Value: "09"}, wantValue: "09", wantReason: rejectUnknownOption},
+		{name: "Unknown field", field: filledField{FieldID: "passportNumber_input", Value: "ZZ999999"}, wantValue: "ZZ999999", wantReason: rejectUnknownField},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, rejected := allowListFields(schema, []filledField{tt.field})
+
+			if tt.wantReason == "" {
+				if len(kept) != 1 || len(rejected) != 0 {
+					t.Fatalf("got kept %+v and rejected %+v, want the field kept", kept, rejected)
+				}
+				if kept[0].Value != tt.wantValue {
+					t.Errorf("got value %q, want %q", kept[0].Value, tt.wantValue)
+				}
+				return
+			}
+
+			if len(kept) != 0 || len(rejected) != 1 {
+				t.Fatalf("got kept %+v and rejected %+v, want the field rejected", kept, rejected)
+			}
+			want := rejectedField{FieldID: tt.field.FieldID, Value: tt.wantValue, Reason: tt.wantReason}
+			if rejected[0] != want {
+				t.Errorf("got %+v, want %+v", rejected[0], want)
+			}
+		})
+	}
+
+	t.Run("Duplicate", func(t *testing.T) {
+		kept, rejected := allowListFields(schema, []filledField{
+			{FieldID: "lastName_input", Value: "MARTIN"},
+			{FieldID: "lastName_input", Value: "SMITH"},
+		})
+
+		if len(kept) != 1 || kept[0].Value != "MARTIN" {
+			t.Errorf("got kept %+v, want only the first value", kept)
+		}
+		want := []rejectedField{{FieldID: "lastName_input", Value: "SMITH", Reason: rejectDuplicate}}
+		if !slices.Equal(rejected, want) {
+			t.Errorf("got rejected %+v, want %+v", rejected, want)
+		}
+	})
+}
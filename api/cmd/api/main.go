@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"runtime/debug"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"dev.danielrb/auto-imm/api/assets"
 	"dev.danielrb/auto-imm/api/internal/database"
+	"dev.danielrb/auto-imm/api/internal/formtemplates"
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/prompts"
 	"dev.danielrb/auto-imm/api/internal/version"
 
 	"github.com/lmittmann/tint"
@@ -32,20 +42,75 @@ type config struct {
 		username       string
 		hashedPassword string
 	}
+	// adminAuth is the credential for the /admin endpoints, which are not
+	// served unless its password is set.
+	adminAuth struct {
+		username       string
+		hashedPassword string
+	}
 	db struct {
 		dsn string
 	}
-	anthropic struct {
-		apiKey    string
-		maxTokens int
+	llm struct {
+		provider      string
+		model         string
+		baseURL       string
+		apiKey        string
+		maxTokens     int
+		taskModels    map[string]string
+		fallbackModel string
+		allowedModels []string
+		repair        bool
+		promptCaching bool
+		cassette      struct {
+			mode string
+			dir  string
+		}
+	}
+	prompts struct {
+		version string
+		dir     string
+	}
+	fillForm struct {
+		rules       bool
+		templateDir string
+	}
+	bulk struct {
+		maxFiles     int
+		pollInterval time.Duration
+	}
+	ocr struct {
+		useTextLayer     bool
+		batchMaxFiles    int
+		batchConcurrency int
+		batchMaxMemory   int64
+		fallback         []string
+	}
+	tesseract struct {
+		enabled  bool
+		language string
+	}
+	preprocess struct {
+		anthropic imaging.Options
+		tesseract imaging.Options
 	}
 }
 
 type application struct {
 	config config
 	db     *database.DB
-	logger *slog.Logger
-	wg     sync.WaitGroup
+	llm    llm.Provider
+	// tesseract runs Tesseract for the tesseract provider.
+	tesseract tesseractEngine
+	prompts   *prompts.Store
+	// formTemplates are the templates of known form pages.
+	formTemplates *formtemplates.Registry
+	logger        *slog.Logger
+	wg            sync.WaitGroup
+	// shutdownCtx is cancelled by shutdown when the server stops, to stop
+	// the bulk OCR jobs running in the background.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
 }
 
 func run(logger *slog.Logger) error {
@@ -55,7 +120,59 @@ func run(logger *slog.Logger) error {
 	flag.IntVar(&cfg.httpPort, "http-port", 3233, "port to listen on for HTTP requests")
 	flag.StringVar(&cfg.basicAuth.username, "basic-auth-username", "admin", "basic auth username")
 	flag.StringVar(&cfg.basicAuth.hashedPassword, "basic-auth-hashed-password", "$2a$10$jRb2qniNcoCyQM23T59RfeEQUbgdAXfR6S0scynmKfJa5Gj3arGJa", "basic auth password hashed with bcrpyt")
+	flag.StringVar(&cfg.adminAuth.username, "admin-username", "admin", "basic auth username for the /admin endpoints")
+	flag.StringVar(&cfg.adminAuth.hashedPassword, "admin-hashed-password", "", "basic auth password for the /admin endpoints hashed with bcrypt, which are disabled unless it is set")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "db.sqlite?_foreign_keys=on", "sqlite3 DSN")
+	flag.StringVar(&cfg.llm.provider, "llm-provider", llm.ProviderAnthropic, "LLM provider used for OCR and form filling: anthropic, openai or ollama")
+	flag.StringVar(&cfg.llm.model, "llm-model", "", "LLM model name (defaults to "+llm.DefaultModel+" for anthropic, required otherwise)")
+	flag.StringVar(&cfg.llm.baseURL, "llm-base-url", "", "base URL of the LLM provider's API, e.g. http://localhost:8080/v1 (required for openai, defaults to "+llm.DefaultOllamaURL+" for ollama and to Anthropic's API for anthropic)")
+	taskModels := make(map[string]*string, len(llmTasks))
+	for task, description := range llmTasks {
+		taskModels[task] = flag.String("llm-model-"+task, "", "LLM model used for "+description+" (defaults to -llm-model)")
+	}
+	flag.StringVar(&cfg.llm.fallbackModel, "llm-fallback-model", "", "LLM model to retry a request with when its model is overloaded")
+	allowedModels := flag.String("llm-allowed-models", "", "comma-separated LLM models that requests made with the admin credential may select with the model parameter")
+	flag.BoolVar(&cfg.llm.promptCaching, "llm-prompt-caching", true, "mark the form filling instructions and form fields as cacheable, so that repeated requests for the same form are cheaper (anthropic only)")
+	flag.BoolVar(&cfg.llm.repair, "llm-repair", true, "ask the LLM to repair replies that are not valid JSON, once, before giving up")
+	flag.StringVar(&cfg.llm.cassette.mode, "llm-cassette", "", "record LLM replies to cassettes, or replay them without calling the LLM provider: record or replay")
+	flag.StringVar(&cfg.llm.cassette.dir, "llm-cassette-dir", "testdata/cassettes", "directory of LLM cassettes")
+	flag.StringVar(&cfg.prompts.version, "prompt-version", "v1", "version of the LLM prompts to use, from assets/prompts")
+	flag.StringVar(&cfg.prompts.dir, "prompt-dir", "", "load prompts from this directory, such as assets/prompts, instead of the embedded ones, and reload them on every use (for development)")
+	flag.StringVar(&cfg.fillForm.templateDir, "form-template-dir", "", "directory of form templates, such as assets/forms, to use instead of the embedded ones and to save the templates changed through the admin endpoints to (seeded with the embedded templates if it has none)")
+	flag.BoolVar(&cfg.fillForm.rules, "fill-form-rules", true, "fill the form fields that map directly to extracted passport and identity document fields, such as names and dates of birth, without the LLM")
+	flag.BoolVar(&cfg.ocr.useTextLayer, "pdf-text-layer", true, "use the embedded text layer of PDF pages instead of OCR where possible")
+	flag.BoolVar(&cfg.tesseract.enabled, "tesseract-enabled", false, "enable the offline tesseract OCR provider and the /api/ocr/tesseract endpoint")
+	flag.StringVar(&cfg.tesseract.language, "tesseract-language", "eng", "default tesseract language codes, joined with + (e.g. eng+fra)")
+	flag.IntVar(&cfg.ocr.batchMaxFiles, "ocr-batch-max-files", 20, "maximum number of files in a batch OCR request")
+	flag.IntVar(&cfg.ocr.batchConcurrency, "ocr-batch-concurrency", 4, "number of files in a batch OCR request processed at the same time")
+	flag.Int64Var(&cfg.ocr.batchMaxMemory, "ocr-batch-max-memory", 256, "megabytes of files and decoded images that a batch OCR request may hold in memory at once")
+	flag.IntVar(&cfg.bulk.maxFiles, "bulk-max-files", 500, "maximum number of files in a bulk OCR job")
+	flag.DurationVar(&cfg.bulk.pollInterval, "bulk-poll-interval", time.Minute, "how often to check whether the LLM batches of bulk OCR jobs have ended")
+	fallbackChain := flag.String("ocr-fallback", "anthropic,tesseract", "comma-separated OCR providers to fall back to, in order, when the requested provider is unavailable")
+
+	// Claude downscales anything over 1568px or ~1.15 megapixels itself and
+	// rejects images over 5MB once base64 encoded, so there is no point
+	// sending more than that.
+	preprocessFlags(&cfg.preprocess.anthropic, "anthropic", imaging.Options{
+		MaxDimension: 1568,
+		MaxPixels:    1_150_000,
+		MaxBytes:     3_750_000,
+		Format:       imaging.FormatJPEG,
+		JPEGQuality:  85,
+		MinDPI:       100,
+		MaxDPI:       200,
+		Accept:       []string{imaging.MediaTypeJPEG, imaging.MediaTypePNG, imaging.MediaTypeGIF, imaging.MediaTypeWebP},
+	})
+	// Tesseract is more accurate on large, lossless images and runs locally,
+	// so only guard against absurdly large inputs.
+	preprocessFlags(&cfg.preprocess.tesseract, "tesseract", imaging.Options{
+		MaxDimension: 6000,
+		MaxPixels:    25_000_000,
+		Format:       imaging.FormatPNG,
+		MinDPI:       200,
+		MaxDPI:       300,
+		Accept:       []string{imaging.MediaTypeJPEG, imaging.MediaTypePNG, imaging.MediaTypeGIF, imaging.MediaTypeTIFF},
+	})
 
 	showVersion := flag.Bool("version", false, "display version and exit")
 
@@ -66,12 +183,81 @@ func run(logger *slog.Logger) error {
 		return nil
 	}
 
-	// Read Anthropic API key from environment variable
-	cfg.anthropic.apiKey = os.Getenv("ANTHROPIC_API_KEY")
-	if cfg.anthropic.apiKey == "" {
-		logger.Warn("ANTHROPIC_API_KEY environment variable not set - OCR endpoint will not function")
+	var err error
+	cfg.ocr.fallback, err = parseFallbackChain(*fallbackChain)
+	if err != nil {
+		return err
+	}
+
+	cfg.llm.maxTokens = 4096
+	cfg.llm.allowedModels = parseModelList(*allowedModels)
+	cfg.llm.taskModels = make(map[string]string, len(taskModels))
+	for task, model := range taskModels {
+		cfg.llm.taskModels[task] = strings.TrimSpace(*model)
+	}
+
+	// Read the API key from an environment variable. Self-hosted
+	// OpenAI-compatible servers usually do not need one.
+	if cfg.llm.provider == llm.ProviderAnthropic {
+		cfg.llm.apiKey = os.Getenv("ANTHROPIC_API_KEY")
+	} else {
+		cfg.llm.apiKey = os.Getenv("LLM_API_KEY")
+	}
+
+	var provider llm.Provider
+
+	// Replaying cassettes never calls the provider, so needs no API key
+	if cfg.llm.provider == llm.ProviderAnthropic && cfg.llm.apiKey == "" && cfg.llm.cassette.mode != llm.CassetteReplay {
+		if cfg.tesseract.enabled && slices.Equal(cfg.ocr.fallback, []string{ocrProviderAnthropic, ocrProviderTesseract}) {
+			logger.Warn("ANTHROPIC_API_KEY environment variable not set - OCR endpoint will fall back to " + ocrProviderTesseract)
+		} else {
+			logger.Warn("ANTHROPIC_API_KEY environment variable not set - OCR endpoint will not function")
+		}
+	} else {
+		provider, err = llm.New(llm.Config{
+			Provider: cfg.llm.provider,
+			Model:    cfg.llm.model,
+			BaseURL:  cfg.llm.baseURL,
+			APIKey:   cfg.llm.apiKey,
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info("using llm provider", "provider", provider.Name(), "model", provider.Model())
+
+		if cfg.llm.cassette.mode != "" {
+			provider, err = llm.NewCassette(provider, cfg.llm.cassette.dir, cfg.llm.cassette.mode)
+			if err != nil {
+				return err
+			}
+			logger.Info("using llm cassettes", "mode", cfg.llm.cassette.mode, "dir", cfg.llm.cassette.dir)
+		}
+	}
+
+	var promptFiles fs.FS
+	if cfg.prompts.dir != "" {
+		promptFiles = os.DirFS(cfg.prompts.dir)
+	} else {
+		promptFiles, err = fs.Sub(assets.EmbeddedFiles, "prompts")
+		if err != nil {
+			return err
+		}
+	}
+
+	promptStore, err := prompts.NewStore(promptFiles, cfg.prompts.version, cfg.prompts.dir != "")
+	if err != nil {
+		return err
+	}
+
+	formFiles, err := fs.Sub(assets.EmbeddedFiles, "forms")
+	if err != nil {
+		return err
+	}
+
+	formTemplates, err := formtemplates.New(formFiles, cfg.fillForm.templateDir)
+	if err != nil {
+		return err
 	}
-	cfg.anthropic.maxTokens = 4096
 
 	db, err := database.New(cfg.db.dsn)
 	if err != nil {
@@ -80,10 +266,41 @@ func run(logger *slog.Logger) error {
 	defer db.Close()
 
 	app := &application{
-		config: cfg,
-		db:     db,
-		logger: logger,
+		config:        cfg,
+		db:            db,
+		llm:           provider,
+		tesseract:     gosseractEngine{},
+		prompts:       promptStore,
+		formTemplates: formTemplates,
+		logger:        logger,
+	}
+	app.shutdownCtx, app.shutdown = context.WithCancel(context.Background())
+	defer app.shutdown()
+
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "bulk":
+			return app.bulkCommand(args[1:])
+		default:
+			return fmt.Errorf("unknown command %q", args[0])
+		}
 	}
 
 	return app.serveHTTP()
 }
+
+// preprocessFlags registers the command-line flags controlling how images are
+// prepared for one OCR provider, e.g. -anthropic-image-max-dimension.
+func preprocessFlags(opts *imaging.Options, provider string, defaults imaging.Options) {
+	*opts = defaults
+
+	flag.IntVar(&opts.MaxDimension, provider+"-image-max-dimension", defaults.MaxDimension, "longest image edge in pixels sent to "+provider+" (0 for no limit)")
+	flag.IntVar(&opts.MaxPixels, provider+"-image-max-pixels", defaults.MaxPixels, "largest image area in pixels sent to "+provider+" (0 for no limit)")
+	flag.IntVar(&opts.MaxBytes, provider+"-image-max-bytes", defaults.MaxBytes, "largest encoded image size in bytes sent to "+provider+" (0 for no limit)")
+	flag.IntVar(&opts.JPEGQuality, provider+"-image-jpeg-quality", defaults.JPEGQuality, "starting JPEG quality for images sent to "+provider)
+	flag.IntVar(&opts.MinDPI, provider+"-page-min-dpi", defaults.MinDPI, "lowest resolution document pages are rendered at for "+provider)
+	flag.IntVar(&opts.MaxDPI, provider+"-page-max-dpi", defaults.MaxDPI, "highest resolution document pages are rendered at for "+provider)
+	flag.BoolVar(&opts.Grayscale, provider+"-image-grayscale", defaults.Grayscale, "convert images to grayscale before sending them to "+provider)
+	flag.BoolVar(&opts.NormalizeContrast, provider+"-image-normalize-contrast", defaults.NormalizeContrast, "stretch image contrast before sending images to "+provider)
+	flag.BoolVar(&opts.Deskew, provider+"-image-deskew", defaults.Deskew, "straighten skewed scans before sending them to "+provider)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -45,6 +46,9 @@ func (app *application) logAccess(next http.Handler) http.Handler {
 	})
 }
 
+// requireBasicAuthentication protects the /api endpoints with the credential
+// given to the browser extension. The admin credential is accepted too, and
+// only requests made with it may select a model.
 func (app *application) requireBasicAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username, plaintextPassword, ok := r.BasicAuth()
@@ -53,25 +57,89 @@ func (app *application) requireBasicAuthentication(next http.Handler) http.Handl
 			return
 		}
 
-		if app.config.basicAuth.username != username {
+		// The two credentials may have the same user name
+		admin, err := app.checkCredential(username, plaintextPassword, app.config.adminAuth.username, app.config.adminAuth.hashedPassword)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if admin {
+			next.ServeHTTP(w, contextSetAdmin(r))
+			return
+		}
+
+		valid, err := app.checkCredential(username, plaintextPassword, app.config.basicAuth.username, app.config.basicAuth.hashedPassword)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if !valid {
 			app.basicAuthenticationRequired(w, r)
 			return
 		}
 
-		err := bcrypt.CompareHashAndPassword([]byte(app.config.basicAuth.hashedPassword), []byte(plaintextPassword))
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdminAuthentication protects the /admin endpoints with their own
+// credential, so that the credential given to the browser extension cannot
+// read every client's documents or change the form templates.
+func (app *application) requireAdminAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, plaintextPassword, ok := r.BasicAuth()
+		if !ok {
 			app.basicAuthenticationRequired(w, r)
 			return
-		case err != nil:
+		}
+
+		valid, err := app.checkCredential(username, plaintextPassword, app.config.adminAuth.username, app.config.adminAuth.hashedPassword)
+		if err != nil {
 			app.serverError(w, r, err)
 			return
 		}
+		if !valid {
+			app.basicAuthenticationRequired(w, r)
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, contextSetAdmin(r))
 	})
 }
 
+// checkCredential reports whether a user name and password match a
+// credential. A credential without a password, such as the admin credential
+// when the /admin endpoints are disabled, matches nothing.
+func (app *application) checkCredential(username, plaintextPassword, wantUsername, hashedPassword string) (bool, error) {
+	if hashedPassword == "" || wantUsername != username {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(plaintextPassword))
+	switch {
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+type adminKey struct{}
+
+// contextSetAdmin marks a request as made with the admin credential.
+func contextSetAdmin(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminKey{}, true))
+}
+
+// contextIsAdmin reports whether a request was made with the admin
+// credential.
+func contextIsAdmin(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminKey{}).(bool)
+	return admin
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"dev.danielrb/auto-imm/api/internal/llm"
+)
+
+// Tasks that are sent to the LLM. Each can be routed to a different model.
+const (
+	taskClassify = "classify"
+	taskExtract  = "extract"
+	taskMatch    = "match"
+	taskRepair   = "repair"
+)
+
+// llmTasks describes each task, for the flags that select their models.
+var llmTasks = map[string]string{
+	taskClassify: "classifying document pages",
+	taskExtract:  "extracting text and fields from documents",
+	taskMatch:    "matching extracted values to form fields",
+	taskRepair:   "repairing replies that are not valid JSON",
+}
+
+// parseModelList parses a comma-separated list of model names.
+func parseModelList(value string) []string {
+	var models []string
+
+	for _, model := range strings.Split(value, ",") {
+		model = strings.TrimSpace(model)
+		if model != "" && !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	}
+
+	return models
+}
+
+// allowedModels returns the models that a request may select with its model
+// parameter. Only requests made with the admin credential may select one, as
+// the credential given to the browser extension is shared by all its users.
+func (app *application) allowedModels(r *http.Request) []string {
+	if !contextIsAdmin(r) {
+		return nil
+	}
+
+	return app.config.llm.allowedModels
+}
+
+// modelRouting holds the model that a client selected for a request, if any,
+// and records the models that served each of its tasks and the tokens they
+// used, so that they can be reported in the response.
+type modelRouting struct {
+	override string
+
+	mu    sync.Mutex
+	used  map[string][]string
+	usage llm.Usage
+}
+
+type modelRoutingKey struct{}
+
+// withModelRouting returns a context that routes the LLM requests made with it
+// to model, if set, instead of to the configured models.
+func withModelRouting(ctx context.Context, model string) (context.Context, *modelRouting) {
+	routing := &modelRouting{override: model}
+	return context.WithValue(ctx, modelRoutingKey{}, routing), routing
+}
+
+func contextModelRouting(ctx context.Context) *modelRouting {
+	routing, _ := ctx.Value(modelRoutingKey{}).(*modelRouting)
+	return routing
+}
+
+func (r *modelRouting) record(task, model string, usage llm.Usage) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.usage.Add(usage)
+
+	if r.used == nil {
+		r.used = make(map[string][]string)
+	}
+	if !slices.Contains(r.used[task], model) {
+		r.used[task] = append(r.used[task], model)
+	}
+}
+
+// models returns the models used for each task, or nil if the LLM was not
+// used.
+func (r *modelRouting) models() map[string][]string {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.used) == 0 {
+		return nil
+	}
+
+	models := make(map[string][]string, len(r.used))
+	for task, used := range r.used {
+		models[task] = slices.Clone(used)
+	}
+
+	return models
+}
+
+// tokens returns the tokens used by the request, or nil if the LLM was not
+// used.
+func (r *modelRouting) tokens() *llm.Usage {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.used) == 0 {
+		return nil
+	}
+
+	usage := r.usage
+	return &usage
+}
+
+// modelFor returns the model that a task is sent to: the one selected for the
+// request, otherwise the one configured for the task, otherwise the
+// provider's default.
+func (app *application) modelFor(ctx context.Context, task string) string {
+	if routing := contextModelRouting(ctx); routing != nil && routing.override != "" {
+		return routing.override
+	}
+
+	if model := app.config.llm.taskModels[task]; model != "" {
+		return model
+	}
+
+	return app.llm.Model()
+}
+
+// complete sends a request for a task to its model. If the model is
+// overloaded, the request is sent once more to the fallback model.
+func (app *application) complete(ctx context.Context, task string, req llm.Request) (string, error) {
+	req.Model = app.modelFor(ctx, task)
+
+	response, err := app.llm.Complete(ctx, req)
+
+	fallback := app.config.llm.fallbackModel
+	if llm.Overloaded(err) && fallback != "" && fallback != req.Model && ctx.Err() == nil {
+		app.logger.Warn("llm model overloaded, falling back", "task", task, "model", req.Model, "fallback", fallback)
+		req.Model = fallback
+		response, err = app.llm.Complete(ctx, req)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	usage := response.Usage
+	app.logger.Info("llm usage", "task", task, "model", req.Model, "inputTokens", usage.InputTokens, "outputTokens", usage.OutputTokens, "cacheReadTokens", usage.CacheReadTokens, "cacheCreationTokens", usage.CacheCreationTokens)
+
+	contextModelRouting(ctx).record(task, req.Model, usage)
+
+	return response.Text, nil
+}
+
+// parseWithRepair parses a reply from the LLM. If it cannot be parsed, the
+// repair model is asked once to fix it, and the repaired reply is parsed
+// instead. If that fails too, the original error is returned.
+func (app *application) parseWithRepair(ctx context.Context, responseText string, parse func(string) error) error {
+	err := parse(responseText)
+	if err == nil || !app.config.llm.repair {
+		return err
+	}
+
+	prompt, promptErr := app.prompts.Execute("repair.tmpl", struct {
+		Response string
+		Error    string
+	}{responseText, err.Error()})
+	if promptErr != nil {
+		return promptErr
+	}
+
+	repaired, repairErr := app.complete(ctx, taskRepair, llm.Request{
+		MaxTokens: app.config.llm.maxTokens,
+		Parts:     []llm.Part{llm.Text(prompt)},
+	})
+	if repairErr != nil {
+		app.logger.Warn("failed to repair llm response", "error", repairErr.Error())
+		return err
+	}
+
+	if parse(repaired) != nil {
+		app.logger.Warn("repaired llm response is still invalid", "error", err.Error())
+		return err
+	}
+
+	app.logger.Info("repaired llm response")
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"dev.danielrb/auto-imm/api/internal/response"
+)
+
+// Stages reported in "stage" events.
+const (
+	stageUploaded      = "uploaded"
+	stagePageRendered  = "page_rendered"
+	stageClassified    = "classified"
+	stagePageExtracted = "page_extracted"
+	stageMatching      = "matching"
+	stageFallback      = "fallback"
+	stageDone          = "done"
+)
+
+// Names of the events sent in an event stream.
+const (
+	eventStage  = "stage"
+	eventPage   = "page"
+	eventResult = "result"
+	eventError  = "error"
+)
+
+// heartbeatInterval is how often a comment is written to an idle event stream
+// so that proxies do not close the connection.
+const heartbeatInterval = 15 * time.Second
+
+type stageEvent struct {
+	Stage string `json:"stage"`
+	Page  int    `json:"page,omitempty"`
+	Pages int    `json:"pages,omitempty"`
+}
+
+type pageEvent struct {
+	Page int    `json:"page"`
+	Text string `json:"text"`
+}
+
+// progressReporter receives progress events while a request is processed. It
+// is nil unless the client asked for an event stream, in which case reporting
+// progress does nothing.
+type progressReporter func(event string, data any)
+
+func (p progressReporter) stage(stage string, page, pages int) {
+	if p != nil {
+		p(eventStage, stageEvent{Stage: stage, Page: page, Pages: pages})
+	}
+}
+
+func (p progressReporter) pageText(page int, text string) {
+	if p != nil {
+		p(eventPage, pageEvent{Page: page, Text: text})
+	}
+}
+
+// wantsEventStream reports whether the client asked for the response as
+// Server-Sent Events.
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamEvents runs fn while streaming the progress it reports to the client
+// as Server-Sent Events. The stream ends with a "done" stage and a "result"
+// event holding the value returned by fn, or with an "error" event holding
+// the problem that problemFor maps the error onto.
+func (app *application) streamEvents(w http.ResponseWriter, r *http.Request, fn func(progress progressReporter) (any, error), problemFor func(err error) response.Problem) {
+	stream, err := response.NewEventStream(w, defaultWriteTimeout)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	progress := func(event string, data any) {
+		err := stream.Send(event, data)
+		if err != nil {
+			app.logger.Warn("failed to send event", "event", event, "error", err.Error())
+		}
+	}
+
+	// The heartbeat is stopped, and waited for, before returning, so that it
+	// cannot write to the response once the handler has returned
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_ = stream.Comment("heartbeat")
+			}
+		}
+	}()
+
+	// The headers have been sent, so a panic is reported as an error event
+	// rather than left to recoverPanic, which would write a problem response
+	defer func() {
+		pv := recover()
+		if pv != nil {
+			app.reportServerError(r, fmt.Errorf("%v", pv))
+			progress(eventError, app.problem(r, http.StatusInternalServerError, errCodeServerError, serverErrorMessage))
+		}
+	}()
+
+	result, err := fn(progress)
+	if err != nil {
+		progress(eventError, problemFor(err))
+		return
+	}
+
+	progressReporter(progress).stage(stageDone, 0, 0)
+	progress(eventResult, result)
+}
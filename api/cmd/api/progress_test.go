@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dev.danielrb/auto-imm/api/internal/llm/llmtest"
+	"dev.danielrb/auto-imm/api/internal/response"
+)
+
+// readEventStream sends a request and returns the response, with its body
+// read in full.
+func readEventStream(t *testing.T, h http.Handler, r *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	r.RequestURI = ""
+	r.URL.Scheme = "http"
+	r.URL.Host = srv.Listener.Addr().String()
+	r.Header.Set("Accept", "text/event-stream")
+
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+func TestOCREventStream(t *testing.T) {
+	app, srv := newTestApplication(t)
+	srv.Enqueue(llmtest.Reply(testClassification), llmtest.Reply(testExtraction))
+
+	r := newUploadRequest(t, "/api/ocr", testImage(t), nil)
+	r.SetBasicAuth(testUsername, testPassword)
+
+	resp, body := readEventStream(t, app.routes(), r)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d and content type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var events []string
+	for _, line := range strings.Split(body, "\n") {
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, event)
+		}
+	}
+	if len(events) < 2 || events[len(events)-2] != eventStage || events[len(events)-1] != eventResult {
+		t.Errorf("got events %q, want them to end with the done stage and the result", events)
+	}
+	if !strings.Contains(body, `"stage":"done"`) {
+		t.Errorf("got stream %q, want a done stage", body)
+	}
+}
+
+func TestStreamEventsError(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	tests := []struct {
+		name     string
+		fn       func(progress progressReporter) (any, error)
+		wantCode string
+	}{
+		{
+			name: "Error",
+			fn: func(progress progressReporter) (any, error) {
+				return nil, errAIResponseInvalid
+			},
+			wantCode: errCodeAIResponseInvalid,
+		},
+		{
+			name: "Panic",
+			fn: func(progress progressReporter) (any, error) {
+				progress.stage(stageUploaded, 0, 0)
+				panic("something went wrong")
+			},
+			wantCode: errCodeServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				app.streamEvents(w, r, tt.fn, func(err error) response.Problem {
+					if errors.Is(err, errAIResponseInvalid) {
+						return app.aiResponseInvalidProblem(r, err)
+					}
+					return app.problem(r, http.StatusInternalServerError, errCodeServerError, serverErrorMessage)
+				})
+			}))
+
+			resp, body := readEventStream(t, h, httptest.NewRequest(http.MethodPost, "/api/ocr", nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+
+			if !strings.Contains(body, "event: "+eventError+"\n") || !strings.Contains(body, `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("got stream %q, want an error event with code %s", body, tt.wantCode)
+			}
+			if strings.Count(body, "event: ") != strings.Count(body, "\n\n") {
+				t.Errorf("got stream %q, want nothing but events", body)
+			}
+		})
+	}
+}
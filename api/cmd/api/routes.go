@@ -13,8 +13,26 @@ func (app *application) routes() http.Handler {
 	mux.Handle("GET /restricted-basic-auth", app.requireBasicAuthentication(http.HandlerFunc(app.restricted)))
 
 	mux.Handle("POST /api/ocr", app.requireBasicAuthentication(http.HandlerFunc(app.extractTextFromImage)))
+	mux.Handle("POST /api/classify", app.requireBasicAuthentication(http.HandlerFunc(app.classifyUpload)))
+	mux.Handle("POST /api/documents/split", app.requireBasicAuthentication(http.HandlerFunc(app.splitDocument)))
+	mux.Handle("POST /api/ocr/batch", app.requireBasicAuthentication(http.HandlerFunc(app.extractTextFromImages)))
 	mux.Handle("POST /api/fill-form", app.requireBasicAuthentication(http.HandlerFunc(app.fillForm)))
-	// mux.Handle("POST /api/ocr/tesseract", app.requireBasicAuthentication(http.HandlerFunc(app.extractTextFromImageTesseract)))
+
+	if app.config.adminAuth.hashedPassword != "" {
+		mux.Handle("POST /admin/bulk-jobs", app.requireAdminAuthentication(http.HandlerFunc(app.createBulkJobHandler)))
+		mux.Handle("GET /admin/bulk-jobs", app.requireAdminAuthentication(http.HandlerFunc(app.listBulkJobs)))
+		mux.Handle("GET /admin/bulk-jobs/{id}", app.requireAdminAuthentication(http.HandlerFunc(app.showBulkJob)))
+		mux.Handle("GET /admin/documents/{id}", app.requireAdminAuthentication(http.HandlerFunc(app.showDocument)))
+		mux.Handle("GET /admin/form-templates", app.requireAdminAuthentication(http.HandlerFunc(app.listFormTemplates)))
+		mux.Handle("POST /admin/form-templates/fingerprint", app.requireAdminAuthentication(http.HandlerFunc(app.fingerprintForm)))
+		mux.Handle("GET /admin/form-templates/{id}", app.requireAdminAuthentication(http.HandlerFunc(app.showFormTemplate)))
+		mux.Handle("PUT /admin/form-templates/{id}", app.requireAdminAuthentication(http.HandlerFunc(app.saveFormTemplate)))
+		mux.Handle("DELETE /admin/form-templates/{id}", app.requireAdminAuthentication(http.HandlerFunc(app.deleteFormTemplate)))
+	}
+
+	if app.config.tesseract.enabled {
+		mux.Handle("POST /api/ocr/tesseract", app.requireBasicAuthentication(http.HandlerFunc(app.extractTextFromImageTesseract)))
+	}
 
 	return app.enableCORS(app.logAccess(app.recoverPanic(mux)))
 }
@@ -36,15 +36,22 @@ func (app *application) serveHTTP() error {
 		signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
 		<-quitChan
 
+		app.shutdown()
+
 		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
 		defer cancel()
 
 		shutdownErrorChan <- srv.Shutdown(ctx)
 	}()
 
+	err := app.resumeBulkJobs()
+	if err != nil {
+		return err
+	}
+
 	app.logger.Info("starting server", slog.Group("server", "addr", srv.Addr))
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
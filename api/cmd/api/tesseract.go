@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+
+	"github.com/otiai10/gosseract/v2"
+)
+
+// tesseractOptions are the per-request settings for the Tesseract provider.
+type tesseractOptions struct {
+	// Language is one or more Tesseract language codes joined with "+".
+	Language string
+	// Output is ocrOutputText, ocrOutputLayout or ocrOutputHOCR.
+	Output string
+}
+
+// tesseractPage is the result of running Tesseract over one image.
+type tesseractPage struct {
+	Text   string
+	Layout *pageLayout
+}
+
+// pageLayout describes where the text on a page was found. Lines and words
+// are only set for the layout output, and HOCR only for the hocr output.
+type pageLayout struct {
+	Page  int          `json:"page"`
+	Lines []layoutLine `json:"lines,omitempty"`
+	HOCR  string       `json:"hocr,omitempty"`
+}
+
+type layoutLine struct {
+	Text        string       `json:"text"`
+	Confidence  float64      `json:"confidence"`
+	BoundingBox boundingBox  `json:"boundingBox"`
+	Words       []layoutWord `json:"words"`
+}
+
+type layoutWord struct {
+	Text        string      `json:"text"`
+	Confidence  float64     `json:"confidence"`
+	BoundingBox boundingBox `json:"boundingBox"`
+}
+
+// checkTesseractLanguage returns errLanguageNotFound if the trained data for
+// any of the languages is not installed.
+func (app *application) checkTesseractLanguage(language string) error {
+	available, err := app.tesseract.Languages()
+	if err != nil {
+		return err
+	}
+
+	for _, lang := range strings.Split(language, "+") {
+		if !slices.Contains(available, lang) {
+			return fmt.Errorf("%w: %s", errLanguageNotFound, lang)
+		}
+	}
+
+	return nil
+}
+
+// tesseractEngine runs Tesseract over images, so that tests can stand in for
+// it where it is not installed.
+type tesseractEngine interface {
+	// Languages returns the codes of the languages whose trained data is
+	// installed.
+	Languages() ([]string, error)
+	Recognize(imageData []byte, width, height int, opts tesseractOptions) (tesseractPage, error)
+}
+
+// gosseractEngine runs the Tesseract library through gosseract.
+type gosseractEngine struct{}
+
+func (gosseractEngine) Languages() ([]string, error) {
+	return gosseract.GetAvailableLanguages()
+}
+
+// Recognize extracts the text from an image. The width and height of the
+// image are used to report word and line positions as fractions of the page.
+func (gosseractEngine) Recognize(imageData []byte, width, height int, opts tesseractOptions) (tesseractPage, error) {
+	client := gosseract.NewClient()
+	defer client.Close()
+
+	err := client.SetLanguage(strings.Split(opts.Language, "+")...)
+	if err != nil {
+		return tesseractPage{}, err
+	}
+
+	// Set image from bytes
+	if err := client.SetImageFromBytes(imageData); err != nil {
+		return tesseractPage{}, fmt.Errorf("invalid image format: %w", err)
+	}
+
+	var page tesseractPage
+
+	page.Text, err = client.Text()
+	if err != nil {
+		return tesseractPage{}, fmt.Errorf("OCR processing failed: %w", err)
+	}
+
+	switch opts.Output {
+	case ocrOutputLayout:
+		boxes, err := client.GetBoundingBoxesVerbose()
+		if err != nil {
+			return tesseractPage{}, fmt.Errorf("OCR layout analysis failed: %w", err)
+		}
+		page.Layout = &pageLayout{Lines: layoutLines(boxes, width, height)}
+	case ocrOutputHOCR:
+		hocr, err := client.HOCRText()
+		if err != nil {
+			return tesseractPage{}, fmt.Errorf("OCR layout analysis failed: %w", err)
+		}
+		page.Layout = &pageLayout{HOCR: hocr}
+	}
+
+	return page, nil
+}
+
+// layoutLines groups the words Tesseract found into lines. Tesseract reports
+// confidences from 0 to 100 and boxes in pixels, which are converted to the
+// 0 to 1 scale and page fractions used by extracted fields.
+func layoutLines(boxes []gosseract.BoundingBox, width, height int) []layoutLine {
+	type lineKey struct{ block, par, line int }
+
+	var (
+		lines   []layoutLine
+		bounds  []image.Rectangle
+		current lineKey
+	)
+
+	for _, box := range boxes {
+		word := strings.TrimSpace(box.Word)
+		if word == "" {
+			continue
+		}
+
+		key := lineKey{box.BlockNum, box.ParNum, box.LineNum}
+		if len(lines) == 0 || key != current {
+			lines = append(lines, layoutLine{})
+			bounds = append(bounds, box.Box)
+			current = key
+		}
+
+		i := len(lines) - 1
+		lines[i].Words = append(lines[i].Words, layoutWord{
+			Text:        word,
+			Confidence:  box.Confidence / 100,
+			BoundingBox: pageFraction(box.Box, width, height),
+		})
+		bounds[i] = bounds[i].Union(box.Box)
+	}
+
+	for i := range lines {
+		words := make([]string, len(lines[i].Words))
+		var confidence float64
+		for j, word := range lines[i].Words {
+			words[j] = word.Text
+			confidence += word.Confidence
+		}
+
+		lines[i].Text = strings.Join(words, " ")
+		lines[i].Confidence = confidence / float64(len(words))
+		lines[i].BoundingBox = pageFraction(bounds[i], width, height)
+	}
+
+	return lines
+}
+
+func pageFraction(r image.Rectangle, width, height int) boundingBox {
+	if width == 0 || height == 0 {
+		return boundingBox{}
+	}
+
+	w, h := float64(width), float64(height)
+	return boundingBox{
+		X:      float64(r.Min.X) / w,
+		Y:      float64(r.Min.Y) / h,
+		Width:  float64(r.Dx()) / w,
+		Height: float64(r.Dy()) / h,
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"dev.danielrb/auto-imm/api/assets"
+	"dev.danielrb/auto-imm/api/internal/formtemplates"
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/llm"
+	"dev.danielrb/auto-imm/api/internal/llm/llmtest"
+	"dev.danielrb/auto-imm/api/internal/prompts"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credentials of the applications made by newTestApplication.
+const (
+	testUsername      = "admin"
+	testPassword      = "pa55word"
+	testAdminUsername = "root"
+	testAdminPassword = "s3cret"
+)
+
+// newTestApplication returns an application configured as it is by default,
+// with the Anthropic provider pointed at a fake Messages API that does not
+// retry failed requests.
+func newTestApplication(t *testing.T) (*application, *llmtest.Server) {
+	t.Helper()
+
+	srv := llmtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	app := &application{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		llm:       llm.NewAnthropic("test", llm.DefaultModel, option.WithBaseURL(srv.URL), option.WithMaxRetries(0)),
+		tesseract: &fakeTesseract{},
+	}
+	app.shutdownCtx, app.shutdown = context.WithCancel(context.Background())
+	t.Cleanup(app.shutdown)
+
+	app.config.basicAuth.username = testUsername
+	app.config.basicAuth.hashedPassword = hashPassword(t, testPassword)
+	app.config.adminAuth.username = testAdminUsername
+	app.config.adminAuth.hashedPassword = hashPassword(t, testAdminPassword)
+	app.config.llm.maxTokens = 4096
+	app.config.ocr.batchConcurrency = 4
+	app.config.ocr.batchMaxFiles = 20
+	app.config.ocr.batchMaxMemory = 256
+	app.config.llm.repair = true
+	app.config.fillForm.rules = true
+	app.config.preprocess.anthropic = imaging.Options{
+		MaxDimension: 1568,
+		MaxPixels:    1_150_000,
+		MaxBytes:     3_750_000,
+		Format:       imaging.FormatJPEG,
+		JPEGQuality:  85,
+		MinDPI:       100,
+		MaxDPI:       200,
+		Accept:       []string{imaging.MediaTypeJPEG, imaging.MediaTypePNG, imaging.MediaTypeGIF, imaging.MediaTypeWebP},
+	}
+
+	promptFiles, err := fs.Sub(assets.EmbeddedFiles, "prompts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.prompts, err = prompts.NewStore(promptFiles, "v1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	formFiles, err := fs.Sub(assets.EmbeddedFiles, "forms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.formTemplates, err = formtemplates.New(formFiles, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app, srv
+}
+
+// fakeTesseract stands in for Tesseract, reading the same text from every
+// image, or failing with err if it is set.
+type fakeTesseract struct {
+	text string
+	err  error
+}
+
+func (f *fakeTesseract) Languages() ([]string, error) {
+	return []string{"eng", "fra"}, nil
+}
+
+func (f *fakeTesseract) Recognize(imageData []byte, width, height int, opts tesseractOptions) (tesseractPage, error) {
+	if f.err != nil {
+		return tesseractPage{}, f.err
+	}
+	return tesseractPage{Text: f.text}, nil
+}
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(hash)
+}
+
+// testResponse is a response recorded by serve, with its body decoded.
+type testResponse struct {
+	status int
+	header http.Header
+	body   map[string]any
+}
+
+// serve sends a request through the application's routes, with the given
+// basic auth credentials unless the user name is empty. The request goes
+// over a real connection, as handlers such as the batch handler set
+// deadlines on it.
+func serve(t *testing.T, app *application, r *http.Request, username, password string) testResponse {
+	t.Helper()
+
+	if username != "" {
+		r.SetBasicAuth(username, password)
+	}
+
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	r.RequestURI = ""
+	r.URL.Scheme = "http"
+	r.URL.Host = srv.Listener.Addr().String()
+
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := testResponse{status: resp.StatusCode, header: resp.Header}
+	if len(body) > 0 {
+		err := json.Unmarshal(body, &res.body)
+		if err != nil {
+			t.Fatalf("response is not a JSON object: %v: %s", err, body)
+		}
+	}
+
+	return res
+}
+
+// newJSONRequest returns a request with data encoded as its JSON body.
+func newJSONRequest(t *testing.T, method, target string, data any) *http.Request {
+	t.Helper()
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// newUploadRequest returns a multipart request that uploads a file in the
+// "file" field, along with the given form values.
+func newUploadRequest(t *testing.T, target string, file []byte, values map[string]string) *http.Request {
+	t.Helper()
+
+	return newNamedUploadRequest(t, target, "upload", "application/octet-stream", file, values)
+}
+
+// newNamedUploadRequest is newUploadRequest for a file with the given name
+// and declared content type.
+func newNamedUploadRequest(t *testing.T, target, filename, contentType string, file []byte, values map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+	header.Set("Content-Type", contentType)
+
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range values {
+		err = mw.WriteField(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// newBatchRequest returns a multipart request that uploads each file in a
+// "file" field, along with the given form values.
+func newBatchRequest(t *testing.T, files [][]byte, values map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for i, file := range files {
+		part, err := mw.CreateFormFile("file", fmt.Sprintf("upload%d", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = part.Write(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, value := range values {
+		err := mw.WriteField(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/ocr/batch", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// testImage returns a small PNG image.
+func testImage(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 64, 40))
+	for x := 8; x < 56; x++ {
+		img.SetGray(x, 20, color.Gray{Y: 255})
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// testImageDeclaring returns a small PNG image whose header declares the
+// given size, as a decompression bomb would.
+func testImageDeclaring(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+
+	data := testImage(t)
+
+	// The IHDR chunk follows the 8-byte signature, with its length and type
+	// before its data and a CRC of the type and data after it.
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	return data
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+	"dev.danielrb/auto-imm/api/internal/formtemplates"
+	"dev.danielrb/auto-imm/api/internal/imaging"
+	"dev.danielrb/auto-imm/api/internal/request"
+	"dev.danielrb/auto-imm/api/internal/validator"
+)
+
+const (
+	ocrProviderAnthropic = "anthropic"
+	ocrProviderTesseract = "tesseract"
+)
+
+// Outputs available from the Tesseract provider.
+const (
+	ocrOutputText   = "text"
+	ocrOutputLayout = "layout"
+	ocrOutputHOCR   = "hocr"
+)
+
+var (
+	ocrOutputs    = []string{ocrOutputText, ocrOutputLayout, ocrOutputHOCR}
+	ocrMediaTypes = []string{
+		imaging.MediaTypeJPEG, imaging.MediaTypePNG, imaging.MediaTypeGIF, imaging.MediaTypeWebP,
+		imaging.MediaTypeTIFF, imaging.MediaTypeHEIC, imaging.MediaTypePDF,
+	}
+)
+
+const (
+	maxFilenameRunes          = 255
+	maxPages                  = 200
+	maxFormHTMLRunes          = 500_000
+	maxDocumentsTextRunes     = 200_000
+	maxDocuments              = 100
+	maxExtractedFields        = 2000
+	maxPageRangeSpecification = 100
+	maxLanguageRunes          = 100
+	maxTemplateNameRunes      = 200
+	maxTemplateFields         = 500
+)
+
+// maxFormJSONBytes is the largest JSON body holding a form's HTML. It fits
+// formHTML and documentsExtractedText at their limits, even with four bytes
+// per rune, along with the documents.
+const maxFormJSONBytes = 8 << 20
+
+var (
+	errPagesOutOfRange   = errors.New("selected pages exceed the number of pages in the document")
+	errInvalidPageRanges = errors.New("must be a list of page numbers or ranges such as 1-3,5")
+	errLanguageNotFound  = errors.New("tesseract language data is not installed")
+)
+
+// tesseractLanguageRX matches one or more Tesseract language codes joined with
+// "+", such as "eng" or "eng+fra+chi_sim".
+var tesseractLanguageRX = regexp.MustCompile(`^[a-z][a-z_]*(\+[a-z][a-z_]*)*$`)
+
+type ocrInput struct {
+	File       *request.File
+	MediaType  string
+	Provider   string
+	Pages      string
+	pageRanges pageRanges
+	// DocumentType skips classification when the client already knows what
+	// kind of document it is uploading.
+	DocumentType string
+	// Mode is empty, or ocrModeConsensus to run both providers.
+	Mode string
+	// Language and Output are only used by the Tesseract provider.
+	Language string
+	Output   string
+	// Model overrides the configured LLM models for this request. It must be
+	// one of models.
+	Model     string
+	models    []string
+	providers []string
+	Validator validator.Validator
+}
+
+func (app *application) newOCRInput(r *http.Request, file *request.File, provider, pages string) *ocrInput {
+	if provider == "" {
+		provider = ocrProviderAnthropic
+	}
+
+	return &ocrInput{
+		File:      file,
+		MediaType: imaging.DetectMediaType(file.Data),
+		Provider:  provider,
+		Pages:     pages,
+		models:    app.allowedModels(r),
+		providers: app.ocrProviders(),
+	}
+}
+
+func (input *ocrInput) validate() {
+	v := &input.Validator
+
+	v.CheckField(input.File.Size > 0, "file", "File must not be empty")
+	v.CheckField(validator.MaxRunes(input.File.Filename, maxFilenameRunes), "file", fmt.Sprintf("Filename must not be more than %d characters", maxFilenameRunes))
+
+	v.CheckField(validator.In(input.Provider, input.providers...), "provider", fmt.Sprintf("Provider must be one of: %s", strings.Join(input.providers, ", ")))
+
+	if input.Mode != "" {
+		v.CheckField(input.Mode == ocrModeConsensus, "mode", fmt.Sprintf("Mode must be %s", ocrModeConsensus))
+		v.CheckField(validator.In(ocrProviderTesseract, input.providers...), "mode", "Mode consensus requires the tesseract provider to be enabled")
+		v.CheckField(input.Provider == ocrProviderAnthropic, "provider", "Provider cannot be selected in consensus mode")
+	}
+
+	if input.Provider == ocrProviderTesseract {
+		v.CheckField(input.Output == "" || validator.In(input.Output, ocrOutputs...), "output", fmt.Sprintf("Output must be one of: %s", strings.Join(ocrOutputs, ", ")))
+	} else {
+		v.CheckField(input.Output == "" || input.Output == ocrOutputText, "output", "Output can only be selected for the tesseract provider")
+	}
+
+	if input.Provider == ocrProviderTesseract || input.Mode == ocrModeConsensus {
+		v.CheckField(validator.MaxRunes(input.Language, maxLanguageRunes), "language", fmt.Sprintf("Language must not be more than %d characters", maxLanguageRunes))
+		v.CheckField(input.Language == "" || validator.Matches(input.Language, tesseractLanguageRX), "language", "Language must be one or more Tesseract language codes joined with +, such as eng+fra")
+	} else {
+		v.CheckField(input.Language == "", "language", "Language can only be selected for the tesseract provider")
+	}
+
+	if input.Model != "" {
+		v.CheckField(input.Provider == ocrProviderAnthropic, "model", "Model can only be selected for the anthropic provider")
+		checkModel(v, input.Model, input.models)
+	}
+
+	if input.Pages != "" {
+		v.CheckField(imaging.IsPaged(input.MediaType), "pages", "Pages can only be selected for PDF and TIFF files")
+		v.CheckField(validator.MaxRunes(input.Pages, maxPageRangeSpecification), "pages", fmt.Sprintf("Pages must not be more than %d characters", maxPageRangeSpecification))
+
+		ranges, err := parsePageRanges(input.Pages)
+		if err != nil {
+			v.AddFieldError("pages", "Pages "+err.Error())
+		} else {
+			v.CheckField(ranges.last() <= maxPages, "pages", fmt.Sprintf("Pages must not exceed %d", maxPages))
+			input.pageRanges = ranges
+		}
+	}
+
+	if input.DocumentType != "" {
+		v.CheckField(validator.In(input.DocumentType, documentTypeNames()...), "documentType", fmt.Sprintf("Document type must be one of: %s", strings.Join(documentTypeNames(), ", ")))
+	}
+}
+
+type bulkJobInput struct {
+	Files []*request.File
+	// DocumentType skips classification when every file is the same kind
+	// of document.
+	DocumentType string
+	// Model overrides the configured LLM models for the job. It must be one
+	// of models.
+	Model     string
+	models    []string
+	Validator validator.Validator
+}
+
+// newBulkJobInput returns the input of a bulk job. Jobs are only started with
+// the admin credential or from the command line, so they may select any of
+// the allowed models.
+func (app *application) newBulkJobInput() *bulkJobInput {
+	return &bulkJobInput{models: app.config.llm.allowedModels}
+}
+
+func (input *bulkJobInput) validate() {
+	v := &input.Validator
+
+	v.CheckField(len(input.Files) > 0, "file", "At least one file must be provided")
+
+	for _, file := range input.Files {
+		v.CheckField(file.Size > 0, "file", fmt.Sprintf("File %q must not be empty", file.Filename))
+		v.CheckField(validator.MaxRunes(file.Filename, maxFilenameRunes), "file", fmt.Sprintf("Filenames must not be more than %d characters", maxFilenameRunes))
+
+		mediaType := imaging.DetectMediaType(file.Data)
+		v.CheckField(validator.In(mediaType, ocrMediaTypes...), "file", fmt.Sprintf("File %q is of type %q, which is not supported", file.Filename, mediaType))
+	}
+
+	if input.Model != "" {
+		checkModel(v, input.Model, input.models)
+	}
+
+	if input.DocumentType != "" {
+		v.CheckField(validator.In(input.DocumentType, documentTypeNames()...), "documentType", fmt.Sprintf("Document type must be one of: %s", strings.Join(documentTypeNames(), ", ")))
+	}
+}
+
+var fingerprintRX = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// formTemplateInput is a form template sent to be saved. The fingerprint can
+// be given directly, or worked out from the HTML of the form page, in which
+// case the fields are also checked against those of the form.
+type formTemplateInput struct {
+	ID          string               `json:"-"`
+	Name        string               `json:"name"`
+	Fingerprint string               `json:"fingerprint"`
+	FormHTML    string               `json:"formHTML"`
+	Fields      []form.TemplateField `json:"fields"`
+	Validator   validator.Validator  `json:"-"`
+}
+
+func (input *formTemplateInput) validate() {
+	v := &input.Validator
+
+	v.CheckField(formtemplates.ValidID(input.ID), "id", "ID must be up to 64 lower case letters, digits and hyphens, starting with a letter or digit")
+
+	v.CheckField(validator.NotBlank(input.Name), "name", "Name is required")
+	v.CheckField(validator.MaxRunes(input.Name, maxTemplateNameRunes), "name", fmt.Sprintf("Name must not be more than %d characters", maxTemplateNameRunes))
+
+	var formFields map[string]bool
+
+	switch {
+	case input.FormHTML != "":
+		v.CheckField(validator.MaxRunes(input.FormHTML, maxFormHTMLRunes), "formHTML", fmt.Sprintf("FormHTML must not be more than %d characters", maxFormHTMLRunes))
+
+		fields := form.Parse(input.FormHTML)
+		fingerprint := form.Fingerprint(fields)
+		v.CheckField(len(fields) > 0, "formHTML", "FormHTML must contain fields with IDs")
+		v.CheckField(input.Fingerprint == "" || input.Fingerprint == fingerprint, "fingerprint", "Fingerprint does not match formHTML")
+		input.Fingerprint = fingerprint
+
+		formFields = make(map[string]bool, len(fields))
+		for _, field := range fields {
+			formFields[field.ID] = true
+		}
+	case input.Fingerprint != "":
+		v.CheckField(fingerprintRX.MatchString(input.Fingerprint), "fingerprint", "Fingerprint must be 64 lower case hexadecimal characters")
+	default:
+		v.AddFieldError("fingerprint", "Fingerprint or formHTML is required")
+	}
+
+	v.CheckField(len(input.Fields) > 0, "fields", "Fields must map at least one field")
+	v.CheckField(len(input.Fields) <= maxTemplateFields, "fields", fmt.Sprintf("Fields must not contain more than %d fields", maxTemplateFields))
+
+	var (
+		profiles = profileFields()
+		seen     = make(map[string]bool, len(input.Fields))
+	)
+
+	for _, f := range input.Fields {
+		v.CheckField(validator.NotBlank(f.FieldID), "fields", "Every field must have a fieldId")
+		v.CheckField(!seen[f.FieldID], "fields", fmt.Sprintf("Field %q is mapped more than once", f.FieldID))
+		v.CheckField(formFields == nil || formFields[f.FieldID], "fields", fmt.Sprintf("Field %q is not in the form", f.FieldID))
+		v.CheckField(validator.In(f.Profile, profiles...), "fields", fmt.Sprintf("Profile must be one of: %s", strings.Join(profiles, ", ")))
+		v.CheckField(f.Transform == "" || validator.In(f.Transform, form.Transforms...), "fields", fmt.Sprintf("Transform must be one of: %s", strings.Join(form.Transforms, ", ")))
+		seen[f.FieldID] = true
+	}
+}
+
+type splitInput struct {
+	File      *request.File
+	MediaType string
+	Segments  string
+	segments  pageRanges
+	Validator validator.Validator
+}
+
+func (input *splitInput) validate() {
+	v := &input.Validator
+
+	v.CheckField(input.File.Size > 0, "file", "File must not be empty")
+	v.CheckField(validator.MaxRunes(input.File.Filename, maxFilenameRunes), "file", fmt.Sprintf("Filename must not be more than %d characters", maxFilenameRunes))
+
+	v.CheckField(validator.NotBlank(input.Segments), "segments", "Segments must be provided")
+	v.CheckField(validator.MaxRunes(input.Segments, maxPageRangeSpecification), "segments", fmt.Sprintf("Segments must not be more than %d characters", maxPageRangeSpecification))
+
+	if v.HasErrors() {
+		return
+	}
+
+	ranges, err := parsePageRanges(input.Segments)
+	if err != nil {
+		v.AddFieldError("segments", "Segments "+err.Error())
+		return
+	}
+
+	v.CheckField(ranges.last() <= maxPages, "segments", fmt.Sprintf("Segments must not exceed page %d", maxPages))
+	input.segments = ranges
+}
+
+type fillFormInput struct {
+	FormHTML               string `json:"formHTML"`
+	DocumentsExtractedText string `json:"documentsExtractedText"`
+	// Documents are the documents returned by /api/ocr. They are optional,
+	// and let the provenance of extracted values be passed through to the
+	// filled fields.
+	Documents []documentSegment `json:"documents"`
+	// Model overrides the configured LLM model for this request. It must be
+	// one of models.
+	Model     string `json:"model"`
+	models    []string
+	Validator validator.Validator `json:"-"`
+}
+
+func (input *fillFormInput) validate() {
+	v := &input.Validator
+
+	v.CheckField(validator.NotBlank(input.FormHTML), "formHTML", "FormHTML is required")
+	v.CheckField(validator.MaxRunes(input.FormHTML, maxFormHTMLRunes), "formHTML", fmt.Sprintf("FormHTML must not be more than %d characters", maxFormHTMLRunes))
+
+	v.CheckField(validator.NotBlank(input.DocumentsExtractedText), "documentsExtractedText", "DocumentsExtractedText is required")
+	v.CheckField(validator.MaxRunes(input.DocumentsExtractedText, maxDocumentsTextRunes), "documentsExtractedText", fmt.Sprintf("DocumentsExtractedText must not be more than %d characters", maxDocumentsTextRunes))
+
+	var numFields int
+	for _, document := range input.Documents {
+		numFields += len(document.Fields)
+	}
+	v.CheckField(len(input.Documents) <= maxDocuments, "documents", fmt.Sprintf("Documents must not contain more than %d documents", maxDocuments))
+	v.CheckField(numFields <= maxExtractedFields, "documents", fmt.Sprintf("Documents must not contain more than %d fields", maxExtractedFields))
+
+	if input.Model != "" {
+		checkModel(v, input.Model, input.models)
+	}
+}
+
+// checkModel checks that a model selected by a client is one that the client
+// is allowed to select, as returned by allowedModels.
+func checkModel(v *validator.Validator, model string, allowed []string) {
+	if len(allowed) == 0 {
+		v.AddFieldError("model", "Model cannot be selected by this client")
+		return
+	}
+
+	v.CheckField(validator.In(model, allowed...), "model", fmt.Sprintf("Model must be one of: %s", strings.Join(allowed, ", ")))
+}
+
+type pageRange struct {
+	first int
+	last  int
+}
+
+// pageRanges is a selection of 1-based, inclusive page ranges. An empty
+// selection means every page.
+type pageRanges []pageRange
+
+// parsePageRanges parses a page selection such as "1-3,5".
+func parsePageRanges(value string) (pageRanges, error) {
+	var ranges pageRanges
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, errInvalidPageRanges
+		}
+
+		firstValue, lastValue, isRange := strings.Cut(part, "-")
+		if !isRange {
+			lastValue = firstValue
+		}
+
+		first, err := strconv.Atoi(strings.TrimSpace(firstValue))
+		if err != nil {
+			return nil, errInvalidPageRanges
+		}
+		last, err := strconv.Atoi(strings.TrimSpace(lastValue))
+		if err != nil {
+			return nil, errInvalidPageRanges
+		}
+
+		switch {
+		case first < 1:
+			return nil, errors.New("must be 1 or greater")
+		case first > last:
+			return nil, fmt.Errorf("must list ranges in ascending order, got %d-%d", first, last)
+		}
+
+		ranges = append(ranges, pageRange{first: first, last: last})
+	}
+
+	return ranges, nil
+}
+
+func (pr pageRanges) contains(page int) bool {
+	if len(pr) == 0 {
+		return true
+	}
+
+	for _, r := range pr {
+		if page >= r.first && page <= r.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pr pageRanges) last() int {
+	var last int
+	for _, r := range pr {
+		last = max(last, r.last)
+	}
+	return last
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"dev.danielrb/auto-imm/api/internal/request"
+	"dev.danielrb/auto-imm/api/internal/validator"
+)
+
+var (
+	testPNG = []byte("\x89PNG\r\n\x1a\n")
+	testPDF = []byte("%PDF-1.7\n")
+)
+
+// checkFieldErrors fails the test unless the validator has errors for exactly
+// the given fields.
+func checkFieldErrors(t *testing.T, v validator.Validator, want ...string) {
+	t.Helper()
+
+	got := slices.Sorted(maps.Keys(v.FieldErrors))
+	slices.Sort(want)
+
+	if !slices.Equal(got, want) {
+		t.Errorf("got errors for %v, want %v: %v", got, want, v.FieldErrors)
+	}
+}
+
+func TestOCRInputValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		filename   string
+		provider   string
+		providers  []string
+		mode       string
+		output     string
+		language   string
+		model      string
+		models     []string
+		admin      bool
+		pages      string
+		docType    string
+		wantErrors []string
+	}{
+		{name: "Valid", data: testPNG},
+		{name: "Empty file", data: []byte{}, wantErrors: []string{"file"}},
+		{name: "Long filename", data: testPNG, filename: strings.Repeat("a", maxFilenameRunes+1), wantErrors: []string{"file"}},
+		{name: "Filename at limit", data: testPNG, filename: strings.Repeat("é", maxFilenameRunes)},
+
+		{name: "Unknown provider", data: testPNG, provider: "textract", wantErrors: []string{"provider"}},
+		{name: "Tesseract disabled", data: testPNG, provider: ocrProviderTesseract, wantErrors: []string{"provider"}},
+		{name: "Tesseract enabled", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}},
+
+		{name: "Consensus", data: testPNG, mode: ocrModeConsensus, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}},
+		{name: "Consensus without tesseract", data: testPNG, mode: ocrModeConsensus, wantErrors: []string{"mode"}},
+		{name: "Unknown mode", data: testPNG, mode: "majority", providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, wantErrors: []string{"mode"}},
+		{name: "Consensus with provider", data: testPNG, mode: ocrModeConsensus, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, wantErrors: []string{"provider"}},
+
+		{name: "Tesseract output", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, output: ocrOutputHOCR},
+		{name: "Unknown tesseract output", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, output: "alto", wantErrors: []string{"output"}},
+		{name: "Anthropic text output", data: testPNG, output: ocrOutputText},
+		{name: "Anthropic layout output", data: testPNG, output: ocrOutputLayout, wantErrors: []string{"output"}},
+
+		{name: "Tesseract languages", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, language: "eng+fra+chi_sim"},
+		{name: "Invalid language", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, language: "eng,fra", wantErrors: []string{"language"}},
+		{name: "Long language", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, language: strings.Repeat("a", maxLanguageRunes+1), wantErrors: []string{"language"}},
+		{name: "Consensus language", data: testPNG, mode: ocrModeConsensus, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, language: "deu"},
+		{name: "Anthropic language", data: testPNG, language: "eng", wantErrors: []string{"language"}},
+
+		{name: "Allowed model", data: testPNG, model: "claude-b", models: []string{"claude-a", "claude-b"}, admin: true},
+		{name: "Other model", data: testPNG, model: "claude-c", models: []string{"claude-a", "claude-b"}, admin: true, wantErrors: []string{"model"}},
+		{name: "No models allowed", data: testPNG, model: "claude-a", admin: true, wantErrors: []string{"model"}},
+		{name: "Model with the extension credential", data: testPNG, model: "claude-a", models: []string{"claude-a"}, wantErrors: []string{"model"}},
+		{name: "Tesseract model", data: testPNG, provider: ocrProviderTesseract, providers: []string{ocrProviderAnthropic, ocrProviderTesseract}, model: "claude-a", models: []string{"claude-a"}, admin: true, wantErrors: []string{"model"}},
+
+		{name: "PDF pages", data: testPDF, pages: "1-3,5"},
+		{name: "Image pages", data: testPNG, pages: "1", wantErrors: []string{"pages"}},
+		{name: "Invalid pages", data: testPDF, pages: "1-x", wantErrors: []string{"pages"}},
+		{name: "Pages past limit", data: testPDF, pages: "1-201", wantErrors: []string{"pages"}},
+		{name: "Long pages", data: testPDF, pages: strings.Repeat("1,", maxPageRangeSpecification/2) + "1", wantErrors: []string{"pages"}},
+
+		{name: "Document type", data: testPNG, docType: "passport"},
+		{name: "Unknown document type", data: testPNG, docType: "visa", wantErrors: []string{"documentType"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := tt.filename
+			if filename == "" {
+				filename = "upload"
+			}
+
+			app := &application{}
+			app.config.llm.allowedModels = tt.models
+			if tt.providers != nil {
+				app.config.tesseract.enabled = true
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/ocr", nil)
+			if tt.admin {
+				r = contextSetAdmin(r)
+			}
+
+			input := app.newOCRInput(r, &request.File{Filename: filename, Size: int64(len(tt.data)), Data: tt.data}, tt.provider, tt.pages)
+			input.Mode = tt.mode
+			input.Output = tt.output
+			input.Language = tt.language
+			input.Model = tt.model
+			input.DocumentType = tt.docType
+
+			input.validate()
+			checkFieldErrors(t, input.Validator, tt.wantErrors...)
+		})
+	}
+}
+
+func TestBulkJobInputValidate(t *testing.T) {
+	png := &request.File{Filename: "a.png", Size: int64(len(testPNG)), Data: testPNG}
+
+	tests := []struct {
+		name       string
+		files      []*request.File
+		model      string
+		models     []string
+		docType    string
+		wantErrors []string
+	}{
+		{name: "Valid", files: []*request.File{png, {Filename: "b.pdf", Size: int64(len(testPDF)), Data: testPDF}}},
+		{name: "No files", wantErrors: []string{"file"}},
+		{name: "Empty file", files: []*request.File{png, {Filename: "empty.png"}}, wantErrors: []string{"file"}},
+		{name: "Unsupported file", files: []*request.File{{Filename: "notes.txt", Size: 5, Data: []byte("notes")}}, wantErrors: []string{"file"}},
+		{name: "Long filename", files: []*request.File{{Filename: strings.Repeat("a", maxFilenameRunes+1), Size: int64(len(testPNG)), Data: testPNG}}, wantErrors: []string{"file"}},
+		{name: "Allowed model", files: []*request.File{png}, model: "claude-a", models: []string{"claude-a"}},
+		{name: "Other model", files: []*request.File{png}, model: "claude-b", models: []string{"claude-a"}, wantErrors: []string{"model"}},
+		{name: "No models allowed", files: []*request.File{png}, model: "claude-a", wantErrors: []string{"model"}},
+		{name: "Document type", files: []*request.File{png}, docType: "national_id"},
+		{name: "Unknown document type", files: []*request.File{png}, docType: "visa", wantErrors: []string{"documentType"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.llm.allowedModels = tt.models
+
+			input := app.newBulkJobInput()
+			input.Files = tt.files
+			input.Model = tt.model
+			input.DocumentType = tt.docType
+
+			input.validate()
+			checkFieldErrors(t, input.Validator, tt.wantErrors...)
+		})
+	}
+}
+
+func TestFillFormInputValidate(t *testing.T) {
+	manyFields := make([]extractedField, maxExtractedFields+1)
+
+	tests := []struct {
+		name       string
+		input      fillFormInput
+		wantErrors []string
+	}{
+		{name: "Valid", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: "Jane Doe"}},
+		{name: "Missing form", input: fillFormInput{FormHTML: " ", DocumentsExtractedText: "Jane Doe"}, wantErrors: []string{"formHTML"}},
+		{name: "Missing text", input: fillFormInput{FormHTML: "<input id=a>"}, wantErrors: []string{"documentsExtractedText"}},
+		{name: "Form at limit", input: fillFormInput{FormHTML: strings.Repeat("é", maxFormHTMLRunes), DocumentsExtractedText: "Jane Doe"}},
+		{name: "Long form", input: fillFormInput{FormHTML: strings.Repeat("a", maxFormHTMLRunes+1), DocumentsExtractedText: "Jane Doe"}, wantErrors: []string{"formHTML"}},
+		{name: "Text at limit", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: strings.Repeat("é", maxDocumentsTextRunes)}},
+		{name: "Long text", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: strings.Repeat("a", maxDocumentsTextRunes+1)}, wantErrors: []string{"documentsExtractedText"}},
+		{name: "Too many documents", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: "Jane Doe", Documents: make([]documentSegment, maxDocuments+1)}, wantErrors: []string{"documents"}},
+		{name: "Too many fields", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: "Jane Doe", Documents: []documentSegment{{Fields: manyFields}}}, wantErrors: []string{"documents"}},
+		{name: "Allowed model", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: "Jane Doe", Model: "claude-a", models: []string{"claude-a"}}},
+		{name: "Other model", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: "Jane Doe", Model: "claude-b", models: []string{"claude-a"}}, wantErrors: []string{"model"}},
+		{name: "No models allowed", input: fillFormInput{FormHTML: "<input id=a>", DocumentsExtractedText: "Jane Doe", Model: "claude-a"}, wantErrors: []string{"model"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.input.validate()
+			checkFieldErrors(t, tt.input.Validator, tt.wantErrors...)
+		})
+	}
+}
+
+func TestParsePageRanges(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    pageRanges
+		wantErr bool
+	}{
+		{value: "1", want: pageRanges{{1, 1}}},
+		{value: "1-3,5", want: pageRanges{{1, 3}, {5, 5}}},
+		{value: " 2 - 4 , 7 ", want: pageRanges{{2, 4}, {7, 7}}},
+		{value: "5,1-2", want: pageRanges{{5, 5}, {1, 2}}},
+		{value: "", wantErr: true},
+		{value: "1,,2", wantErr: true},
+		{value: "1-", wantErr: true},
+		{value: "a", wantErr: true},
+		{value: "0-2", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "3-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parsePageRanges(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageRanges(t *testing.T) {
+	ranges := pageRanges{{1, 3}, {7, 7}}
+
+	for page, want := range map[int]bool{1: true, 3: true, 4: false, 7: true, 8: false} {
+		if got := ranges.contains(page); got != want {
+			t.Errorf("contains(%d) = %v, want %v", page, got, want)
+		}
+	}
+	if got := ranges.last(); got != 7 {
+		t.Errorf("last() = %d, want 7", got)
+	}
+	if !(pageRanges(nil)).contains(42) {
+		t.Error("an empty selection should contain every page")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// apiClient calls the OCR and form filling endpoints of a running server.
+type apiClient struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+func newAPIClient(baseURL, username, password string, timeout time.Duration) *apiClient {
+	return &apiClient{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// ocrResponse holds the parts of an /api/ocr response that are evaluated.
+type ocrResponse struct {
+	Text      string            `json:"text"`
+	Documents []json.RawMessage `json:"documents"`
+	Metadata  struct {
+		Document *struct {
+			Type string `json:"type"`
+		} `json:"document"`
+		InjectionWarnings []json.RawMessage `json:"injectionWarnings"`
+	} `json:"metadata"`
+}
+
+// fillFormResponse holds the parts of an /api/fill-form response that are
+// evaluated.
+type fillFormResponse struct {
+	Fields []struct {
+		FieldID string `json:"fieldId"`
+		Value   string `json:"value"`
+	} `json:"fields"`
+	RejectedFields    []json.RawMessage `json:"rejectedFields"`
+	InjectionWarnings []json.RawMessage `json:"injectionWarnings"`
+}
+
+// values returns the filled values by field ID.
+func (r *fillFormResponse) values() map[string]string {
+	fields := make(map[string]string, len(r.Fields))
+	for _, f := range r.Fields {
+		fields[f.FieldID] = f.Value
+	}
+
+	return fields
+}
+
+type ocrField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// fields returns the values extracted from every document in the upload. If
+// a field appears in more than one document, the first value is kept.
+func (r *ocrResponse) fields() (map[string]string, error) {
+	fields := make(map[string]string)
+
+	for _, raw := range r.Documents {
+		var document struct {
+			Fields []ocrField `json:"fields"`
+		}
+		err := json.Unmarshal(raw, &document)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range document.Fields {
+			if _, ok := fields[f.Name]; !ok {
+				fields[f.Name] = f.Value
+			}
+		}
+	}
+
+	return fields, nil
+}
+
+// ocr uploads a document to /api/ocr.
+func (c *apiClient) ocr(path string) (*ocrResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	fw, err := mw.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	_, err = fw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp ocrResponse
+	err = c.post("/api/ocr", mw.FormDataContentType(), &body, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// fillForm sends a form and the OCR result of a document to /api/fill-form.
+func (c *apiClient) fillForm(formHTML string, ocr *ocrResponse) (*fillFormResponse, error) {
+	body, err := json.Marshal(map[string]any{
+		"formHTML":               formHTML,
+		"documentsExtractedText": ocr.Text,
+		"documents":              ocr.Documents,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp fillFormResponse
+	err = c.post("/api/fill-form", "application/json", bytes.NewReader(body), &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *apiClient) post(path, contentType string, body io.Reader, dst any) error {
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var problem struct {
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(data, &problem) == nil && problem.Detail != "" {
+			return fmt.Errorf("%s returned %d: %s", path, resp.StatusCode, problem.Detail)
+		}
+		return fmt.Errorf("%s returned %d", path, resp.StatusCode)
+	}
+
+	return json.Unmarshal(data, dst)
+}
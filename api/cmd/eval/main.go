@@ -0,0 +1,137 @@
+// Command eval measures how accurately the API extracts fields from documents
+// and fills forms, by running a directory of labelled samples through a
+// running server and comparing the results with the expected values.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/lmittmann/tint"
+)
+
+func main() {
+	logger := slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: slog.LevelInfo}))
+
+	err := run(logger)
+	if err != nil {
+		trace := string(debug.Stack())
+		logger.Error(err.Error(), "trace", trace)
+		os.Exit(1)
+	}
+}
+
+type config struct {
+	samplesDir string
+	label      string
+	out        string
+	compare    string
+	api        struct {
+		baseURL  string
+		username string
+		password string
+		timeout  time.Duration
+	}
+}
+
+func run(logger *slog.Logger) error {
+	var cfg config
+
+	flag.StringVar(&cfg.samplesDir, "samples", "testdata/eval", "directory of labelled samples, one sub-directory per sample")
+	flag.StringVar(&cfg.label, "label", "", "name of this run in reports, such as the prompt or model version (defaults to the API URL)")
+	flag.StringVar(&cfg.out, "out", "", "file to save the run's report to as JSON, for comparing later")
+	flag.StringVar(&cfg.compare, "compare", "", "compare two saved reports side by side instead of running the samples, e.g. old.json,new.json")
+	flag.StringVar(&cfg.api.baseURL, "api", "http://localhost:3233", "base URL of the API server")
+	flag.StringVar(&cfg.api.username, "username", "admin", "basic auth username for the API server")
+	flag.DurationVar(&cfg.api.timeout, "timeout", 10*time.Minute, "timeout for each request to the API server")
+
+	flag.Parse()
+
+	if cfg.compare != "" {
+		before, after, ok := strings.Cut(cfg.compare, ",")
+		if !ok {
+			return errors.New("-compare needs two reports separated by a comma")
+		}
+
+		a, err := loadReport(before)
+		if err != nil {
+			return err
+		}
+		b, err := loadReport(after)
+		if err != nil {
+			return err
+		}
+
+		printComparison(os.Stdout, a, b)
+		return nil
+	}
+
+	// Read the password from the environment so that it does not end up in
+	// the shell history
+	cfg.api.password = os.Getenv("EVAL_API_PASSWORD")
+
+	samples, err := loadSamples(cfg.samplesDir)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no samples found in %s", cfg.samplesDir)
+	}
+
+	if cfg.label == "" {
+		cfg.label = cfg.api.baseURL
+	}
+
+	client := newAPIClient(cfg.api.baseURL, cfg.api.username, cfg.api.password, cfg.api.timeout)
+
+	report := newReport(cfg.label)
+	for _, sample := range samples {
+		logger.Info("evaluating sample", "sample", sample.Name)
+
+		result := evaluateSample(client, sample)
+		if result.Error != "" {
+			logger.Warn("sample failed", "sample", sample.Name, "error", result.Error)
+		}
+		report.add(result)
+	}
+	report.summarize()
+
+	printReport(os.Stdout, report)
+
+	if cfg.out != "" {
+		js, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(cfg.out, append(js, '\n'), 0o644)
+		if err != nil {
+			return err
+		}
+		logger.Info("report saved", "file", cfg.out)
+	}
+
+	return nil
+}
+
+func loadReport(path string) (*report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r report
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid report %s: %w", path, err)
+	}
+
+	return &r, nil
+}
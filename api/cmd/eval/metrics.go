@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// allTypes is the key of the metrics across every document type.
+const allTypes = "all"
+
+// fieldScore counts the values of one sample that were right, wrong and
+// missing. A wrong value counts as both a false positive and a false
+// negative.
+type fieldScore struct {
+	TruePositives  int        `json:"truePositives"`
+	FalsePositives int        `json:"falsePositives"`
+	FalseNegatives int        `json:"falseNegatives"`
+	Mismatches     []mismatch `json:"mismatches,omitempty"`
+}
+
+type mismatch struct {
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Got      string `json:"got"`
+}
+
+func (s *fieldScore) exact() bool {
+	return s.FalsePositives == 0 && s.FalseNegatives == 0
+}
+
+// score compares values with the expected ones. Values that are not expected
+// are ignored, so that samples only need to label the fields that matter,
+// except for fields expected to be empty, which count as false positives if
+// a value is returned.
+func score(expected, got map[string]string) *fieldScore {
+	s := &fieldScore{}
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		want := canonical(expected[name])
+		value, ok := got[name]
+		have := canonical(value)
+
+		switch {
+		case want == "" && have == "":
+			continue
+		case want == "":
+			s.FalsePositives++
+		case !ok || have == "":
+			s.FalseNegatives++
+		case want == have:
+			s.TruePositives++
+			continue
+		default:
+			s.FalsePositives++
+			s.FalseNegatives++
+		}
+
+		s.Mismatches = append(s.Mismatches, mismatch{Field: name, Expected: expected[name], Got: value})
+	}
+
+	return s
+}
+
+// canonical reduces a value to upper case letters and digits with accents
+// removed, and writes dates as YYYYMMDD, so that values are compared
+// regardless of formatting.
+func canonical(value string) string {
+	value = strings.TrimSpace(value)
+
+	for _, layout := range []string{"2006-01-02", "2006/01/02", "02/01/2006", "02.01.2006", "2 Jan 2006", "2 January 2006", "Jan 2, 2006", "January 2, 2006", "02 Jan 06"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format("20060102")
+		}
+	}
+
+	var b strings.Builder
+	for _, r := range norm.NFD.String(value) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+
+	return b.String()
+}
+
+// sampleResult is the outcome of evaluating one sample.
+type sampleResult struct {
+	Name         string      `json:"name"`
+	DocumentType string      `json:"documentType"`
+	ClassifiedAs string      `json:"classifiedAs"`
+	Extraction   *fieldScore `json:"extraction"`
+	Form         *fieldScore `json:"form,omitempty"`
+	// Injection is whether the sample contains a prompt injection, and
+	// Flagged whether the API flagged one.
+	Injection bool `json:"injection,omitempty"`
+	Flagged   bool `json:"flagged,omitempty"`
+	// Rejected is the number of filled values that the API left out
+	// because the form could not take them.
+	Rejected int    `json:"rejected,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// evaluateSample runs a sample through the API and scores the results. If a
+// request fails, every expected value counts as missing.
+func evaluateSample(client *apiClient, s sample) sampleResult {
+	result := sampleResult{Name: s.Name, DocumentType: s.DocumentType, Injection: s.Injection}
+	if result.DocumentType == "" {
+		result.DocumentType = "unlabelled"
+	}
+
+	fail := func(err error) sampleResult {
+		result.Error = err.Error()
+		if result.Extraction == nil {
+			result.Extraction = score(s.Fields, nil)
+		}
+		if s.Form != "" && result.Form == nil {
+			result.Form = score(s.FormFields, nil)
+		}
+		return result
+	}
+
+	ocr, err := client.ocr(s.path(s.File))
+	if err != nil {
+		return fail(err)
+	}
+
+	if ocr.Metadata.Document != nil {
+		result.ClassifiedAs = ocr.Metadata.Document.Type
+	}
+	result.Flagged = len(ocr.Metadata.InjectionWarnings) > 0
+
+	fields, err := ocr.fields()
+	if err != nil {
+		return fail(err)
+	}
+	result.Extraction = score(s.Fields, fields)
+
+	if s.Form == "" {
+		return result
+	}
+
+	formHTML, err := os.ReadFile(s.path(s.Form))
+	if err != nil {
+		return fail(err)
+	}
+
+	fill, err := client.fillForm(string(formHTML), ocr)
+	if err != nil {
+		return fail(err)
+	}
+	result.Form = score(s.FormFields, fill.values())
+	result.Flagged = result.Flagged || len(fill.InjectionWarnings) > 0
+	result.Rejected = len(fill.RejectedFields)
+
+	return result
+}
+
+// metrics sums the scores of a group of samples.
+type metrics struct {
+	Samples        int     `json:"samples"`
+	Classified     int     `json:"classified"`
+	TruePositives  int     `json:"truePositives"`
+	FalsePositives int     `json:"falsePositives"`
+	FalseNegatives int     `json:"falseNegatives"`
+	ExactMatches   int     `json:"exactMatches"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+	ExactMatch     float64 `json:"exactMatch"`
+}
+
+func (m *metrics) add(s *fieldScore) {
+	m.Samples++
+	m.TruePositives += s.TruePositives
+	m.FalsePositives += s.FalsePositives
+	m.FalseNegatives += s.FalseNegatives
+	if s.exact() {
+		m.ExactMatches++
+	}
+}
+
+func (m *metrics) summarize() {
+	m.Precision = ratio(m.TruePositives, m.TruePositives+m.FalsePositives)
+	m.Recall = ratio(m.TruePositives, m.TruePositives+m.FalseNegatives)
+	m.ExactMatch = ratio(m.ExactMatches, m.Samples)
+}
+
+func ratio(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// injectionMetrics counts how well prompt injections were flagged: the share
+// of samples with an injection that were flagged, and of samples without one
+// that were flagged anyway.
+type injectionMetrics struct {
+	Samples        int     `json:"samples"`
+	Flagged        int     `json:"flagged"`
+	Clean          int     `json:"clean"`
+	FalseAlarms    int     `json:"falseAlarms"`
+	DetectionRate  float64 `json:"detectionRate"`
+	FalseAlarmRate float64 `json:"falseAlarmRate"`
+}
+
+// report holds the results of a run, with metrics for each document type and
+// across all of them.
+type report struct {
+	Label      string              `json:"label"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	Samples    []sampleResult      `json:"samples"`
+	Extraction map[string]*metrics `json:"extraction"`
+	Forms      map[string]*metrics `json:"forms"`
+	Injection  injectionMetrics    `json:"injection"`
+}
+
+func newReport(label string) *report {
+	return &report{
+		Label:      label,
+		CreatedAt:  time.Now().UTC(),
+		Extraction: make(map[string]*metrics),
+		Forms:      make(map[string]*metrics),
+	}
+}
+
+func (r *report) add(result sampleResult) {
+	r.Samples = append(r.Samples, result)
+
+	switch {
+	case result.Injection:
+		r.Injection.Samples++
+		if result.Flagged {
+			r.Injection.Flagged++
+		}
+	default:
+		r.Injection.Clean++
+		if result.Flagged {
+			r.Injection.FalseAlarms++
+		}
+	}
+
+	for _, key := range []string{result.DocumentType, allTypes} {
+		if r.Extraction[key] == nil {
+			r.Extraction[key] = &metrics{}
+		}
+		r.Extraction[key].add(result.Extraction)
+		if result.ClassifiedAs == result.DocumentType {
+			r.Extraction[key].Classified++
+		}
+
+		if result.Form != nil {
+			if r.Forms[key] == nil {
+				r.Forms[key] = &metrics{}
+			}
+			r.Forms[key].add(result.Form)
+		}
+	}
+}
+
+func (r *report) summarize() {
+	for _, m := range r.Extraction {
+		m.summarize()
+	}
+	for _, m := range r.Forms {
+		m.summarize()
+	}
+	r.Injection.DetectionRate = ratio(r.Injection.Flagged, r.Injection.Samples)
+	r.Injection.FalseAlarmRate = ratio(r.Injection.FalseAlarms, r.Injection.Clean)
+}
+
+// sortedTypes returns the document types of a set of metrics in name order,
+// with the total last.
+func sortedTypes(groups ...map[string]*metrics) []string {
+	var types []string
+	for _, group := range groups {
+		for t := range group {
+			if t != allTypes && !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Strings(types)
+
+	return append(types, allTypes)
+}
+
+func printReport(w io.Writer, r *report) {
+	fmt.Fprintf(w, "Run: %s\n\n", r.Label)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "EXTRACTION\tSAMPLES\tCLASSIFIED\tPRECISION\tRECALL\tEXACT MATCH")
+	for _, t := range sortedTypes(r.Extraction) {
+		m := r.Extraction[t]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", t, m.Samples, percent(ratio(m.Classified, m.Samples)), percent(m.Precision), percent(m.Recall), percent(m.ExactMatch))
+	}
+
+	if len(r.Forms) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "FORMS\tSAMPLES\t\tPRECISION\tRECALL\tEXACT MATCH")
+		for _, t := range sortedTypes(r.Forms) {
+			m := r.Forms[t]
+			fmt.Fprintf(tw, "%s\t%d\t\t%s\t%s\t%s\n", t, m.Samples, percent(m.Precision), percent(m.Recall), percent(m.ExactMatch))
+		}
+	}
+	if r.Injection.Samples > 0 || r.Injection.FalseAlarms > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "INJECTION\tSAMPLES\tFLAGGED\tRATE")
+		fmt.Fprintf(tw, "with injection\t%d\t%d\t%s\n", r.Injection.Samples, r.Injection.Flagged, percent(r.Injection.DetectionRate))
+		fmt.Fprintf(tw, "without\t%d\t%d\t%s\n", r.Injection.Clean, r.Injection.FalseAlarms, percent(r.Injection.FalseAlarmRate))
+	}
+	tw.Flush()
+
+	for _, s := range r.Samples {
+		if s.Error == "" && s.Extraction.exact() && (s.Form == nil || s.Form.exact()) && s.Injection == s.Flagged {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s (%s):\n", s.Name, s.DocumentType)
+		if s.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", s.Error)
+		}
+		if s.ClassifiedAs != s.DocumentType && s.ClassifiedAs != "" {
+			fmt.Fprintf(w, "  classified as %s\n", s.ClassifiedAs)
+		}
+		switch {
+		case s.Injection && !s.Flagged:
+			fmt.Fprintln(w, "  injection not flagged")
+		case !s.Injection && s.Flagged:
+			fmt.Fprintln(w, "  flagged as injection")
+		}
+		for _, m := range s.Extraction.Mismatches {
+			fmt.Fprintf(w, "  %s: expected %q, got %q\n", m.Field, m.Expected, m.Got)
+		}
+		if s.Form != nil {
+			for _, m := range s.Form.Mismatches {
+				fmt.Fprintf(w, "  form %s: expected %q, got %q\n", m.Field, m.Expected, m.Got)
+			}
+		}
+	}
+}
+
+// printComparison prints the metrics of two runs side by side, with the
+// change from the first to the second.
+func printComparison(w io.Writer, a, b *report) {
+	fmt.Fprintf(w, "A: %s (%s)\nB: %s (%s)\n\n", a.Label, a.CreatedAt.Format(time.DateTime), b.Label, b.CreatedAt.Format(time.DateTime))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	section := func(title string, ma, mb map[string]*metrics) {
+		fmt.Fprintf(tw, "%s\tSAMPLES\tPRECISION A\tB\tCHANGE\tRECALL A\tB\tCHANGE\tEXACT A\tB\tCHANGE\n", title)
+		for _, t := range sortedTypes(ma, mb) {
+			x, y := ma[t], mb[t]
+			if x == nil {
+				x = &metrics{}
+			}
+			if y == nil {
+				y = &metrics{}
+			}
+			fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t, x.Samples, y.Samples,
+				percent(x.Precision), percent(y.Precision), change(x.Precision, y.Precision),
+				percent(x.Recall), percent(y.Recall), change(x.Recall, y.Recall),
+				percent(x.ExactMatch), percent(y.ExactMatch), change(x.ExactMatch, y.ExactMatch))
+		}
+	}
+
+	section("EXTRACTION", a.Extraction, b.Extraction)
+	if len(a.Forms) > 0 || len(b.Forms) > 0 {
+		fmt.Fprintln(tw)
+		section("FORMS", a.Forms, b.Forms)
+	}
+	tw.Flush()
+
+	// List the samples that got better or worse
+	results := make(map[string]sampleResult, len(a.Samples))
+	for _, s := range a.Samples {
+		results[s.Name] = s
+	}
+
+	var changed []string
+	for _, s := range b.Samples {
+		before, ok := results[s.Name]
+		if !ok {
+			continue
+		}
+
+		x, y := correct(before), correct(s)
+		if x != y {
+			changed = append(changed, fmt.Sprintf("  %s: %d -> %d correct values", s.Name, x, y))
+		}
+	}
+
+	if len(changed) > 0 {
+		fmt.Fprintln(w, "\nChanged samples:")
+		for _, line := range changed {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func correct(s sampleResult) int {
+	n := s.Extraction.TruePositives
+	if s.Form != nil {
+		n += s.Form.TruePositives
+	}
+	return n
+}
+
+func percent(f float64) string {
+	return fmt.Sprintf("%.1f%%", f*100)
+}
+
+func change(a, b float64) string {
+	return fmt.Sprintf("%+.1f", (b-a)*100)
+}
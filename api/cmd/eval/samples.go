@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// sampleFile is the name of the file describing a sample in its directory.
+const sampleFile = "sample.json"
+
+// sample is a labelled document, and optionally a form to fill from it, with
+// the values that the pipeline is expected to produce.
+type sample struct {
+	Name string `json:"-"`
+	// File is the uploaded document, relative to the sample's directory.
+	File string `json:"file"`
+	// DocumentType is the type the document should be classified as.
+	DocumentType string `json:"documentType"`
+	// Fields are the expected extracted values, by field name.
+	Fields map[string]string `json:"fields"`
+	// Form is an HTML form to fill from the document, relative to the
+	// sample's directory, and FormFields the expected values by field ID.
+	Form       string            `json:"form"`
+	FormFields map[string]string `json:"formFields"`
+	// Injection says whether the document or form contains a prompt
+	// injection, which the API should flag. The expected values are the
+	// genuine ones, so a successful injection shows up as wrong values.
+	Injection bool `json:"injection"`
+
+	dir string
+}
+
+// loadSamples reads every sample in a directory, in name order. Each sample
+// is a sub-directory holding a sample.json file along with its document and
+// form.
+func loadSamples(dir string) ([]sample, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []sample
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		sampleDir := filepath.Join(dir, entry.Name())
+
+		data, err := os.ReadFile(filepath.Join(sampleDir, sampleFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var s sample
+		err = json.Unmarshal(data, &s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample %s: %w", sampleDir, err)
+		}
+
+		s.Name = entry.Name()
+		s.dir = sampleDir
+
+		switch {
+		case s.File == "":
+			return nil, fmt.Errorf("sample %s has no file", s.Name)
+		case s.Form != "" && len(s.FormFields) == 0:
+			return nil, fmt.Errorf("sample %s has a form but no formFields", s.Name)
+		}
+
+		samples = append(samples, s)
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+
+	return samples, nil
+}
+
+func (s sample) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestLoadSamples checks that the samples run by make eval and make
+// eval-adversarial load, and that their documents and forms exist.
+func TestLoadSamples(t *testing.T) {
+	for _, dir := range []string{"../../testdata/eval", "../../testdata/adversarial"} {
+		t.Run(dir, func(t *testing.T) {
+			samples, err := loadSamples(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) == 0 {
+				t.Fatal("no samples found")
+			}
+
+			for _, s := range samples {
+				if s.DocumentType == "" || len(s.Fields) == 0 {
+					t.Errorf("sample %s has no expected document type or fields", s.Name)
+				}
+
+				files := []string{s.File}
+				if s.Form != "" {
+					files = append(files, s.Form)
+				}
+				for _, file := range files {
+					_, err := os.Stat(s.path(file))
+					if err != nil {
+						t.Errorf("sample %s: %v", s.Name, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -11,16 +11,30 @@ require (
 	golang.org/x/exp v0.0.0-20251113190631-e25ba8c21ef6
 )
 
-require github.com/anthropics/anthropic-sdk-go v1.18.0
+require (
+	github.com/anthropics/anthropic-sdk-go v1.18.0
+	github.com/gen2brain/go-fitz v1.24.15
+	github.com/gen2brain/heic v0.4.5
+	github.com/otiai10/gosseract/v2 v2.4.1
+	github.com/pdfcpu/pdfcpu v0.11.1
+	golang.org/x/image v0.33.0
+	golang.org/x/text v0.31.0
+)
 
 require (
+	github.com/clipperhouse/uax29/v2 v2.2.0 // indirect
 	github.com/ebitengine/purego v0.8.4 // indirect
-	github.com/gen2brain/go-fitz v1.24.15 // indirect
+	github.com/hhrutter/lzw v1.0.0 // indirect
+	github.com/hhrutter/pkcs7 v0.2.0 // indirect
+	github.com/hhrutter/tiff v1.0.2 // indirect
 	github.com/jupiterrider/ffi v0.5.0 // indirect
-	github.com/otiai10/gosseract/v2 v2.4.1 // indirect
+	github.com/mattn/go-runewidth v0.0.19 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/tetratelabs/wazero v1.9.0 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
 	golang.org/x/sys v0.38.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Statuses of a bulk OCR job. A job classifies the pages of its documents,
+// unless it was given their type, and then extracts them, each step as one
+// batch of LLM requests.
+const (
+	BulkJobClassifying = "classifying"
+	BulkJobExtracting  = "extracting"
+	BulkJobEnded       = "ended"
+	BulkJobFailed      = "failed"
+)
+
+// Statuses of a document in a bulk OCR job.
+const (
+	DocumentPending = "pending"
+	DocumentSuccess = "success"
+	DocumentError   = "error"
+)
+
+// BulkJob is a set of documents processed together through the LLM
+// provider's batch API.
+type BulkJob struct {
+	ID           int64  `db:"id" json:"id"`
+	Status       string `db:"status" json:"status"`
+	DocumentType string `db:"document_type" json:"documentType,omitempty"`
+	Model        string `db:"model" json:"model,omitempty"`
+	// LLMBatchID is the batch that the job is waiting for, if any.
+	LLMBatchID string     `db:"llm_batch_id" json:"llmBatchId,omitempty"`
+	Error      string     `db:"error" json:"error,omitempty"`
+	CreatedAt  time.Time  `db:"created_at" json:"createdAt"`
+	UpdatedAt  time.Time  `db:"updated_at" json:"updatedAt"`
+	EndedAt    *time.Time `db:"ended_at" json:"endedAt,omitempty"`
+
+	// Counts of the job's documents, by status
+	Documents int `db:"documents" json:"documents"`
+	Succeeded int `db:"succeeded" json:"succeeded"`
+	Failed    int `db:"failed" json:"failed"`
+}
+
+// Document is an uploaded document and, once processed, its OCR result.
+type Document struct {
+	ID        int64  `db:"id" json:"id"`
+	BulkJobID int64  `db:"bulk_job_id" json:"bulkJobId"`
+	Filename  string `db:"filename" json:"filename"`
+	MediaType string `db:"media_type" json:"mediaType"`
+	Status    string `db:"status" json:"status"`
+	// Pages holds the classification of each page as JSON, between the
+	// steps of a job.
+	Pages string `db:"pages" json:"-"`
+	// Result is the OCR result as JSON.
+	Result    string    `db:"result" json:"-"`
+	Error     string    `db:"error" json:"error,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+// NewDocument is a file to add to a bulk job.
+type NewDocument struct {
+	Filename  string
+	MediaType string
+	Data      []byte
+}
+
+const bulkJobColumns = `
+	j.id, j.status, j.document_type, j.model, j.llm_batch_id, j.error, j.created_at, j.updated_at, j.ended_at,
+	(SELECT COUNT(*) FROM documents d WHERE d.bulk_job_id = j.id) AS documents,
+	(SELECT COUNT(*) FROM documents d WHERE d.bulk_job_id = j.id AND d.status = 'success') AS succeeded,
+	(SELECT COUNT(*) FROM documents d WHERE d.bulk_job_id = j.id AND d.status = 'error') AS failed`
+
+// documentColumns are the columns of a document, without its file.
+const documentColumns = `id, bulk_job_id, filename, media_type, status, pages, result, error, created_at, updated_at`
+
+// InsertBulkJob adds a job and its documents, and sets the job's ID.
+func (db *DB) InsertBulkJob(job *BulkJob, documents []NewDocument) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	job.CreatedAt, job.UpdatedAt = now, now
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO bulk_jobs (status, document_type, model, llm_batch_id, error, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		job.Status, job.DocumentType, job.Model, job.LLMBatchID, job.Error, job.CreatedAt, job.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	job.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, document := range documents {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO documents (bulk_job_id, filename, media_type, data, status, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			job.ID, document.Filename, document.MediaType, document.Data, DocumentPending, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	job.Documents = len(documents)
+
+	return tx.Commit()
+}
+
+// GetBulkJob returns a job, and whether it exists.
+func (db *DB) GetBulkJob(id int64) (*BulkJob, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	var job BulkJob
+
+	err := db.GetContext(ctx, &job, `SELECT `+bulkJobColumns+` FROM bulk_jobs j WHERE j.id = $1`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &job, true, nil
+}
+
+// ListBulkJobs returns every job, newest first.
+func (db *DB) ListBulkJobs() ([]BulkJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	jobs := []BulkJob{}
+
+	err := db.SelectContext(ctx, &jobs, `SELECT `+bulkJobColumns+` FROM bulk_jobs j ORDER BY j.id DESC`)
+
+	return jobs, err
+}
+
+// UnfinishedBulkJobs returns the jobs that have neither ended nor failed,
+// oldest first.
+func (db *DB) UnfinishedBulkJobs() ([]BulkJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	var jobs []BulkJob
+
+	err := db.SelectContext(ctx, &jobs, `SELECT `+bulkJobColumns+` FROM bulk_jobs j WHERE j.status IN ($1, $2) ORDER BY j.id`, BulkJobClassifying, BulkJobExtracting)
+
+	return jobs, err
+}
+
+// UpdateBulkJob saves the status, batch, error and end time of a job.
+func (db *DB) UpdateBulkJob(job *BulkJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	job.UpdatedAt = time.Now().UTC()
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE bulk_jobs SET status = $1, llm_batch_id = $2, error = $3, updated_at = $4, ended_at = $5
+		WHERE id = $6`,
+		job.Status, job.LLMBatchID, job.Error, job.UpdatedAt, job.EndedAt, job.ID)
+
+	return err
+}
+
+// BulkJobDocuments returns the documents of a job, in the order they were
+// added, without their files.
+func (db *DB) BulkJobDocuments(jobID int64) ([]Document, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	documents := []Document{}
+
+	err := db.SelectContext(ctx, &documents, `SELECT `+documentColumns+` FROM documents WHERE bulk_job_id = $1 ORDER BY id`, jobID)
+
+	return documents, err
+}
+
+// GetDocument returns a document without its file, and whether it exists.
+func (db *DB) GetDocument(id int64) (*Document, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	var document Document
+
+	err := db.GetContext(ctx, &document, `SELECT `+documentColumns+` FROM documents WHERE id = $1`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &document, true, nil
+}
+
+// DocumentData returns the file of a document.
+func (db *DB) DocumentData(id int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	var data []byte
+
+	err := db.GetContext(ctx, &data, `SELECT data FROM documents WHERE id = $1`, id)
+
+	return data, err
+}
+
+// UpdateDocument saves the status, page classifications, result and error of
+// a document.
+func (db *DB) UpdateDocument(document *Document) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	document.UpdatedAt = time.Now().UTC()
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE documents SET status = $1, pages = $2, result = $3, error = $4, updated_at = $5
+		WHERE id = $6`,
+		document.Status, document.Pages, document.Result, document.Error, document.UpdatedAt, document.ID)
+
+	return err
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	_ "embed"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -11,6 +12,11 @@ import (
 
 const defaultTimeout = 3 * time.Second
 
+// schema creates the tables that do not exist yet.
+//
+//go:embed schema.sql
+var schema string
+
 type DB struct {
 	dsn string
 	*sqlx.DB
@@ -30,5 +36,11 @@ func New(dsn string) (*DB, error) {
 	db.SetConnMaxIdleTime(5 * time.Minute)
 	db.SetConnMaxLifetime(2 * time.Hour)
 
+	_, err = db.ExecContext(ctx, schema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &DB{dsn: dsn, DB: db}, nil
 }
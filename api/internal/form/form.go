@@ -0,0 +1,294 @@
+// Package form reads the fillable fields of an HTML form into a normalized
+// schema. The schema only holds what is needed to fill the form, and leaves
+// out markup, scripts and values that change between page loads, so that the
+// same form page always gives the same schema.
+package form
+
+import (
+	"html"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Field is a fillable field of a form.
+type Field struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Tag is "input", "select" or "textarea".
+	Tag string `json:"tag"`
+	// Type is the type attribute of an input, such as "text" or "radio".
+	Type  string `json:"type,omitempty"`
+	Label string `json:"label,omitempty"`
+	// Group is the legend of the fieldset, or the label of the ARIA group,
+	// that the field is in, such as "Date of birth" for the parts of a date.
+	Group string `json:"group,omitempty"`
+	// Autocomplete is the autocomplete attribute, such as "family-name".
+	Autocomplete string `json:"autocomplete,omitempty"`
+	// Value is the value attribute of a radio button or checkbox, which is
+	// what is submitted when it is selected.
+	Value     string   `json:"value,omitempty"`
+	Required  bool     `json:"required,omitempty"`
+	MaxLength int      `json:"maxLength,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Options   []Option `json:"options,omitempty"`
+}
+
+// Option is an option of a select field. The label is left out if it is the
+// same as the value.
+type Option struct {
+	Value string `json:"value"`
+	Label string `json:"label,omitempty"`
+}
+
+// Input types that cannot be filled in.
+var ignoredTypes = []string{"hidden", "submit", "button", "reset", "image", "file"}
+
+var (
+	// ignoredRX matches comments, and elements whose content is not text.
+	ignoredRX = regexp.MustCompile(`(?is)<!--.*?-->|<script\b.*?</script\s*>|<style\b.*?</style\s*>|<template\b.*?</template\s*>`)
+	tagRX     = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)((?:\s+[^\s/>"'=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+	attrRX    = regexp.MustCompile(`([^\s/>"'=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+)
+
+// group is a fieldset, or an element with an ARIA group role, and the fields
+// directly inside it.
+type group struct {
+	tag    string
+	label  string
+	fields []int
+}
+
+// Parse reads the fields of a form. Only fields with an id attribute are
+// returned, as that is how fields are filled. Labels are taken from label
+// elements, either naming the field with a for attribute or wrapping it, and
+// otherwise from the aria-label, title or placeholder attributes. Groups are
+// taken from the innermost fieldset legend or group aria-label around the
+// field.
+func Parse(source string) []Field {
+	source = ignoredRX.ReplaceAllString(source, "")
+
+	var (
+		fields []Field
+		labels = make(map[string]string)
+
+		// The label element being read, and the fields it wraps
+		inLabel     bool
+		labelFor    string
+		labelText   strings.Builder
+		labelFields []int
+
+		// The groups being read, innermost last, and the legend being read
+		groups     []group
+		inLegend   bool
+		legendText strings.Builder
+
+		// The select and option being read
+		selectField    = -1
+		option         *Option
+		optionHasValue bool
+		optionText     strings.Builder
+	)
+
+	endOption := func() {
+		if option == nil {
+			return
+		}
+		option.Label = normalizeSpace(optionText.String())
+		if !optionHasValue {
+			option.Value = option.Label
+		}
+		if option.Label == option.Value {
+			option.Label = ""
+		}
+		fields[selectField].Options = append(fields[selectField].Options, *option)
+		option = nil
+	}
+
+	// endGroups ends the groups from the innermost one to the one at index
+	// i. Fields in a group without a label are part of the group around it.
+	endGroups := func(i int) {
+		for len(groups) > i {
+			g := groups[len(groups)-1]
+			groups = groups[:len(groups)-1]
+
+			if g.label == "" {
+				if len(groups) > 0 {
+					groups[len(groups)-1].fields = append(groups[len(groups)-1].fields, g.fields...)
+				}
+				continue
+			}
+			for _, field := range g.fields {
+				fields[field].Group = g.label
+			}
+		}
+	}
+
+	text := func(s string) {
+		s = html.UnescapeString(s)
+		if inLabel {
+			labelText.WriteString(s)
+		}
+		if inLegend {
+			legendText.WriteString(s)
+		}
+		if option != nil {
+			optionText.WriteString(s)
+		}
+	}
+
+	pos := 0
+	for _, m := range tagRX.FindAllStringSubmatchIndex(source, -1) {
+		text(source[pos:m[0]])
+		pos = m[1]
+
+		closing := m[3] > m[2]
+		tag := strings.ToLower(source[m[4]:m[5]])
+		attrs := parseAttrs(source[m[6]:m[7]])
+
+		switch {
+		case (tag == "fieldset" || attrs["role"] == "group" || attrs["role"] == "radiogroup") && !closing:
+			groups = append(groups, group{tag: tag, label: normalizeSpace(attrs["aria-label"])})
+		case tag == "legend" && !closing:
+			inLegend = true
+			legendText.Reset()
+		case tag == "legend" && closing && inLegend:
+			for i := len(groups) - 1; i >= 0; i-- {
+				if groups[i].tag == "fieldset" {
+					if groups[i].label == "" {
+						groups[i].label = normalizeSpace(legendText.String())
+					}
+					break
+				}
+			}
+			inLegend = false
+		case tag == "label" && !closing:
+			inLabel, labelFor, labelFields = true, attrs["for"], nil
+			labelText.Reset()
+		case tag == "label" && closing && inLabel:
+			label := normalizeSpace(labelText.String())
+			if labelFor != "" {
+				if _, ok := labels[labelFor]; !ok {
+					labels[labelFor] = label
+				}
+			}
+			for _, i := range labelFields {
+				if _, ok := labels[fields[i].ID]; !ok {
+					labels[fields[i].ID] = label
+				}
+			}
+			inLabel = false
+		case tag == "option" && !closing && selectField >= 0:
+			endOption()
+			option = &Option{Value: attrs["value"]}
+			optionHasValue = hasAttr(attrs, "value")
+			optionText.Reset()
+		case tag == "option" && closing:
+			endOption()
+		case tag == "select" && closing:
+			endOption()
+			selectField = -1
+		case (tag == "input" || tag == "select" || tag == "textarea") && !closing:
+			field, ok := newField(tag, attrs)
+			if !ok {
+				continue
+			}
+			fields = append(fields, field)
+			if len(groups) > 0 {
+				groups[len(groups)-1].fields = append(groups[len(groups)-1].fields, len(fields)-1)
+			}
+			if inLabel {
+				labelFields = append(labelFields, len(fields)-1)
+			}
+			if tag == "select" {
+				selectField = len(fields) - 1
+			}
+		}
+
+		if closing {
+			for i := len(groups) - 1; i >= 0; i-- {
+				if groups[i].tag == tag {
+					endGroups(i)
+					break
+				}
+			}
+		}
+	}
+	endGroups(0)
+
+	for i := range fields {
+		if label, ok := labels[fields[i].ID]; ok && label != "" {
+			fields[i].Label = label
+		}
+	}
+
+	return fields
+}
+
+func newField(tag string, attrs map[string]string) (Field, bool) {
+	field := Field{
+		ID:       attrs["id"],
+		Name:     attrs["name"],
+		Tag:      tag,
+		Required: hasAttr(attrs, "required") || attrs["aria-required"] == "true",
+		Pattern:  attrs["pattern"],
+	}
+	if autocomplete := strings.ToLower(normalizeSpace(attrs["autocomplete"])); autocomplete != "on" && autocomplete != "off" {
+		field.Autocomplete = autocomplete
+	}
+	if field.ID == "" {
+		return Field{}, false
+	}
+
+	if tag == "input" {
+		field.Type = strings.ToLower(attrs["type"])
+		if field.Type == "" {
+			field.Type = "text"
+		}
+		if slices.Contains(ignoredTypes, field.Type) {
+			return Field{}, false
+		}
+		if field.Type == "radio" || field.Type == "checkbox" {
+			field.Value = attrs["value"]
+		}
+	}
+
+	if n, err := strconv.Atoi(attrs["maxlength"]); err == nil && n > 0 {
+		field.MaxLength = n
+	}
+
+	for _, name := range []string{"aria-label", "title", "placeholder"} {
+		if label := normalizeSpace(attrs[name]); label != "" {
+			field.Label = label
+			break
+		}
+	}
+
+	return field, true
+}
+
+// parseAttrs parses the attributes of a tag. Names are lower case, values are
+// unescaped, and attributes without a value are set to an empty string.
+func parseAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+
+	for _, m := range attrRX.FindAllStringSubmatch(s, -1) {
+		name := strings.ToLower(m[1])
+		if _, ok := attrs[name]; ok {
+			continue
+		}
+		attrs[name] = html.UnescapeString(m[2] + m[3] + m[4])
+	}
+
+	return attrs
+}
+
+func hasAttr(attrs map[string]string, name string) bool {
+	_, ok := attrs[name]
+	return ok
+}
+
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,159 @@
+package form
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []Field
+	}{
+		{
+			name:   "Label for a field",
+			source: `<label for="surname">Surname <span>(required)</span></label><input id="surname" name="surname" type="text" required maxlength="100" autocomplete="family-name">`,
+			want:   []Field{{ID: "surname", Name: "surname", Tag: "input", Type: "text", Label: "Surname (required)", Autocomplete: "family-name", Required: true, MaxLength: 100}},
+		},
+		{
+			name:   "Label before it is named",
+			source: `<input id="city"><p>Write the city</p><label for="city">City</label>`,
+			want:   []Field{{ID: "city", Tag: "input", Type: "text", Label: "City"}},
+		},
+		{
+			name:   "Wrapping label",
+			source: `<label>Given names <input id="given" aria-required="true"></label>`,
+			want:   []Field{{ID: "given", Tag: "input", Type: "text", Label: "Given names", Required: true}},
+		},
+		{
+			name:   "First label wins",
+			source: `<label for="a">First</label><label for="a">Second</label><label>Wrapping <input id="a"></label>`,
+			want:   []Field{{ID: "a", Tag: "input", Type: "text", Label: "First"}},
+		},
+		{
+			name:   "Label attributes",
+			source: `<input id="a" aria-label="Aria" title="Title"><input id="b" title="Title" placeholder="Placeholder"><input id="c" placeholder=" Place  holder "><label for="d"> </label><input id="d" title="Title">`,
+			want: []Field{
+				{ID: "a", Tag: "input", Type: "text", Label: "Aria"},
+				{ID: "b", Tag: "input", Type: "text", Label: "Title"},
+				{ID: "c", Tag: "input", Type: "text", Label: "Place holder"},
+				{ID: "d", Tag: "input", Type: "text", Label: "Title"},
+			},
+		},
+		{
+			name: "Fieldset legend",
+			source: `<fieldset><legend>Date of <b>birth</b></legend>
+				<select id="year"><option>1974</option></select>
+				<div><input id="month" type="number"></div>
+			</fieldset><input id="after">`,
+			want: []Field{
+				{ID: "year", Tag: "select", Group: "Date of birth", Options: []Option{{Value: "1974"}}},
+				{ID: "month", Tag: "input", Type: "number", Group: "Date of birth"},
+				{ID: "after", Tag: "input", Type: "text"},
+			},
+		},
+		{
+			name: "Nested groups",
+			source: `<fieldset><legend>Applicant</legend>
+				<input id="surname">
+				<div role="radiogroup" aria-label="Sex">
+					<input id="f" name="sex" type="radio" value="F"><label for="f">Female</label>
+				</div>
+				<div role="group"><input id="unlabelled-group"></div>
+				<fieldset><legend>Spouse</legend><input id="spouse-surname"></fieldset>
+			</fieldset>`,
+			want: []Field{
+				{ID: "surname", Tag: "input", Type: "text", Group: "Applicant"},
+				{ID: "f", Name: "sex", Tag: "input", Type: "radio", Label: "Female", Group: "Sex", Value: "F"},
+				{ID: "unlabelled-group", Tag: "input", Type: "text", Group: "Applicant"},
+				{ID: "spouse-surname", Tag: "input", Type: "text", Group: "Spouse"},
+			},
+		},
+		{
+			name: "Options",
+			source: `<select id="sex" name="sex">
+				<option value="">Choose&hellip;</option>
+				<option value="F">Female</option>
+				<option>  Male  </option>
+				<option value="X">X
+			</select>`,
+			want: []Field{{ID: "sex", Name: "sex", Tag: "select", Options: []Option{
+				{Value: "", Label: "Choose…"},
+				{Value: "F", Label: "Female"},
+				{Value: "Male"},
+				{Value: "X"},
+			}}},
+		},
+		{
+			name: "Comments and scripts",
+			source: `<!-- <input id="commented"> -->
+				<script>document.write('<input id="scripted">')</script>
+				<SCRIPT type="module">const s = "<label for='a'>Script</label>"</SCRIPT>
+				<style>label::after { content: "<input id='styled'>" }</style>
+				<template><input id="templated"></template>
+				<label for="a">Real<!-- label --></label><input id="a">`,
+			want: []Field{{ID: "a", Tag: "input", Type: "text", Label: "Real"}},
+		},
+		{
+			name: "Fields that are left out",
+			source: `<input name="no-id">
+				<input id="hidden" type="hidden"><input id="submit" type="SUBMIT"><input id="file" type="file">
+				<button id="button">Go</button>
+				<textarea id="notes" maxlength="x"></textarea>
+				<input id="agree" type="checkbox" value="yes" autocomplete="off">`,
+			want: []Field{
+				{ID: "notes", Tag: "textarea"},
+				{ID: "agree", Tag: "input", Type: "checkbox", Value: "yes"},
+			},
+		},
+		{
+			name:   "Attributes",
+			source: `<INPUT ID='a' Name=b data-x="1 > 0" pattern="[A-Z&amp;]+" autocomplete=" Section-1  Family-Name " value="ignored" disabled>`,
+			want:   []Field{{ID: "a", Name: "b", Tag: "input", Type: "text", Autocomplete: "section-1 family-name", Pattern: "[A-Z&]+"}},
+		},
+		{
+			name:   "No form",
+			source: `<p>Nothing to fill</p>`,
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.source)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEvalForm(t *testing.T) {
+	fields := evalForm(t)
+
+	if len(fields) != 9 {
+		t.Fatalf("got %d fields, want 9", len(fields))
+	}
+
+	want := map[string]Field{
+		"lastName_input":               {Label: "Surname or last name Write your name exactly as it appears on your passport or identity document.", Autocomplete: "family-name", Required: true, MaxLength: 100},
+		"gender_radio-button-03-input": {Label: "Unknown", Group: "Gender", Value: "03", Required: true},
+	}
+
+	for _, field := range fields {
+		w, ok := want[field.ID]
+		if !ok {
+			continue
+		}
+		if field.Label != w.Label || field.Group != w.Group || field.Value != w.Value || field.Autocomplete != w.Autocomplete || field.Required != w.Required || field.MaxLength != w.MaxLength {
+			t.Errorf("got %+v for %s, want %+v", field, field.ID, w)
+		}
+	}
+
+	for _, field := range fields[2:5] {
+		if field.Group != "* Date of birth (required) Select your date of birth exactly as it appears on your passport." {
+			t.Errorf("got group %q for %s, want the date of birth", field.Group, field.ID)
+		}
+	}
+}
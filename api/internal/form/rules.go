@@ -0,0 +1,532 @@
+package form
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Profile fields that rules fill form fields from. They are named like the
+// fields extracted from passports and identity documents.
+const (
+	ProfileSurname        = "surname"
+	ProfileGivenNames     = "givenNames"
+	ProfileSex            = "sex"
+	ProfileDateOfBirth    = "dateOfBirth"
+	ProfilePlaceOfBirth   = "placeOfBirth"
+	ProfilePassportNumber = "passportNumber"
+	ProfileDateOfIssue    = "dateOfIssue"
+	ProfileDateOfExpiry   = "dateOfExpiry"
+)
+
+// Profile holds an applicant's details by profile field.
+type Profile map[string]string
+
+// Filled is a value that a rule filled a field with.
+type Filled struct {
+	FieldID string
+	Value   string
+	// Profile is the profile field that the value was taken from.
+	Profile string
+}
+
+// Parts of a date that is split across fields.
+const (
+	partYear  = "year"
+	partMonth = "month"
+	partDay   = "day"
+)
+
+// target is what a field is for: a profile field and, for a date split
+// across fields, the part of the date.
+type target struct {
+	profile string
+	part    string
+}
+
+var autocompleteTargets = map[string]target{
+	"family-name": {profile: ProfileSurname},
+	"given-name":  {profile: ProfileGivenNames},
+	"sex":         {profile: ProfileSex},
+	"bday":        {profile: ProfileDateOfBirth},
+	"bday-year":   {profile: ProfileDateOfBirth, part: partYear},
+	"bday-month":  {profile: ProfileDateOfBirth, part: partMonth},
+	"bday-day":    {profile: ProfileDateOfBirth, part: partDay},
+}
+
+// keyProfiles maps IDs and names, and their first and last segments, in
+// lower case without punctuation, to profile fields.
+var keyProfiles = map[string]string{
+	"surname":        ProfileSurname,
+	"lastname":       ProfileSurname,
+	"familyname":     ProfileSurname,
+	"givenname":      ProfileGivenNames,
+	"givennames":     ProfileGivenNames,
+	"firstname":      ProfileGivenNames,
+	"sex":            ProfileSex,
+	"gender":         ProfileSex,
+	"dob":            ProfileDateOfBirth,
+	"dateofbirth":    ProfileDateOfBirth,
+	"birthdate":      ProfileDateOfBirth,
+	"birthday":       ProfileDateOfBirth,
+	"placeofbirth":   ProfilePlaceOfBirth,
+	"cityofbirth":    ProfilePlaceOfBirth,
+	"birthplace":     ProfilePlaceOfBirth,
+	"passportnumber": ProfilePassportNumber,
+	"passportno":     ProfilePassportNumber,
+	"dateofissue":    ProfileDateOfIssue,
+	"issuedate":      ProfileDateOfIssue,
+	"dateofexpiry":   ProfileDateOfExpiry,
+	"expirydate":     ProfileDateOfExpiry,
+	"expirationdate": ProfileDateOfExpiry,
+}
+
+// labelProfiles maps the words that labels start with, in lower case
+// without punctuation, to profile fields.
+var labelProfiles = []struct {
+	phrase  string
+	profile string
+}{
+	{"surname", ProfileSurname},
+	{"last name", ProfileSurname},
+	{"family name", ProfileSurname},
+	{"given name", ProfileGivenNames},
+	{"first name", ProfileGivenNames},
+	{"sex", ProfileSex},
+	{"gender", ProfileSex},
+	{"date of birth", ProfileDateOfBirth},
+	{"place of birth", ProfilePlaceOfBirth},
+	{"city of birth", ProfilePlaceOfBirth},
+	{"passport number", ProfilePassportNumber},
+	{"date of issue", ProfileDateOfIssue},
+	{"issue date", ProfileDateOfIssue},
+	{"passport issue date", ProfileDateOfIssue},
+	{"date of expiry", ProfileDateOfExpiry},
+	{"expiry date", ProfileDateOfExpiry},
+	{"expiration date", ProfileDateOfExpiry},
+	{"passport expiry date", ProfileDateOfExpiry},
+	{"passport expiration date", ProfileDateOfExpiry},
+}
+
+// otherPeople are words in labels and groups that show a field is about
+// someone other than the applicant, such as "Spouse's surname".
+var otherPeople = []string{
+	"spouse", "partner", "father", "mother", "parent", "parents", "child", "children", "son", "daughter",
+	"sibling", "brother", "sister", "relative", "contact", "representative",
+}
+
+// Fill fills the fields that map directly to profile fields, and returns the
+// fields it could not fill. A field is recognized by its autocomplete
+// attribute, its ID or name, or its label, and the parts of a date split
+// across fields by the group they are in. Fields about other people, fields
+// whose profile field matches more than one field, and values that do not
+// fit their field are left unfilled.
+func Fill(fields []Field, profile Profile) ([]Filled, []Field) {
+	var (
+		order   []target
+		targets = make(map[target][]int)
+		units   = make(map[target]map[string]bool)
+	)
+
+	for i, field := range fields {
+		t, ok := fieldTarget(field)
+		if !ok || strings.TrimSpace(profile[t.profile]) == "" {
+			continue
+		}
+
+		if _, ok := targets[t]; !ok {
+			order = append(order, t)
+			units[t] = make(map[string]bool)
+		}
+		targets[t] = append(targets[t], i)
+		units[t][unitKey(field)] = true
+	}
+
+	var (
+		filled []Filled
+		done   = make(map[int]bool)
+	)
+
+	for _, t := range order {
+		// Radio buttons of the same group are one field
+		if len(units[t]) != 1 {
+			continue
+		}
+
+		indices := targets[t]
+		value := strings.TrimSpace(profile[t.profile])
+
+		var (
+			id string
+			ok bool
+		)
+		if fields[indices[0]].Type == "radio" {
+			i, found := chooseRadio(fields, indices, value)
+			id, value, ok = fields[i].ID, fields[i].Value, found
+		} else {
+			id = fields[indices[0]].ID
+			value, ok = formatValue(fields[indices[0]], t, value)
+		}
+		if !ok {
+			continue
+		}
+
+		filled = append(filled, Filled{FieldID: id, Value: value, Profile: t.profile})
+		for _, i := range indices {
+			done[i] = true
+		}
+	}
+
+	var rest []Field
+	for i, field := range fields {
+		if !done[i] {
+			rest = append(rest, field)
+		}
+	}
+
+	return filled, rest
+}
+
+// fieldTarget returns what a field is for, if a rule recognizes it.
+func fieldTarget(field Field) (target, bool) {
+	label, group := normalizeLabel(field.Label), normalizeLabel(field.Group)
+	if aboutOtherPerson(label) || aboutOtherPerson(group) {
+		return target{}, false
+	}
+
+	tokens := strings.Fields(field.Autocomplete)
+	if len(tokens) > 0 {
+		if t, ok := autocompleteTargets[tokens[len(tokens)-1]]; ok {
+			return t, true
+		}
+	}
+
+	keys := fieldKeys(field)
+
+	// The part of a date is for the date named by its key, such as dobYear,
+	// or else by its group
+	if part, profile := datePart(keys, label); part != "" {
+		if profile == "" {
+			profile = labelProfile(group)
+		}
+		if !isDate(profile) {
+			return target{}, false
+		}
+		return target{profile: profile, part: part}, true
+	}
+
+	for _, key := range keys {
+		if profile, ok := keyProfiles[key]; ok {
+			return target{profile: profile}, true
+		}
+	}
+
+	if profile := labelProfile(label); profile != "" {
+		return target{profile: profile}, true
+	}
+
+	// The label of a radio button is its option, so the group says what
+	// it is for
+	if field.Type == "radio" && labelProfile(group) == ProfileSex {
+		return target{profile: ProfileSex}, true
+	}
+
+	return target{}, false
+}
+
+// fieldKeys returns the ID and name of a field, and their first and last
+// segments, such as "lastname" for lastName_input, in lower case without
+// punctuation.
+func fieldKeys(field Field) []string {
+	var keys []string
+
+	for _, s := range []string{field.ID, field.Name} {
+		segments := strings.FieldsFunc(s, func(r rune) bool {
+			return strings.ContainsRune("_.-:[]", r)
+		})
+		if len(segments) == 0 {
+			continue
+		}
+
+		keys = append(keys, normalizeKey(s))
+		if len(segments) > 1 {
+			keys = append(keys, normalizeKey(segments[0]), normalizeKey(segments[len(segments)-1]))
+		}
+	}
+
+	return keys
+}
+
+// datePart returns the part of a date that a field is for, and the date
+// profile field if its key names one.
+func datePart(keys []string, label string) (string, string) {
+	for _, part := range []string{partYear, partMonth, partDay} {
+		for _, key := range keys {
+			if key == part {
+				return part, ""
+			}
+			if prefix, ok := strings.CutSuffix(key, part); ok && isDate(keyProfiles[prefix]) {
+				return part, keyProfiles[prefix]
+			}
+		}
+
+		if label == part || label == "select "+part {
+			return part, ""
+		}
+	}
+
+	return "", ""
+}
+
+func labelProfile(label string) string {
+	for _, l := range labelProfiles {
+		if label == l.phrase || strings.HasPrefix(label, l.phrase+" ") {
+			return l.profile
+		}
+	}
+
+	return ""
+}
+
+func isDate(profile string) bool {
+	return profile == ProfileDateOfBirth || profile == ProfileDateOfIssue || profile == ProfileDateOfExpiry
+}
+
+func aboutOtherPerson(label string) bool {
+	for _, word := range strings.Fields(label) {
+		if slices.Contains(otherPeople, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unitKey identifies the radio group of a radio button, or else the field.
+func unitKey(field Field) string {
+	if field.Type == "radio" && field.Name != "" {
+		return "radio:" + field.Name
+	}
+
+	return "id:" + field.ID
+}
+
+// formatValue formats a profile value for a field, returning false if it
+// does not fit the field.
+func formatValue(field Field, t target, value string) (string, bool) {
+	if field.Type == "radio" || field.Type == "checkbox" {
+		return "", false
+	}
+
+	switch {
+	case t.part != "":
+		date, ok := parseDate(value)
+		if !ok {
+			return "", false
+		}
+
+		return chooseValue(field, datePartValues(date, t.part)...)
+
+	case isDate(t.profile):
+		// Text fields for dates expect all sorts of formats, so only date
+		// inputs are filled
+		date, ok := parseDate(value)
+		if !ok || field.Type != "date" {
+			return "", false
+		}
+		return date.Format(time.DateOnly), true
+
+	case t.profile == ProfileSex:
+		sex := normalizeSex(value)
+		if sex == "" || field.Tag != "select" {
+			return "", false
+		}
+		return sexOption(field, sex)
+
+	case t.profile == ProfileSurname || t.profile == ProfileGivenNames:
+		if !validName(value) {
+			return "", false
+		}
+	}
+
+	return chooseValue(field, value)
+}
+
+// datePartValues returns the ways a part of a date is written, such as "03",
+// "3", "March" and "Mar" for the month.
+func datePartValues(date time.Time, part string) []string {
+	switch part {
+	case partYear:
+		return []string{fmt.Sprint(date.Year())}
+	case partMonth:
+		month := date.Month()
+		return []string{fmt.Sprintf("%02d", int(month)), fmt.Sprint(int(month)), month.String(), month.String()[:3]}
+	default:
+		return []string{fmt.Sprintf("%02d", date.Day()), fmt.Sprint(date.Day())}
+	}
+}
+
+// sexOption returns the value of the option of a select for a sex, as
+// returned by normalizeSex.
+func sexOption(field Field, sex string) (string, bool) {
+	for _, option := range field.Options {
+		if normalizeSex(option.Label) == sex || (option.Label == "" && normalizeSex(option.Value) == sex) {
+			return option.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// chooseValue returns the first of the candidate values that a field takes:
+// for a select, the value of the option with the candidate as its value or
+// label, and otherwise a candidate that fits in the field.
+func chooseValue(field Field, candidates ...string) (string, bool) {
+	if field.Tag == "select" {
+		for _, candidate := range candidates {
+			for _, option := range field.Options {
+				if option.Value == candidate {
+					return option.Value, true
+				}
+			}
+		}
+		for _, candidate := range candidates {
+			for _, option := range field.Options {
+				if option.Label != "" && strings.EqualFold(option.Label, candidate) {
+					return option.Value, true
+				}
+			}
+		}
+		return "", false
+	}
+
+	value := candidates[0]
+	if field.MaxLength > 0 && utf8.RuneCountInString(value) > field.MaxLength {
+		return "", false
+	}
+
+	return value, true
+}
+
+// sexCodes are the values of IRCC's sex radio buttons, used when their
+// labels cannot be read.
+var sexCodes = map[string]string{
+	"female":  "01",
+	"male":    "02",
+	"unknown": "03",
+	"another": "04",
+}
+
+// chooseRadio returns the radio button for a sex, chosen by its label or
+// else by IRCC's codes.
+func chooseRadio(fields []Field, indices []int, value string) (int, bool) {
+	sex := normalizeSex(value)
+	if sex == "" {
+		return 0, false
+	}
+
+	for _, i := range indices {
+		if normalizeSex(fields[i].Label) == sex {
+			return i, true
+		}
+	}
+
+	for _, i := range indices {
+		if normalizeSex(fields[i].Label) != "" {
+			return 0, false
+		}
+	}
+
+	for _, i := range indices {
+		if fields[i].Value == sexCodes[sex] {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// normalizeSex returns "female", "male", "another" or "unknown" for the
+// ways a sex is written in documents and forms, or an empty string.
+func normalizeSex(s string) string {
+	switch normalizeLabel(s) {
+	case "f", "female", "femme", "féminin", "feminin", "woman":
+		return "female"
+	case "m", "male", "homme", "masculin", "man":
+		return "male"
+	case "x", "another", "another gender", "other", "non binary", "nonbinary", "unspecified":
+		return "another"
+	case "u", "unknown":
+		return "unknown"
+	}
+
+	return ""
+}
+
+var dateLayouts = []string{
+	time.DateOnly,
+	"2006/01/02",
+	"2006.01.02",
+	"02 Jan 2006",
+	"2 Jan 2006",
+	"02 January 2006",
+	"2 January 2006",
+	"Jan 2, 2006",
+	"January 2, 2006",
+	time.RFC3339,
+}
+
+// parseDate parses a date in one of the unambiguous formats that documents
+// are extracted in. Dates such as 03/04/2001 could be either way round, so
+// they are not parsed.
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// validName reports whether a name only holds the characters that IRCC
+// accepts: English and French letters, hyphens, apostrophes and spaces, not
+// at either end.
+func validName(name string) bool {
+	if name == "" || strings.ContainsAny(name[:1]+name[len(name)-1:], "-' ") {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case r < utf8.RuneSelf && unicode.IsLetter(r):
+		case strings.ContainsRune("-' ", r):
+		case strings.ContainsRune("àâäçéèêëîïôöùûüÿæœÀÂÄÇÉÈÊËÎÏÔÖÙÛÜŸÆŒ", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeKey returns a key in lower case without punctuation.
+func normalizeKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// normalizeLabel returns the words of a label in lower case, without
+// punctuation.
+func normalizeLabel(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
@@ -0,0 +1,326 @@
+package form
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// evalForm returns the fields of the IRCC form that the eval samples are
+// filled into.
+func evalForm(t *testing.T) []Field {
+	t.Helper()
+
+	source, err := os.ReadFile("../../testdata/eval/form.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Parse(string(source))
+}
+
+// filledValues returns the filled values by field ID.
+func filledValues(filled []Filled) map[string]string {
+	values := make(map[string]string)
+	for _, f := range filled {
+		values[f.FieldID] = f.Value
+	}
+	return values
+}
+
+func fieldIDs(fields []Field) []string {
+	var ids []string
+	for _, field := range fields {
+		ids = append(ids, field.ID)
+	}
+	return ids
+}
+
+func TestFillEvalForm(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  Profile
+		want     map[string]string
+		wantRest []string
+	}{
+		{
+			name: "Passport",
+			profile: Profile{
+				ProfileSurname:        "ERIKSSON",
+				ProfileGivenNames:     "ANNA MARIA",
+				ProfileSex:            "F",
+				ProfileDateOfBirth:    "1974-08-12",
+				ProfilePassportNumber: "L898902C3",
+			},
+			want: map[string]string{
+				"lastName_input":               "ERIKSSON",
+				"firstName_input":              "ANNA MARIA",
+				"year_sltDateYear":             "1974",
+				"month_sltDateMonth":           "08",
+				"day_sltDateDay":               "12",
+				"gender_radio-button-01-input": "01",
+			},
+		},
+		{
+			name:    "Single digit day",
+			profile: Profile{ProfileDateOfBirth: "5 March 2001"},
+			want: map[string]string{
+				"year_sltDateYear":   "2001",
+				"month_sltDateMonth": "03",
+				"day_sltDateDay":     "5",
+			},
+			wantRest: []string{"lastName_input", "firstName_input", "gender_radio-button-02-input", "gender_radio-button-01-input", "gender_radio-button-03-input", "gender_radio-button-04-input"},
+		},
+		{
+			name:     "Ambiguous day and month",
+			profile:  Profile{ProfileDateOfBirth: "03/04/2001"},
+			want:     map[string]string{},
+			wantRest: []string{"year_sltDateYear", "month_sltDateMonth", "day_sltDateDay"},
+		},
+		{
+			name:     "Year out of range",
+			profile:  Profile{ProfileDateOfBirth: "1850-01-01"},
+			want:     map[string]string{"month_sltDateMonth": "01", "day_sltDateDay": "1"},
+			wantRest: []string{"year_sltDateYear"},
+		},
+		{
+			name:     "Invalid name",
+			profile:  Profile{ProfileSurname: "ERIKSSON2", ProfileGivenNames: "-ANNA"},
+			want:     map[string]string{},
+			wantRest: []string{"lastName_input", "firstName_input"},
+		},
+		{
+			// A name cut short to fit would be wrong on the application,
+			// so it is left for the applicant rather than truncated
+			name:     "Name over maxlength",
+			profile:  Profile{ProfileSurname: strings.Repeat("A", 101), ProfileGivenNames: strings.Repeat("A", 100)},
+			want:     map[string]string{"firstName_input": strings.Repeat("A", 100)},
+			wantRest: []string{"lastName_input"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := evalForm(t)
+
+			filled, rest := Fill(fields, tt.profile)
+
+			got := filledValues(filled)
+			if len(got) != len(tt.want) {
+				t.Errorf("got %d filled fields %v, want %d", len(got), got, len(tt.want))
+			}
+			for id, value := range tt.want {
+				if got[id] != value {
+					t.Errorf("got %q for %s, want %q", got[id], id, value)
+				}
+			}
+
+			restIDs := fieldIDs(rest)
+			for _, id := range tt.wantRest {
+				if !slices.Contains(restIDs, id) {
+					t.Errorf("%s was not left unfilled", id)
+				}
+			}
+		})
+	}
+}
+
+func TestFillGenderRadios(t *testing.T) {
+	tests := []struct {
+		sex  string
+		want string
+	}{
+		{sex: "F", want: "gender_radio-button-01-input"},
+		{sex: "Female", want: "gender_radio-button-01-input"},
+		{sex: "M", want: "gender_radio-button-02-input"},
+		{sex: "Homme", want: "gender_radio-button-02-input"},
+		{sex: "Unknown", want: "gender_radio-button-03-input"},
+		{sex: "X", want: "gender_radio-button-04-input"},
+		{sex: "Non-binary", want: "gender_radio-button-04-input"},
+		{sex: "<", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sex, func(t *testing.T) {
+			for _, labelled := range []bool{true, false} {
+				fields := evalForm(t)
+				if !labelled {
+					// IRCC's labels are sometimes rendered as images, and the
+					// codes of the values are all that is left
+					for i := range fields {
+						if fields[i].Type == "radio" {
+							fields[i].Label = ""
+						}
+					}
+				}
+
+				filled, rest := Fill(fields, Profile{ProfileSex: tt.sex})
+
+				if tt.want == "" {
+					if len(filled) != 0 || len(rest) != len(fields) {
+						t.Errorf("got %v filled, want none", filled)
+					}
+					continue
+				}
+				if len(filled) != 1 || filled[0].FieldID != tt.want || filled[0].Profile != ProfileSex {
+					t.Errorf("got %v filled with labels %t, want %s", filled, labelled, tt.want)
+					continue
+				}
+				if filled[0].Value != strings.TrimSuffix(strings.TrimPrefix(tt.want, "gender_radio-button-"), "-input") {
+					t.Errorf("got value %q for %s", filled[0].Value, tt.want)
+				}
+				for _, field := range rest {
+					if field.Type == "radio" {
+						t.Errorf("the radio button %s was left unfilled", field.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFillUnknownRadioLabels(t *testing.T) {
+	fields := []Field{
+		{ID: "sex-a", Name: "sex", Tag: "input", Type: "radio", Value: "02", Label: "Hombre", Group: "Sex"},
+		{ID: "sex-b", Name: "sex", Tag: "input", Type: "radio", Value: "01", Label: "Female", Group: "Sex"},
+	}
+
+	// A label that is read and does not match means the codes may not be
+	// IRCC's
+	filled, _ := Fill(fields, Profile{ProfileSex: "M"})
+	if len(filled) != 0 {
+		t.Errorf("got %v filled, want none", filled)
+	}
+
+	filled, _ = Fill(fields, Profile{ProfileSex: "F"})
+	if len(filled) != 1 || filled[0].FieldID != "sex-b" {
+		t.Errorf("got %v filled, want sex-b", filled)
+	}
+}
+
+func TestFillOtherPeople(t *testing.T) {
+	profile := Profile{ProfileSurname: "ERIKSSON", ProfileDateOfBirth: "1974-08-12"}
+
+	tests := []struct {
+		name  string
+		field Field
+	}{
+		{name: "Label", field: Field{ID: "spouseLastName", Tag: "input", Type: "text", Label: "Spouse's surname"}},
+		{name: "Label with a surname key", field: Field{ID: "surname", Tag: "input", Type: "text", Label: "Surname of your father"}},
+		{name: "Group", field: Field{ID: "lastName", Tag: "input", Type: "text", Label: "Last name", Group: "Details of your partner"}},
+		{name: "Autocomplete", field: Field{ID: "x1", Tag: "input", Type: "text", Autocomplete: "family-name", Group: "Emergency contact"}},
+		{name: "Date part", field: Field{ID: "year_sltDateYear", Tag: "select", Label: "Select year", Group: "Mother's date of birth", Options: []Option{{Value: "1974"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filled, rest := Fill([]Field{tt.field}, profile)
+			if len(filled) != 0 || len(rest) != 1 {
+				t.Errorf("got %v filled, want none", filled)
+			}
+		})
+	}
+}
+
+func TestFillAmbiguousFields(t *testing.T) {
+	fields := []Field{
+		{ID: "surname", Tag: "input", Type: "text"},
+		{ID: "applicant-surname", Tag: "input", Type: "text", Label: "Surname at birth"},
+		{ID: "givenName", Tag: "input", Type: "text"},
+	}
+
+	filled, rest := Fill(fields, Profile{ProfileSurname: "ERIKSSON", ProfileGivenNames: "ANNA"})
+
+	if len(filled) != 1 || filled[0].FieldID != "givenName" {
+		t.Errorf("got %v filled, want givenName", filled)
+	}
+	if ids := fieldIDs(rest); !slices.Equal(ids, []string{"surname", "applicant-surname"}) {
+		t.Errorf("got %v left, want both surname fields", ids)
+	}
+}
+
+func TestFillDates(t *testing.T) {
+	tests := []struct {
+		name  string
+		field Field
+		value string
+		want  string
+	}{
+		{name: "Date input", field: Field{ID: "dob", Tag: "input", Type: "date"}, value: "12 Aug 1974", want: "1974-08-12"},
+		{name: "Text input", field: Field{ID: "dob", Tag: "input", Type: "text"}, value: "1974-08-12", want: ""},
+		{name: "Month name", field: Field{ID: "dobMonth", Tag: "select", Options: []Option{{Value: "Jul"}, {Value: "Aug"}}}, value: "1974-08-12", want: "Aug"},
+		{name: "Month label", field: Field{ID: "dob-month", Tag: "select", Options: []Option{{Value: "7", Label: "July"}, {Value: "8", Label: "August"}}}, value: "1974-08-12", want: "8"},
+		{name: "Autocomplete", field: Field{ID: "f3", Tag: "input", Type: "text", Autocomplete: "section-1 bday-day", MaxLength: 2}, value: "1974-08-02", want: "02"},
+		{name: "Expiry group", field: Field{ID: "year", Tag: "input", Type: "text", Group: "Passport expiry date"}, value: "2030-01-01", want: "2030"},
+		{name: "Part without a date", field: Field{ID: "year", Tag: "input", Type: "text", Group: "Year of arrival"}, value: "2030-01-01", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := Profile{ProfileDateOfBirth: tt.value, ProfileDateOfExpiry: tt.value}
+
+			filled, _ := Fill([]Field{tt.field}, profile)
+
+			got := filledValues(filled)[tt.field.ID]
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		field Field
+		want  target
+		ok    bool
+	}{
+		{name: "Autocomplete", field: Field{ID: "a", Autocomplete: "shipping family-name"}, want: target{profile: ProfileSurname}, ok: true},
+		{name: "ID", field: Field{ID: "lastName"}, want: target{profile: ProfileSurname}, ok: true},
+		{name: "ID segment", field: Field{ID: "applicant_passportNumber"}, want: target{profile: ProfilePassportNumber}, ok: true},
+		{name: "Name", field: Field{ID: "f1", Name: "form[dateOfBirth]"}, want: target{profile: ProfileDateOfBirth}, ok: true},
+		{name: "Label", field: Field{ID: "f1", Label: "Place of birth (city)"}, want: target{profile: ProfilePlaceOfBirth}, ok: true},
+		{name: "Label prefix only", field: Field{ID: "f1", Label: "Surnames used before"}, ok: false},
+		{name: "Date part key", field: Field{ID: "dobYear"}, want: target{profile: ProfileDateOfBirth, part: partYear}, ok: true},
+		{name: "Date part group", field: Field{ID: "year_sltDateYear", Label: "Select year", Group: "Date of birth"}, want: target{profile: ProfileDateOfBirth, part: partYear}, ok: true},
+		{name: "Date part label", field: Field{ID: "f1", Label: "Day", Group: "Date of issue"}, want: target{profile: ProfileDateOfIssue, part: partDay}, ok: true},
+		{name: "Date part of nothing", field: Field{ID: "month_sltDateMonth", Group: "Gender"}, ok: false},
+		{name: "Sex radio group", field: Field{ID: "r1", Type: "radio", Label: "Female", Group: "Gender"}, want: target{profile: ProfileSex}, ok: true},
+		{name: "Unknown", field: Field{ID: "f1", Label: "Email address"}, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := fieldTarget(tt.field)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got %+v, %t, want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "ERIKSSON", want: true},
+		{name: "Anna Maria", want: true},
+		{name: "O'Brien-Smith", want: true},
+		{name: "Hélène Côté", want: true},
+		{name: "Müller", want: true},
+		{name: "Łukasz", want: false},
+		{name: "Anna2", want: false},
+		{name: "-Anna", want: false},
+		{name: "Anna'", want: false},
+		{name: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := validName(tt.name); got != tt.want {
+			t.Errorf("validName(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package form
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Transforms that a template applies to a profile value before filling a
+// field with it.
+const (
+	// TransformYear, TransformMonth and TransformDay take a part of a date,
+	// written the way the field's options are, such as "03" or "March".
+	TransformYear  = "year"
+	TransformMonth = "month"
+	TransformDay   = "day"
+	// TransformDate writes a date as YYYY-MM-DD.
+	TransformDate = "date"
+	// TransformSex writes a sex as "female", "male", "another" or
+	// "unknown", and picks the matching option of a select.
+	TransformSex   = "sex"
+	TransformUpper = "upper"
+	TransformLower = "lower"
+)
+
+// Transforms lists the transforms that templates can use.
+var Transforms = []string{TransformYear, TransformMonth, TransformDay, TransformDate, TransformSex, TransformUpper, TransformLower}
+
+// Template maps the fields of a known form page, recognized by its
+// fingerprint, to profile fields.
+type Template struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Version goes up by one every time the template is changed.
+	Version     int             `json:"version"`
+	Fingerprint string          `json:"fingerprint"`
+	Fields      []TemplateField `json:"fields"`
+}
+
+// TemplateField maps a field of a form to a profile field.
+type TemplateField struct {
+	FieldID string `json:"fieldId"`
+	Profile string `json:"profile"`
+	// Transform is one of Transforms, or empty to use the value as it is.
+	Transform string `json:"transform,omitempty"`
+	// When is the value, after the transform, that selects a radio button
+	// or checkbox.
+	When string `json:"when,omitempty"`
+	// Values maps values, after the transform, to the values that the field
+	// takes, such as "female" to "F". Values that are not listed are left
+	// unfilled.
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// Fingerprint identifies a form page by the IDs and labels of its fields, in
+// any order, so that a page matches its template whatever values or markup it
+// holds.
+func Fingerprint(fields []Field) string {
+	lines := make([]string, len(fields))
+	for i, field := range fields {
+		lines[i] = field.ID + "\x00" + field.Label
+	}
+	slices.Sort(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Fill fills the fields that the template maps to profile fields, and
+// returns the fields it could not fill, either because the profile has no
+// value for them or because the value does not fit the field. The radio
+// buttons and checkboxes that the template lists are all filled when one of
+// them is selected.
+func (t *Template) Fill(fields []Field, profile Profile) ([]Filled, []Field) {
+	byID := make(map[string]int, len(fields))
+	for i, field := range fields {
+		if _, ok := byID[field.ID]; !ok {
+			byID[field.ID] = i
+		}
+	}
+
+	var (
+		filled   []Filled
+		done     = make(map[int]bool)
+		selected = make(map[string]bool)
+		buttons  = make(map[string][]int)
+	)
+
+	for _, tf := range t.Fields {
+		i, ok := byID[tf.FieldID]
+		if !ok || done[i] {
+			continue
+		}
+		field := fields[i]
+
+		value := strings.TrimSpace(profile[tf.Profile])
+		if value == "" {
+			continue
+		}
+
+		if field.Type == "radio" || field.Type == "checkbox" {
+			value, ok = tf.transform(value)
+			if !ok {
+				continue
+			}
+
+			key := tf.Profile + "\x00" + field.Name
+			buttons[key] = append(buttons[key], i)
+			if value == tf.When && !selected[key] {
+				selected[key] = true
+				filled = append(filled, Filled{FieldID: field.ID, Value: field.Value, Profile: tf.Profile})
+			}
+			continue
+		}
+
+		value, ok = tf.fill(field, value)
+		if !ok {
+			continue
+		}
+
+		filled = append(filled, Filled{FieldID: field.ID, Value: value, Profile: tf.Profile})
+		done[i] = true
+	}
+
+	// Buttons are only done with if one of them was selected, and otherwise
+	// are left for something else to choose
+	for key, indices := range buttons {
+		if selected[key] {
+			for _, i := range indices {
+				done[i] = true
+			}
+		}
+	}
+
+	var rest []Field
+	for i, field := range fields {
+		if !done[i] {
+			rest = append(rest, field)
+		}
+	}
+
+	return filled, rest
+}
+
+// transform applies the transform to a value, returning false if the value
+// cannot be transformed, such as a date in an unknown format.
+func (tf *TemplateField) transform(value string) (string, bool) {
+	switch tf.Transform {
+	case TransformYear, TransformMonth, TransformDay, TransformDate:
+		date, ok := parseDate(value)
+		if !ok {
+			return "", false
+		}
+		if tf.Transform == TransformDate {
+			return date.Format(time.DateOnly), true
+		}
+		return datePartValues(date, tf.Transform)[0], true
+	case TransformSex:
+		sex := normalizeSex(value)
+		return sex, sex != ""
+	case TransformUpper:
+		return strings.ToUpper(value), true
+	case TransformLower:
+		return strings.ToLower(value), true
+	}
+
+	return value, true
+}
+
+// fill returns the value that a field, other than a radio button or
+// checkbox, is filled with.
+func (tf *TemplateField) fill(field Field, value string) (string, bool) {
+	transformed, ok := tf.transform(value)
+	if !ok {
+		return "", false
+	}
+
+	if tf.Values != nil {
+		mapped, ok := tf.Values[transformed]
+		if !ok {
+			return "", false
+		}
+		return chooseValue(field, mapped)
+	}
+
+	switch tf.Transform {
+	case TransformYear, TransformMonth, TransformDay:
+		date, _ := parseDate(value)
+		return chooseValue(field, datePartValues(date, tf.Transform)...)
+	case TransformSex:
+		if field.Tag == "select" {
+			return sexOption(field, transformed)
+		}
+	}
+
+	return chooseValue(field, transformed)
+}
@@ -0,0 +1,223 @@
+package form
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// evalTemplate returns the embedded template of the IRCC form in
+// testdata/eval/form.html.
+func evalTemplate(t *testing.T) Template {
+	t.Helper()
+
+	data, err := os.ReadFile("../../assets/forms/ircc-personal-details.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var template Template
+	err = json.Unmarshal(data, &template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return template
+}
+
+func TestFingerprint(t *testing.T) {
+	fields := evalForm(t)
+	want := Fingerprint(fields)
+
+	if want != evalTemplate(t).Fingerprint {
+		t.Errorf("got fingerprint %s for the eval form, want that of its template", want)
+	}
+
+	source, err := os.ReadFile("../../testdata/eval/form.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		fields []Field
+		same   bool
+	}{
+		{
+			name:   "Parsed again",
+			fields: Parse(string(source)),
+			same:   true,
+		},
+		{
+			name: "Fields in another order",
+			fields: func() []Field {
+				reversed := slices.Clone(fields)
+				slices.Reverse(reversed)
+				return reversed
+			}(),
+			same: true,
+		},
+		{
+			name:   "Values, options and markup changed",
+			fields: Parse(strings.NewReplacer(`value="2025"`, `value="2026"`, `class="`, `class="x `, `required=""`, "").Replace(string(source))),
+			same:   true,
+		},
+		{
+			name: "Label changed",
+			fields: func() []Field {
+				changed := slices.Clone(fields)
+				changed[0].Label = "Family name"
+				return changed
+			}(),
+			same: false,
+		},
+		{
+			name:   "Field removed",
+			fields: fields[1:],
+			same:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Fingerprint(tt.fields)
+			if (got == want) != tt.same {
+				t.Errorf("got fingerprint %s, want one that is the same as %s: %t", got, want, tt.same)
+			}
+		})
+	}
+
+}
+
+func TestTemplateFillEvalForm(t *testing.T) {
+	template := evalTemplate(t)
+
+	tests := []struct {
+		name     string
+		profile  Profile
+		want     map[string]string
+		wantRest int
+	}{
+		{
+			name:     "Passport",
+			profile:  Profile{ProfileSurname: "ERIKSSON", ProfileGivenNames: "ANNA MARIA", ProfileDateOfBirth: "1974-08-02", ProfileSex: "Female"},
+			want:     map[string]string{"lastName_input": "ERIKSSON", "firstName_input": "ANNA MARIA", "year_sltDateYear": "1974", "month_sltDateMonth": "08", "day_sltDateDay": "2", "gender_radio-button-01-input": "01"},
+			wantRest: 0,
+		},
+		{
+			name:     "Another gender",
+			profile:  Profile{ProfileSex: "X"},
+			want:     map[string]string{"gender_radio-button-04-input": "04"},
+			wantRest: 5,
+		},
+		{
+			// The radio buttons are left for the rules when none is selected
+			name:     "Unknown sex",
+			profile:  Profile{ProfileSex: "?"},
+			want:     map[string]string{},
+			wantRest: 9,
+		},
+		{
+			name:     "Ambiguous date",
+			profile:  Profile{ProfileDateOfBirth: "02/08/1974"},
+			want:     map[string]string{},
+			wantRest: 9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filled, rest := template.Fill(evalForm(t), tt.profile)
+
+			got := filledValues(filled)
+			if len(got) != len(tt.want) {
+				t.Errorf("got filled fields %v, want %v", got, tt.want)
+			}
+			for id, value := range tt.want {
+				if got[id] != value {
+					t.Errorf("got %q for %s, want %q", got[id], id, value)
+				}
+			}
+			if len(rest) != tt.wantRest {
+				t.Errorf("got %d fields left, want %d", len(rest), tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestTemplateFillTransforms(t *testing.T) {
+	months := Field{ID: "f", Tag: "select", Options: []Option{{Value: "Jan"}, {Value: "Feb"}, {Value: "Mar"}}}
+	sexes := Field{ID: "f", Tag: "select", Options: []Option{{Value: "1", Label: "Male"}, {Value: "2", Label: "Female"}}}
+	text := Field{ID: "f", Tag: "input", Type: "text"}
+
+	tests := []struct {
+		name  string
+		field Field
+		tf    TemplateField
+		value string
+		want  string
+		ok    bool
+	}{
+		{name: "None", field: text, tf: TemplateField{}, value: " Anna ", want: "Anna", ok: true},
+		{name: "Year", field: text, tf: TemplateField{Transform: TransformYear}, value: "2 March 2001", want: "2001", ok: true},
+		{name: "Month", field: text, tf: TemplateField{Transform: TransformMonth}, value: "2001-03-02", want: "03", ok: true},
+		{name: "Month option", field: months, tf: TemplateField{Transform: TransformMonth}, value: "2001-03-02", want: "Mar", ok: true},
+		{name: "Day", field: text, tf: TemplateField{Transform: TransformDay}, value: "2001-03-02", want: "02", ok: true},
+		{name: "Date", field: text, tf: TemplateField{Transform: TransformDate}, value: "Mar 2, 2001", want: "2001-03-02", ok: true},
+		{name: "Ambiguous date", field: text, tf: TemplateField{Transform: TransformDate}, value: "02/03/2001", ok: false},
+		{name: "Sex", field: text, tf: TemplateField{Transform: TransformSex}, value: "F", want: "female", ok: true},
+		{name: "Sex option", field: sexes, tf: TemplateField{Transform: TransformSex}, value: "F", want: "2", ok: true},
+		{name: "Sex without option", field: sexes, tf: TemplateField{Transform: TransformSex}, value: "X", ok: false},
+		{name: "Sex values", field: text, tf: TemplateField{Transform: TransformSex, Values: map[string]string{"female": "F", "male": "M"}}, value: "Femme", want: "F", ok: true},
+		{name: "Value not listed", field: text, tf: TemplateField{Transform: TransformSex, Values: map[string]string{"female": "F", "male": "M"}}, value: "X", ok: false},
+		{name: "Upper", field: text, tf: TemplateField{Transform: TransformUpper}, value: "Éloïse", want: "ÉLOÏSE", ok: true},
+		{name: "Lower", field: text, tf: TemplateField{Transform: TransformLower}, value: "ERIKSSON", want: "eriksson", ok: true},
+		{name: "Over maxlength", field: Field{ID: "f", Tag: "input", Type: "text", MaxLength: 3}, tf: TemplateField{}, value: "ANNA", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.tf.FieldID, tt.tf.Profile = "f", ProfileSurname
+			template := Template{Fields: []TemplateField{tt.tf}}
+
+			filled, rest := template.Fill([]Field{tt.field}, Profile{ProfileSurname: tt.value})
+
+			if !tt.ok {
+				if len(filled) != 0 || len(rest) != 1 {
+					t.Errorf("got %v filled, want none", filled)
+				}
+				return
+			}
+			if len(filled) != 1 || filled[0].Value != tt.want || filled[0].Profile != ProfileSurname {
+				t.Errorf("got %v filled, want %q", filled, tt.want)
+			}
+			if len(rest) != 0 {
+				t.Errorf("got %d fields left, want none", len(rest))
+			}
+		})
+	}
+}
+
+func TestTemplateFillMissingFields(t *testing.T) {
+	template := Template{Fields: []TemplateField{
+		{FieldID: "gone", Profile: ProfileSurname},
+		{FieldID: "surname", Profile: ProfileSurname},
+		{FieldID: "surname", Profile: ProfileGivenNames},
+		{FieldID: "tick", Profile: ProfileSex, Transform: TransformSex, When: "female"},
+	}}
+	fields := []Field{
+		{ID: "surname", Tag: "input", Type: "text"},
+		{ID: "tick", Name: "woman", Tag: "input", Type: "checkbox", Value: "yes"},
+	}
+
+	filled, rest := template.Fill(fields, Profile{ProfileSurname: "ERIKSSON", ProfileGivenNames: "ANNA", ProfileSex: "M"})
+
+	if len(filled) != 1 || filled[0].FieldID != "surname" || filled[0].Value != "ERIKSSON" {
+		t.Errorf("got %v filled, want only the surname", filled)
+	}
+	if len(rest) != 1 || rest[0].ID != "tick" {
+		t.Errorf("got %v left, want the checkbox", rest)
+	}
+}
@@ -0,0 +1,294 @@
+// Package formtemplates keeps the registry of form templates: the form pages
+// that come up over and over, such as those of the IRCC portal, and the
+// profile fields that their fields are filled from. Each template is a JSON
+// file named after its ID, such as ircc-personal-details.json.
+package formtemplates
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+)
+
+var (
+	// ErrReadOnly is returned when changing the templates of a registry
+	// without a directory.
+	ErrReadOnly = errors.New("formtemplates: the templates are read-only")
+	// ErrDuplicateFingerprint is returned when saving a template with the
+	// fingerprint of another one.
+	ErrDuplicateFingerprint = errors.New("formtemplates: another template has the same fingerprint")
+)
+
+var idRX = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// ValidID reports whether an ID can be used as a template's file name: lower
+// case letters, digits and hyphens, up to 64 characters.
+func ValidID(id string) bool {
+	return idRX.MatchString(id)
+}
+
+// Load reads the templates at the top level of fsys.
+func Load(fsys fs.FS) (map[string]form.Template, error) {
+	paths, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		templates    = make(map[string]form.Template, len(paths))
+		fingerprints = make(map[string]string, len(paths))
+	)
+
+	for _, path := range paths {
+		// Hidden files are templates being saved
+		if strings.HasPrefix(path, ".") {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		var t form.Template
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+
+		err = dec.Decode(&t)
+		if err != nil {
+			return nil, fmt.Errorf("formtemplates: %s: %w", path, err)
+		}
+
+		if t.ID != strings.TrimSuffix(path, ".json") {
+			return nil, fmt.Errorf("formtemplates: %s: the file must be named after the template's ID %q", path, t.ID)
+		}
+		if other, ok := fingerprints[t.Fingerprint]; ok {
+			return nil, fmt.Errorf("formtemplates: %s: %w: %s", path, ErrDuplicateFingerprint, other)
+		}
+
+		templates[t.ID] = t
+		fingerprints[t.Fingerprint] = t.ID
+	}
+
+	return templates, nil
+}
+
+// Registry holds the templates in use. A registry with a directory saves the
+// changes made to it there, and is otherwise read-only.
+type Registry struct {
+	dir string
+
+	mu        sync.RWMutex
+	templates map[string]form.Template
+}
+
+// New returns a registry of the templates in dir or, if dir is empty, a
+// read-only registry of the templates in fsys. A directory without any
+// templates, such as one that does not exist yet, is first seeded with the
+// templates in fsys.
+func New(fsys fs.FS, dir string) (*Registry, error) {
+	if dir == "" {
+		templates, err := Load(fsys)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Registry{templates: templates}, nil
+	}
+
+	err := seed(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := Load(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registry{dir: dir, templates: templates}, nil
+}
+
+// seed copies the templates in fsys to dir if it has none. Hidden files are
+// templates being saved, so they are neither copied nor counted.
+func seed(fsys fs.FS, dir string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range existing {
+		if !strings.HasPrefix(filepath.Base(path), ".") {
+			return nil
+		}
+	}
+
+	paths, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if strings.HasPrefix(path, ".") {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(filepath.Join(dir, path), data, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadOnly reports whether the templates cannot be changed.
+func (r *Registry) ReadOnly() bool {
+	return r.dir == ""
+}
+
+// List returns the templates, ordered by ID.
+func (r *Registry) List() []form.Template {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	templates := make([]form.Template, 0, len(r.templates))
+	for _, t := range r.templates {
+		templates = append(templates, t)
+	}
+	slices.SortFunc(templates, func(a, b form.Template) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return templates
+}
+
+// Get returns the template with the given ID, and whether it exists.
+func (r *Registry) Get(id string) (form.Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.templates[id]
+	return t, ok
+}
+
+// Match returns the template for a form page with the given fields, and
+// whether there is one.
+func (r *Registry) Match(fields []form.Field) (form.Template, bool) {
+	if len(fields) == 0 {
+		return form.Template{}, false
+	}
+	fingerprint := form.Fingerprint(fields)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, t := range r.templates {
+		if t.Fingerprint == fingerprint {
+			return t, true
+		}
+	}
+
+	return form.Template{}, false
+}
+
+// Save adds a template, or replaces the one with the same ID, and writes it
+// to the registry's directory. Its version is set to one more than that of
+// the template it replaces, or to 1. It returns the saved template and
+// whether it was added.
+func (r *Registry) Save(t form.Template) (form.Template, bool, error) {
+	if r.ReadOnly() {
+		return form.Template{}, false, ErrReadOnly
+	}
+	if !ValidID(t.ID) {
+		return form.Template{}, false, fmt.Errorf("formtemplates: invalid ID %q", t.ID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.templates {
+		if other.ID != t.ID && other.Fingerprint == t.Fingerprint {
+			return form.Template{}, false, ErrDuplicateFingerprint
+		}
+	}
+
+	old, exists := r.templates[t.ID]
+	t.Version = old.Version + 1
+
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return form.Template{}, false, err
+	}
+
+	// Write to a temporary file first, so that a failed write does not
+	// leave a broken template behind
+	tmp, err := os.CreateTemp(r.dir, "."+t.ID+"-*.json")
+	if err != nil {
+		return form.Template{}, false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err != nil {
+		tmp.Close()
+		return form.Template{}, false, err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return form.Template{}, false, err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(r.dir, t.ID+".json"))
+	if err != nil {
+		return form.Template{}, false, err
+	}
+
+	r.templates[t.ID] = t
+
+	return t, !exists, nil
+}
+
+// Delete removes a template and its file, and reports whether it existed.
+func (r *Registry) Delete(id string) (bool, error) {
+	if r.ReadOnly() {
+		return false, ErrReadOnly
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.templates[id]; !ok {
+		return false, nil
+	}
+
+	err := os.Remove(filepath.Join(r.dir, id+".json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	delete(r.templates, id)
+
+	return true, nil
+}
@@ -0,0 +1,262 @@
+package formtemplates
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"dev.danielrb/auto-imm/api/internal/form"
+)
+
+var testFields = []form.Field{
+	{ID: "lastName", Tag: "input", Type: "text", Label: "Surname"},
+	{ID: "firstName", Tag: "input", Type: "text", Label: "Given names"},
+}
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"names.json": {Data: []byte(`{
+  "id": "names",
+  "name": "Names",
+  "version": 3,
+  "fingerprint": "` + form.Fingerprint(testFields) + `",
+  "fields": [{"fieldId": "lastName", "profile": "surname"}]
+}`)},
+		"other.json":      {Data: []byte(`{"id": "other", "name": "Other", "version": 1, "fingerprint": "` + strings.Repeat("0", 64) + `", "fields": []}`)},
+		".names-123.json": {Data: []byte(`{`)},
+		"README.md":       {Data: []byte(`Not a template`)},
+	}
+}
+
+func TestLoad(t *testing.T) {
+	templates, err := Load(testFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(templates) != 2 || templates["names"].Version != 3 || templates["other"].Name != "Other" {
+		t.Errorf("got templates %+v, want names and other", templates)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr error
+	}{
+		{
+			name: "Invalid JSON",
+			fsys: fstest.MapFS{"a.json": {Data: []byte(`{"id": "a",`)}},
+		},
+		{
+			name: "Unknown field",
+			fsys: fstest.MapFS{"a.json": {Data: []byte(`{"id": "a", "colour": "red"}`)}},
+		},
+		{
+			name: "Named after another ID",
+			fsys: fstest.MapFS{"a.json": {Data: []byte(`{"id": "b"}`)}},
+		},
+		{
+			name: "Duplicate fingerprint",
+			fsys: fstest.MapFS{
+				"a.json": {Data: []byte(`{"id": "a", "fingerprint": "f"}`)},
+				"b.json": {Data: []byte(`{"id": "b", "fingerprint": "f"}`)},
+			},
+			wantErr: ErrDuplicateFingerprint,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"ircc-personal-details": true,
+		"a":                     true,
+		"0-9":                   true,
+		"":                      false,
+		"-a":                    false,
+		"A":                     false,
+		"a_b":                   false,
+		"../a":                  false,
+		"a.json":                false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := ValidID(id); got != want {
+			t.Errorf("ValidID(%q) = %t, want %t", id, got, want)
+		}
+	}
+}
+
+func TestReadOnlyRegistry(t *testing.T) {
+	r, err := New(testFS(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.ReadOnly() {
+		t.Error("got a registry that is not read-only")
+	}
+
+	_, _, err = r.Save(form.Template{ID: "new", Fingerprint: "f"})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got error %v saving, want %v", err, ErrReadOnly)
+	}
+
+	_, err = r.Delete("names")
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got error %v deleting, want %v", err, ErrReadOnly)
+	}
+
+	if _, ok := r.Get("names"); !ok {
+		t.Error("the template was deleted")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	r, err := New(testFS(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reordered := []form.Field{testFields[1], testFields[0]}
+	if got, ok := r.Match(reordered); !ok || got.ID != "names" {
+		t.Errorf("got %q, %t, want names", got.ID, ok)
+	}
+
+	changed := []form.Field{testFields[0], {ID: "firstName", Tag: "input", Type: "text", Label: "First name"}}
+	if got, ok := r.Match(changed); ok {
+		t.Errorf("got %q for a changed form, want no template", got.ID)
+	}
+
+	if got, ok := r.Match(nil); ok {
+		t.Errorf("got %q for a form without fields, want no template", got.ID)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "templates")
+
+	r, err := New(testFS(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.ReadOnly() {
+		t.Fatal("got a read-only registry")
+	}
+
+	// The directory is seeded with the templates of the file system
+	if got := r.List(); len(got) != 2 || got[0].ID != "names" || got[1].ID != "other" {
+		t.Fatalf("got templates %+v, want names and other", got)
+	}
+
+	t.Run("Save", func(t *testing.T) {
+		template := form.Template{
+			ID:          "passport",
+			Name:        "Passport",
+			Version:     10,
+			Fingerprint: strings.Repeat("a", 64),
+			Fields:      []form.TemplateField{{FieldID: "number", Profile: form.ProfilePassportNumber}},
+		}
+
+		saved, created, err := r.Save(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !created || saved.Version != 1 {
+			t.Errorf("got created %t with version %d, want a new template with version 1", created, saved.Version)
+		}
+
+		template.Name = "Passport page"
+		saved, created, err = r.Save(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created || saved.Version != 2 {
+			t.Errorf("got created %t with version %d, want a replaced template with version 2", created, saved.Version)
+		}
+
+		_, _, err = r.Save(form.Template{ID: "copy", Fingerprint: template.Fingerprint})
+		if !errors.Is(err, ErrDuplicateFingerprint) {
+			t.Errorf("got error %v, want %v", err, ErrDuplicateFingerprint)
+		}
+
+		_, _, err = r.Save(form.Template{ID: "../passport", Fingerprint: "f"})
+		if err == nil {
+			t.Error("got no error for an invalid ID")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		found, err := r.Delete("other")
+		if err != nil || !found {
+			t.Fatalf("got %t, %v, want the template deleted", found, err)
+		}
+
+		found, err = r.Delete("other")
+		if err != nil || found {
+			t.Errorf("got %t, %v deleting again, want not found", found, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "other.json")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got error %v for the file, want it removed", err)
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		// The changes are kept, and the directory is not seeded again as
+		// it has templates
+		r, err := New(testFS(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := r.List()
+		if len(got) != 2 || got[0].ID != "names" || got[1].ID != "passport" {
+			t.Fatalf("got templates %+v, want names and passport", got)
+		}
+		if got[1].Name != "Passport page" || got[1].Version != 2 {
+			t.Errorf("got %+v, want the second version of passport", got[1])
+		}
+
+		hidden, err := filepath.Glob(filepath.Join(dir, ".*"))
+		if err != nil || len(hidden) != 0 {
+			t.Errorf("got temporary files %v left behind", hidden)
+		}
+	})
+}
+
+func TestSeedLeftoverTemporaryFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// A save that was interrupted before any template was written
+	err := os.WriteFile(filepath.Join(dir, ".passport-123.json"), []byte(`{`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(testFS(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.List(); len(got) != 2 {
+		t.Errorf("got %d templates, want the directory seeded with 2", len(got))
+	}
+}
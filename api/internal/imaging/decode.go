@@ -0,0 +1,54 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "github.com/gen2brain/heic"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxDecodePixels is the largest width × height of an image that Decode
+// accepts. A small, highly compressed file can declare huge dimensions, and
+// decoding it takes four bytes per pixel or more, so images are checked
+// before they are decoded. It allows for the largest phone camera photos.
+const MaxDecodePixels = 50_000_000
+
+var (
+	// ErrDecode is returned when an image is corrupt or in a format that
+	// cannot be decoded.
+	ErrDecode = errors.New("image could not be decoded")
+	// ErrTooManyPixels is returned when an image is larger than
+	// MaxDecodePixels.
+	ErrTooManyPixels = errors.New("image has too many pixels")
+)
+
+// Decode decodes a single image in any of the supported formats, including
+// HEIC and WebP. The image's header is read first, and images over
+// MaxDecodePixels are rejected without being decoded.
+func Decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("%w: image is %d×%d pixels", ErrDecode, config.Width, config.Height)
+	}
+	if int64(config.Width)*int64(config.Height) > MaxDecodePixels {
+		return nil, fmt.Errorf("%w: image is %d×%d pixels", ErrTooManyPixels, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+
+	return img, nil
+}
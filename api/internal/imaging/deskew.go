@@ -0,0 +1,124 @@
+package imaging
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	deskewMaxAngle     = 5.0  // degrees
+	deskewStep         = 0.25 // degrees
+	deskewMinAngle     = 0.2  // degrees; smaller skews are left alone
+	deskewAnalysisSize = 800  // pixels on the longest edge
+	deskewDarkLevel    = 128
+)
+
+// deskew straightens a slightly rotated scan or photo of a document. It finds
+// the angle at which the dark pixels line up into the sharpest horizontal rows
+// (the projection profile method) and rotates the image by that angle.
+func deskew(img *image.RGBA) *image.RGBA {
+	angle := skewAngle(img)
+	if math.Abs(angle) < deskewMinAngle {
+		return img
+	}
+
+	return rotate(img, angle)
+}
+
+// skewAngle returns the rotation, in degrees, that best aligns the text in the
+// image with the horizontal axis.
+func skewAngle(img *image.RGBA) float64 {
+	b := img.Bounds()
+	sample := resize(img, float64(deskewAnalysisSize)/float64(max(b.Dx(), b.Dy())))
+	sb := sample.Bounds()
+
+	type point struct{ x, y float64 }
+	var dark []point
+
+	for y := 0; y < sb.Dy(); y++ {
+		for x := 0; x < sb.Dx(); x++ {
+			i := sample.PixOffset(sb.Min.X+x, sb.Min.Y+y)
+			if luminance(sample.Pix[i], sample.Pix[i+1], sample.Pix[i+2]) < deskewDarkLevel {
+				dark = append(dark, point{float64(x), float64(y)})
+			}
+		}
+	}
+
+	if len(dark) == 0 {
+		return 0
+	}
+
+	diagonal := int(math.Hypot(float64(sb.Dx()), float64(sb.Dy()))) + 1
+	rows := make([]int, 2*diagonal+1)
+
+	bestAngle, bestScore := 0.0, -1.0
+	for angle := -deskewMaxAngle; angle <= deskewMaxAngle; angle += deskewStep {
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		clear(rows)
+
+		for _, p := range dark {
+			row := int(p.x*sin+p.y*cos) + diagonal
+			rows[row]++
+		}
+
+		// Well aligned text produces a few very full rows and many empty
+		// ones, which maximises the sum of squares.
+		var score float64
+		for _, n := range rows {
+			score += float64(n) * float64(n)
+		}
+
+		if score > bestScore {
+			bestAngle, bestScore = angle, score
+		}
+	}
+
+	return bestAngle
+}
+
+// rotate rotates an image about its centre by the given angle in degrees,
+// keeping the original dimensions and filling uncovered areas with white.
+func rotate(img *image.RGBA, angle float64) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cx, cy := float64(w)/2, float64(h)/2
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			sx := dx*cos + dy*sin + cx
+			sy := -dx*sin + dy*cos + cy
+
+			di := dst.PixOffset(x, y)
+			if sx < 0 || sy < 0 || sx > float64(w-1) || sy > float64(h-1) {
+				dst.Pix[di], dst.Pix[di+1], dst.Pix[di+2], dst.Pix[di+3] = 0xFF, 0xFF, 0xFF, 0xFF
+				continue
+			}
+
+			bilinear(img, sx, sy, dst.Pix[di:di+4])
+		}
+	}
+
+	return dst
+}
+
+func bilinear(img *image.RGBA, x, y float64, out []uint8) {
+	b := img.Bounds()
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, b.Dx()-1), min(y0+1, b.Dy()-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	p00 := img.PixOffset(b.Min.X+x0, b.Min.Y+y0)
+	p10 := img.PixOffset(b.Min.X+x1, b.Min.Y+y0)
+	p01 := img.PixOffset(b.Min.X+x0, b.Min.Y+y1)
+	p11 := img.PixOffset(b.Min.X+x1, b.Min.Y+y1)
+
+	for c := 0; c < 4; c++ {
+		top := float64(img.Pix[p00+c])*(1-fx) + float64(img.Pix[p10+c])*fx
+		bottom := float64(img.Pix[p01+c])*(1-fx) + float64(img.Pix[p11+c])*fx
+		out[c] = uint8(top*(1-fy) + bottom*fy + 0.5)
+	}
+}
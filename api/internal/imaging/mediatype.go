@@ -0,0 +1,96 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+)
+
+const (
+	MediaTypeJPEG    = "image/jpeg"
+	MediaTypePNG     = "image/png"
+	MediaTypeGIF     = "image/gif"
+	MediaTypeWebP    = "image/webp"
+	MediaTypeTIFF    = "image/tiff"
+	MediaTypeHEIC    = "image/heic"
+	MediaTypePDF     = "application/pdf"
+	MediaTypeUnknown = "application/octet-stream"
+)
+
+// heifBrands are the ISO base media file format brands of HEIC images, as
+// found in the "ftyp" box at the start of the file. The generic mif1 and msf1
+// brands are left out, as AVIF images use them too.
+var heifBrands = [][]byte{
+	[]byte("heic"), []byte("heix"), []byte("hevc"), []byte("hevx"),
+	[]byte("heim"), []byte("heis"), []byte("hevm"), []byte("hevs"),
+}
+
+// DetectMediaType identifies a file from its magic bytes, ignoring any name or
+// declared content type. Files that are not recognised are reported using the
+// type returned by http.DetectContentType, so the caller can say what was
+// received.
+func DetectMediaType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return MediaTypeJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return MediaTypePNG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return MediaTypeGIF
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return MediaTypeWebP
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return MediaTypeTIFF
+	case isHEIF(data):
+		return MediaTypeHEIC
+	case isPDF(data):
+		return MediaTypePDF
+	}
+
+	mediaType := http.DetectContentType(data)
+	if i := bytes.IndexByte([]byte(mediaType), ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+
+	return mediaType
+}
+
+// IsPaged reports whether files of the media type can hold several pages and
+// so need to be rendered page by page.
+func IsPaged(mediaType string) bool {
+	return mediaType == MediaTypePDF || mediaType == MediaTypeTIFF
+}
+
+// isHEIF reports whether the "ftyp" box names a HEIC brand, either as its
+// major brand or as one of its compatible brands, since HEIC images often
+// have the generic mif1 brand as their major brand.
+func isHEIF(data []byte) bool {
+	if len(data) < 12 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return false
+	}
+
+	// The major brand is followed by a minor version, then the compatible
+	// brands up to the end of the box
+	size := min(int(binary.BigEndian.Uint32(data[0:4])), len(data))
+	brands := [][]byte{data[8:12]}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, data[i:i+4])
+	}
+
+	for _, brand := range brands {
+		for _, heif := range heifBrands {
+			if bytes.Equal(brand, heif) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isPDF allows for the junk that some scanners write before the header; the
+// PDF specification permits the header to start anywhere in the first 1024
+// bytes.
+func isPDF(data []byte) bool {
+	return bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-"))
+}
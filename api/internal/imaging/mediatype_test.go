@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/gif"
+	"testing"
+)
+
+// ftyp returns the start of an ISO base media file with the given major and
+// compatible brands.
+func ftyp(major string, compatible ...string) []byte {
+	box := []byte("\x00\x00\x00\x00ftyp" + major + "\x00\x00\x00\x00")
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	binary.BigEndian.PutUint32(box, uint32(len(box)))
+
+	return box
+}
+
+func TestDetectMediaType(t *testing.T) {
+	var gifData bytes.Buffer
+	err := gif.Encode(&gifData, testImage(8, 8), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "JPEG", data: encodeJPEG(t, testImage(8, 8)), want: MediaTypeJPEG},
+		{name: "PNG", data: encodePNG(t, testImage(8, 8)), want: MediaTypePNG},
+		{name: "GIF", data: gifData.Bytes(), want: MediaTypeGIF},
+		{name: "GIF87a", data: []byte("GIF87a\x08\x00\x08\x00"), want: MediaTypeGIF},
+		{name: "WebP", data: []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), want: MediaTypeWebP},
+		{name: "RIFF that is not WebP", data: []byte("RIFF\x24\x00\x00\x00WAVEfmt "), want: "audio/wave"},
+		{name: "Little-endian TIFF", data: []byte("II*\x00\x08\x00\x00\x00"), want: MediaTypeTIFF},
+		{name: "Big-endian TIFF", data: []byte("MM\x00*\x00\x00\x00\x08"), want: MediaTypeTIFF},
+		{name: "HEIC", data: ftyp("heic", "mif1", "heic"), want: MediaTypeHEIC},
+		{name: "HEIC with a generic major brand", data: ftyp("mif1", "mif1", "heic", "miaf"), want: MediaTypeHEIC},
+		{name: "HEIC sequence", data: ftyp("msf1", "msf1", "hevc"), want: MediaTypeHEIC},
+		{name: "AVIF", data: ftyp("avif", "mif1", "miaf", "MA1B"), want: MediaTypeUnknown},
+		{name: "AVIF with a generic major brand", data: ftyp("mif1", "avif", "mif1", "miaf"), want: MediaTypeUnknown},
+		{name: "Generic HEIF", data: ftyp("mif1", "mif1"), want: MediaTypeUnknown},
+		{name: "MP4", data: ftyp("isom", "isom", "mp41"), want: "video/mp4"},
+		{name: "HEIC brand after the ftyp box", data: append(ftyp("avif", "mif1"), "\x00\x00\x00\x0cheicheic"...), want: MediaTypeUnknown},
+		{name: "Truncated ftyp box", data: []byte("\x00\x00\x00\x18ftyphe"), want: MediaTypeUnknown},
+		{name: "PDF", data: []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), want: MediaTypePDF},
+		{name: "PDF after scanner junk", data: append(bytes.Repeat([]byte{0}, 500), "%PDF-1.4\n"...), want: MediaTypePDF},
+		{name: "PDF header too late", data: append(bytes.Repeat([]byte{' '}, 1024), "%PDF-1.4\n"...), want: "text/plain"},
+		{name: "Text", data: []byte("Surname: ERIKSSON"), want: "text/plain"},
+		{name: "HTML", data: []byte("<!DOCTYPE html><html>"), want: "text/html"},
+		{name: "Empty", data: nil, want: "text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectMediaType(tt.data); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPaged(t *testing.T) {
+	for mediaType, want := range map[string]bool{
+		MediaTypePDF:  true,
+		MediaTypeTIFF: true,
+		MediaTypeJPEG: false,
+		MediaTypeHEIC: false,
+	} {
+		if got := IsPaged(mediaType); got != want {
+			t.Errorf("IsPaged(%q) = %t, want %t", mediaType, got, want)
+		}
+	}
+}
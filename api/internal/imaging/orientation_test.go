@@ -0,0 +1,114 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// withOrientation returns a JPEG with an EXIF segment holding the given
+// orientation inserted after its start of image marker.
+func withOrientation(t *testing.T, data []byte, orientation int, order binary.ByteOrder) []byte {
+	t.Helper()
+
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	// One IFD entry, of type SHORT, followed by no next IFD
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, []uint16{exifOrientationTag, 3})
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, []uint16{uint16(orientation), 0})
+	binary.Write(&tiff, order, uint32(0))
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var out bytes.Buffer
+	out.Write(data[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(data[2:])
+
+	return out.Bytes()
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	data := encodeJPEG(t, testImage(8, 8))
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			got := jpegOrientation(withOrientation(t, data, orientation, order))
+			if got != orientation {
+				t.Errorf("got orientation %d from %v EXIF, want %d", got, order, orientation)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "No EXIF", data: data},
+		{name: "Not a JPEG", data: encodePNG(t, testImage(8, 8))},
+		{name: "Out of range", data: withOrientation(t, data, 9, binary.BigEndian)},
+		{name: "Truncated", data: withOrientation(t, data, 6, binary.BigEndian)[:20]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != 1 {
+				t.Errorf("got orientation %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// The stored image is 3×2, with a red top-left and a blue top-right
+	// corner.
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.SetRGBA(0, 0, red)
+	src.SetRGBA(2, 0, blue)
+
+	tests := []struct {
+		orientation int
+		wantSize    image.Point
+		wantRed     image.Point
+		wantBlue    image.Point
+	}{
+		{orientation: 1, wantSize: image.Pt(3, 2), wantRed: image.Pt(0, 0), wantBlue: image.Pt(2, 0)},
+		{orientation: 2, wantSize: image.Pt(3, 2), wantRed: image.Pt(2, 0), wantBlue: image.Pt(0, 0)},
+		{orientation: 3, wantSize: image.Pt(3, 2), wantRed: image.Pt(2, 1), wantBlue: image.Pt(0, 1)},
+		{orientation: 4, wantSize: image.Pt(3, 2), wantRed: image.Pt(0, 1), wantBlue: image.Pt(2, 1)},
+		{orientation: 5, wantSize: image.Pt(2, 3), wantRed: image.Pt(0, 0), wantBlue: image.Pt(0, 2)},
+		{orientation: 6, wantSize: image.Pt(2, 3), wantRed: image.Pt(1, 0), wantBlue: image.Pt(1, 2)},
+		{orientation: 7, wantSize: image.Pt(2, 3), wantRed: image.Pt(1, 2), wantBlue: image.Pt(1, 0)},
+		{orientation: 8, wantSize: image.Pt(2, 3), wantRed: image.Pt(0, 2), wantBlue: image.Pt(0, 0)},
+	}
+
+	for _, tt := range tests {
+		dst := applyOrientation(src, tt.orientation)
+
+		if dst.Bounds().Size() != tt.wantSize {
+			t.Errorf("orientation %d: got size %v, want %v", tt.orientation, dst.Bounds().Size(), tt.wantSize)
+			continue
+		}
+		if got := dst.RGBAAt(tt.wantRed.X, tt.wantRed.Y); got != red {
+			t.Errorf("orientation %d: got %v at %v, want red", tt.orientation, got, tt.wantRed)
+		}
+		if got := dst.RGBAAt(tt.wantBlue.X, tt.wantBlue.Y); got != blue {
+			t.Errorf("orientation %d: got %v at %v, want blue", tt.orientation, got, tt.wantBlue)
+		}
+	}
+}
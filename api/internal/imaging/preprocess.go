@@ -0,0 +1,295 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"slices"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+const minJPEGQuality = 40
+
+// ErrTooLarge is returned when an image cannot be encoded within the byte
+// budget even at the lowest quality and size settings.
+var ErrTooLarge = errors.New("image cannot be encoded within the size limit")
+
+// Options control how images are prepared before they are sent to an OCR
+// engine. Each engine has its own limits, so the application keeps one set of
+// Options per provider. Zero values disable the corresponding limit or step.
+type Options struct {
+	// MaxDimension is the longest edge, in pixels, an image may have.
+	MaxDimension int
+	// MaxPixels is the largest width × height an image may have.
+	MaxPixels int
+	// MaxBytes is the largest encoded size of the image.
+	MaxBytes int
+	// Format is the encoding used for preprocessed images, FormatJPEG or
+	// FormatPNG.
+	Format string
+	// JPEGQuality is the starting JPEG quality; it is lowered as needed to
+	// meet MaxBytes.
+	JPEGQuality int
+	// Accept lists the media types that may be passed through untouched when
+	// no other preprocessing is needed.
+	Accept []string
+	// MinDPI and MaxDPI bound the resolution that document pages are
+	// rendered at. Pages start at the highest resolution that fits the pixel
+	// limits and are retried at lower resolutions, down to MinDPI, until
+	// they fit MaxBytes.
+	MinDPI int
+	MaxDPI int
+
+	Grayscale         bool
+	NormalizeContrast bool
+	Deskew            bool
+}
+
+func (opts Options) filtersEnabled() bool {
+	return opts.Grayscale || opts.NormalizeContrast || opts.Deskew
+}
+
+// Encoded is an encoded image along with the settings used to produce it.
+type Encoded struct {
+	Data      []byte
+	MediaType string
+	Width     int
+	Height    int
+	// Quality is the JPEG quality used, or 0 for other formats.
+	Quality int
+	// DPI is the resolution a document page was rendered at, or 0 for
+	// uploaded images.
+	DPI int
+	// Attempts is the number of renders needed to fit the byte limit.
+	Attempts int
+}
+
+// Preprocess prepares a single uploaded image. It applies the EXIF
+// orientation, downsizes the image to fit the pixel limits, runs any enabled
+// filters and encodes the result within the byte limit. If none of that is
+// needed and the media type is accepted, the original data is returned as-is.
+func Preprocess(data []byte, mediaType string, opts Options) (Encoded, error) {
+	img, err := Decode(data)
+	if err != nil {
+		return Encoded{}, err
+	}
+
+	orientation := 1
+	if mediaType == MediaTypeJPEG {
+		orientation = jpegOrientation(data)
+	}
+
+	unchanged := orientation == 1 &&
+		!opts.filtersEnabled() &&
+		scaleFactor(img.Bounds(), opts) == 1 &&
+		(opts.MaxBytes == 0 || len(data) <= opts.MaxBytes) &&
+		slices.Contains(opts.Accept, mediaType)
+	if unchanged {
+		return Encoded{
+			Data:      data,
+			MediaType: mediaType,
+			Width:     img.Bounds().Dx(),
+			Height:    img.Bounds().Dy(),
+		}, nil
+	}
+
+	rgba := applyOrientation(toRGBA(img), orientation)
+
+	return Encode(PreprocessImage(rgba, opts), opts)
+}
+
+// PreprocessImage downsizes an already decoded image, such as a rendered PDF
+// page, and runs any enabled filters over it.
+func PreprocessImage(img image.Image, opts Options) image.Image {
+	rgba := resize(toRGBA(img), scaleFactor(img.Bounds(), opts))
+
+	if opts.Grayscale {
+		grayscale(rgba)
+	}
+
+	if opts.NormalizeContrast {
+		normalizeContrast(rgba)
+	}
+
+	if opts.Deskew {
+		rgba = deskew(rgba)
+	}
+
+	if opts.Grayscale {
+		gray := image.NewGray(rgba.Bounds())
+		draw.Draw(gray, gray.Bounds(), rgba, rgba.Bounds().Min, draw.Src)
+		return gray
+	}
+
+	return rgba
+}
+
+// Encode encodes an image in the configured format. JPEG images that exceed
+// MaxBytes are re-encoded at progressively lower quality, and then at smaller
+// sizes, until they fit.
+func Encode(img image.Image, opts Options) (Encoded, error) {
+	return encode(img, opts, true)
+}
+
+func encode(img image.Image, opts Options, allowResize bool) (Encoded, error) {
+	if opts.Format == FormatPNG {
+		var buf bytes.Buffer
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return Encoded{}, fmt.Errorf("failed to encode image as PNG: %w", err)
+		}
+
+		if opts.MaxBytes == 0 || buf.Len() <= opts.MaxBytes {
+			return Encoded{
+				Data:      buf.Bytes(),
+				MediaType: MediaTypePNG,
+				Width:     img.Bounds().Dx(),
+				Height:    img.Bounds().Dy(),
+			}, nil
+		}
+
+		// Fall through to JPEG, which compresses photos far better.
+	}
+
+	quality := opts.JPEGQuality
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+
+	for {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return Encoded{}, fmt.Errorf("failed to encode image as JPEG: %w", err)
+		}
+
+		if opts.MaxBytes == 0 || buf.Len() <= opts.MaxBytes {
+			return Encoded{
+				Data:      buf.Bytes(),
+				MediaType: MediaTypeJPEG,
+				Width:     img.Bounds().Dx(),
+				Height:    img.Bounds().Dy(),
+				Quality:   quality,
+			}, nil
+		}
+
+		switch {
+		case quality > minJPEGQuality:
+			quality = max(quality-10, minJPEGQuality)
+		case allowResize && img.Bounds().Dx() > 256 && img.Bounds().Dy() > 256:
+			img = resize(toRGBA(img), 0.75)
+		default:
+			return Encoded{}, ErrTooLarge
+		}
+	}
+}
+
+// scaleFactor returns the factor an image must be scaled by to fit within the
+// dimension and pixel limits. It never enlarges images.
+func scaleFactor(bounds image.Rectangle, opts Options) float64 {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	factor := 1.0
+
+	if opts.MaxDimension > 0 {
+		factor = min(factor, float64(opts.MaxDimension)/max(w, h))
+	}
+
+	if opts.MaxPixels > 0 {
+		factor = min(factor, math.Sqrt(float64(opts.MaxPixels)/(w*h)))
+	}
+
+	return factor
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+func resize(img *image.RGBA, factor float64) *image.RGBA {
+	if factor >= 1 {
+		return img
+	}
+
+	b := img.Bounds()
+	w := max(1, int(float64(b.Dx())*factor))
+	h := max(1, int(float64(b.Dy())*factor))
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+	return dst
+}
+
+// luminance returns the Rec. 601 luma of an 8-bit RGB pixel.
+func luminance(r, g, b uint8) uint8 {
+	return uint8((299*int(r) + 587*int(g) + 114*int(b)) / 1000)
+}
+
+func grayscale(img *image.RGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		y := luminance(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = y, y, y
+	}
+}
+
+// normalizeContrast stretches the luminance histogram so that the darkest and
+// lightest 1% of pixels map to black and white. This rescues faded scans and
+// photos taken in poor light.
+func normalizeContrast(img *image.RGBA) {
+	var histogram [256]int
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		histogram[luminance(img.Pix[i], img.Pix[i+1], img.Pix[i+2])]++
+	}
+
+	total := len(img.Pix) / 4
+	clip := total / 100
+
+	low, count := 0, 0
+	for ; low < 255; low++ {
+		count += histogram[low]
+		if count > clip {
+			break
+		}
+	}
+
+	high, count := 255, 0
+	for ; high > 0; high-- {
+		count += histogram[high]
+		if count > clip {
+			break
+		}
+	}
+
+	if high-low < 16 || (low == 0 && high == 255) {
+		return
+	}
+
+	var lookup [256]uint8
+	for v := range lookup {
+		stretched := (v - low) * 255 / (high - low)
+		lookup[v] = uint8(min(max(stretched, 0), 255))
+	}
+
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		img.Pix[i] = lookup[img.Pix[i]]
+		img.Pix[i+1] = lookup[img.Pix[i+1]]
+		img.Pix[i+2] = lookup[img.Pix[i+2]]
+	}
+}
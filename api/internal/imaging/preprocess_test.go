@@ -0,0 +1,237 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+)
+
+// testImage returns an image of the given size filled with noise, which
+// compresses poorly.
+func testImage(w, h int) *image.RGBA {
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.IntN(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// withPNGSize returns a PNG whose header declares the given size, without
+// the pixel data to match, as an attacker would send.
+func withPNGSize(data []byte, w, h uint32) []byte {
+	data = bytes.Clone(data)
+
+	// The IHDR chunk follows the 8-byte signature, with its length and type
+	// before its data and a CRC of the type and data after it.
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	return data
+}
+
+func TestPreprocess(t *testing.T) {
+	small := encodePNG(t, testImage(40, 20))
+
+	tests := []struct {
+		name          string
+		data          []byte
+		mediaType     string
+		opts          Options
+		wantMediaType string
+		wantWidth     int
+		wantHeight    int
+		wantUnchanged bool
+	}{
+		{
+			name:          "Accepted as is",
+			data:          small,
+			mediaType:     MediaTypePNG,
+			opts:          Options{MaxDimension: 100, Format: FormatJPEG, Accept: []string{MediaTypePNG}},
+			wantMediaType: MediaTypePNG,
+			wantWidth:     40,
+			wantHeight:    20,
+			wantUnchanged: true,
+		},
+		{
+			name:          "Media type not accepted",
+			data:          small,
+			mediaType:     MediaTypePNG,
+			opts:          Options{Format: FormatJPEG, Accept: []string{MediaTypeJPEG}},
+			wantMediaType: MediaTypeJPEG,
+			wantWidth:     40,
+			wantHeight:    20,
+		},
+		{
+			name:          "Over the maximum dimension",
+			data:          encodePNG(t, testImage(400, 200)),
+			mediaType:     MediaTypePNG,
+			opts:          Options{MaxDimension: 100, Format: FormatPNG, Accept: []string{MediaTypePNG}},
+			wantMediaType: MediaTypePNG,
+			wantWidth:     100,
+			wantHeight:    50,
+		},
+		{
+			name:          "Over the maximum pixels",
+			data:          encodePNG(t, testImage(400, 100)),
+			mediaType:     MediaTypePNG,
+			opts:          Options{MaxPixels: 10_000, Format: FormatPNG, Accept: []string{MediaTypePNG}},
+			wantMediaType: MediaTypePNG,
+			wantWidth:     200,
+			wantHeight:    50,
+		},
+		{
+			name:          "Filters enabled",
+			data:          small,
+			mediaType:     MediaTypePNG,
+			opts:          Options{Grayscale: true, Format: FormatPNG, Accept: []string{MediaTypePNG}},
+			wantMediaType: MediaTypePNG,
+			wantWidth:     40,
+			wantHeight:    20,
+		},
+		{
+			name:          "Rotated by EXIF",
+			data:          withOrientation(t, encodeJPEG(t, testImage(40, 20)), 6, binary.LittleEndian),
+			mediaType:     MediaTypeJPEG,
+			opts:          Options{Format: FormatJPEG, Accept: []string{MediaTypeJPEG}},
+			wantMediaType: MediaTypeJPEG,
+			wantWidth:     20,
+			wantHeight:    40,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := Preprocess(tt.data, tt.mediaType, tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if encoded.MediaType != tt.wantMediaType || encoded.Width != tt.wantWidth || encoded.Height != tt.wantHeight {
+				t.Errorf("got %s %d×%d, want %s %d×%d", encoded.MediaType, encoded.Width, encoded.Height, tt.wantMediaType, tt.wantWidth, tt.wantHeight)
+			}
+			if unchanged := bytes.Equal(encoded.Data, tt.data); unchanged != tt.wantUnchanged {
+				t.Errorf("got the original data %v, want %v", unchanged, tt.wantUnchanged)
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(encoded.Data))
+			if err != nil {
+				t.Fatalf("the encoded image does not decode: %v", err)
+			}
+			if img.Bounds().Dx() != tt.wantWidth || img.Bounds().Dy() != tt.wantHeight {
+				t.Errorf("the encoded image is %v, want %d×%d", img.Bounds(), tt.wantWidth, tt.wantHeight)
+			}
+			if tt.opts.Grayscale && img.ColorModel() != color.GrayModel {
+				t.Errorf("got color model %v, want gray", img.ColorModel())
+			}
+		})
+	}
+}
+
+func TestPreprocessMaxBytes(t *testing.T) {
+	data := encodePNG(t, testImage(300, 300))
+
+	encoded, err := Preprocess(data, MediaTypePNG, Options{MaxBytes: 40_000, Format: FormatPNG, JPEGQuality: 90})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(encoded.Data) > 40_000 {
+		t.Errorf("got %d bytes, want at most 40000", len(encoded.Data))
+	}
+	if encoded.MediaType != MediaTypeJPEG {
+		t.Errorf("got media type %s, want a PNG over the limit to fall back to JPEG", encoded.MediaType)
+	}
+	if encoded.Quality >= 90 && encoded.Width == 300 {
+		t.Errorf("got quality %d at %d×%d, want the quality or size lowered", encoded.Quality, encoded.Width, encoded.Height)
+	}
+
+	_, err = Preprocess(encodePNG(t, testImage(100, 100)), MediaTypePNG, Options{MaxBytes: 100, Format: FormatJPEG})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got error %v, want ErrTooLarge", err)
+	}
+}
+
+func TestPreprocessInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{name: "Not an image", data: []byte("%PDF-1.4 not an image"), wantErr: ErrDecode},
+		{name: "Truncated", data: encodePNG(t, testImage(40, 20))[:60], wantErr: ErrDecode},
+		{name: "Too many pixels", data: withPNGSize(encodePNG(t, testImage(4, 4)), 12_000, 12_000), wantErr: ErrTooManyPixels},
+		{name: "Too many pixels in one dimension", data: withPNGSize(encodePNG(t, testImage(4, 4)), 1_000_000, 51), wantErr: ErrTooManyPixels},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Preprocess(tt.data, MediaTypePNG, Options{Format: FormatJPEG})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScaleFactor(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		opts   Options
+		want   float64
+	}{
+		{name: "No limits", bounds: image.Rect(0, 0, 4000, 3000), want: 1},
+		{name: "Within limits", bounds: image.Rect(0, 0, 800, 600), opts: Options{MaxDimension: 1568, MaxPixels: 1_150_000}, want: 1},
+		{name: "Never enlarges", bounds: image.Rect(0, 0, 10, 10), opts: Options{MaxDimension: 1568}, want: 1},
+		{name: "Longest edge", bounds: image.Rect(0, 0, 3000, 4000), opts: Options{MaxDimension: 1000}, want: 0.25},
+		{name: "Pixels", bounds: image.Rect(0, 0, 2000, 2000), opts: Options{MaxPixels: 1_000_000}, want: 0.5},
+		{name: "Tightest limit", bounds: image.Rect(0, 0, 4000, 1000), opts: Options{MaxDimension: 2000, MaxPixels: 1_000_000}, want: 0.5},
+		{name: "Offset bounds", bounds: image.Rect(100, 100, 2100, 1100), opts: Options{MaxDimension: 1000}, want: 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scaleFactor(tt.bounds, tt.opts)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+const pointsPerInch = 72
+
+// PageRenderer is implemented by documents whose pages can be rasterised, such
+// as a *fitz.Document.
+type PageRenderer interface {
+	Bound(pageNumber int) (image.Rectangle, error)
+	ImageDPI(pageNumber int, dpi float64) (*image.RGBA, error)
+}
+
+// RenderPage renders a document page and encodes it within the limits in
+// opts. The page is first rendered at the highest resolution that fits the
+// pixel limits, capped at MaxDPI. If the encoded page is still over MaxBytes
+// at the lowest acceptable JPEG quality, it is rendered again at a lower
+// resolution, down to MinDPI, so text stays legible. As a last resort the
+// page is downscaled below MinDPI rather than rejected.
+func RenderPage(doc PageRenderer, pageNumber int, opts Options) (Encoded, error) {
+	bounds, err := doc.Bound(pageNumber)
+	if err != nil {
+		return Encoded{}, err
+	}
+
+	dpi := pageDPI(bounds, opts)
+	minDPI := min(dpi, max(opts.MinDPI, 1))
+
+	for attempt := 1; ; attempt++ {
+		img, err := doc.ImageDPI(pageNumber, float64(dpi))
+		if err != nil {
+			return Encoded{}, err
+		}
+
+		lastAttempt := dpi <= minDPI
+
+		encoded, err := encode(PreprocessImage(img, opts), opts, lastAttempt)
+		if err == nil {
+			encoded.DPI = dpi
+			encoded.Attempts = attempt
+			return encoded, nil
+		}
+
+		if !errors.Is(err, ErrTooLarge) || lastAttempt {
+			return Encoded{}, err
+		}
+
+		dpi = max(minDPI, dpi*85/100)
+	}
+}
+
+// pageDPI returns the highest resolution, capped at MaxDPI, at which a page
+// with the given bounds (in points) fits the dimension and pixel limits.
+func pageDPI(bounds image.Rectangle, opts Options) int {
+	dpi := float64(opts.MaxDPI)
+	if dpi == 0 {
+		dpi = 150
+	}
+
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	if w <= 0 || h <= 0 {
+		return int(dpi)
+	}
+
+	if opts.MaxDimension > 0 {
+		dpi = min(dpi, float64(opts.MaxDimension)*pointsPerInch/max(w, h))
+	}
+
+	if opts.MaxPixels > 0 {
+		dpi = min(dpi, pointsPerInch*math.Sqrt(float64(opts.MaxPixels)/(w*h)))
+	}
+
+	return max(1, int(dpi))
+}
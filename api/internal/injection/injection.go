@@ -0,0 +1,120 @@
+// Package injection looks for prompt injection in untrusted text, such as
+// the text of an uploaded document or a scraped form: passages written to
+// make an LLM ignore its instructions rather than to be read by a person.
+//
+// The patterns are a heuristic. They catch the common phrasings, so that
+// suspicious uploads can be flagged for review, but they are no substitute
+// for delimiting untrusted content in prompts and checking what the model
+// returns.
+package injection
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Rules that a finding can match.
+const (
+	// RuleIgnoreInstructions matches text telling the model to ignore or
+	// override its instructions.
+	RuleIgnoreInstructions = "ignore_instructions"
+	// RuleNewInstructions matches text claiming to give the model new
+	// instructions or a system prompt.
+	RuleNewInstructions = "new_instructions"
+	// RuleRoleChange matches text telling the model to take on another role.
+	RuleRoleChange = "role_change"
+	// RuleChatMarkup matches the markup that chat models use to separate
+	// turns, such as <|im_start|> or [INST].
+	RuleChatMarkup = "chat_markup"
+	// RuleFieldOverride matches text telling the model what to put in every
+	// field.
+	RuleFieldOverride = "field_override"
+	// RuleOutputOverride matches text telling the model what to reply with.
+	RuleOutputOverride = "output_override"
+)
+
+// The rules only match phrasings that are unlikely in genuine documents and
+// forms, which often tell the reader what to enter or which instructions to
+// follow.
+var rules = []struct {
+	name string
+	rx   *regexp.Regexp
+}{
+	{RuleIgnoreInstructions, regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override|bypass)\b[^.\n]{0,40}?\b(previous|above|prior|earlier|preceding|all|any|your|system)\b[^.\n]{0,20}?\b(instructions?|prompts?|rules|directions|guidelines)\b|\b(ignore|disregard|forget)\s+(everything\s+|all\s+)?(of\s+)?(the\s+)?(above|previous|preceding)\b`)},
+	{RuleNewInstructions, regexp.MustCompile(`(?i)\b(new|real|actual|hidden|secret)\s+(instructions?|directives?)\s*:|\bsystem\s+(prompt|message|instructions?)\b|\b(note|message|instructions?)\s+(to|for)\s+(the\s+)?(ai|assistant|model|llm|chatbot|language\s+model)\b`)},
+	{RuleRoleChange, regexp.MustCompile(`(?i)\byou\s+are\s+(now|no\s+longer)\b|\bpretend\s+(to\s+be|you\s+are)\b|\bfrom\s+now\s+on,?\s+you\b`)},
+	{RuleChatMarkup, regexp.MustCompile(`(?im)<\|?\s*(im_start|im_end|system|assistant|endoftext)\s*\|?>|\[/?INST\]|<</?SYS>>|^\s*(system|assistant)\s*:`)},
+	{RuleFieldOverride, regexp.MustCompile(`(?i)\b(set|fill|change|put|replace)\b[^.\n]{0,30}?\b(every|all|each)\b[^.\n]{0,15}?\b(fields?|values?)\s+(to|as)\b`)},
+	{RuleOutputOverride, regexp.MustCompile(`(?i)\b(respond|reply|return|output)\b[^.\n]{0,20}?\b(only|exactly|just)\b[^.\n]{0,20}?\bjson\b`)},
+}
+
+// invisibleRX matches zero-width and formatting characters, which can hide
+// injected text from a reader or split up its words.
+var invisibleRX = regexp.MustCompile(`[\x{00AD}\x{200B}-\x{200F}\x{202A}-\x{202E}\x{2060}-\x{2064}\x{FEFF}]`)
+
+// An excerpt includes up to excerptContext bytes either side of the match,
+// and is cut short at maxExcerptRunes.
+const (
+	excerptContext  = 40
+	maxExcerptRunes = 160
+)
+
+// Finding is a passage that looks like prompt injection.
+type Finding struct {
+	Rule string `json:"rule"`
+	// Source says which input the passage was found in. It is set by the
+	// caller.
+	Source  string `json:"source,omitempty"`
+	Excerpt string `json:"excerpt"`
+}
+
+// Scan looks for prompt injection in text, and returns the first passage
+// matching each rule.
+func Scan(text string) []Finding {
+	text = invisibleRX.ReplaceAllString(text, "")
+
+	var findings []Finding
+	for _, rule := range rules {
+		loc := rule.rx.FindStringIndex(text)
+		if loc == nil {
+			continue
+		}
+		findings = append(findings, Finding{Rule: rule.name, Excerpt: excerpt(text, loc[0], loc[1])})
+	}
+
+	return findings
+}
+
+// excerpt returns the matched passage with the rest of its sentence, up to a
+// few words either side, on one line.
+func excerpt(text string, start, end int) string {
+	from := strings.LastIndexAny(text[:start], ".\n") + 1
+	if start-from > excerptContext {
+		from = start - excerptContext
+		if i := strings.IndexByte(text[from:start], ' '); i >= 0 {
+			from += i + 1
+		} else {
+			from = start
+		}
+	}
+
+	to := len(text)
+	if i := strings.IndexAny(text[end:], ".\n"); i >= 0 {
+		to = end + i
+	}
+	if to-end > excerptContext {
+		to = end + excerptContext
+		if i := strings.LastIndexByte(text[end:to], ' '); i >= 0 {
+			to = end + i
+		} else {
+			to = end
+		}
+	}
+
+	s := strings.Join(strings.Fields(strings.ToValidUTF8(text[from:to], "")), " ")
+	if runes := []rune(s); len(runes) > maxExcerptRunes {
+		s = string(runes[:maxExcerptRunes]) + "…"
+	}
+
+	return s
+}
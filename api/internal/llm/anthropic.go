@@ -0,0 +1,192 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// Anthropic sends messages to Claude through Anthropic's API, one by one or
+// through the Message Batches API.
+type Anthropic struct {
+	client anthropic.Client
+	model  string
+}
+
+// NewAnthropic returns a provider for Anthropic's API.
+func NewAnthropic(apiKey, model string, opts ...option.RequestOption) *Anthropic {
+	opts = append([]option.RequestOption{option.WithAPIKey(apiKey)}, opts...)
+
+	return &Anthropic{
+		client: anthropic.NewClient(opts...),
+		model:  model,
+	}
+}
+
+func (p *Anthropic) Name() string {
+	return ProviderAnthropic
+}
+
+func (p *Anthropic) Model() string {
+	return p.model
+}
+
+func (p *Anthropic) Complete(ctx context.Context, req Request) (Response, error) {
+	params := p.params(req)
+
+	message, err := p.client.Messages.New(ctx, anthropic.MessageNewParams{
+		Model:     params.Model,
+		MaxTokens: params.MaxTokens,
+		Messages:  params.Messages,
+	})
+	if err != nil {
+		return Response{}, apiError(err)
+	}
+
+	return messageResponse(message), nil
+}
+
+// CreateBatch submits requests to the Message Batches API.
+func (p *Anthropic) CreateBatch(ctx context.Context, requests []BatchRequest) (Batch, error) {
+	if len(requests) > MaxBatchRequests {
+		return Batch{}, fmt.Errorf("llm: a batch can hold at most %d requests", MaxBatchRequests)
+	}
+
+	params := make([]anthropic.MessageBatchNewParamsRequest, len(requests))
+	for i, req := range requests {
+		params[i] = anthropic.MessageBatchNewParamsRequest{
+			CustomID: req.ID,
+			Params:   p.params(req.Request),
+		}
+	}
+
+	batch, err := p.client.Messages.Batches.New(ctx, anthropic.MessageBatchNewParams{Requests: params})
+	if err != nil {
+		return Batch{}, apiError(err)
+	}
+
+	return newBatch(batch), nil
+}
+
+func (p *Anthropic) GetBatch(ctx context.Context, id string) (Batch, error) {
+	batch, err := p.client.Messages.Batches.Get(ctx, id)
+	if err != nil {
+		return Batch{}, apiError(err)
+	}
+
+	return newBatch(batch), nil
+}
+
+func (p *Anthropic) BatchResults(ctx context.Context, id string) ([]BatchResult, error) {
+	stream := p.client.Messages.Batches.ResultsStreaming(ctx, id)
+	defer stream.Close()
+
+	var results []BatchResult
+	for stream.Next() {
+		line := stream.Current()
+		result := BatchResult{ID: line.CustomID}
+
+		switch line.Result.Type {
+		case "succeeded":
+			message := line.Result.AsSucceeded().Message
+			result.Response = messageResponse(&message)
+		case "errored":
+			e := line.Result.AsErrored().Error.Error
+			result.Err = &BatchError{Type: line.Result.Type, ErrorType: e.Type, Message: e.Message}
+		default:
+			result.Err = &BatchError{Type: line.Result.Type}
+		}
+
+		results = append(results, result)
+	}
+
+	err := stream.Err()
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	return results, nil
+}
+
+// params returns the parameters of a message with the request's parts.
+func (p *Anthropic) params(req Request) anthropic.MessageBatchNewParamsRequestParams {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+
+	blocks := make([]anthropic.ContentBlockParamUnion, len(req.Parts))
+	for i, part := range req.Parts {
+		if part.Image != nil {
+			blocks[i] = anthropic.NewImageBlockBase64(part.MediaType, base64.StdEncoding.EncodeToString(part.Image))
+		} else {
+			blocks[i] = anthropic.NewTextBlock(part.Text)
+		}
+		if part.Cache {
+			*blocks[i].GetCacheControl() = anthropic.NewCacheControlEphemeralParam()
+		}
+	}
+
+	return anthropic.MessageBatchNewParamsRequestParams{
+		Model:     anthropic.Model(model),
+		MaxTokens: int64(req.MaxTokens),
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(blocks...),
+		},
+	}
+}
+
+// apiError wraps the errors returned by Anthropic's API in an APIError.
+func apiError(err error) error {
+	var apiErr *anthropic.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	e := &APIError{Provider: ProviderAnthropic, StatusCode: apiErr.StatusCode, Err: err}
+	if apiErr.Response != nil {
+		e.RetryAfter = apiErr.Response.Header.Get("Retry-After")
+	}
+
+	return e
+}
+
+func messageResponse(message *anthropic.Message) Response {
+	var text string
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			text += block.Text
+		}
+	}
+
+	return Response{
+		Text: text,
+		Usage: Usage{
+			InputTokens:         int(message.Usage.InputTokens),
+			OutputTokens:        int(message.Usage.OutputTokens),
+			CacheReadTokens:     int(message.Usage.CacheReadInputTokens),
+			CacheCreationTokens: int(message.Usage.CacheCreationInputTokens),
+		},
+	}
+}
+
+func newBatch(batch *anthropic.MessageBatch) Batch {
+	return Batch{
+		ID:     batch.ID,
+		Status: string(batch.ProcessingStatus),
+		Counts: BatchCounts{
+			Processing: int(batch.RequestCounts.Processing),
+			Succeeded:  int(batch.RequestCounts.Succeeded),
+			Errored:    int(batch.RequestCounts.Errored),
+			Canceled:   int(batch.RequestCounts.Canceled),
+			Expired:    int(batch.RequestCounts.Expired),
+		},
+		CreatedAt: batch.CreatedAt,
+		ExpiresAt: batch.ExpiresAt,
+		EndedAt:   batch.EndedAt,
+	}
+}
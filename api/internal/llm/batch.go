@@ -0,0 +1,84 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Statuses of a batch.
+const (
+	BatchInProgress = "in_progress"
+	BatchCanceling  = "canceling"
+	BatchEnded      = "ended"
+)
+
+// MaxBatchRequests is the most requests that Anthropic's API accepts in one
+// batch.
+const MaxBatchRequests = 100_000
+
+// Batcher is implemented by providers that can process many requests as one
+// batch. A batch is processed asynchronously, usually within an hour and at
+// most within a day, at half the price of sending the requests one by one.
+type Batcher interface {
+	// CreateBatch submits requests to be processed as a batch.
+	CreateBatch(ctx context.Context, requests []BatchRequest) (Batch, error)
+	// GetBatch returns the current state of a batch.
+	GetBatch(ctx context.Context, id string) (Batch, error)
+	// BatchResults returns the results of a batch that has ended.
+	BatchResults(ctx context.Context, id string) ([]BatchResult, error)
+}
+
+// BatchRequest is a request in a batch. The ID identifies its result, and
+// may only hold letters, digits, hyphens and underscores.
+type BatchRequest struct {
+	ID string
+	Request
+}
+
+// Batch is the state of a batch.
+type Batch struct {
+	ID string `json:"id"`
+	// Status is BatchInProgress, BatchCanceling or BatchEnded.
+	Status    string      `json:"status"`
+	Counts    BatchCounts `json:"counts"`
+	CreatedAt time.Time   `json:"createdAt"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	// EndedAt is zero until the batch has ended.
+	EndedAt time.Time `json:"endedAt,omitzero"`
+}
+
+// BatchCounts counts the requests of a batch by how far they got.
+type BatchCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// BatchResult is the result of a request in a batch: either its response, or
+// why it failed.
+type BatchResult struct {
+	ID       string
+	Response Response
+	Err      error
+}
+
+// BatchError is the error of a request in a batch that did not succeed.
+type BatchError struct {
+	// Type is "errored", "canceled" or "expired".
+	Type string
+	// ErrorType and Message describe why an errored request failed, such
+	// as "invalid_request_error".
+	ErrorType string
+	Message   string
+}
+
+func (e *BatchError) Error() string {
+	if e.ErrorType == "" {
+		return fmt.Sprintf("batch request %s", e.Type)
+	}
+
+	return fmt.Sprintf("batch request %s: %s: %s", e.Type, e.ErrorType, e.Message)
+}
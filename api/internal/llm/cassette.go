@@ -0,0 +1,193 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Modes of a cassette.
+const (
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+)
+
+// ErrCassetteMiss is returned in replay mode for a request that has not been
+// recorded.
+var ErrCassetteMiss = errors.New("llm: no cassette recorded for request")
+
+// Cassette wraps a provider to record its replies to files, or to replay
+// recorded replies without calling it, so that prompts can be tested
+// repeatably and without paying for every run. Each request is stored in its
+// own file in the directory, named after a hash of the request.
+type Cassette struct {
+	provider Provider
+	dir      string
+	mode     string
+}
+
+// NewCassette returns a cassette in record or replay mode. In replay mode the
+// wrapped provider is never called, so it does not need an API key.
+func NewCassette(provider Provider, dir, mode string) (*Cassette, error) {
+	if mode != CassetteRecord && mode != CassetteReplay {
+		return nil, fmt.Errorf("llm: unknown cassette mode %q", mode)
+	}
+
+	if mode == CassetteRecord {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Cassette{provider: provider, dir: dir, mode: mode}, nil
+}
+
+// LoadCassettes returns a cassette that replays the recordings in dir, as made
+// by a provider with the given name and default model, such as "anthropic"
+// and DefaultModel. It needs no provider, and is meant for tests:
+//
+//	app.llm, err = llm.LoadCassettes("testdata/cassettes", llm.ProviderAnthropic, llm.DefaultModel)
+func LoadCassettes(dir, name, model string) (*Cassette, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("llm: cassette directory %s is not a directory", dir)
+	}
+
+	return NewCassette(replayOnly{name: name, model: model}, dir, CassetteReplay)
+}
+
+// replayOnly stands in for the provider of a cassette that only replays.
+type replayOnly struct {
+	name  string
+	model string
+}
+
+func (p replayOnly) Name() string {
+	return p.name
+}
+
+func (p replayOnly) Model() string {
+	return p.model
+}
+
+func (p replayOnly) Complete(ctx context.Context, req Request) (Response, error) {
+	return Response{}, ErrCassetteMiss
+}
+
+func (c *Cassette) Name() string {
+	return c.provider.Name()
+}
+
+func (c *Cassette) Model() string {
+	return c.provider.Model()
+}
+
+// cassetteRequest is the form of a request that is hashed and stored. Images
+// are stored as a hash of their data to keep cassettes small.
+type cassetteRequest struct {
+	Provider  string         `json:"provider"`
+	Model     string         `json:"model"`
+	MaxTokens int            `json:"maxTokens"`
+	Parts     []cassettePart `json:"parts"`
+}
+
+type cassettePart struct {
+	Text        string `json:"text,omitempty"`
+	MediaType   string `json:"mediaType,omitempty"`
+	ImageSHA256 string `json:"imageSha256,omitempty"`
+	Cache       bool   `json:"cache,omitempty"`
+}
+
+type cassetteFile struct {
+	Request  cassetteRequest `json:"request"`
+	Response string          `json:"response"`
+	// Usage is the usage of the recorded request, which is returned again
+	// on replay so that cache savings can be checked offline.
+	Usage Usage `json:"usage"`
+}
+
+func (c *Cassette) Complete(ctx context.Context, req Request) (Response, error) {
+	key := cassetteRequest{
+		Provider:  c.provider.Name(),
+		Model:     req.Model,
+		MaxTokens: req.MaxTokens,
+	}
+	if key.Model == "" {
+		key.Model = c.provider.Model()
+	}
+	for _, part := range req.Parts {
+		if part.Image != nil {
+			sum := sha256.Sum256(part.Image)
+			key.Parts = append(key.Parts, cassettePart{MediaType: part.MediaType, ImageSHA256: hex.EncodeToString(sum[:]), Cache: part.Cache})
+		} else {
+			key.Parts = append(key.Parts, cassettePart{Text: part.Text, Cache: part.Cache})
+		}
+	}
+
+	js, err := json.Marshal(key)
+	if err != nil {
+		return Response{}, err
+	}
+	sum := sha256.Sum256(js)
+	path := filepath.Join(c.dir, hex.EncodeToString(sum[:16])+".json")
+
+	if c.mode == CassetteReplay {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return Response{}, fmt.Errorf("%w: %s", ErrCassetteMiss, path)
+		}
+		if err != nil {
+			return Response{}, err
+		}
+
+		var file cassetteFile
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			return Response{}, fmt.Errorf("llm: invalid cassette %s: %w", path, err)
+		}
+
+		return Response{Text: file.Response, Usage: file.Usage}, nil
+	}
+
+	response, err := c.provider.Complete(ctx, req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	data, err := json.MarshalIndent(cassetteFile{Request: key, Response: response.Text, Usage: response.Usage}, "", "  ")
+	if err != nil {
+		return Response{}, err
+	}
+
+	// Write to a temporary file first so that a concurrent replay never
+	// reads half a cassette
+	tmp, err := os.CreateTemp(c.dir, ".cassette-*")
+	if err != nil {
+		return Response{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Response{}, err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return response, nil
+}
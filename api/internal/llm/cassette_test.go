@@ -0,0 +1,184 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// scriptedProvider replies to every request with the same response, and
+// counts the requests it receives.
+type scriptedProvider struct {
+	response Response
+	err      error
+	calls    int
+}
+
+func (p *scriptedProvider) Name() string {
+	return ProviderAnthropic
+}
+
+func (p *scriptedProvider) Model() string {
+	return DefaultModel
+}
+
+func (p *scriptedProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	p.calls++
+	return p.response, p.err
+}
+
+func TestCassetteRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cassettes")
+	ctx := context.Background()
+
+	image := []byte("\x89PNG\r\n\x1a\nimage")
+	req := Request{
+		MaxTokens: 256,
+		Parts:     []Part{{Text: "Classify this document.", Cache: true}, Image("image/png", image)},
+	}
+	recorded := Response{
+		Text:  `{"type": "passport", "confidence": 0.9}`,
+		Usage: Usage{InputTokens: 12, OutputTokens: 9, CacheReadTokens: 400},
+	}
+
+	provider := &scriptedProvider{response: recorded}
+	recorder, err := NewCassette(provider, dir, CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := recorder.Complete(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error recording: %v", err)
+	}
+	if resp != recorded || provider.calls != 1 {
+		t.Fatalf("got %+v after %d calls, want the provider's reply after 1", resp, provider.calls)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d cassette files, want 1", len(files))
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, image) {
+		t.Error("the cassette stores the image rather than its hash")
+	}
+
+	player, err := LoadCassettes(dir, ProviderAnthropic, DefaultModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = player.Complete(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error replaying: %v", err)
+	}
+	if resp != recorded {
+		t.Errorf("got %+v, want the recorded reply %+v", resp, recorded)
+	}
+
+	misses := []struct {
+		name string
+		req  Request
+	}{
+		{name: "Other prompt", req: Request{MaxTokens: 256, Parts: []Part{{Text: "Extract this document.", Cache: true}, Image("image/png", image)}}},
+		{name: "Other image", req: Request{MaxTokens: 256, Parts: []Part{{Text: "Classify this document.", Cache: true}, Image("image/png", []byte("\x89PNG\r\n\x1a\nother"))}}},
+		{name: "Other model", req: Request{Model: "claude-haiku-4-5", MaxTokens: 256, Parts: req.Parts}},
+		{name: "Other token limit", req: Request{MaxTokens: 512, Parts: req.Parts}},
+		{name: "Not cached", req: Request{MaxTokens: 256, Parts: []Part{Text("Classify this document."), Image("image/png", image)}}},
+	}
+
+	for _, tt := range misses {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := player.Complete(ctx, tt.req)
+			if !errors.Is(err, ErrCassetteMiss) {
+				t.Errorf("got error %v, want ErrCassetteMiss", err)
+			}
+		})
+	}
+
+	t.Run("Other provider", func(t *testing.T) {
+		player, err := LoadCassettes(dir, ProviderOpenAI, DefaultModel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = player.Complete(ctx, req)
+		if !errors.Is(err, ErrCassetteMiss) {
+			t.Errorf("got error %v, want ErrCassetteMiss", err)
+		}
+	})
+}
+
+func TestCassetteReplayNeverCallsProvider(t *testing.T) {
+	provider := &scriptedProvider{response: Response{Text: "live"}}
+
+	cassette, err := NewCassette(provider, t.TempDir(), CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cassette.Complete(context.Background(), Request{Parts: []Part{Text("Hi")}})
+	if !errors.Is(err, ErrCassetteMiss) {
+		t.Errorf("got error %v, want ErrCassetteMiss", err)
+	}
+	if provider.calls != 0 {
+		t.Errorf("the provider was called %d times in replay mode", provider.calls)
+	}
+}
+
+func TestCassetteRecordError(t *testing.T) {
+	dir := t.TempDir()
+	provider := &scriptedProvider{err: &APIError{Provider: ProviderAnthropic, StatusCode: 529, Err: errors.New("overloaded")}}
+
+	cassette, err := NewCassette(provider, dir, CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cassette.Complete(context.Background(), Request{Parts: []Part{Text("Hi")}})
+	if !Overloaded(err) {
+		t.Errorf("got error %v, want the provider's error", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d files after a failed request, want none", len(entries))
+	}
+}
+
+func TestLoadCassettes(t *testing.T) {
+	_, err := LoadCassettes(filepath.Join(t.TempDir(), "missing"), ProviderAnthropic, DefaultModel)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v, want os.ErrNotExist for a missing directory", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "cassette.json")
+	err = os.WriteFile(file, []byte("{}"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadCassettes(file, ProviderAnthropic, DefaultModel)
+	if err == nil {
+		t.Error("got no error for a file rather than a directory")
+	}
+
+	_, err = NewCassette(&scriptedProvider{}, t.TempDir(), "rewind")
+	if err == nil {
+		t.Error("got no error for an unknown mode")
+	}
+}
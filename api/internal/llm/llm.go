@@ -0,0 +1,178 @@
+// Package llm sends prompts, with text and images, to large language models
+// behind a common interface, so that the same requests can be served by
+// Anthropic's API or by a self-hosted model.
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// Names of the supported providers.
+const (
+	ProviderAnthropic = "anthropic"
+	ProviderOpenAI    = "openai"
+	ProviderOllama    = "ollama"
+)
+
+// Providers lists the names of the supported providers.
+var Providers = []string{ProviderAnthropic, ProviderOpenAI, ProviderOllama}
+
+// Provider sends a single user message to a model and returns its reply.
+type Provider interface {
+	// Name returns the name of the provider, such as "anthropic".
+	Name() string
+	// Model returns the model that requests are sent to unless they name
+	// another one.
+	Model() string
+	// Complete sends a message and returns the reply.
+	Complete(ctx context.Context, req Request) (Response, error)
+}
+
+// Request is a single user message.
+type Request struct {
+	// Model overrides the provider's default model if set.
+	Model     string
+	MaxTokens int
+	Parts     []Part
+}
+
+// Part is a piece of a message: either text, or an image with its media type.
+type Part struct {
+	Text      string
+	Image     []byte
+	MediaType string
+	// Cache marks the end of a prefix of the message that the provider may
+	// cache, so that later messages starting with the same parts are cheaper
+	// and faster. Anthropic's API allows up to four such parts per message,
+	// and only caches prefixes of at least 1024 tokens. Providers that do
+	// not support caching ignore it.
+	Cache bool
+}
+
+// Text returns a text part.
+func Text(text string) Part {
+	return Part{Text: text}
+}
+
+// Image returns an image part.
+func Image(mediaType string, data []byte) Part {
+	return Part{Image: data, MediaType: mediaType}
+}
+
+// Response is the reply to a request.
+type Response struct {
+	Text  string
+	Usage Usage
+}
+
+// Usage counts the tokens of a request. InputTokens only counts the input
+// that was not read from or written to the cache.
+type Usage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	// CacheReadTokens is the input read from the cache: the cache hits.
+	CacheReadTokens int `json:"cacheReadTokens"`
+	// CacheCreationTokens is the input written to the cache because it was
+	// not there yet: the cache misses.
+	CacheCreationTokens int `json:"cacheCreationTokens"`
+}
+
+// Add adds the tokens of another request.
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.CacheReadTokens += other.CacheReadTokens
+	u.CacheCreationTokens += other.CacheCreationTokens
+}
+
+// APIError is an error response from a provider's API.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	// RetryAfter is the value of the Retry-After header, if any.
+	RetryAfter string
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %v", e.Provider, e.StatusCode, http.StatusText(e.StatusCode), e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// statusOverloaded is the status that Anthropic's API returns when a model is
+// temporarily overloaded.
+const statusOverloaded = 529
+
+// Overloaded reports whether err means that the model is temporarily
+// overloaded, in which case the request may succeed with another model.
+func Overloaded(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == statusOverloaded || apiErr.StatusCode == http.StatusServiceUnavailable)
+}
+
+// Config selects and configures a provider.
+type Config struct {
+	// Provider is one of ProviderAnthropic, ProviderOpenAI or ProviderOllama.
+	Provider string
+	// Model is the default model. It defaults to DefaultModel for the
+	// Anthropic provider and must be set for the others.
+	Model string
+	// BaseURL is the URL of the API, such as http://localhost:8080/v1 for a
+	// llama.cpp server. It is required for the OpenAI provider, defaults to
+	// DefaultOllamaURL for the Ollama provider, and overrides the URL of
+	// Anthropic's API for the Anthropic provider, such as to point it at a
+	// proxy or at llmtest.Server.
+	BaseURL string
+	APIKey  string
+	// Timeout limits how long a request to an OpenAI-compatible API may
+	// take. Local models can be slow, so it defaults to five minutes.
+	Timeout time.Duration
+}
+
+const (
+	// DefaultModel is the default model of the Anthropic provider.
+	DefaultModel = "claude-sonnet-4-5"
+	// DefaultOllamaURL is the OpenAI-compatible API of a local Ollama
+	// server.
+	DefaultOllamaURL = "http://localhost:11434/v1"
+)
+
+// New returns the provider described by cfg.
+func New(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderAnthropic:
+		if cfg.Model == "" {
+			cfg.Model = DefaultModel
+		}
+		var opts []option.RequestOption
+		if cfg.BaseURL != "" {
+			opts = append(opts, option.WithBaseURL(cfg.BaseURL))
+		}
+		return NewAnthropic(cfg.APIKey, cfg.Model, opts...), nil
+	case ProviderOpenAI, ProviderOllama:
+		if cfg.BaseURL == "" && cfg.Provider == ProviderOllama {
+			cfg.BaseURL = DefaultOllamaURL
+		}
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("llm: a base URL is required for the %s provider", cfg.Provider)
+		}
+		if cfg.Model == "" {
+			return nil, fmt.Errorf("llm: a model is required for the %s provider", cfg.Provider)
+		}
+		if cfg.Timeout == 0 {
+			cfg.Timeout = 5 * time.Minute
+		}
+		return NewOpenAI(cfg.Provider, cfg.BaseURL, cfg.APIKey, cfg.Model, cfg.Timeout), nil
+	}
+
+	return nil, fmt.Errorf("llm: unknown provider %q", cfg.Provider)
+}
@@ -0,0 +1,435 @@
+// Package llmtest provides a fake of Anthropic's Messages API, and of its
+// Message Batches API, that returns scripted responses, so that code using
+// the llm package can be run without network access or an API key.
+//
+//	srv := llmtest.NewServer()
+//	defer srv.Close()
+//
+//	srv.Enqueue(llmtest.Reply(`{"type": "passport", "confidence": 0.9}`))
+//	provider := llm.NewAnthropic("test", llm.DefaultModel, option.WithBaseURL(srv.URL), option.WithMaxRetries(0))
+//
+// The Anthropic client retries rate limit and server errors, so disable
+// retries as above when scripting errors, or enqueue one error per attempt.
+package llmtest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response is a scripted response to one request.
+type Response struct {
+	// Text is the text of the reply. It is ignored if Status is set.
+	Text string
+	// Status, if set to anything other than 200, sends an error response
+	// with ErrorType and Message, such as 429 and "rate_limit_error".
+	Status    int
+	ErrorType string
+	Message   string
+	// Header is added to the response, such as a Retry-After header.
+	Header http.Header
+	// Delay is how long to wait before responding, to simulate latency.
+	// The wait ends early if the client gives up on the request.
+	Delay time.Duration
+}
+
+// Reply returns a successful response with the given text.
+func Reply(text string) Response {
+	return Response{Text: text}
+}
+
+// Error returns an error response in the format of Anthropic's API.
+func Error(status int, errorType, message string) Response {
+	return Response{Status: status, ErrorType: errorType, Message: message}
+}
+
+// Request is a request received by the server.
+type Request struct {
+	APIKey    string
+	Model     string
+	MaxTokens int
+	// Text holds the text blocks of the message, joined with newlines.
+	Text string
+	// Images is the number of image blocks in the message.
+	Images int
+	// CacheBreakpoints is the number of blocks marked with cache_control.
+	CacheBreakpoints int
+}
+
+// Server is a fake Messages API. Responses are returned in the order they
+// were enqueued; once they run out, every request gets a 500 error.
+//
+// Prompt caching is simulated: the prefix of a message up to each block
+// marked with cache_control is remembered, and the usage of later messages
+// starting with the same prefix reports it as read from the cache. Unlike the
+// real API, prefixes are cached whatever their length and never expire.
+// Tokens are counted as one for every four bytes of text.
+//
+// The requests of a batch take their responses from the script when the
+// batch is created, in order, and the batch is reported as in progress until
+// its state has been requested a number of times, set with SetBatchPolls.
+// Delays and headers of responses are ignored in batches.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	responses  []Response
+	requests   []Request
+	cache      map[[sha256.Size]byte]bool
+	batches    map[string]*batch
+	batchPolls int
+}
+
+// NewServer starts a fake Messages API. Point the Anthropic client at its URL
+// with option.WithBaseURL, and close it when done.
+func NewServer() *Server {
+	s := &Server{
+		cache:   make(map[[sha256.Size]byte]bool),
+		batches: make(map[string]*batch),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", s.handleMessage)
+	mux.HandleFunc("POST /v1/messages/batches", s.handleCreateBatch)
+	mux.HandleFunc("GET /v1/messages/batches/{id}", s.handleGetBatch)
+	mux.HandleFunc("GET /v1/messages/batches/{id}/results", s.handleBatchResults)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, Error(http.StatusNotFound, "not_found_error", "Not found: "+r.Method+" "+r.URL.Path))
+	})
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetBatchPolls sets how many times the state of a batch is reported as in
+// progress before the batch ends. It applies to batches created afterwards.
+func (s *Server) SetBatchPolls(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batchPolls = n
+}
+
+// Enqueue adds responses to the end of the script.
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses = append(s.responses, responses...)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+type messageRequest struct {
+	Model     string `json:"model"`
+	MaxTokens int    `json:"max_tokens"`
+	Messages  []struct {
+		Content []struct {
+			Type   string `json:"type"`
+			Text   string `json:"text"`
+			Source struct {
+				Data string `json:"data"`
+			} `json:"source"`
+			CacheControl *struct {
+				Type string `json:"type"`
+			} `json:"cache_control"`
+		} `json:"content"`
+	} `json:"messages"`
+}
+
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	var body messageRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, Error(http.StatusBadRequest, "invalid_request_error", err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	n, req, resp, usage := s.receive(r.Header.Get("X-Api-Key"), body)
+	s.mu.Unlock()
+
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		writeError(w, resp)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, message(n, req.Model, resp.Text, usage))
+}
+
+// receive records a request and takes the next response from the script,
+// along with the input usage of a successful response. The caller must hold
+// s.mu.
+func (s *Server) receive(apiKey string, body messageRequest) (int, Request, Response, map[string]any) {
+	req := Request{
+		APIKey:    apiKey,
+		Model:     body.Model,
+		MaxTokens: body.MaxTokens,
+	}
+	var (
+		text        []string
+		tokens      int
+		prefix      = sha256.New()
+		breakpoints []cachePrefix
+	)
+	io.WriteString(prefix, body.Model)
+	for _, message := range body.Messages {
+		for _, block := range message.Content {
+			switch block.Type {
+			case "text":
+				text = append(text, block.Text)
+				tokens += len(block.Text) / 4
+			case "image":
+				req.Images++
+			}
+			io.WriteString(prefix, "\x00"+block.Type+"\x00"+block.Text+block.Source.Data)
+
+			if block.CacheControl != nil {
+				req.CacheBreakpoints++
+				breakpoints = append(breakpoints, cachePrefix{key: [sha256.Size]byte(prefix.Sum(nil)), tokens: tokens})
+			}
+		}
+	}
+	req.Text = strings.Join(text, "\n")
+
+	s.requests = append(s.requests, req)
+	resp := Error(http.StatusInternalServerError, "api_error", "llmtest: no scripted response left")
+	if len(s.responses) > 0 {
+		resp = s.responses[0]
+		s.responses = s.responses[1:]
+	}
+	var usage map[string]any
+	if resp.Status == 0 || resp.Status == http.StatusOK {
+		usage = s.cacheUsage(breakpoints, tokens)
+		usage["output_tokens"] = len(resp.Text) / 4
+	}
+
+	return len(s.requests), req, resp, usage
+}
+
+// message returns a reply in the format of the Messages API.
+func message(n int, model, text string, usage map[string]any) map[string]any {
+	return map[string]any{
+		"id":            fmt.Sprintf("msg_llmtest_%d", n),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       []map[string]any{{"type": "text", "text": text}},
+		"stop_reason":   "end_turn",
+		"stop_sequence": nil,
+		"usage":         usage,
+	}
+}
+
+// batch is a batch created on the server, with the results of its requests.
+type batch struct {
+	id        string
+	createdAt time.Time
+	endedAt   time.Time
+	// polls is the number of times left that the batch is reported as in
+	// progress.
+	polls   int
+	results []map[string]any
+	counts  map[string]int
+}
+
+func (s *Server) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Requests []struct {
+			CustomID string         `json:"custom_id"`
+			Params   messageRequest `json:"params"`
+		} `json:"requests"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, Error(http.StatusBadRequest, "invalid_request_error", err.Error()))
+		return
+	}
+	if len(body.Requests) == 0 {
+		writeError(w, Error(http.StatusBadRequest, "invalid_request_error", "requests: must not be empty"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &batch{
+		id:        fmt.Sprintf("msgbatch_llmtest_%d", len(s.batches)+1),
+		createdAt: time.Now().UTC(),
+		polls:     s.batchPolls,
+		counts:    make(map[string]int),
+	}
+
+	for _, request := range body.Requests {
+		n, req, resp, usage := s.receive(r.Header.Get("X-Api-Key"), request.Params)
+
+		result := map[string]any{"type": "succeeded", "message": message(n, req.Model, resp.Text, usage)}
+		if resp.Status != 0 && resp.Status != http.StatusOK {
+			result = map[string]any{
+				"type": "errored",
+				"error": map[string]any{
+					"type":  "error",
+					"error": map[string]any{"type": resp.ErrorType, "message": resp.Message},
+				},
+			}
+		}
+
+		b.counts[result["type"].(string)]++
+		b.results = append(b.results, map[string]any{"custom_id": request.CustomID, "result": result})
+	}
+
+	if b.polls == 0 {
+		b.endedAt = b.createdAt
+	}
+	s.batches[b.id] = b
+
+	writeJSON(w, http.StatusOK, s.batchJSON(b))
+}
+
+func (s *Server) handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.batches[r.PathValue("id")]
+	if !ok {
+		writeError(w, Error(http.StatusNotFound, "not_found_error", "Batch not found"))
+		return
+	}
+
+	// The batch ends after it has been reported as in progress for the last
+	// time
+	data := s.batchJSON(b)
+	if b.polls > 0 {
+		b.polls--
+		if b.polls == 0 {
+			b.endedAt = time.Now().UTC()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (s *Server) handleBatchResults(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.batches[r.PathValue("id")]
+	switch {
+	case !ok:
+		writeError(w, Error(http.StatusNotFound, "not_found_error", "Batch not found"))
+		return
+	case b.endedAt.IsZero():
+		writeError(w, Error(http.StatusBadRequest, "invalid_request_error", "Batch is still in progress"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-jsonl")
+	enc := json.NewEncoder(w)
+	for _, result := range b.results {
+		enc.Encode(result)
+	}
+}
+
+// batchJSON returns the state of a batch in the format of the Message
+// Batches API. The caller must hold s.mu.
+func (s *Server) batchJSON(b *batch) map[string]any {
+	status, endedAt := "in_progress", any(nil)
+	counts := map[string]int{"processing": len(b.results), "succeeded": 0, "errored": 0, "canceled": 0, "expired": 0}
+	if !b.endedAt.IsZero() {
+		status, endedAt = "ended", b.endedAt
+		counts["processing"] = 0
+		for typ, n := range b.counts {
+			counts[typ] = n
+		}
+	}
+
+	return map[string]any{
+		"id":                  b.id,
+		"type":                "message_batch",
+		"processing_status":   status,
+		"request_counts":      counts,
+		"created_at":          b.createdAt,
+		"expires_at":          b.createdAt.Add(24 * time.Hour),
+		"ended_at":            endedAt,
+		"archived_at":         nil,
+		"cancel_initiated_at": nil,
+		"results_url":         s.URL + "/v1/messages/batches/" + b.id + "/results",
+	}
+}
+
+// cachePrefix is the prefix of a message up to a cache breakpoint.
+type cachePrefix struct {
+	key    [sha256.Size]byte
+	tokens int
+}
+
+// cacheUsage works out the input usage of a message with the given cache
+// breakpoints and total input tokens, and caches its prefixes. The caller
+// must hold s.mu.
+func (s *Server) cacheUsage(breakpoints []cachePrefix, tokens int) map[string]any {
+	var read, created int
+
+	// The longest cached prefix is read from the cache, and the rest of the
+	// message up to the last breakpoint is written to it
+	for i := len(breakpoints) - 1; i >= 0; i-- {
+		if s.cache[breakpoints[i].key] {
+			read = breakpoints[i].tokens
+			break
+		}
+	}
+	if len(breakpoints) > 0 {
+		created = breakpoints[len(breakpoints)-1].tokens - read
+	}
+	for _, bp := range breakpoints {
+		s.cache[bp.key] = true
+	}
+
+	return map[string]any{
+		"input_tokens":                tokens - read - created,
+		"cache_read_input_tokens":     read,
+		"cache_creation_input_tokens": created,
+	}
+}
+
+func writeError(w http.ResponseWriter, resp Response) {
+	writeJSON(w, resp.Status, map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    resp.ErrorType,
+			"message": resp.Message,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,167 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAI sends messages to any API compatible with OpenAI's chat completions,
+// which includes Ollama, llama.cpp's server and vLLM. Images are sent as data
+// URLs, so the model must support vision to read them.
+type OpenAI struct {
+	name    string
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+// NewOpenAI returns a provider for the OpenAI-compatible API at baseURL, such
+// as http://localhost:11434/v1. The API key may be empty for local servers.
+func NewOpenAI(name, baseURL, apiKey, model string, timeout time.Duration) *OpenAI {
+	return &OpenAI{
+		name:    name,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (p *OpenAI) Name() string {
+	return p.name
+}
+
+func (p *OpenAI) Model() string {
+	return p.model
+}
+
+type openAIContent struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content []openAIContent `json:"content"`
+}
+
+type openAIRequest struct {
+	Model     string          `json:"model"`
+	MaxTokens int             `json:"max_tokens,omitempty"`
+	Messages  []openAIMessage `json:"messages"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	// Usage is not returned by every server. OpenAI caches long prompts
+	// by itself and reports the cached part of the prompt.
+	Usage *struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails *struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *OpenAI) Complete(ctx context.Context, req Request) (Response, error) {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+
+	message := openAIMessage{Role: "user"}
+	for _, part := range req.Parts {
+		if part.Image != nil {
+			url := "data:" + part.MediaType + ";base64," + base64.StdEncoding.EncodeToString(part.Image)
+			message.Content = append(message.Content, openAIContent{Type: "image_url", ImageURL: &openAIImageURL{URL: url}})
+		} else {
+			message.Content = append(message.Content, openAIContent{Type: "text", Text: part.Text})
+		}
+	}
+
+	body, err := json.Marshal(openAIRequest{
+		Model:     model,
+		MaxTokens: req.MaxTokens,
+		Messages:  []openAIMessage{message},
+	})
+	if err != nil {
+		return Response{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return Response{}, err
+	}
+
+	var completion openAIResponse
+	decodeErr := json.Unmarshal(respBody, &completion)
+
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(respBody))
+		if decodeErr == nil && completion.Error != nil {
+			msg = completion.Error.Message
+		}
+		return Response{}, &APIError{
+			Provider:   p.name,
+			StatusCode: resp.StatusCode,
+			RetryAfter: resp.Header.Get("Retry-After"),
+			Err:        errors.New(msg),
+		}
+	}
+
+	if decodeErr != nil {
+		return Response{}, fmt.Errorf("%s: failed to decode response: %w", p.name, decodeErr)
+	}
+	if len(completion.Choices) == 0 {
+		return Response{}, fmt.Errorf("%s: response has no choices", p.name)
+	}
+
+	response := Response{Text: completion.Choices[0].Message.Content}
+	if u := completion.Usage; u != nil {
+		response.Usage.InputTokens = u.PromptTokens
+		response.Usage.OutputTokens = u.CompletionTokens
+		if u.PromptTokensDetails != nil {
+			response.Usage.CacheReadTokens = u.PromptTokensDetails.CachedTokens
+			response.Usage.InputTokens -= u.PromptTokensDetails.CachedTokens
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,196 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newOpenAIStub starts a server that records the chat completion request it
+// receives and replies with the given status, headers and body.
+func newOpenAIStub(t *testing.T, status int, header http.Header, body string) (*OpenAI, *openAIRequest) {
+	t.Helper()
+
+	var received openAIRequest
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("got request %s %s, want POST /v1/chat/completions", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer key" {
+			t.Errorf("got Authorization header %q, want %q", got, "Bearer key")
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&received)
+		if err != nil {
+			t.Errorf("request body is not JSON: %v", err)
+		}
+
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return NewOpenAI(ProviderOpenAI, srv.URL+"/v1/", "key", "llava", time.Minute), &received
+}
+
+func TestOpenAIComplete(t *testing.T) {
+	p, received := newOpenAIStub(t, http.StatusOK, nil, `{
+		"choices": [{"message": {"role": "assistant", "content": "{\"type\": \"passport\"}"}}],
+		"usage": {"prompt_tokens": 120, "completion_tokens": 8, "prompt_tokens_details": {"cached_tokens": 100}}
+	}`)
+
+	resp, err := p.Complete(context.Background(), Request{
+		MaxTokens: 256,
+		Parts:     []Part{Text("Classify this document."), Image("image/png", []byte("\x89PNG\r\n\x1a\n"))},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.Text != `{"type": "passport"}` {
+		t.Errorf("got text %q", resp.Text)
+	}
+	want := Usage{InputTokens: 20, OutputTokens: 8, CacheReadTokens: 100}
+	if resp.Usage != want {
+		t.Errorf("got usage %+v, want %+v", resp.Usage, want)
+	}
+
+	if received.Model != "llava" || received.MaxTokens != 256 {
+		t.Errorf("got model %q and max tokens %d, want llava and 256", received.Model, received.MaxTokens)
+	}
+	if len(received.Messages) != 1 || received.Messages[0].Role != "user" {
+		t.Fatalf("got messages %+v, want one user message", received.Messages)
+	}
+
+	content := received.Messages[0].Content
+	if len(content) != 2 {
+		t.Fatalf("got %d content parts, want 2", len(content))
+	}
+	if content[0].Type != "text" || content[0].Text != "Classify this document." {
+		t.Errorf("got first part %+v, want the text", content[0])
+	}
+	if content[1].Type != "image_url" || content[1].ImageURL == nil {
+		t.Fatalf("got second part %+v, want an image URL", content[1])
+	}
+
+	wantURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n"))
+	if content[1].ImageURL.URL != wantURL {
+		t.Errorf("got image URL %q, want %q", content[1].ImageURL.URL, wantURL)
+	}
+}
+
+func TestOpenAICompleteModel(t *testing.T) {
+	p, received := newOpenAIStub(t, http.StatusOK, nil, `{"choices": [{"message": {"content": "ok"}}]}`)
+
+	resp, err := p.Complete(context.Background(), Request{Model: "qwen2.5vl", Parts: []Part{Text("Hi")}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received.Model != "qwen2.5vl" {
+		t.Errorf("got model %q, want the one in the request", received.Model)
+	}
+	if resp.Usage != (Usage{}) {
+		t.Errorf("got usage %+v, want none as the server did not report it", resp.Usage)
+	}
+}
+
+func TestOpenAICompleteErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		header         http.Header
+		body           string
+		wantStatus     int
+		wantRetryAfter string
+		wantMessage    string
+		wantOverloaded bool
+	}{
+		{
+			name:           "Rate limited",
+			status:         http.StatusTooManyRequests,
+			header:         http.Header{"Retry-After": {"30"}},
+			body:           `{"error": {"message": "Rate limit reached"}}`,
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "30",
+			wantMessage:    "Rate limit reached",
+		},
+		{
+			name:           "Unavailable",
+			status:         http.StatusServiceUnavailable,
+			header:         http.Header{"Retry-After": {"5"}},
+			body:           `model is loading`,
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "5",
+			wantMessage:    "model is loading",
+			wantOverloaded: true,
+		},
+		{
+			name:        "Unauthorized",
+			status:      http.StatusUnauthorized,
+			body:        `{"error": {"message": "Incorrect API key"}}`,
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "Incorrect API key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newOpenAIStub(t, tt.status, tt.header, tt.body)
+
+			_, err := p.Complete(context.Background(), Request{Parts: []Part{Text("Hi")}})
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got error %v, want an *APIError", err)
+			}
+			if apiErr.Provider != ProviderOpenAI || apiErr.StatusCode != tt.wantStatus || apiErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("got %+v, want status %d and Retry-After %q", apiErr, tt.wantStatus, tt.wantRetryAfter)
+			}
+			if !strings.Contains(err.Error(), tt.wantMessage) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.wantMessage)
+			}
+			if got := Overloaded(err); got != tt.wantOverloaded {
+				t.Errorf("got Overloaded %v, want %v", got, tt.wantOverloaded)
+			}
+		})
+	}
+}
+
+func TestOpenAICompleteInvalidResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "No choices", body: `{"choices": []}`, wantErr: "response has no choices"},
+		{name: "Missing choices", body: `{}`, wantErr: "response has no choices"},
+		{name: "Not JSON", body: `<html>Bad gateway</html>`, wantErr: "failed to decode response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newOpenAIStub(t, http.StatusOK, nil, tt.body)
+
+			_, err := p.Complete(context.Background(), Request{Parts: []Part{Text("Hi")}})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+
+			var apiErr *APIError
+			if errors.As(err, &apiErr) {
+				t.Errorf("got an *APIError for a 200 response: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Package mrz finds and decodes the machine readable zone (MRZ) printed on
+// passports and identity cards, as specified by ICAO Doc 9303.
+package mrz
+
+import (
+	"strings"
+	"time"
+)
+
+// Formats of machine readable zone.
+const (
+	// FormatTD1 is used on identity cards: three lines of 30 characters.
+	FormatTD1 = "TD1"
+	// FormatTD2 is used on some identity cards and visas: two lines of 36
+	// characters.
+	FormatTD2 = "TD2"
+	// FormatTD3 is used on passports: two lines of 44 characters.
+	FormatTD3 = "TD3"
+)
+
+// MRZ is a decoded machine readable zone.
+type MRZ struct {
+	Format         string `json:"format"`
+	DocumentCode   string `json:"documentCode"`
+	IssuingCountry string `json:"issuingCountry"`
+	Surname        string `json:"surname"`
+	GivenNames     string `json:"givenNames"`
+	DocumentNumber string `json:"documentNumber"`
+	Nationality    string `json:"nationality"`
+	// DateOfBirth and DateOfExpiry are formatted as YYYY-MM-DD, or empty if
+	// the date could not be read.
+	DateOfBirth  string `json:"dateOfBirth"`
+	Sex          string `json:"sex"`
+	DateOfExpiry string `json:"dateOfExpiry"`
+	Checks       Checks `json:"checks"`
+}
+
+// Checks reports which of the check digits in the zone are correct.
+type Checks struct {
+	DocumentNumber bool `json:"documentNumber"`
+	DateOfBirth    bool `json:"dateOfBirth"`
+	DateOfExpiry   bool `json:"dateOfExpiry"`
+	Composite      bool `json:"composite"`
+}
+
+// Valid reports whether every check digit is correct.
+func (c Checks) Valid() bool {
+	return c.DocumentNumber && c.DateOfBirth && c.DateOfExpiry && c.Composite
+}
+
+// Find looks for a machine readable zone in OCR text and decodes it. OCR
+// engines often insert spaces into the zone or misread the filler character,
+// so these are cleaned up before the lines are matched.
+func Find(text string) (*MRZ, bool) {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = clean(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	for i := range lines {
+		switch {
+		case i+2 < len(lines) && len(lines[i]) == 30 && len(lines[i+1]) == 30 && len(lines[i+2]) == 30:
+			return parseTD1(lines[i], lines[i+1], lines[i+2]), true
+		case i+1 < len(lines) && len(lines[i]) == 36 && len(lines[i+1]) == 36:
+			return parseTD2(lines[i], lines[i+1]), true
+		case i+1 < len(lines) && len(lines[i]) == 44 && len(lines[i+1]) == 44:
+			return parseTD3(lines[i], lines[i+1]), true
+		}
+	}
+
+	return nil, false
+}
+
+// clean returns a line with spaces removed and common misreadings of the
+// filler character replaced, or an empty string if the line cannot be part of
+// a machine readable zone.
+func clean(line string) string {
+	line = strings.ToUpper(line)
+	line = strings.NewReplacer(" ", "", "\t", "", "«", "<<", "‹", "<").Replace(line)
+
+	if !strings.Contains(line, "<") {
+		return ""
+	}
+
+	for _, c := range line {
+		if !isMRZChar(c) {
+			return ""
+		}
+	}
+
+	return line
+}
+
+func isMRZChar(c rune) bool {
+	return c == '<' || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// CheckDigit returns the check digit of a field, computed with the repeating
+// 7, 3, 1 weights over the character values, where digits are worth their
+// value, letters 10 to 35 and the filler character 0.
+func CheckDigit(field string) int {
+	weights := [3]int{7, 3, 1}
+
+	var sum int
+	for i, c := range field {
+		var value int
+		switch {
+		case c >= '0' && c <= '9':
+			value = int(c - '0')
+		case c >= 'A' && c <= 'Z':
+			value = int(c-'A') + 10
+		}
+		sum += value * weights[i%3]
+	}
+
+	return sum % 10
+}
+
+func checks(field string, digit byte) bool {
+	if digit == '<' {
+		// Some countries leave the check digit empty when the field is
+		// empty too.
+		return strings.Trim(field, "<") == ""
+	}
+
+	return digit >= '0' && digit <= '9' && CheckDigit(field) == int(digit-'0')
+}
+
+func parseTD3(line1, line2 string) *MRZ {
+	m := &MRZ{
+		Format:         FormatTD3,
+		DocumentCode:   field(line1[0:2]),
+		IssuingCountry: field(line1[2:5]),
+		DocumentNumber: field(line2[0:9]),
+		Nationality:    field(line2[10:13]),
+		DateOfBirth:    date(line2[13:19], true),
+		Sex:            field(line2[20:21]),
+		DateOfExpiry:   date(line2[21:27], false),
+	}
+	m.Surname, m.GivenNames = names(line1[5:44])
+
+	m.Checks = Checks{
+		DocumentNumber: checks(line2[0:9], line2[9]),
+		DateOfBirth:    checks(line2[13:19], line2[19]),
+		DateOfExpiry:   checks(line2[21:27], line2[27]),
+		Composite:      checks(line2[0:10]+line2[13:20]+line2[21:43], line2[43]),
+	}
+
+	return m
+}
+
+func parseTD2(line1, line2 string) *MRZ {
+	m := &MRZ{
+		Format:         FormatTD2,
+		DocumentCode:   field(line1[0:2]),
+		IssuingCountry: field(line1[2:5]),
+		DocumentNumber: field(line2[0:9]),
+		Nationality:    field(line2[10:13]),
+		DateOfBirth:    date(line2[13:19], true),
+		Sex:            field(line2[20:21]),
+		DateOfExpiry:   date(line2[21:27], false),
+	}
+	m.Surname, m.GivenNames = names(line1[5:36])
+
+	m.Checks = Checks{
+		DocumentNumber: checks(line2[0:9], line2[9]),
+		DateOfBirth:    checks(line2[13:19], line2[19]),
+		DateOfExpiry:   checks(line2[21:27], line2[27]),
+		Composite:      checks(line2[0:10]+line2[13:20]+line2[21:35], line2[35]),
+	}
+
+	return m
+}
+
+func parseTD1(line1, line2, line3 string) *MRZ {
+	m := &MRZ{
+		Format:         FormatTD1,
+		DocumentCode:   field(line1[0:2]),
+		IssuingCountry: field(line1[2:5]),
+		DocumentNumber: field(line1[5:14]),
+		DateOfBirth:    date(line2[0:6], true),
+		Sex:            field(line2[7:8]),
+		DateOfExpiry:   date(line2[8:14], false),
+		Nationality:    field(line2[15:18]),
+	}
+	m.Surname, m.GivenNames = names(line3)
+
+	m.Checks = Checks{
+		DocumentNumber: checks(line1[5:14], line1[14]),
+		DateOfBirth:    checks(line2[0:6], line2[6]),
+		DateOfExpiry:   checks(line2[8:14], line2[14]),
+		Composite:      checks(line1[5:30]+line2[0:7]+line2[8:15]+line2[18:29], line2[29]),
+	}
+
+	return m
+}
+
+// field returns the value of a field with the filler characters removed.
+func field(s string) string {
+	return strings.TrimSpace(strings.ReplaceAll(s, "<", " "))
+}
+
+// names splits the name field into the surname and given names, which are
+// separated by two filler characters.
+func names(s string) (surname, givenNames string) {
+	surname, givenNames, _ = strings.Cut(strings.TrimRight(s, "<"), "<<")
+	return field(surname), strings.Join(strings.Fields(field(givenNames)), " ")
+}
+
+// date converts a YYMMDD date to YYYY-MM-DD. The zone only has two digit
+// years, so dates of birth are assumed to be in the past and expiry dates to
+// be at most 50 years in the past.
+func date(s string, past bool) string {
+	t, err := time.Parse("060102", s)
+	if err != nil {
+		return ""
+	}
+
+	now := time.Now()
+	switch {
+	case past && t.After(now):
+		t = t.AddDate(-100, 0, 0)
+	case !past && t.Before(now.AddDate(-50, 0, 0)):
+		t = t.AddDate(100, 0, 0)
+	}
+
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,234 @@
+package mrz
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The specimen zones of ICAO Doc 9303, for Anna Maria Eriksson of Utopia.
+const (
+	specimenTD1 = "I<UTOD231458907<<<<<<<<<<<<<<<\n7408122F1204159UTO<<<<<<<<<<<6\nERIKSSON<<ANNA<MARIA<<<<<<<<<<"
+	specimenTD2 = "I<UTOERIKSSON<<ANNA<MARIA<<<<<<<<<<<\nD231458907UTO7408122F1204159<<<<<<<6"
+	specimenTD3 = "P<UTOERIKSSON<<ANNA<MARIA<<<<<<<<<<<<<<<<<<<\nL898902C36UTO7408122F1204159ZE184226B<<<<<10"
+)
+
+// replaceAt returns the zone with the character at a position of a line
+// replaced.
+func replaceAt(zone string, line, pos int, c byte) string {
+	lines := strings.Split(zone, "\n")
+	b := []byte(lines[line])
+	b[pos] = c
+	lines[line] = string(b)
+	return strings.Join(lines, "\n")
+}
+
+func TestFindSpecimens(t *testing.T) {
+	tests := []struct {
+		zone string
+		want MRZ
+	}{
+		{
+			zone: specimenTD1,
+			want: MRZ{Format: FormatTD1, DocumentCode: "I", IssuingCountry: "UTO", Surname: "ERIKSSON", GivenNames: "ANNA MARIA", DocumentNumber: "D23145890", Nationality: "UTO", DateOfBirth: "1974-08-12", Sex: "F", DateOfExpiry: "2012-04-15"},
+		},
+		{
+			zone: specimenTD2,
+			want: MRZ{Format: FormatTD2, DocumentCode: "I", IssuingCountry: "UTO", Surname: "ERIKSSON", GivenNames: "ANNA MARIA", DocumentNumber: "D23145890", Nationality: "UTO", DateOfBirth: "1974-08-12", Sex: "F", DateOfExpiry: "2012-04-15"},
+		},
+		{
+			zone: specimenTD3,
+			want: MRZ{Format: FormatTD3, DocumentCode: "P", IssuingCountry: "UTO", Surname: "ERIKSSON", GivenNames: "ANNA MARIA", DocumentNumber: "L898902C3", Nationality: "UTO", DateOfBirth: "1974-08-12", Sex: "F", DateOfExpiry: "2012-04-15"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want.Format, func(t *testing.T) {
+			tt.want.Checks = Checks{DocumentNumber: true, DateOfBirth: true, DateOfExpiry: true, Composite: true}
+
+			// The zone is surrounded by the rest of the page's text
+			got, ok := Find("UTOPIA\nPASSPORT / IDENTITY CARD\n" + tt.zone + "\nSignature")
+			if !ok {
+				t.Fatal("the zone was not found")
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+			if !got.Checks.Valid() {
+				t.Error("got invalid checks for a specimen")
+			}
+		})
+	}
+}
+
+func TestFindCorruptedCheckDigits(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		want Checks
+	}{
+		{
+			name: "TD3 document number",
+			zone: replaceAt(specimenTD3, 1, 9, '5'),
+			want: Checks{DocumentNumber: false, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD3 misread document number",
+			zone: replaceAt(specimenTD3, 1, 7, '0'),
+			want: Checks{DocumentNumber: false, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD3 date of birth",
+			zone: replaceAt(specimenTD3, 1, 19, '3'),
+			want: Checks{DocumentNumber: true, DateOfBirth: false, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD3 date of expiry",
+			zone: replaceAt(specimenTD3, 1, 27, '8'),
+			want: Checks{DocumentNumber: true, DateOfBirth: true, DateOfExpiry: false, Composite: false},
+		},
+		{
+			name: "TD3 composite",
+			zone: replaceAt(specimenTD3, 1, 43, '1'),
+			want: Checks{DocumentNumber: true, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD3 optional data",
+			zone: replaceAt(specimenTD3, 1, 30, '9'),
+			want: Checks{DocumentNumber: true, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD2 document number",
+			zone: replaceAt(specimenTD2, 1, 9, '0'),
+			want: Checks{DocumentNumber: false, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD2 composite",
+			zone: replaceAt(specimenTD2, 1, 35, '0'),
+			want: Checks{DocumentNumber: true, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD1 document number",
+			zone: replaceAt(specimenTD1, 0, 14, '1'),
+			want: Checks{DocumentNumber: false, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD1 date of birth",
+			zone: replaceAt(specimenTD1, 1, 6, '0'),
+			want: Checks{DocumentNumber: true, DateOfBirth: false, DateOfExpiry: true, Composite: false},
+		},
+		{
+			name: "TD1 composite",
+			zone: replaceAt(specimenTD1, 1, 29, '0'),
+			want: Checks{DocumentNumber: true, DateOfBirth: true, DateOfExpiry: true, Composite: false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Find(tt.zone)
+			if !ok {
+				t.Fatal("the zone was not found")
+			}
+			if got.Checks != tt.want {
+				t.Errorf("got checks %+v, want %+v", got.Checks, tt.want)
+			}
+			if got.Checks.Valid() {
+				t.Error("got valid checks for a corrupted zone")
+			}
+		})
+	}
+}
+
+func TestFindOCRNoise(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "Spaces", text: "P<UTO ERIKSSON<<ANNA<MARIA <<<<<<<<<<<<<<<<<<<\nL898902C3 6UTO740812 2F1204159ZE184226B<<<<<10"},
+		{name: "Lower case", text: strings.ToLower(specimenTD3)},
+		{name: "Guillemets", text: "P<UTOERIKSSON«ANNA<MARIA<<<<<<<<<<<<<<<<<<<\nL898902C36UTO7408122F1204159ZE184226B«<<<10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Find(tt.text)
+			if !ok {
+				t.Fatal("the zone was not found")
+			}
+			if got.DocumentNumber != "L898902C3" || !got.Checks.Valid() {
+				t.Errorf("got %+v, want the specimen with valid checks", *got)
+			}
+		})
+	}
+
+	for _, text := range []string{"", "Surname: ERIKSSON\nGiven names: ANNA MARIA", "P<UTOERIKSSON<<ANNA<MARIA<<<<<<<<<<<<<<<<<<<"} {
+		if got, ok := Find(text); ok {
+			t.Errorf("found %+v in %q, want no zone", *got, text)
+		}
+	}
+}
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		field string
+		want  int
+	}{
+		{field: "L898902C3", want: 6},
+		{field: "D23145890", want: 7},
+		{field: "740812", want: 2},
+		{field: "120415", want: 9},
+		{field: "ZE184226B<<<<<", want: 1},
+		{field: "L898902C36740812212041 59ZE184226B<<<<<1", want: 0},
+		{field: "<<<<<<<<<", want: 0},
+		{field: "", want: 0},
+	}
+
+	for _, tt := range tests {
+		got := CheckDigit(strings.ReplaceAll(tt.field, " ", ""))
+		if got != tt.want {
+			t.Errorf("CheckDigit(%q) = %d, want %d", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyCheckDigit(t *testing.T) {
+	// Some countries leave the check digit of an empty optional field as a
+	// filler character
+	if !checks("<<<<<<<<<<<<<<", '<') {
+		t.Error("got an invalid check for an empty field with no check digit")
+	}
+	if checks("ZE184226B<<<<<", '<') {
+		t.Error("got a valid check for a field with data but no check digit")
+	}
+}
+
+func TestDateCentury(t *testing.T) {
+	nextYear := time.Now().Year() + 1
+
+	tests := []struct {
+		name string
+		s    string
+		past bool
+		want string
+	}{
+		{name: "Birth last century", s: "740812", past: true, want: "1974-08-12"},
+		{name: "Birth this century", s: "010203", past: true, want: "2001-02-03"},
+		{name: "Birth would be in the future", s: fmt.Sprintf("%02d0101", nextYear%100), past: true, want: fmt.Sprintf("%d-01-01", nextYear-100)},
+		{name: "Expiry this century", s: "300101", want: "2030-01-01"},
+		{name: "Expiry long ago", s: "120415", want: "2012-04-15"},
+		{name: "Expiry beyond 2068", s: "700101", want: "2070-01-01"},
+		{name: "Invalid", s: "741332", past: true, want: ""},
+		{name: "Filler", s: "<<<<<<", past: true, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := date(tt.s, tt.past)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
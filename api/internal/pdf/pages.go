@@ -0,0 +1,35 @@
+// Package pdf rewrites PDF files without rendering them, so that the pages
+// keep their original quality and text layer.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+func init() {
+	// Stop pdfcpu from reading or creating a configuration directory in the
+	// user's home directory.
+	model.ConfigPath = "disable"
+}
+
+// ExtractPages returns a new PDF holding pages first to last, inclusive and
+// numbered from 1, of the given PDF.
+func ExtractPages(data []byte, first, last int) ([]byte, error) {
+	conf := model.NewDefaultConfiguration()
+	// Scanners and phone apps often write slightly malformed PDFs, which
+	// MuPDF renders happily and strict validation would reject.
+	conf.ValidationMode = model.ValidationRelaxed
+
+	var buf bytes.Buffer
+
+	err := api.Trim(bytes.NewReader(data), &buf, []string{fmt.Sprintf("%d-%d", first, last)}, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract pages %d-%d: %w", first, last, err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+// Package prompts loads the prompts sent to LLM providers from versioned
+// text/template files. Each version is a directory of templates, one for each
+// prompt, such as v1/extract.tmpl, so that a new version can be tried and
+// evaluated alongside the old one.
+package prompts
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var funcs = template.FuncMap{
+	"join":  strings.Join,
+	"fence": Fence,
+}
+
+// Fence wraps untrusted content, such as the text of an uploaded document, in
+// <tag> and </tag> lines, so that the prompt can tell the model to treat
+// everything between them as data rather than instructions. The tag is
+// escaped wherever it appears in the content, so that the content cannot
+// close the fence early and pass off what follows as instructions.
+func Fence(tag, content string) string {
+	rx := regexp.MustCompile(`(?i)<(\s*/?\s*` + regexp.QuoteMeta(tag) + `\b)`)
+	content = rx.ReplaceAllString(content, "&lt;$1")
+
+	return "<" + tag + ">\n" + content + "\n</" + tag + ">"
+}
+
+// Set is one version of the prompts.
+type Set struct {
+	version string
+	tmpl    *template.Template
+}
+
+// Load parses the templates of a version from the directory of that name in
+// fsys.
+func Load(fsys fs.FS, version string) (*Set, error) {
+	info, err := fs.Stat(fsys, version)
+	if err != nil || !info.IsDir() || strings.ContainsAny(version, `/\.`) {
+		return nil, fmt.Errorf("prompts: unknown version %q", version)
+	}
+
+	tmpl, err := template.New(version).Funcs(funcs).Option("missingkey=error").ParseFS(fsys, path.Join(version, "*.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("prompts: %w", err)
+	}
+
+	return &Set{version: version, tmpl: tmpl}, nil
+}
+
+// Version returns the version of the prompts.
+func (s *Set) Version() string {
+	return s.version
+}
+
+// Execute renders the prompt with the given name, such as "extract.tmpl".
+// Leading and trailing whitespace is removed so that template files can end
+// with a newline.
+func (s *Set) Execute(name string, data any) (string, error) {
+	var buf bytes.Buffer
+
+	err := s.tmpl.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		return "", fmt.Errorf("prompts: %w", err)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Versions lists the versions in fsys.
+func Versions(fsys fs.FS) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+
+	return versions, nil
+}
+
+// Store holds the prompts in use. In reload mode the templates are parsed
+// again every time a prompt is rendered, so that changes to the files on disk
+// take effect without restarting the server.
+type Store struct {
+	fsys   fs.FS
+	reload bool
+
+	mu  sync.Mutex
+	set *Set
+}
+
+// NewStore loads a version of the prompts from fsys.
+func NewStore(fsys fs.FS, version string, reload bool) (*Store, error) {
+	set, err := Load(fsys, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{fsys: fsys, reload: reload, set: set}, nil
+}
+
+// Version returns the version of the prompts in use.
+func (s *Store) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.set.version
+}
+
+// Execute renders the prompt with the given name.
+func (s *Store) Execute(name string, data any) (string, error) {
+	s.mu.Lock()
+	set := s.set
+
+	if s.reload {
+		// Report broken templates rather than quietly using the old ones, so
+		// that mistakes show up straight away while iterating
+		reloaded, err := Load(s.fsys, set.version)
+		if err != nil {
+			s.mu.Unlock()
+			return "", err
+		}
+		s.set, set = reloaded, reloaded
+	}
+	s.mu.Unlock()
+
+	return set.Execute(name, data)
+}
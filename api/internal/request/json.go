@@ -9,16 +9,26 @@ import (
 	"strings"
 )
 
+// DefaultMaxBytes is the largest body that DecodeJSON and DecodeJSONStrict
+// accept.
+const DefaultMaxBytes = 1_048_576
+
 func DecodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	return decodeJSON(w, r, dst, false)
+	return decodeJSON(w, r, dst, DefaultMaxBytes, false)
 }
 
 func DecodeJSONStrict(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	return decodeJSON(w, r, dst, true)
+	return decodeJSON(w, r, dst, DefaultMaxBytes, true)
+}
+
+// DecodeJSONLimit works like DecodeJSON, for bodies of up to maxBytes rather
+// than DefaultMaxBytes.
+func DecodeJSONLimit(w http.ResponseWriter, r *http.Request, dst interface{}, maxBytes int64) error {
+	return decodeJSON(w, r, dst, maxBytes, false)
 }
 
-func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}, disallowUnknownFields bool) error {
-	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}, maxBytes int64, disallowUnknownFields bool) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	dec := json.NewDecoder(r.Body)
 
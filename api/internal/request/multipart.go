@@ -0,0 +1,253 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// ErrFileTooLarge is returned when an uploaded file, or the multipart body
+// carrying it, exceeds the permitted size.
+var ErrFileTooLarge = errors.New("uploaded file is too large")
+
+type File struct {
+	Filename string
+	Size     int64
+	Data     []byte
+}
+
+// DecodeMultipartFile parses a multipart/form-data request and reads the file
+// in the named form field into memory. Files larger than maxFileSize result in
+// ErrFileTooLarge. The remaining form values are available through
+// r.FormValue once this returns.
+func DecodeMultipartFile(w http.ResponseWriter, r *http.Request, field string, maxFileSize int64) (*File, error) {
+	// Allow some headroom over the file size for the multipart framing and
+	// any other form values sent alongside the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+1_048_576)
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesError):
+			return nil, ErrFileTooLarge
+		case errors.Is(err, http.ErrNotMultipart):
+			return nil, errors.New("body must be multipart/form-data")
+		default:
+			return nil, fmt.Errorf("body contains a badly-formed multipart form: %w", err)
+		}
+	}
+
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, fmt.Errorf("%s is required", field)
+	}
+	defer file.Close()
+
+	if header.Size > maxFileSize {
+		return nil, ErrFileTooLarge
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Filename: header.Filename,
+		Size:     header.Size,
+		Data:     data,
+	}, nil
+}
+
+// UploadedFile is a file from a multipart request that has been streamed to a
+// temporary file on disk rather than held in memory.
+type UploadedFile struct {
+	Filename string
+	Size     int64
+	// Err is set when the file was rejected, for example with ErrFileTooLarge.
+	// Rejected files have no data on disk.
+	Err error
+
+	path string
+}
+
+// Open opens the file on disk for reading, without loading it into memory.
+func (f *UploadedFile) Open() (*os.File, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	return os.Open(f.path)
+}
+
+// Load reads the file from disk into memory. Callers processing many files
+// should bound how many of them are loaded at once.
+func (f *UploadedFile) Load() (*File, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Filename: f.Filename,
+		Size:     f.Size,
+		Data:     data,
+	}, nil
+}
+
+// MultipartFiles holds the files and form values decoded by
+// DecodeMultipartFiles. Close must be called to remove the temporary files.
+type MultipartFiles struct {
+	Files  []*UploadedFile
+	Values url.Values
+}
+
+// Close removes the temporary files backing the uploaded files.
+func (m *MultipartFiles) Close() error {
+	var errs []error
+
+	for _, file := range m.Files {
+		if file.path == "" {
+			continue
+		}
+
+		err := os.Remove(file.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// DecodeMultipartFiles streams every file in the named form field of a
+// multipart/form-data request to a temporary file. Files larger than
+// maxFileSize are discarded and marked with ErrFileTooLarge so that the rest
+// of the request can still be processed. Requests carrying more than maxFiles
+// files are rejected. Other form values are collected into Values.
+func DecodeMultipartFiles(w http.ResponseWriter, r *http.Request, field string, maxFileSize int64, maxFiles int) (*MultipartFiles, error) {
+	// Oversized files are read and discarded rather than rejecting the whole
+	// request, so the body may be a little larger than the sum of the
+	// accepted files.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxFiles)*(maxFileSize+1)+1_048_576)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		if errors.Is(err, http.ErrNotMultipart) {
+			return nil, errors.New("body must be multipart/form-data")
+		}
+		return nil, fmt.Errorf("body contains a badly-formed multipart form: %w", err)
+	}
+
+	files := &MultipartFiles{Values: make(url.Values)}
+
+	var valuesSize int64
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			files.Close()
+			return nil, multipartError(err)
+		}
+
+		switch {
+		case part.FormName() == field && part.FileName() != "":
+			if len(files.Files) == maxFiles {
+				part.Close()
+				files.Close()
+				return nil, fmt.Errorf("body must not contain more than %d files", maxFiles)
+			}
+
+			file, err := saveUploadedFile(part, maxFileSize)
+			part.Close()
+			if err != nil {
+				files.Close()
+				return nil, multipartError(err)
+			}
+
+			files.Files = append(files.Files, file)
+
+		case part.FileName() == "":
+			value, err := io.ReadAll(io.LimitReader(part, 1_048_576-valuesSize+1))
+			part.Close()
+			if err != nil {
+				files.Close()
+				return nil, multipartError(err)
+			}
+
+			valuesSize += int64(len(value))
+			if valuesSize > 1_048_576 {
+				files.Close()
+				return nil, errors.New("body contains too much form data")
+			}
+
+			files.Values.Add(part.FormName(), string(value))
+
+		default:
+			part.Close()
+		}
+	}
+
+	if len(files.Files) == 0 {
+		return nil, fmt.Errorf("%s is required", field)
+	}
+
+	return files, nil
+}
+
+func saveUploadedFile(part *multipart.Part, maxFileSize int64) (*UploadedFile, error) {
+	file := &UploadedFile{Filename: part.FileName()}
+
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	file.path = tmp.Name()
+
+	file.Size, err = io.Copy(tmp, io.LimitReader(part, maxFileSize+1))
+	if err != nil {
+		os.Remove(file.path)
+		return nil, err
+	}
+
+	if file.Size > maxFileSize {
+		os.Remove(file.path)
+		file.path = ""
+		file.Err = ErrFileTooLarge
+
+		// Drain the rest of the part so the next one can be read.
+		n, err := io.Copy(io.Discard, part)
+		if err != nil {
+			return nil, err
+		}
+		file.Size += n
+	}
+
+	return file, nil
+}
+
+func multipartError(err error) error {
+	var maxBytesError *http.MaxBytesError
+
+	if errors.As(err, &maxBytesError) {
+		return ErrFileTooLarge
+	}
+
+	return fmt.Errorf("body contains a badly-formed multipart form: %w", err)
+}
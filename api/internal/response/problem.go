@@ -0,0 +1,54 @@
+package response
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Problem is an RFC 9457 problem details object. Code is a stable,
+// machine-readable identifier that clients can branch on instead of matching
+// on the human-readable Detail message.
+type Problem struct {
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Status      int               `json:"status"`
+	Detail      string            `json:"detail,omitempty"`
+	Instance    string            `json:"instance,omitempty"`
+	Code        string            `json:"code"`
+	Errors      []string          `json:"errors,omitempty"`
+	FieldErrors map[string]string `json:"fieldErrors,omitempty"`
+}
+
+func NewProblem(status int, code, detail string) Problem {
+	return Problem{
+		Type:   "/problems/" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func ProblemJSON(w http.ResponseWriter, problem Problem, headers http.Header) error {
+	js, err := json.MarshalIndent(problem, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	js = append(js, '\n')
+
+	for key, values := range headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	_, err = w.Write(js)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package response
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStream writes Server-Sent Events to a response. It is safe for
+// concurrent use.
+//
+// Every event pushes the connection's write deadline back by the stream's
+// timeout, so a stream that keeps making progress can run for longer than the
+// server's WriteTimeout, while one that stalls is still cut off.
+type EventStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// NewEventStream sends the headers for an event stream response and returns
+// a stream to write events to.
+func NewEventStream(w http.ResponseWriter, timeout time.Duration) (*EventStream, error) {
+	rc := http.NewResponseController(w)
+
+	err := rc.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop reverse proxies such as nginx from buffering the events.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err = rc.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventStream{w: w, rc: rc, timeout: timeout}, nil
+}
+
+// Send writes an event with the given name and JSON-encoded data.
+func (s *EventStream) Send(event string, data any) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.rc.SetWriteDeadline(time.Now().Add(s.timeout))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, js)
+	if err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+// Comment writes a comment line, which clients ignore. Comments keep idle
+// connections open through proxies, but unlike events they do not extend the
+// write deadline.
+func (s *EventStream) Comment(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.w, ": %s\n\n", strings.ReplaceAll(text, "\n", " "))
+	if err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}